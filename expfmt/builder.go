@@ -0,0 +1,170 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// FamilyBuilder builds a MetricFamily sample by sample without the
+// boilerplate of setting every field to a pointer, e.g.
+//
+//	mf, err := NewCounterFamily("http_requests_total", "Number of requests.").
+//		AddSample(42, "code", "200").
+//		AddSample(3, "code", "500").
+//		Build()
+//
+// Labels are given as alternating names and values. The first misuse, like an
+// odd number of label strings or a sample of the wrong kind for the type of
+// the family, is reported by Build.
+type FamilyBuilder struct {
+	mf  *dto.MetricFamily
+	err error
+}
+
+// NewCounterFamily returns a FamilyBuilder for a counter family. Its samples
+// are added with AddSample.
+func NewCounterFamily(name, help string) *FamilyBuilder {
+	return newFamilyBuilder(name, help, dto.MetricType_COUNTER)
+}
+
+// NewGaugeFamily returns a FamilyBuilder for a gauge family. Its samples are
+// added with AddSample.
+func NewGaugeFamily(name, help string) *FamilyBuilder {
+	return newFamilyBuilder(name, help, dto.MetricType_GAUGE)
+}
+
+// NewUntypedFamily returns a FamilyBuilder for an untyped family. Its samples
+// are added with AddSample.
+func NewUntypedFamily(name, help string) *FamilyBuilder {
+	return newFamilyBuilder(name, help, dto.MetricType_UNTYPED)
+}
+
+// NewHistogramFamily returns a FamilyBuilder for a (classic) histogram
+// family. Its samples are added with AddHistogram.
+func NewHistogramFamily(name, help string) *FamilyBuilder {
+	return newFamilyBuilder(name, help, dto.MetricType_HISTOGRAM)
+}
+
+func newFamilyBuilder(name, help string, metricType dto.MetricType) *FamilyBuilder {
+	mf := &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: metricType.Enum(),
+	}
+	if help != "" {
+		mf.Help = proto.String(help)
+	}
+	return &FamilyBuilder{mf: mf}
+}
+
+// AddSample adds a sample with the given value and labels to a counter, gauge,
+// or untyped family.
+func (b *FamilyBuilder) AddSample(value float64, labels ...string) *FamilyBuilder {
+	m := b.newMetric(labels)
+	if m == nil {
+		return b
+	}
+	switch b.mf.GetType() {
+	case dto.MetricType_COUNTER:
+		m.Counter = &dto.Counter{Value: proto.Float64(value)}
+	case dto.MetricType_GAUGE:
+		m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	case dto.MetricType_UNTYPED:
+		m.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+	default:
+		b.fail(fmt.Errorf("cannot add a plain sample to a %s family", typeName(b.mf.GetType())))
+		return b
+	}
+	b.mf.Metric = append(b.mf.Metric, m)
+	return b
+}
+
+// AddHistogram adds a histogram with the given sample count and sum and the
+// given buckets, mapping upper bounds to cumulative counts, to a histogram
+// family. The buckets are sorted by their upper bound. The +Inf bucket may be
+// omitted, the encoders add it.
+func (b *FamilyBuilder) AddHistogram(count uint64, sum float64, buckets map[float64]uint64, labels ...string) *FamilyBuilder {
+	m := b.newMetric(labels)
+	if m == nil {
+		return b
+	}
+	if b.mf.GetType() != dto.MetricType_HISTOGRAM {
+		b.fail(fmt.Errorf("cannot add a histogram to a %s family", typeName(b.mf.GetType())))
+		return b
+	}
+	bounds := make([]float64, 0, len(buckets))
+	for bound := range buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(count),
+		SampleSum:   proto.Float64(sum),
+		Bucket:      make([]*dto.Bucket, 0, len(bounds)),
+	}
+	for _, bound := range bounds {
+		h.Bucket = append(h.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(bound),
+			CumulativeCount: proto.Uint64(buckets[bound]),
+		})
+	}
+	m.Histogram = h
+	b.mf.Metric = append(b.mf.Metric, m)
+	return b
+}
+
+// Build returns the built family, or the first error encountered while
+// building it.
+func (b *FamilyBuilder) Build() (*dto.MetricFamily, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.mf.GetName() == "" {
+		return nil, errors.New("metric family has no name")
+	}
+	return b.mf, nil
+}
+
+// newMetric returns a new metric with the given labels, or nil if the labels
+// are invalid or an error occurred before.
+func (b *FamilyBuilder) newMetric(labels []string) *dto.Metric {
+	if b.err != nil {
+		return nil
+	}
+	if len(labels)%2 != 0 {
+		b.fail(fmt.Errorf("odd number of label strings %q", labels))
+		return nil
+	}
+	m := &dto.Metric{}
+	for i := 0; i < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{
+			Name:  proto.String(labels[i]),
+			Value: proto.String(labels[i+1]),
+		})
+	}
+	return m
+}
+
+// fail records err unless an error was recorded before.
+func (b *FamilyBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFamilyBuilder(t *testing.T) {
+	scenarios := []struct {
+		builder *FamilyBuilder
+		want    *dto.MetricFamily
+		out     string
+	}{
+		// 0: Counter.
+		{
+			builder: NewCounterFamily("http_requests_total", "Number of requests.").
+				AddSample(42, "code", "200", "method", "get").
+				AddSample(3, "code", "500", "method", "get"),
+			want: &dto.MetricFamily{
+				Name: proto.String("http_requests_total"),
+				Help: proto.String("Number of requests."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("code"), Value: proto.String("200")},
+							{Name: proto.String("method"), Value: proto.String("get")},
+						},
+						Counter: &dto.Counter{Value: proto.Float64(42)},
+					},
+					{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("code"), Value: proto.String("500")},
+							{Name: proto.String("method"), Value: proto.String("get")},
+						},
+						Counter: &dto.Counter{Value: proto.Float64(3)},
+					},
+				},
+			},
+			out: `# HELP http_requests Number of requests.
+# TYPE http_requests counter
+http_requests_total{code="200",method="get"} 42.0
+http_requests_total{code="500",method="get"} 3.0
+`,
+		},
+		// 1: Gauge without help and labels.
+		{
+			builder: NewGaugeFamily("temperature", "").AddSample(21.5),
+			want: &dto.MetricFamily{
+				Name: proto.String("temperature"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{Gauge: &dto.Gauge{Value: proto.Float64(21.5)}},
+				},
+			},
+			out: `# TYPE temperature gauge
+temperature 21.5
+`,
+		},
+		// 2: Histogram with unsorted buckets and without +Inf bucket.
+		{
+			builder: NewHistogramFamily("request_duration_seconds", "Request latency.").
+				AddHistogram(5, 3.5, map[float64]uint64{1: 4, 0.5: 2}, "path", "/"),
+			want: &dto.MetricFamily{
+				Name: proto.String("request_duration_seconds"),
+				Help: proto.String("Request latency."),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("path"), Value: proto.String("/")},
+						},
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(5),
+							SampleSum:   proto.Float64(3.5),
+							Bucket: []*dto.Bucket{
+								{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)},
+								{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(4)},
+							},
+						},
+					},
+				},
+			},
+			out: `# HELP request_duration_seconds Request latency.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{path="/",le="0.5"} 2
+request_duration_seconds_bucket{path="/",le="1.0"} 4
+request_duration_seconds_bucket{path="/",le="+Inf"} 5
+request_duration_seconds_sum{path="/"} 3.5
+request_duration_seconds_count{path="/"} 5
+`,
+		},
+		// 3: Histogram with +Inf bucket.
+		{
+			builder: NewHistogramFamily("size_bytes", "").
+				AddHistogram(1, 2048, map[float64]uint64{1024: 0, math.Inf(+1): 1}),
+			want: &dto.MetricFamily{
+				Name: proto.String("size_bytes"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(1),
+							SampleSum:   proto.Float64(2048),
+							Bucket: []*dto.Bucket{
+								{UpperBound: proto.Float64(1024), CumulativeCount: proto.Uint64(0)},
+								{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(1)},
+							},
+						},
+					},
+				},
+			},
+			out: `# TYPE size_bytes histogram
+size_bytes_bucket{le="1024.0"} 0
+size_bytes_bucket{le="+Inf"} 1
+size_bytes_sum 2048.0
+size_bytes_count 1
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		mf, err := scenario.builder.Build()
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if !proto.Equal(scenario.want, mf) {
+			t.Errorf("%d. expected %v, got %v", i, scenario.want, mf)
+		}
+		var out bytes.Buffer
+		if _, err := MetricFamilyToOpenMetrics(&out, mf); err != nil {
+			t.Errorf("%d. error encoding: %s", i, err)
+			continue
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestFamilyBuilderError(t *testing.T) {
+	scenarios := []struct {
+		builder *FamilyBuilder
+		err     string
+	}{
+		// 0: Odd number of label strings.
+		{
+			builder: NewCounterFamily("foos_total", "").AddSample(1, "code"),
+			err:     `odd number of label strings ["code"]`,
+		},
+		// 1: Plain sample in a histogram family.
+		{
+			builder: NewHistogramFamily("request_duration_seconds", "").AddSample(1),
+			err:     "cannot add a plain sample to a histogram family",
+		},
+		// 2: Histogram in a gauge family.
+		{
+			builder: NewGaugeFamily("temperature", "").AddHistogram(1, 1, nil),
+			err:     "cannot add a histogram to a gauge family",
+		},
+		// 3: The first error is kept.
+		{
+			builder: NewGaugeFamily("temperature", "").
+				AddSample(1, "room").
+				AddHistogram(1, 1, nil).
+				AddSample(2),
+			err: `odd number of label strings ["room"]`,
+		},
+		// 4: No name.
+		{
+			builder: NewUntypedFamily("", "").AddSample(1),
+			err:     "metric family has no name",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		mf, err := scenario.builder.Build()
+		if err == nil {
+			t.Errorf("%d. expected error, got %v", i, mf)
+			continue
+		}
+		if !strings.Contains(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error containing %q, got %q", i, scenario.err, err)
+		}
+	}
+}
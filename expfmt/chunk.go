@@ -0,0 +1,89 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"fmt"
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ChunkMetricFamily splits mf into several metric families, each of which
+// encodes to at most maxBytes bytes in the text format (as created by
+// MetricFamilyToText with the given options). The chunks share the name, help,
+// and type of mf and partition its Metric entries, keeping their order. The
+// Metric messages themselves are not copied.
+//
+// An error is returned if a single metric (together with the HELP and TYPE
+// lines) doesn't fit into maxBytes, or if mf cannot be encoded at all. A
+// family without metrics is returned as the only chunk.
+func ChunkMetricFamily(mf *dto.MetricFamily, maxBytes int, opts ...EncoderOption) ([]*dto.MetricFamily, error) {
+	if len(mf.Metric) == 0 {
+		return []*dto.MetricFamily{mf}, nil
+	}
+
+	// Sample lines are independent of each other, so the size of a chunk is
+	// the size of the metadata plus the sizes of its metrics. The size of
+	// the metadata follows from encoding the first metric once and twice.
+	single, err := encodedTextSize(mf, mf.Metric[:1], opts)
+	if err != nil {
+		return nil, err
+	}
+	double, err := encodedTextSize(mf, []*dto.Metric{mf.Metric[0], mf.Metric[0]}, opts)
+	if err != nil {
+		return nil, err
+	}
+	metadataSize := 2*single - double
+
+	var (
+		chunks    []*dto.MetricFamily
+		start     int
+		chunkSize = metadataSize
+	)
+	for i := range mf.Metric {
+		size, err := encodedTextSize(mf, mf.Metric[i:i+1], opts)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBytes {
+			return nil, fmt.Errorf(
+				"metric %d of family %q needs %d bytes, exceeding the budget of %d bytes",
+				i, mf.GetName(), size, maxBytes,
+			)
+		}
+		metricSize := size - metadataSize
+		if chunkSize+metricSize > maxBytes {
+			chunks = append(chunks, chunkOf(mf, mf.Metric[start:i:i]))
+			start, chunkSize = i, metadataSize
+		}
+		chunkSize += metricSize
+	}
+	return append(chunks, chunkOf(mf, mf.Metric[start:])), nil
+}
+
+// encodedTextSize returns the number of bytes the metric family with the
+// metadata of mf and the given metrics encodes to.
+func encodedTextSize(mf *dto.MetricFamily, metrics []*dto.Metric, opts []EncoderOption) (int, error) {
+	return MetricFamilyToText(io.Discard, chunkOf(mf, metrics), opts...)
+}
+
+func chunkOf(mf *dto.MetricFamily, metrics []*dto.Metric) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   mf.Name,
+		Help:   mf.Help,
+		Type:   mf.Type,
+		Metric: metrics,
+	}
+}
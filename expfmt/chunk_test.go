@@ -0,0 +1,129 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChunkMetricFamily(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("requests_total"),
+		Help: proto.String("Total number of requests."),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	for i := 0; i < 1000; i++ {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{
+					Name:  proto.String("instance"),
+					Value: proto.String(fmt.Sprintf("instance-%d", i)),
+				},
+			},
+			Counter: &dto.Counter{
+				Value: proto.Float64(float64(i)),
+			},
+		})
+	}
+
+	const maxBytes = 1024
+	chunks, err := ChunkMetricFamily(mf, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+
+	var (
+		union []*dto.Metric
+		whole bytes.Buffer
+		parts bytes.Buffer
+	)
+	for i, chunk := range chunks {
+		var buf bytes.Buffer
+		n, err := MetricFamilyToText(&buf, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > maxBytes {
+			t.Errorf("chunk %d encodes to %d bytes, exceeding %d", i, n, maxBytes)
+		}
+		if chunk.GetName() != mf.GetName() || chunk.GetHelp() != mf.GetHelp() || chunk.GetType() != mf.GetType() {
+			t.Errorf("chunk %d has different metadata than the original family", i)
+		}
+		// Strip the HELP and TYPE lines to compare the samples.
+		lines := strings.SplitN(buf.String(), "\n", 3)
+		parts.WriteString(lines[2])
+		union = append(union, chunk.Metric...)
+	}
+	if len(union) != len(mf.Metric) {
+		t.Fatalf("expected %d metrics in all chunks, got %d", len(mf.Metric), len(union))
+	}
+	for i := range union {
+		if union[i] != mf.Metric[i] {
+			t.Fatalf("metric %d differs from the original", i)
+		}
+	}
+	if _, err := MetricFamilyToText(&whole, mf); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := strings.SplitN(whole.String(), "\n", 3)[2], parts.String(); expected != got {
+		t.Errorf("expected samples %q, got %q", expected, got)
+	}
+}
+
+func TestChunkMetricFamilyTooLarge(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("name"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Gauge: &dto.Gauge{Value: proto.Float64(1)},
+			},
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("label"),
+						Value: proto.String(strings.Repeat("x", 100)),
+					},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(2)},
+			},
+		},
+	}
+
+	_, err := ChunkMetricFamily(mf, 64)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if expected := `metric 1 of family "name" needs 135 bytes, exceeding the budget of 64 bytes`; err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err.Error())
+	}
+
+	// The label value cap is honored when sizing the metrics.
+	chunks, err := ChunkMetricFamily(mf, 64, WithLabelValueMaxLength(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 {
+		t.Errorf("expected 1 chunk, got %d", len(chunks))
+	}
+}
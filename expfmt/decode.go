@@ -23,6 +23,8 @@ import (
 
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 
 	"github.com/prometheus/common/model"
 )
@@ -38,8 +40,41 @@ type DecodeOptions struct {
 	Timestamp model.Time
 }
 
+// DecoderOption is an option for the decoders returned by NewDecoder.
+type DecoderOption func(*decoderOption)
+
+type decoderOption struct {
+	discardUnknown bool
+	rejectUnknown  bool
+}
+
+// WithDiscardUnknownFields is a DecoderOption that makes the protobuf decoder
+// drop fields unknown to the MetricFamily message of the client_model version
+// in use, e.g. fields from newer or older versions. By default, unknown fields
+// are kept as unknown fields of the decoded messages. It has no effect on the
+// text decoder.
+func WithDiscardUnknownFields() DecoderOption {
+	return func(o *decoderOption) {
+		o.discardUnknown = true
+		o.rejectUnknown = false
+	}
+}
+
+// WithRejectUnknownFields is a DecoderOption that makes the protobuf decoder
+// return an error if a decoded message contains fields unknown to the
+// MetricFamily message of the client_model version in use. It has no effect on
+// the text decoder.
+func WithRejectUnknownFields() DecoderOption {
+	return func(o *decoderOption) {
+		o.rejectUnknown = true
+		o.discardUnknown = false
+	}
+}
+
 // ResponseFormat extracts the correct format from a HTTP response header.
-// If no matching format can be found FormatUnknown is returned.
+// If no matching format can be found FormatUnknown is returned. A valid
+// escaping parameter (see model.EscapingScheme) is kept in the returned
+// format.
 func ResponseFormat(h http.Header) Format {
 	ct := h.Get(hdrContentType)
 
@@ -47,7 +82,18 @@ func ResponseFormat(h http.Header) Format {
 	if err != nil {
 		return FmtUnknown
 	}
+	format := responseFormat(mediatype, params)
+	if e, ok := params[model.EscapingKey]; ok && format != FmtUnknown {
+		if scheme, err := model.ToEscapingScheme(e); err == nil {
+			return format.WithEscapingScheme(scheme)
+		}
+	}
+	return format
+}
 
+// responseFormat returns the format for the given media type and parameters,
+// ignoring the escaping parameter.
+func responseFormat(mediatype string, params map[string]string) Format {
 	const textType = "text/plain"
 
 	switch mediatype {
@@ -65,6 +111,15 @@ func ResponseFormat(h http.Header) Format {
 			return FmtUnknown
 		}
 		return FmtText
+
+	case OpenMetricsType:
+		switch params["version"] {
+		case OpenMetricsVersion_1_0_0, "":
+			return FmtOpenMetrics_1_0_0
+		case OpenMetricsVersion_0_0_1:
+			return FmtOpenMetrics_0_0_1
+		}
+		return FmtUnknown
 	}
 
 	return FmtUnknown
@@ -72,17 +127,28 @@ func ResponseFormat(h http.Header) Format {
 
 // NewDecoder returns a new decoder based on the given input format.
 // If the input format does not imply otherwise, a text format decoder is returned.
-func NewDecoder(r io.Reader, format Format) Decoder {
-	switch format {
+// If the format has an escaping parameter (see Format.WithEscapingScheme), the
+// escaping of metric and label names is reversed as far as possible (see
+// model.UnescapeName).
+func NewDecoder(r io.Reader, format Format, options ...DecoderOption) Decoder {
+	o := decoderOption{}
+	for _, option := range options {
+		option(&o)
+	}
+	scheme := format.ToEscapingScheme()
+	switch format.withoutEscaping() {
 	case FmtProtoDelim:
-		return &protoDecoder{r: r}
+		return &protoDecoder{r: r, opts: o, scheme: scheme}
 	}
-	return &textDecoder{r: r}
+	return &textDecoder{r: r, scheme: scheme}
 }
 
 // protoDecoder implements the Decoder interface for protocol buffers.
 type protoDecoder struct {
-	r io.Reader
+	r      io.Reader
+	br     *bufio.Reader // Buffers r across calls of Decode.
+	opts   decoderOption
+	scheme model.EscapingScheme
 }
 
 // Decode implements the Decoder interface.
@@ -90,9 +156,18 @@ func (d *protoDecoder) Decode(v *dto.MetricFamily) error {
 	opts := protodelim.UnmarshalOptions{
 		MaxSize: -1,
 	}
-	if err := opts.UnmarshalFrom(bufio.NewReader(d.r), v); err != nil {
+	opts.UnmarshalOptions.DiscardUnknown = d.opts.discardUnknown
+	// Create the buffered reader only once, as it reads ahead into the
+	// following metric families.
+	if d.br == nil {
+		d.br = bufio.NewReader(d.r)
+	}
+	if err := opts.UnmarshalFrom(d.br, v); err != nil {
 		return err
 	}
+	if d.opts.rejectUnknown && hasUnknownFields(v.ProtoReflect()) {
+		return fmt.Errorf("unknown fields in metric family %q", v.GetName())
+	}
 	if !model.IsValidMetricName(model.LabelValue(v.GetName())) {
 		return fmt.Errorf("invalid metric name %q", v.GetName())
 	}
@@ -112,14 +187,56 @@ func (d *protoDecoder) Decode(v *dto.MetricFamily) error {
 			}
 		}
 	}
+	unescapeMetricFamily(v, d.scheme)
 	return nil
 }
 
+// unescapeMetricFamily reverses the escaping of the name of mf and of the
+// label names of its metrics according to scheme.
+func unescapeMetricFamily(mf *dto.MetricFamily, scheme model.EscapingScheme) {
+	if scheme == model.NoEscaping {
+		return
+	}
+	mf.Name = proto.String(model.UnescapeName(mf.GetName(), scheme))
+	for _, m := range mf.Metric {
+		for _, l := range m.GetLabel() {
+			if l != nil {
+				l.Name = proto.String(model.UnescapeName(l.GetName(), scheme))
+			}
+		}
+	}
+}
+
+// hasUnknownFields returns whether m or any message nested in it has unknown
+// fields.
+func hasUnknownFields(m protoreflect.Message) bool {
+	if len(m.GetUnknown()) > 0 {
+		return true
+	}
+	found := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			l := v.List()
+			for i := 0; i < l.Len() && !found; i++ {
+				found = hasUnknownFields(l.Get(i).Message())
+			}
+		case fd.IsMap():
+			// MetricFamily doesn't contain maps.
+		case fd.Message() != nil:
+			found = hasUnknownFields(v.Message())
+		}
+		return !found
+	})
+	return found
+}
+
 // textDecoder implements the Decoder interface for the text protocol.
 type textDecoder struct {
-	r    io.Reader
-	fams map[string]*dto.MetricFamily
-	err  error
+	r      io.Reader
+	scheme model.EscapingScheme
+	fams   map[string]*dto.MetricFamily
+	err    error
 }
 
 // Decode implements the Decoder interface.
@@ -140,6 +257,7 @@ func (d *textDecoder) Decode(v *dto.MetricFamily) error {
 		v.Type = fam.Type
 		v.Metric = fam.Metric
 		delete(d.fams, key)
+		unescapeMetricFamily(v, d.scheme)
 		return nil
 	}
 	return d.err
@@ -25,6 +25,7 @@ import (
 	"testing"
 
 	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/prometheus/common/model"
@@ -443,6 +444,22 @@ func testDiscriminatorHTTPHeader(t testing.TB) {
 			input:  map[string]string{"Content-Type": `text/plain; version=0.0.3`},
 			output: FmtUnknown,
 		},
+		{
+			input:  map[string]string{"Content-Type": `application/openmetrics-text; version=1.0.0; charset=utf-8`},
+			output: FmtOpenMetrics_1_0_0,
+		},
+		{
+			input:  map[string]string{"Content-Type": `application/openmetrics-text; version=0.0.1`},
+			output: FmtOpenMetrics_0_0_1,
+		},
+		{
+			input:  map[string]string{"Content-Type": `application/openmetrics-text`},
+			output: FmtOpenMetrics_1_0_0,
+		},
+		{
+			input:  map[string]string{"Content-Type": `application/openmetrics-text; version=2.0.0`},
+			output: FmtUnknown,
+		},
 	}
 
 	for i, scenario := range scenarios {
@@ -464,6 +481,65 @@ func testDiscriminatorHTTPHeader(t testing.TB) {
 	}
 }
 
+func TestProtoDecoderUnknownFields(t *testing.T) {
+	// A field number no version of client_model uses.
+	unknown := protowire.AppendTag(nil, 999, protowire.BytesType)
+	unknown = protowire.AppendString(unknown, "from the future")
+
+	metric := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+	metric.ProtoReflect().SetUnknown(unknown)
+	mf := &dto.MetricFamily{
+		Name:   proto.String("gauge"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{metric},
+	}
+	b, err := proto.Marshal(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, unknown...)
+	in := string(protowire.AppendBytes(nil, b))
+
+	scenarios := []struct {
+		options       []DecoderOption
+		fail          bool
+		expectUnknown bool
+	}{
+		{
+			expectUnknown: true,
+		},
+		{
+			options: []DecoderOption{WithDiscardUnknownFields()},
+		},
+		{
+			options: []DecoderOption{WithRejectUnknownFields()},
+			fail:    true,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		dec := NewDecoder(strings.NewReader(in), FmtProtoDelim, scenario.options...)
+		var got dto.MetricFamily
+		err := dec.Decode(&got)
+		if scenario.fail {
+			if err == nil {
+				t.Errorf("%d. expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if got.GetName() != "gauge" || len(got.Metric) != 1 || got.Metric[0].GetGauge().GetValue() != 1 {
+			t.Errorf("%d. unexpected metric family %v", i, &got)
+		}
+		if found := hasUnknownFields(got.ProtoReflect()); found != scenario.expectUnknown {
+			t.Errorf("%d. expected unknown fields to be kept: %t, got %t", i, scenario.expectUnknown, found)
+		}
+	}
+}
+
 func TestDiscriminatorHTTPHeader(t *testing.T) {
 	testDiscriminatorHTTPHeader(t)
 }
@@ -568,3 +644,114 @@ func TestTextDecoderWithBufioReader(t *testing.T) {
 		t.Fatal("Metric foo not decoded")
 	}
 }
+
+func TestDecodeEscapedNames(t *testing.T) {
+	original := &dto.MetricFamily{
+		Name: proto.String("http.server.requests"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("http.status_code"), Value: proto.String("200")},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(7)},
+			},
+		},
+	}
+	escaped := func(scheme model.EscapingScheme) *dto.MetricFamily {
+		mf := proto.Clone(original).(*dto.MetricFamily)
+		mf.Name = proto.String(model.EscapeName(mf.GetName(), scheme))
+		for _, l := range mf.Metric[0].Label {
+			l.Name = proto.String(model.EscapeName(l.GetName(), scheme))
+		}
+		return mf
+	}
+
+	scenarios := []struct {
+		format Format
+		scheme model.EscapingScheme
+		// The name expected after decoding, or "" for the original one.
+		name string
+	}{
+		{format: FmtText, scheme: model.DotsEscaping},
+		{format: FmtText, scheme: model.ValueEncodingEscaping},
+		{format: FmtProtoDelim, scheme: model.DotsEscaping},
+		{format: FmtProtoDelim, scheme: model.ValueEncodingEscaping},
+		// Escaping with underscores cannot be reversed.
+		{format: FmtText, scheme: model.UnderscoreEscaping, name: "http_server_requests"},
+	}
+
+	for i, scenario := range scenarios {
+		// The encoder escapes the names according to the format.
+		var (
+			buf    strings.Builder
+			format = scenario.format.WithEscapingScheme(scenario.scheme)
+			in     = proto.Clone(original).(*dto.MetricFamily)
+		)
+		if err := NewEncoder(&buf, format).Encode(in); err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		if strings.Contains(buf.String(), "http.server") {
+			t.Fatalf("%d. expected escaped names in %q", i, buf.String())
+		}
+		if !proto.Equal(in, original) {
+			t.Errorf("%d. expected the encoded family to be left untouched, got %v", i, in)
+		}
+
+		var got dto.MetricFamily
+		if err := NewDecoder(strings.NewReader(buf.String()), format).Decode(&got); err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		expected := original
+		if scenario.name != "" {
+			expected = escaped(scenario.scheme)
+			expected.Name = proto.String(scenario.name)
+		}
+		if !proto.Equal(&got, expected) {
+			t.Errorf("%d. expected %v, got %v", i, expected, &got)
+		}
+
+		// The same via the Content-Type of a response.
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{hdrContentType: []string{string(format)}},
+			Body:       io.NopCloser(strings.NewReader(buf.String())),
+		}
+		families, err := DecodeResponse(resp)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		if len(families) != 1 || !proto.Equal(families[0], expected) {
+			t.Errorf("%d. expected %v, got %v", i, expected, families)
+		}
+	}
+}
+
+func TestFormatEscapingScheme(t *testing.T) {
+	f := FmtText.WithEscapingScheme(model.DotsEscaping)
+	if expected := FmtText + "; escaping=dots"; f != expected {
+		t.Errorf("expected %q, got %q", expected, f)
+	}
+	if got := f.ToEscapingScheme(); got != model.DotsEscaping {
+		t.Errorf("expected dots escaping, got %s", got)
+	}
+	f = f.WithEscapingScheme(model.ValueEncodingEscaping)
+	if expected := FmtText + "; escaping=values"; f != expected {
+		t.Errorf("expected %q, got %q", expected, f)
+	}
+	if got := f.withoutEscaping(); got != FmtText {
+		t.Errorf("expected %q, got %q", FmtText, got)
+	}
+	if got := FmtProtoDelim.ToEscapingScheme(); got != model.NoEscaping {
+		t.Errorf("expected no escaping, got %s", got)
+	}
+
+	header := http.Header{hdrContentType: []string{ProtoType + "; proto=" + ProtoProtocol + "; encoding=delimited; escaping=values"}}
+	if got, expected := ResponseFormat(header), FmtProtoDelim.WithEscapingScheme(model.ValueEncodingEscaping); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	header.Set(hdrContentType, "text/plain; escaping=bogus")
+	if got := ResponseFormat(header); got != FmtText {
+		t.Errorf("expected %q, got %q", FmtText, got)
+	}
+}
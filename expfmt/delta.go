@@ -0,0 +1,118 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DeltaEncoder encodes snapshots of metric families, writing only those
+// families that are new or have changed since the previous snapshot. It is
+// meant for change feeds over metrics. A DeltaEncoder must not be used
+// concurrently.
+type DeltaEncoder struct {
+	enc          Encoder
+	fingerprints map[string]uint64 // Keyed by family name.
+}
+
+// NewDeltaEncoder returns a DeltaEncoder writing the changed families to enc.
+func NewDeltaEncoder(enc Encoder) *DeltaEncoder {
+	return &DeltaEncoder{enc: enc, fingerprints: map[string]uint64{}}
+}
+
+// Encode writes those families of the snapshot that differ from the family of
+// the same name in the previous snapshot, or didn't exist there. It returns
+// the sorted names of the families of the previous snapshot that are missing
+// from this one.
+//
+// Whether a family has changed is decided by a fingerprint of its content,
+// which doesn't depend on the order of its metrics or of their labels. If
+// encoding a family fails, Encode returns the error right away. The failed
+// family and those not processed yet count as changed in the next snapshot,
+// and no removed families are reported.
+func (d *DeltaEncoder) Encode(snapshot []*dto.MetricFamily) (removed []string, err error) {
+	seen := make(map[string]struct{}, len(snapshot))
+	for _, mf := range snapshot {
+		name := mf.GetName()
+		seen[name] = struct{}{}
+		fp, err := familyFingerprint(mf)
+		if err != nil {
+			return nil, err
+		}
+		if last, ok := d.fingerprints[name]; ok && last == fp {
+			continue
+		}
+		if err := d.enc.Encode(mf); err != nil {
+			delete(d.fingerprints, name)
+			return nil, err
+		}
+		d.fingerprints[name] = fp
+	}
+	for name := range d.fingerprints {
+		if _, ok := seen[name]; !ok {
+			removed = append(removed, name)
+			delete(d.fingerprints, name)
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// familyFingerprint hashes the metadata and metrics of mf. The hashes of the
+// metrics are summed up so that their order doesn't matter.
+func familyFingerprint(mf *dto.MetricFamily) (uint64, error) {
+	h := fnv.New64a()
+	h.Write([]byte(mf.GetName()))
+	h.Write([]byte{0xff})
+	h.Write([]byte(mf.GetHelp()))
+	h.Write([]byte{0xff, byte(mf.GetType())})
+	fp := h.Sum64()
+	for _, m := range mf.Metric {
+		mfp, err := metricFingerprint(m)
+		if err != nil {
+			return 0, err
+		}
+		fp += mfp
+	}
+	return fp, nil
+}
+
+// metricFingerprint hashes m with its labels sorted by name.
+func metricFingerprint(m *dto.Metric) (uint64, error) {
+	labels := make([]*dto.LabelPair, len(m.Label))
+	copy(labels, m.Label)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+	h := fnv.New64a()
+	for _, l := range labels {
+		h.Write([]byte(l.GetName()))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.GetValue()))
+		h.Write([]byte{0xff})
+	}
+	withoutLabels := proto.Clone(m).(*dto.Metric)
+	withoutLabels.Label = nil
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(withoutLabels)
+	if err != nil {
+		return 0, err
+	}
+	h.Write(b)
+	return h.Sum64(), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeFamily(name string, values map[string]float64, order []string) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, instance := range order {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("job"), Value: proto.String("test")},
+				{Name: proto.String("instance"), Value: proto.String(instance)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(values[instance])},
+		})
+	}
+	return mf
+}
+
+func TestDeltaEncoder(t *testing.T) {
+	var out bytes.Buffer
+	enc := NewDeltaEncoder(NewEncoder(&out, FmtText))
+
+	removed, err := enc.Encode([]*dto.MetricFamily{
+		gaugeFamily("unchanged", map[string]float64{"a": 1, "b": 2}, []string{"a", "b"}),
+		gaugeFamily("changed", map[string]float64{"a": 1}, []string{"a"}),
+		gaugeFamily("removed", map[string]float64{"a": 1}, []string{"a"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected no removed families, got %v", removed)
+	}
+	expected := `# TYPE unchanged gauge
+unchanged{job="test",instance="a"} 1
+unchanged{job="test",instance="b"} 2
+# TYPE changed gauge
+changed{job="test",instance="a"} 1
+# TYPE removed gauge
+removed{job="test",instance="a"} 1
+`
+	if got := out.String(); got != expected {
+		t.Errorf("expected first snapshot %q, got %q", expected, got)
+	}
+
+	out.Reset()
+	// Metrics of "unchanged" in a different order, with labels in a
+	// different order.
+	unchanged := gaugeFamily("unchanged", map[string]float64{"a": 1, "b": 2}, []string{"b", "a"})
+	for _, m := range unchanged.Metric {
+		m.Label[0], m.Label[1] = m.Label[1], m.Label[0]
+	}
+	removed, err = enc.Encode([]*dto.MetricFamily{
+		unchanged,
+		gaugeFamily("changed", map[string]float64{"a": 2}, []string{"a"}),
+		gaugeFamily("new", map[string]float64{"a": 1}, []string{"a"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"removed"}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected removed families %v, got %v", expected, removed)
+	}
+	expected = `# TYPE changed gauge
+changed{job="test",instance="a"} 2
+# TYPE new gauge
+new{job="test",instance="a"} 1
+`
+	if got := out.String(); got != expected {
+		t.Errorf("expected second snapshot %q, got %q", expected, got)
+	}
+}
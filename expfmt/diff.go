@@ -0,0 +1,86 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/common/model"
+)
+
+// ExpositionDiff is the difference between two expositions as computed by
+// DiffExpositions. All maps are keyed by the signature of a series, i.e. its
+// metric name followed by its labels sorted by name, as rendered by
+// model.Metric.String, e.g. `http_requests_total{code="200",method="get"}`.
+type ExpositionDiff struct {
+	Added   map[string]*model.Sample // Series only present in the new exposition.
+	Removed map[string]*model.Sample // Series only present in the old exposition.
+	Changed map[string]SeriesChange  // Series whose value has changed.
+}
+
+// SeriesChange is a series whose value differs between two expositions.
+type SeriesChange struct {
+	Metric   model.Metric
+	Old, New model.SampleValue
+}
+
+// DiffExpositions compares the series of the old exposition a with those of
+// the new exposition b, both as returned by TextParser.TextToMetricFamilies.
+// Summaries and histograms are compared series by series, like their
+// samples appear in the text format, i.e. each quantile and bucket as well as
+// the sum and count are separate series. Only the values are compared, not
+// the timestamps, and NaN values are considered equal to each other. Native
+// histograms and families of types not supported by ExtractSamples are
+// ignored. Should a series appear more than once in an exposition, the last
+// occurrence counts.
+func DiffExpositions(a, b map[string]*dto.MetricFamily) ExpositionDiff {
+	var (
+		old  = exposedSeries(a)
+		diff = ExpositionDiff{
+			Added:   map[string]*model.Sample{},
+			Removed: map[string]*model.Sample{},
+			Changed: map[string]SeriesChange{},
+		}
+	)
+	for key, s := range exposedSeries(b) {
+		o, ok := old[key]
+		switch {
+		case !ok:
+			diff.Added[key] = s
+		case !o.Value.Equal(s.Value):
+			diff.Changed[key] = SeriesChange{Metric: s.Metric, Old: o.Value, New: s.Value}
+		}
+		delete(old, key)
+	}
+	for key, s := range old {
+		diff.Removed[key] = s
+	}
+	return diff
+}
+
+// exposedSeries returns the samples of all families, keyed by the signature of
+// their series.
+func exposedSeries(families map[string]*dto.MetricFamily) map[string]*model.Sample {
+	series := map[string]*model.Sample{}
+	for _, mf := range families {
+		samples, err := extractSamples(mf, &DecodeOptions{})
+		if err != nil {
+			continue // Unsupported type.
+		}
+		for _, s := range samples {
+			series[s.Metric.String()] = s
+		}
+	}
+	return series
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestDiffExpositions(t *testing.T) {
+	parse := func(in string) map[string]*dto.MetricFamily {
+		var p TextParser
+		mfs, err := p.TextToMetricFamilies(strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfs
+	}
+
+	a := parse(`# TYPE http_requests_total counter
+http_requests_total{method="get",code="200"} 10
+http_requests_total{method="post",code="200"} 3
+# TYPE temperature gauge
+temperature NaN
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.1
+rpc_duration_seconds_sum 5
+rpc_duration_seconds_count 50
+# TYPE request_size_bytes histogram
+request_size_bytes_bucket{le="100"} 4
+request_size_bytes_bucket{le="+Inf"} 5
+request_size_bytes_sum 300
+request_size_bytes_count 5
+`)
+	b := parse(`# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 12
+http_requests_total{method="get",code="500"} 1
+# TYPE temperature gauge
+temperature NaN
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.1
+rpc_duration_seconds{quantile="0.9"} 0.3
+rpc_duration_seconds_sum 5
+rpc_duration_seconds_count 50
+# TYPE request_size_bytes histogram
+request_size_bytes_bucket{le="100"} 4
+request_size_bytes_bucket{le="+Inf"} 6
+request_size_bytes_sum 1300
+request_size_bytes_count 6
+up 1
+`)
+
+	diff := DiffExpositions(a, b)
+	if got, expected := sortedKeys(diff.Added), []string{
+		`http_requests_total{code="500", method="get"}`,
+		`rpc_duration_seconds{quantile="0.9"}`,
+		`up`,
+	}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected added %q, got %q", expected, got)
+	}
+	if s := diff.Added["up"]; s == nil || s.Value != 1 {
+		t.Errorf("unexpected added sample %v", s)
+	}
+	if got, expected := sortedKeys(diff.Removed), []string{
+		`http_requests_total{code="200", method="post"}`,
+	}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected removed %q, got %q", expected, got)
+	}
+
+	expected := map[string]SeriesChange{
+		`http_requests_total{code="200", method="get"}`: {
+			Metric: model.Metric{"__name__": "http_requests_total", "code": "200", "method": "get"},
+			Old:    10, New: 12,
+		},
+		`request_size_bytes_bucket{le="+Inf"}`: {
+			Metric: model.Metric{"__name__": "request_size_bytes_bucket", "le": "+Inf"},
+			Old:    5, New: 6,
+		},
+		`request_size_bytes_sum`: {
+			Metric: model.Metric{"__name__": "request_size_bytes_sum"},
+			Old:    300, New: 1300,
+		},
+		`request_size_bytes_count`: {
+			Metric: model.Metric{"__name__": "request_size_bytes_count"},
+			Old:    5, New: 6,
+		},
+	}
+	if !reflect.DeepEqual(diff.Changed, expected) {
+		t.Errorf("expected changed %v, got %v", expected, diff.Changed)
+	}
+}
+
+func TestDiffExpositionsEqual(t *testing.T) {
+	mfs := map[string]*dto.MetricFamily{
+		"temperature": {
+			Name:   proto.String("temperature"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(math.NaN())}}},
+		},
+	}
+	diff := DiffExpositions(mfs, mfs)
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 || len(diff.Changed) != 0 {
+		t.Errorf("expected empty diff, got %v", diff)
+	}
+	diff = DiffExpositions(nil, mfs)
+	if len(diff.Added) != 1 || len(diff.Removed) != 0 || len(diff.Changed) != 0 {
+		t.Errorf("expected one added series, got %v", diff)
+	}
+}
+
+func sortedKeys(m map[string]*model.Sample) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -14,14 +14,23 @@
 package expfmt
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/prometheus/common/internal/bitbucket.org/ww/goautoneg"
+	"github.com/prometheus/common/model"
 
 	dto "github.com/prometheus/client_model/go"
 )
@@ -42,6 +51,651 @@ type Closer interface {
 	Close() error
 }
 
+// EncoderOption is an option for the text and OpenMetrics encoders. It is
+// applied to every metric family written.
+type EncoderOption func(*encoderOption)
+
+type encoderOption struct {
+	labelValueMaxRunes    int
+	labelValueMaxRunesErr bool
+	labelSeparatorSpace   bool
+	omitEmptyFamilies     bool
+	legacyASCII           bool
+	rawValues             *RawValues
+	namePrefix            string
+	alwaysHelp            bool
+	normalizedHelp        bool
+	compactFloats         bool
+	verbatimCounterNames  bool
+	escapingScheme        model.EscapingScheme
+	boundPrecision        int
+	nilMetricsErr         bool
+	checksum              bool
+	infoFamilies          map[string]struct{}
+	stateSetFamilies      map[string]struct{}
+	gaugeHistograms       map[string]struct{}
+	units                 map[string]string
+	maxExemplars          int
+	exemplarPolicy        ExemplarPolicy
+	strict                bool
+	metricIDs             map[string]int
+	sortedLabels          bool
+	omitZeroExemplarTs    bool
+	exemplarTsDigits      int
+	omitMetadata          bool // Only set internally, see OpenMetricsStreamEncoder and EncodeState.
+}
+
+// newEncoderOption applies the given options to a fresh encoderOption.
+func newEncoderOption(options []EncoderOption) *encoderOption {
+	o := &encoderOption{}
+	for _, option := range options {
+		option(o)
+	}
+	return o
+}
+
+// labelValueEllipsis marks a label value truncated by WithLabelValueMaxLength.
+const labelValueEllipsis = "…"
+
+// WithLabelValueMaxLength is an EncoderOption that caps every label value at
+// maxRunes runes. Runes rather than bytes are counted so that multi-byte
+// characters are never split. Longer values are truncated and terminated with
+// "…", which counts towards the limit. A maxRunes of zero or less disables the
+// cap.
+func WithLabelValueMaxLength(maxRunes int) EncoderOption {
+	return func(o *encoderOption) {
+		o.labelValueMaxRunes = maxRunes
+		o.labelValueMaxRunesErr = false
+	}
+}
+
+// WithLabelValueMaxLengthError works like WithLabelValueMaxLength, but instead
+// of truncating, the encoder returns an error for a label value exceeding
+// maxRunes runes.
+func WithLabelValueMaxLengthError(maxRunes int) EncoderOption {
+	return func(o *encoderOption) {
+		o.labelValueMaxRunes = maxRunes
+		o.labelValueMaxRunesErr = true
+	}
+}
+
+// WithLabelSeparatorSpace is an EncoderOption that inserts a space after each
+// comma separating label pairs (including the comma after a metric name placed
+// inside the braces), i.e. `{a="1", b="2"}` instead of `{a="1",b="2"}`. Both
+// forms are valid exposition and accepted by the parser.
+func WithLabelSeparatorSpace() EncoderOption {
+	return func(o *encoderOption) {
+		o.labelSeparatorSpace = true
+	}
+}
+
+// WithoutEmptyFamilies is an EncoderOption that makes the encoders skip metric
+// families without any metrics instead of writing their metadata (the
+// OpenMetrics encoder) or returning an error (the text encoder). This helps
+// consumers that cannot handle metadata without samples.
+func WithoutEmptyFamilies() EncoderOption {
+	return func(o *encoderOption) {
+		o.omitEmptyFamilies = true
+	}
+}
+
+// WithLegacyASCII is an EncoderOption for ancient consumers that cannot deal
+// with UTF-8. It replaces every non-ASCII rune in label values and HELP strings
+// by an underscore, like the underscores escaping scheme does for names, so
+// that e.g. "Björn" becomes "Bj_rn". This includes the ellipsis added by
+// WithLabelValueMaxLength.
+func WithLegacyASCII() EncoderOption {
+	return func(o *encoderOption) {
+		o.legacyASCII = true
+	}
+}
+
+// WithRawValues is an EncoderOption that makes the text encoder write sample
+// values recorded in r (see TextParser.RawValues) exactly as they were parsed
+// rather than formatting them anew. Values not recorded in r, e.g. because they
+// have been modified after parsing, are formatted as usual. The OpenMetrics
+// encoder ignores this option, as the recorded text follows the text format,
+// which differs from OpenMetrics in how values are written, e.g. OpenMetrics
+// writes integral floats with a trailing ".0". The protobuf encoders ignore it,
+// too.
+func WithRawValues(r *RawValues) EncoderOption {
+	return func(o *encoderOption) {
+		o.rawValues = r
+	}
+}
+
+// WithAlwaysHelp is an EncoderOption that makes the text and OpenMetrics
+// encoders write a HELP line for every metric family, with an empty help text
+// for families without one, e.g. `# HELP foo `. By default, the HELP line is
+// omitted for a family whose Help field is not set.
+func WithAlwaysHelp() EncoderOption {
+	return func(o *encoderOption) {
+		o.alwaysHelp = true
+	}
+}
+
+// WithNormalizedHelp is an EncoderOption that makes the text and OpenMetrics
+// encoders collapse each run of whitespace in HELP strings, including
+// newlines, into a single space and trim leading and trailing whitespace, so
+// that every help text is written as a single clean line. This is lossy and
+// happens before escaping. By default, help texts are written as they are.
+func WithNormalizedHelp() EncoderOption {
+	return func(o *encoderOption) {
+		o.normalizedHelp = true
+	}
+}
+
+// WithCompactFloats is an EncoderOption that makes the OpenMetrics encoder
+// write integral float sample values without the ".0" it appends by default,
+// e.g. `foos_total 42` rather than `foos_total 42.0`, saving space for large
+// numbers of integral gauges. Values written in scientific notation, like
+// 3.14e+42, and the special values +Inf, -Inf, and NaN are not affected, nor
+// are timestamps, exemplar values, and the `le` and `quantile` labels. The
+// text encoder always writes float values compactly.
+func WithCompactFloats() EncoderOption {
+	return func(o *encoderOption) {
+		o.compactFloats = true
+	}
+}
+
+// WithSuffixHandling is an EncoderOption that determines whether the
+// OpenMetrics encoder handles the `_total` suffix of counters, which it does by
+// default: The suffix is truncated from the HELP and TYPE lines of a counter
+// with the suffix, and a counter without the suffix is written with the
+// `unknown` type. With WithSuffixHandling(false), the name of a counter is used
+// exactly as given in the HELP, TYPE, and sample lines, and its type is always
+// `counter`, e.g. `# TYPE http_requests_total counter` followed by
+// `http_requests_total 42.0`. As no `_total` suffix is recognized then, no
+// `_created` lines are written for counters. The text encoder, which doesn't
+// handle the suffix, ignores this option, as do the protobuf encoders.
+func WithSuffixHandling(enabled bool) EncoderOption {
+	return func(o *encoderOption) {
+		o.verbatimCounterNames = !enabled
+	}
+}
+
+// WithEscapingScheme is an EncoderOption that makes the OpenMetrics encoder
+// escape the metric and label names of the metric families it writes according
+// to scheme (see model.EscapeName), e.g. model.UnderscoreEscaping for consumers
+// that only support legacy names. The suffixes of counters (`_total`),
+// summaries, and histograms are appended to the escaped name, so that they are
+// still recognized, and the `quantile` and `le` labels as well as the labels of
+// exemplars are not escaped. With model.NoEscaping, the default, names not
+// conforming to the legacy validation pattern are written quoted. The text
+// encoder and the protobuf encoders ignore this option.
+func WithEscapingScheme(scheme model.EscapingScheme) EncoderOption {
+	return func(o *encoderOption) {
+		o.escapingScheme = scheme
+	}
+}
+
+// escapeName returns name escaped according to the escaping scheme. It is safe
+// to call on a nil encoderOption.
+func (o *encoderOption) escapeName(name string) string {
+	if o == nil {
+		return name
+	}
+	return model.EscapeName(name, o.escapingScheme)
+}
+
+// WithBoundPrecision is an EncoderOption that rounds the values of the
+// `quantile` label of summaries and the `le` label of histograms to the given
+// number of significant decimal digits before writing them in their shortest
+// form, so that e.g. a quantile of 0.99000001 is written as `0.99` with a
+// precision of 3. This keeps the identity of series stable if the producers
+// of the metrics disagree on the exact bounds. A precision of zero or less
+// (the default) writes the exact values in their shortest form.
+func WithBoundPrecision(digits int) EncoderOption {
+	return func(o *encoderOption) {
+		o.boundPrecision = digits
+	}
+}
+
+// bound returns the value of a `quantile` or `le` label rounded according to
+// the options. It is safe to call on a nil encoderOption.
+func (o *encoderOption) bound(v float64) float64 {
+	if o == nil || o.boundPrecision <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return v
+	}
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', o.boundPrecision, 64), 64)
+	return rounded
+}
+
+// WithNilMetricsError is an EncoderOption that makes the text and OpenMetrics
+// encoders return an error, naming its index, for a nil entry in the Metric
+// slice of a metric family. Nothing is written for such a family. By default,
+// nil entries are skipped silently.
+func WithNilMetricsError() EncoderOption {
+	return func(o *encoderOption) {
+		o.nilMetricsErr = true
+	}
+}
+
+// checkNilMetrics returns an error if in has a nil metric and the options ask
+// for it. It is safe to call on a nil encoderOption.
+func (o *encoderOption) checkNilMetrics(in *dto.MetricFamily) error {
+	if o == nil || !o.nilMetricsErr {
+		return nil
+	}
+	for i, m := range in.Metric {
+		if m == nil {
+			return fmt.Errorf("metric %d of MetricFamily %q is nil", i, in.GetName())
+		}
+	}
+	return nil
+}
+
+// WithChecksum is an EncoderOption that makes the text and OpenMetrics
+// encoders returned by NewEncoder write a `# checksum sha256:<hex>` comment
+// upon Close, after all metric families and before the `# EOF` line of
+// OpenMetrics. It carries the SHA-256 hash of all bytes written before it, so
+// that stored expositions can be checked for corruption, e.g. by a TextParser
+// with VerifyChecksum set. The option is ignored by MetricFamilyToText and
+// MetricFamilyToOpenMetrics, which write a single family each, and by the
+// protobuf encoders.
+func WithChecksum() EncoderOption {
+	return func(o *encoderOption) {
+		o.checksum = true
+	}
+}
+
+// checksumWriter returns the writer to write the metric families to and a
+// function writing the checksum comment to w, if the options ask for it.
+// Otherwise, it returns w itself and a function doing nothing.
+func checksumWriter(w io.Writer, options []EncoderOption) (io.Writer, func() error) {
+	if !newEncoderOption(options).checksum {
+		return w, func() error { return nil }
+	}
+	h := sha256.New()
+	return io.MultiWriter(w, h), func() error {
+		_, err := fmt.Fprintf(w, "# checksum sha256:%x\n", h.Sum(nil))
+		return err
+	}
+}
+
+// WithInfoFamilies is an EncoderOption that makes the OpenMetrics encoder write
+// the metric families with the given names with the info type, which the
+// protobuf format doesn't know. Such a family has to be a gauge or untyped
+// family, its name has to have the `_info` suffix (which is dropped from the
+// HELP and TYPE lines, like the `_total` suffix of counters), and the values
+// of all its metrics have to be 1, e.g. `target_info{env="prod"} 1`. Otherwise,
+// an error is returned. The option may be given more than once. The text
+// encoder, which doesn't know the info type, ignores it, as do the protobuf
+// encoders.
+func WithInfoFamilies(names ...string) EncoderOption {
+	return func(o *encoderOption) {
+		if o.infoFamilies == nil {
+			o.infoFamilies = make(map[string]struct{}, len(names))
+		}
+		for _, name := range names {
+			o.infoFamilies[name] = struct{}{}
+		}
+	}
+}
+
+// isInfo returns whether the family with the given name (without any name
+// prefix) is to be written with the info type. It is safe to call on a nil
+// encoderOption.
+func (o *encoderOption) isInfo(name string) bool {
+	if o == nil {
+		return false
+	}
+	_, ok := o.infoFamilies[name]
+	return ok
+}
+
+// WithStateSetFamilies is an EncoderOption that makes the OpenMetrics encoder
+// write the metric families with the given names with the stateset type, which
+// the protobuf format doesn't know. Such a family has to be a gauge or untyped
+// family with one metric per state. Each metric has to have a label named like
+// the family, holding the name of the state, and the value 0 or 1, e.g.
+// `feature{feature="dark_mode"} 1`. Otherwise, an error is returned. The option
+// may be given more than once. WithInfoFamilies takes precedence. The text
+// encoder, which doesn't know the stateset type, ignores it, as do the protobuf
+// encoders.
+func WithStateSetFamilies(names ...string) EncoderOption {
+	return func(o *encoderOption) {
+		if o.stateSetFamilies == nil {
+			o.stateSetFamilies = make(map[string]struct{}, len(names))
+		}
+		for _, name := range names {
+			o.stateSetFamilies[name] = struct{}{}
+		}
+	}
+}
+
+// isStateSet returns whether the family with the given name (without any name
+// prefix) is to be written with the stateset type. It is safe to call on a nil
+// encoderOption.
+func (o *encoderOption) isStateSet(name string) bool {
+	if o == nil {
+		return false
+	}
+	_, ok := o.stateSetFamilies[name]
+	return ok
+}
+
+// WithGaugeHistogramFamilies is an EncoderOption that makes the OpenMetrics
+// encoder write the histogram families with the given names as gauge
+// histograms, like families of the GAUGE_HISTOGRAM type, for producers that
+// only know the HISTOGRAM type: The TYPE line says `gaugehistogram`, and the
+// `_gcount` and `_gsum` samples are written instead of `_count` and `_sum`.
+// As the buckets of a gauge histogram are gauges, their cumulative counts may
+// decrease, which WithStrictValidation rejects for histograms. Families of
+// other types are not affected. The option may be given more than once. The
+// text encoder, which doesn't know gauge histograms, ignores it, as do the
+// protobuf encoders.
+func WithGaugeHistogramFamilies(names ...string) EncoderOption {
+	return func(o *encoderOption) {
+		if o.gaugeHistograms == nil {
+			o.gaugeHistograms = make(map[string]struct{}, len(names))
+		}
+		for _, name := range names {
+			o.gaugeHistograms[name] = struct{}{}
+		}
+	}
+}
+
+// isGaugeHistogram returns whether the histogram family with the given name
+// (without any name prefix) is to be written as a gauge histogram. It is safe
+// to call on a nil encoderOption.
+func (o *encoderOption) isGaugeHistogram(name string) bool {
+	if o == nil {
+		return false
+	}
+	_, ok := o.gaugeHistograms[name]
+	return ok
+}
+
+// WithUnit is an EncoderOption that makes the OpenMetrics encoder write a
+// `# UNIT` line with the given unit for the metric family with the given name,
+// which the protobuf format has no field for. As required by OpenMetrics, the
+// name (without the `_total`, `_info`, or similar suffix) has to end on an
+// underscore followed by the unit, e.g. unit "seconds" for the family
+// "request_duration_seconds_total". Otherwise, an error is returned. The
+// option may be given once per family. Families without a unit get no UNIT
+// line. The text encoder, which doesn't know the UNIT line, ignores this
+// option, as do the protobuf encoders.
+func WithUnit(name, unit string) EncoderOption {
+	return func(o *encoderOption) {
+		if o.units == nil {
+			o.units = map[string]string{}
+		}
+		o.units[name] = unit
+	}
+}
+
+// unit returns the unit of the family with the given name (without any name
+// prefix), or "" if it has none. It is safe to call on a nil encoderOption.
+func (o *encoderOption) unit(name string) string {
+	if o == nil {
+		return ""
+	}
+	return o.units[name]
+}
+
+// ExemplarPolicy selects the exemplars kept by WithMaxExemplars.
+type ExemplarPolicy int
+
+const (
+	// ExemplarsHighestValue keeps the exemplars with the highest values.
+	ExemplarsHighestValue ExemplarPolicy = iota
+	// ExemplarsMostRecent keeps the exemplars with the most recent
+	// timestamps. Exemplars without a timestamp count as the oldest.
+	ExemplarsMostRecent
+)
+
+// WithMaxExemplars is an EncoderOption that limits the number of exemplars the
+// OpenMetrics encoder writes per metric family to n, across all its metrics.
+// The exemplars to keep are selected according to policy, with ties going to
+// the exemplar written first, so that the selection is deterministic. The
+// other exemplars are dropped. A non-positive n means no limit. The text
+// encoder, which doesn't write exemplars, ignores this option, as do the
+// protobuf encoders.
+func WithMaxExemplars(n int, policy ExemplarPolicy) EncoderOption {
+	return func(o *encoderOption) {
+		o.maxExemplars = n
+		o.exemplarPolicy = policy
+	}
+}
+
+// WithStrictValidation is an EncoderOption that makes the OpenMetrics encoder
+// return an error, naming the metric and the violation, instead of correcting
+// or tolerating the following violations of the OpenMetrics specification:
+// histogram buckets not sorted by their upper bound (or with duplicate upper
+// bounds), decreasing cumulative bucket counts of histograms (but not of gauge
+// histograms), a missing +Inf bucket, summary quantiles outside of [0,1], duplicate
+// label names, label pairs not sorted by name, and several samples of the same
+// series (metrics with the same label set) in a family without increasing
+// timestamps. The latter is checked before anything of the family is written,
+// and the error names the family and the label set. By default, buckets are
+// sorted, a missing +Inf bucket is added, and all other violations are written
+// as they are. Native histograms are not affected. The text encoder ignores
+// this option, as do the protobuf encoders.
+func WithStrictValidation() EncoderOption {
+	return func(o *encoderOption) {
+		o.strict = true
+	}
+}
+
+// WithMetricIDs is an EncoderOption that makes the text and OpenMetrics
+// encoders write a `# id <name> <id>` comment as the first line of every metric
+// family with an ID in ids, which is keyed by the family name (without any
+// name prefix), e.g. for a downstream indexer. The name is written like in the
+// HELP and TYPE lines. Families without an ID get no comment. The TextParser
+// ignores the comment, like any comment other than HELP and TYPE, but note that
+// OpenMetrics doesn't allow such comments, so strict OpenMetrics parsers may
+// reject them. ids must not be modified while encoding. The protobuf encoders
+// ignore this option.
+func WithMetricIDs(ids map[string]int) EncoderOption {
+	return func(o *encoderOption) {
+		o.metricIDs = ids
+	}
+}
+
+// metricID returns the ID of the family with the given name (without any name
+// prefix) and whether it has one. It is safe to call on a nil encoderOption.
+func (o *encoderOption) metricID(name string) (int, bool) {
+	if o == nil {
+		return 0, false
+	}
+	id, ok := o.metricIDs[name]
+	return id, ok
+}
+
+// WithSortedLabels is an EncoderOption that makes the OpenMetrics encoder
+// write the labels of every sample sorted by name (in byte order) if enabled,
+// so that semantically identical metric families are written byte by byte
+// identically, e.g. for golden files. The `quantile` and `le` labels of
+// summaries and histograms are sorted in with the other labels. Sorting
+// happens on a copy of the labels, the metric families are never modified.
+// Exemplar labels are written as they are. By default, labels are written in
+// the order of the Label slice of each metric. The text encoder ignores this
+// option, as do the protobuf encoders.
+func WithSortedLabels(enabled bool) EncoderOption {
+	return func(o *encoderOption) {
+		o.sortedLabels = enabled
+	}
+}
+
+// sortLabels returns labels sorted by name if the options ask for it. labels
+// itself is returned if it is sorted already, a sorted copy otherwise. It is
+// safe to call on a nil encoderOption.
+func (o *encoderOption) sortLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	if o == nil || !o.sortedLabels {
+		return labels
+	}
+	less := func(ls []*dto.LabelPair) func(i, j int) bool {
+		return func(i, j int) bool { return ls[i].GetName() < ls[j].GetName() }
+	}
+	if sort.SliceIsSorted(labels, less(labels)) {
+		return labels
+	}
+	sorted := make([]*dto.LabelPair, len(labels))
+	copy(sorted, labels)
+	sort.SliceStable(sorted, less(sorted))
+	return sorted
+}
+
+// WithZeroExemplarTimestampsOmitted is an EncoderOption that makes the
+// OpenMetrics encoder treat an exemplar timestamp representing the Unix epoch,
+// i.e. a zero-valued Timestamp message, like a missing one, so that no
+// timestamp is written for the exemplar. This is meant for producers that
+// can't leave the Timestamp field nil. By default, only a nil timestamp is
+// omitted, while an epoch timestamp is written as `0.0`. The text encoder,
+// which doesn't write exemplars, ignores this option, as do the protobuf
+// encoders.
+func WithZeroExemplarTimestampsOmitted() EncoderOption {
+	return func(o *encoderOption) {
+		o.omitZeroExemplarTs = true
+	}
+}
+
+// exemplarTimestamp returns the timestamp of e to be written according to the
+// options, or nil if none is to be written. It is safe to call on a nil
+// encoderOption.
+func (o *encoderOption) exemplarTimestamp(e *dto.Exemplar) *timestamppb.Timestamp {
+	ts := e.GetTimestamp()
+	if ts == nil || o == nil || !o.omitZeroExemplarTs {
+		return ts
+	}
+	if ts.GetSeconds() == 0 && ts.GetNanos() == 0 {
+		return nil
+	}
+	return ts
+}
+
+// WithExemplarTimestampPrecision is an EncoderOption that makes the
+// OpenMetrics encoder write exemplar timestamps with exactly the given number
+// of fractional digits, e.g. `12345.600` with 3 digits, formatted directly
+// from the seconds and nanos of the Timestamp message, so that e.g. millisecond
+// precision is preserved even for timestamps whose float representation would
+// lose it. Nanos beyond the precision are rounded. More than 9 digits are
+// treated as 9. A precision of zero or less (the default) writes exemplar
+// timestamps as floats in their shortest form, e.g. `12345.6`. The text
+// encoder, which doesn't write exemplars, ignores this option, as do the
+// protobuf encoders.
+func WithExemplarTimestampPrecision(digits int) EncoderOption {
+	return func(o *encoderOption) {
+		o.exemplarTsDigits = digits
+	}
+}
+
+// exemplarTimestampDigits returns the number of fractional digits to write
+// exemplar timestamps with, or zero for the shortest float form. It is safe to
+// call on a nil encoderOption.
+func (o *encoderOption) exemplarTimestampDigits() int {
+	if o == nil {
+		return 0
+	}
+	return o.exemplarTsDigits
+}
+
+// WithNamePrefix is an EncoderOption that prepends prefix to the name of
+// every metric family as it is written, e.g. to tell tenants apart, without
+// modifying the MetricFamily protos. The suffixes added for summaries and
+// histograms (and the `_total` suffix of OpenMetrics counters) follow the
+// prefixed name. A prefixed name that isn't a valid legacy metric name is
+// quoted like any other such name. The protobuf encoders ignore this option.
+func WithNamePrefix(prefix string) EncoderOption {
+	return func(o *encoderOption) {
+		o.namePrefix = prefix
+	}
+}
+
+// name returns the metric family name n as it has to be written according to
+// the options. It is safe to call on a nil encoderOption.
+func (o *encoderOption) name(n string) string {
+	if o == nil {
+		return n
+	}
+	return o.namePrefix + n
+}
+
+// rawFloat returns the raw text recorded for v or "" if there is none. It is
+// safe to call on a nil encoderOption.
+func (o *encoderOption) rawFloat(v *float64) string {
+	if o == nil {
+		return ""
+	}
+	return o.rawValues.float(v)
+}
+
+// rawUint returns the raw text recorded for v or "" if there is none. It is
+// safe to call on a nil encoderOption.
+func (o *encoderOption) rawUint(v *uint64) string {
+	if o == nil {
+		return ""
+	}
+	return o.rawValues.uint(v)
+}
+
+// help returns the HELP string h as it has to be written according to the
+// options. It is safe to call on a nil encoderOption.
+func (o *encoderOption) help(h string) string {
+	if o == nil {
+		return h
+	}
+	if o.normalizedHelp {
+		h = strings.Join(strings.Fields(h), " ")
+	}
+	if o.legacyASCII {
+		h = replaceNonASCII(h)
+	}
+	return h
+}
+
+// labelValue returns v as it has to be written according to the options. It
+// is safe to call on a nil encoderOption.
+func (o *encoderOption) labelValue(v string) (string, error) {
+	if o == nil {
+		return v, nil
+	}
+	v, err := o.truncateLabelValue(v)
+	if err != nil || !o.legacyASCII {
+		return v, err
+	}
+	return replaceNonASCII(v), nil
+}
+
+func (o *encoderOption) truncateLabelValue(v string) (string, error) {
+	if o.labelValueMaxRunes <= 0 || utf8.RuneCountInString(v) <= o.labelValueMaxRunes {
+		return v, nil
+	}
+	if o.labelValueMaxRunesErr {
+		return "", fmt.Errorf("label value %q exceeds the maximum length of %d runes", v, o.labelValueMaxRunes)
+	}
+	// Cut at a rune boundary, leaving room for the ellipsis.
+	var i, n int
+	for i = range v {
+		if n == o.labelValueMaxRunes-1 {
+			break
+		}
+		n++
+	}
+	return v[:i] + labelValueEllipsis, nil
+}
+
+// replaceNonASCII replaces each non-ASCII rune in s (including invalid UTF-8
+// bytes) by an underscore.
+func replaceNonASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			var b strings.Builder
+			b.Grow(len(s))
+			b.WriteString(s[:i])
+			for _, r := range s[i:] {
+				if r >= utf8.RuneSelf {
+					r = '_'
+				}
+				b.WriteRune(r)
+			}
+			return b.String()
+		}
+	}
+	return s
+}
+
 type encoderCloser struct {
 	encode func(*dto.MetricFamily) error
 	close  func() error
@@ -113,15 +767,22 @@ func NegotiateIncludingOpenMetrics(h http.Header) Format {
 // NewEncoder returns a new encoder based on content type negotiation. All
 // Encoder implementations returned by NewEncoder also implement Closer, and
 // callers should always call the Close method. It is currently only required
-// for FmtOpenMetrics, but a future (breaking) release will add the Close method
-// to the Encoder interface directly. The current version of the Encoder
-// interface is kept for backwards compatibility.
-func NewEncoder(w io.Writer, format Format) Encoder {
-	switch format {
+// for FmtOpenMetrics and for the WithChecksum option, but a future (breaking)
+// release will add the Close method to the Encoder interface directly. The
+// current version of the Encoder interface is kept for backwards
+// compatibility. The options are passed on to
+// the text and OpenMetrics encoders and ignored for the protobuf formats.
+//
+// Metric and label names are escaped according to the escaping parameter of
+// format, if any (see Format.WithEscapingScheme), without modifying the
+// encoded metric families.
+func NewEncoder(w io.Writer, format Format, options ...EncoderOption) Encoder {
+	scheme := format.ToEscapingScheme()
+	switch format.withoutEscaping() {
 	case FmtProtoDelim:
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := protodelim.MarshalTo(w, v)
+				_, err := protodelim.MarshalTo(w, escapeMetricFamily(v, scheme))
 				return err
 			},
 			close: func() error { return nil },
@@ -129,7 +790,7 @@ func NewEncoder(w io.Writer, format Format) Encoder {
 	case FmtProtoCompact:
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := fmt.Fprintln(w, v.String())
+				_, err := fmt.Fprintln(w, escapeMetricFamily(v, scheme).String())
 				return err
 			},
 			close: func() error { return nil },
@@ -137,26 +798,31 @@ func NewEncoder(w io.Writer, format Format) Encoder {
 	case FmtProtoText:
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := fmt.Fprintln(w, prototext.Format(v))
+				_, err := fmt.Fprintln(w, prototext.Format(escapeMetricFamily(v, scheme)))
 				return err
 			},
 			close: func() error { return nil },
 		}
 	case FmtText:
+		cw, writeChecksum := checksumWriter(w, options)
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := MetricFamilyToText(w, v)
+				_, err := MetricFamilyToText(cw, escapeMetricFamily(v, scheme), options...)
 				return err
 			},
-			close: func() error { return nil },
+			close: writeChecksum,
 		}
 	case FmtOpenMetrics_0_0_1, FmtOpenMetrics_1_0_0:
+		cw, writeChecksum := checksumWriter(w, options)
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := MetricFamilyToOpenMetrics(w, v)
+				_, err := MetricFamilyToOpenMetrics(cw, escapeMetricFamily(v, scheme), options...)
 				return err
 			},
 			close: func() error {
+				if err := writeChecksum(); err != nil {
+					return err
+				}
 				_, err := FinalizeOpenMetrics(w)
 				return err
 			},
@@ -164,3 +830,22 @@ func NewEncoder(w io.Writer, format Format) Encoder {
 	}
 	panic(fmt.Errorf("expfmt.NewEncoder: unknown format %q", format))
 }
+
+// escapeMetricFamily returns mf with its name and the label names of its
+// metrics escaped according to scheme. Unless scheme is model.NoEscaping, the
+// escaping is applied to a copy, leaving mf untouched.
+func escapeMetricFamily(mf *dto.MetricFamily, scheme model.EscapingScheme) *dto.MetricFamily {
+	if scheme == model.NoEscaping {
+		return mf
+	}
+	escaped := proto.Clone(mf).(*dto.MetricFamily)
+	escaped.Name = proto.String(model.EscapeName(escaped.GetName(), scheme))
+	for _, m := range escaped.Metric {
+		for _, l := range m.GetLabel() {
+			if l != nil {
+				l.Name = proto.String(model.EscapeName(l.GetName(), scheme))
+			}
+		}
+	}
+	return escaped
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"fmt"
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// EncodeState tracks the metric families whose metadata (HELP and TYPE lines)
+// has already been written by EncodeFamily. Threading one EncodeState through
+// independent EncodeFamily calls makes the resulting output carry the metadata
+// of each family only once, without requiring a single Encoder for all calls.
+//
+// The zero value is ready to use. An EncodeState must not be used
+// concurrently.
+type EncodeState struct {
+	types map[string]dto.MetricType
+}
+
+// EncodeFamily writes in to out in the given format, which must be FmtText or
+// one of the OpenMetrics formats, and returns the number of bytes written. If
+// state records that the metadata of a family with the same name has been
+// written before, in is written without HELP and TYPE lines. A family whose
+// type differs from the type recorded earlier results in an error, and nothing
+// is written. The metadata of in is only recorded if it has actually been written.
+//
+// EncodeFamily does not write the final `# EOF` line of OpenMetrics. Callers
+// have to call FinalizeOpenMetrics themselves.
+func EncodeFamily(out io.Writer, in *dto.MetricFamily, format Format, state *EncodeState, options ...EncoderOption) (int, error) {
+	var encode func(io.Writer, *dto.MetricFamily, ...EncoderOption) (int, error)
+	switch format.withoutEscaping() {
+	case FmtText:
+		encode = MetricFamilyToText
+	case FmtOpenMetrics_0_0_1, FmtOpenMetrics_1_0_0:
+		encode = MetricFamilyToOpenMetrics
+	default:
+		return 0, fmt.Errorf("expfmt.EncodeFamily: unsupported format %q", format)
+	}
+
+	name := in.GetName()
+	if t, ok := state.types[name]; ok {
+		if in.GetType() != t {
+			return 0, fmt.Errorf(
+				"metric family %q of type %s was written as type %s before",
+				name, typeName(in.GetType()), typeName(t),
+			)
+		}
+		options = append(options[:len(options):len(options)], func(o *encoderOption) {
+			o.omitMetadata = true
+		})
+		return encode(out, in, options...)
+	}
+
+	written, err := encode(out, in, options...)
+	if err != nil || written == 0 { // Nothing written, see WithoutEmptyFamilies.
+		return written, err
+	}
+	if state.types == nil {
+		state.types = map[string]dto.MetricType{}
+	}
+	state.types[name] = in.GetType()
+	return written, nil
+}
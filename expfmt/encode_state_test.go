@@ -0,0 +1,129 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestEncodeFamily(t *testing.T) {
+	scenarios := []struct {
+		format   Format
+		expected string
+	}{
+		{
+			format: FmtText,
+			expected: `# HELP up Help for up.
+# TYPE up gauge
+up{instance="a"} 1
+# HELP temperature Help for temperature.
+# TYPE temperature gauge
+temperature{instance="a"} 21.5
+up{instance="b"} 0
+`,
+		},
+		{
+			format: FmtOpenMetrics_1_0_0,
+			expected: `# HELP up Help for up.
+# TYPE up gauge
+up{instance="a"} 1.0
+# HELP temperature Help for temperature.
+# TYPE temperature gauge
+temperature{instance="a"} 21.5
+up{instance="b"} 0.0
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var state EncodeState
+		// Three independent calls, each with its own buffer.
+		var out []byte
+		for _, mf := range []*dto.MetricFamily{
+			gaugeFamilyPart("up", "a", 1),
+			gaugeFamilyPart("temperature", "a", 21.5),
+			gaugeFamilyPart("up", "b", 0),
+		} {
+			var buf bytes.Buffer
+			n, err := EncodeFamily(&buf, mf, scenario.format, &state)
+			if err != nil {
+				t.Fatalf("%d. unexpected error: %s", i, err)
+			}
+			if n != buf.Len() {
+				t.Errorf("%d. expected %d bytes written, got %d", i, buf.Len(), n)
+			}
+			out = append(out, buf.Bytes()...)
+		}
+		if string(out) != scenario.expected {
+			t.Errorf("%d. expected:\n%s\ngot:\n%s", i, scenario.expected, out)
+		}
+	}
+}
+
+func TestEncodeFamilyError(t *testing.T) {
+	var state EncodeState
+	var out bytes.Buffer
+	if _, err := EncodeFamily(&out, gaugeFamilyPart("up", "a", 1), FmtText, &state); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := &dto.MetricFamily{
+		Name: proto.String("up"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{Counter: &dto.Counter{Value: proto.Float64(1)}},
+		},
+	}
+	out.Reset()
+	_, err := EncodeFamily(&out, counter, FmtText, &state)
+	expected := `metric family "up" of type counter was written as type gauge before`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected nothing written, got %q", out.String())
+	}
+
+	if _, err := EncodeFamily(&out, counter, FmtProtoDelim, &state); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestEncodeFamilyEmpty(t *testing.T) {
+	var state EncodeState
+	var out bytes.Buffer
+	empty := &dto.MetricFamily{
+		Name: proto.String("up"),
+		Help: proto.String("Help for up."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	if _, err := EncodeFamily(&out, empty, FmtText, &state, WithoutEmptyFamilies()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncodeFamily(&out, gaugeFamilyPart("up", "a", 1), FmtText, &state); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP up Help for up.
+# TYPE up gauge
+up{instance="a"} 1
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
@@ -15,11 +15,18 @@ package expfmt
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strings"
 	"testing"
 
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
 )
 
 func TestNegotiate(t *testing.T) {
@@ -174,3 +181,836 @@ func TestEncode(t *testing.T) {
 		t.Errorf("expected TextEncoder to return %s, but got %s instead", expected, string(out))
 	}
 }
+
+func TestEncodeLabelValueMaxLength(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("name_1"),
+						Value: proto.String("Björn"),
+					},
+					{
+						Name:  proto.String("name_2"),
+						Value: proto.String("佖佥佖佥"),
+					},
+				},
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		format   Format
+		option   EncoderOption
+		expected string
+		err      string
+	}{
+		{
+			name:     "text, no truncation needed",
+			format:   FmtText,
+			option:   WithLabelValueMaxLength(5),
+			expected: "# TYPE foo_metric gauge\nfoo_metric{name_1=\"Björn\",name_2=\"佖佥佖佥\"} 1\n",
+		},
+		{
+			name:     "text, truncated at rune boundary",
+			format:   FmtText,
+			option:   WithLabelValueMaxLength(3),
+			expected: "# TYPE foo_metric gauge\nfoo_metric{name_1=\"Bj…\",name_2=\"佖佥…\"} 1\n",
+		},
+		{
+			name:     "OpenMetrics, truncated at rune boundary",
+			format:   FmtOpenMetrics_1_0_0,
+			option:   WithLabelValueMaxLength(3),
+			expected: "# TYPE foo_metric gauge\nfoo_metric{name_1=\"Bj…\",name_2=\"佖佥…\"} 1.0\n",
+		},
+		{
+			name:     "disabled",
+			format:   FmtText,
+			option:   WithLabelValueMaxLength(0),
+			expected: "# TYPE foo_metric gauge\nfoo_metric{name_1=\"Björn\",name_2=\"佖佥佖佥\"} 1\n",
+		},
+		{
+			name:   "text, error mode",
+			format: FmtText,
+			option: WithLabelValueMaxLengthError(4),
+			err:    `label value "Björn" exceeds the maximum length of 4 runes`,
+		},
+		{
+			name:   "OpenMetrics, error mode",
+			format: FmtOpenMetrics_1_0_0,
+			option: WithLabelValueMaxLengthError(3),
+			err:    `label value "Björn" exceeds the maximum length of 3 runes`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			err := NewEncoder(&buff, test.format, test.option).Encode(metric)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error during encode: %s", err.Error())
+			}
+			if got := buff.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestEncodeLabelSeparatorSpace(t *testing.T) {
+	labels := []*dto.LabelPair{
+		{
+			Name:  proto.String("a"),
+			Value: proto.String("1"),
+		},
+		{
+			Name:  proto.String("b"),
+			Value: proto.String("2"),
+		},
+	}
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: labels,
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(1),
+					SampleSum:   proto.Float64(2),
+					Quantile: []*dto.Quantile{
+						{
+							Quantile: proto.Float64(0.5),
+							Value:    proto.Float64(2),
+						},
+					},
+				},
+			},
+		},
+	}
+	dotted := &dto.MetricFamily{
+		Name: proto.String("foo.metric"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: labels,
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+
+	var buff bytes.Buffer
+	if _, err := MetricFamilyToText(&buff, metric, WithLabelSeparatorSpace()); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE foo_metric summary
+foo_metric{a="1", b="2", quantile="0.5"} 2
+foo_metric_sum{a="1", b="2"} 2
+foo_metric_count{a="1", b="2"} 1
+`
+	if got := buff.String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	var parser TextParser
+	fams, err := parser.TextToMetricFamilies(&buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(fams["foo_metric"], metric) {
+		t.Errorf("expected %v after round trip, got %v", metric, fams["foo_metric"])
+	}
+
+	buff.Reset()
+	if _, err := MetricFamilyToOpenMetrics(&buff, dotted, WithLabelSeparatorSpace()); err != nil {
+		t.Fatal(err)
+	}
+	expected = `# TYPE "foo.metric" gauge
+{"foo.metric", a="1", b="2"} 1.0
+`
+	if got := buff.String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestEncodeWithoutEmptyFamilies(t *testing.T) {
+	empty := &dto.MetricFamily{
+		Name:   proto.String("name_total"),
+		Help:   proto.String("doc string"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{},
+	}
+
+	tests := []struct {
+		name     string
+		format   Format
+		options  []EncoderOption
+		expected string
+		err      string
+	}{
+		{
+			name:     "OpenMetrics, keep metadata",
+			format:   FmtOpenMetrics_1_0_0,
+			expected: "# HELP name doc string\n# TYPE name counter\n",
+		},
+		{
+			name:    "OpenMetrics, omit empty family",
+			format:  FmtOpenMetrics_1_0_0,
+			options: []EncoderOption{WithoutEmptyFamilies()},
+		},
+		{
+			name:   "text, error",
+			format: FmtText,
+			err:    "MetricFamily has no metrics",
+		},
+		{
+			name:    "text, omit empty family",
+			format:  FmtText,
+			options: []EncoderOption{WithoutEmptyFamilies()},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			err := NewEncoder(&buff, test.format, test.options...).Encode(empty)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("expected error starting with %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error during encode: %s", err.Error())
+			}
+			if got := buff.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestEncodeEscapedFormat(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("process.cpu"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("host.name"), Value: proto.String("a")}},
+				Gauge: &dto.Gauge{Value: proto.Float64(7)},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		format   Format
+		expected string
+	}{
+		{
+			name:     "text",
+			format:   FmtText.WithEscapingScheme(model.UnderscoreEscaping),
+			expected: "# TYPE process_cpu gauge\nprocess_cpu{host_name=\"a\"} 7\n",
+		},
+		{
+			name:     "OpenMetrics",
+			format:   FmtOpenMetrics_1_0_0.WithEscapingScheme(model.DotsEscaping),
+			expected: "# TYPE process_dot_cpu gauge\nprocess_dot_cpu{host_dot_name=\"a\"} 7.0\n# EOF\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			enc := NewEncoder(&buff, test.format)
+			if err := enc.Encode(mf); err != nil {
+				t.Fatalf("unexpected error during encode: %s", err.Error())
+			}
+			if err := enc.(Closer).Close(); err != nil {
+				t.Fatalf("unexpected error during close: %s", err.Error())
+			}
+			if got := buff.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestEncodeLegacyASCII(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Help: proto.String("Grüße an Björn"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("name"),
+						Value: proto.String("Björn"),
+					},
+					{
+						Name:  proto.String("cjk"),
+						Value: proto.String("佖佥"),
+					},
+				},
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		options []EncoderOption
+		out     string
+	}{
+		{
+			out: `# HELP foo_metric Grüße an Björn
+# TYPE foo_metric gauge
+foo_metric{name="Björn",cjk="佖佥"} 1
+`,
+		},
+		{
+			options: []EncoderOption{WithLegacyASCII()},
+			out: `# HELP foo_metric Gr__e an Bj_rn
+# TYPE foo_metric gauge
+foo_metric{name="Bj_rn",cjk="__"} 1
+`,
+		},
+		{
+			options: []EncoderOption{WithLegacyASCII(), WithLabelValueMaxLength(4)},
+			out: `# HELP foo_metric Gr__e an Bj_rn
+# TYPE foo_metric gauge
+foo_metric{name="Bj__",cjk="__"} 1
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var buff bytes.Buffer
+		if _, err := MetricFamilyToText(&buff, metric, scenario.options...); err != nil {
+			t.Fatalf("%d. error: %s", i, err)
+		}
+		if got := buff.String(); got != scenario.out {
+			t.Errorf("%d. expected %q, got %q", i, scenario.out, got)
+		}
+	}
+
+	var buff bytes.Buffer
+	if _, err := MetricFamilyToOpenMetrics(&buff, metric, WithLegacyASCII()); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP foo_metric Gr__e an Bj_rn
+# TYPE foo_metric gauge
+foo_metric{name="Bj_rn",cjk="__"} 1.0
+`
+	if got := buff.String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestEncodeNamePrefix(t *testing.T) {
+	histogram := &dto.MetricFamily{
+		Name: proto.String("request_duration_seconds"),
+		Help: proto.String("Duration of requests."),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("code"),
+						Value: proto.String("200"),
+					},
+				},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(1.5),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(3)},
+					},
+				},
+			},
+		},
+	}
+	counter := &dto.MetricFamily{
+		Name: proto.String("requests_total"),
+		Help: proto.String("Number of requests."),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Counter: &dto.Counter{
+					Value: proto.Float64(42),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		create func(io.Writer, *dto.MetricFamily, ...EncoderOption) (int, error)
+		in     *dto.MetricFamily
+		prefix string
+		out    string
+	}{
+		{
+			create: MetricFamilyToText,
+			in:     histogram,
+			prefix: "tenant_a_",
+			out: `# HELP tenant_a_request_duration_seconds Duration of requests.
+# TYPE tenant_a_request_duration_seconds histogram
+tenant_a_request_duration_seconds_bucket{code="200",le="1"} 2
+tenant_a_request_duration_seconds_bucket{code="200",le="+Inf"} 3
+tenant_a_request_duration_seconds_sum{code="200"} 1.5
+tenant_a_request_duration_seconds_count{code="200"} 3
+`,
+		},
+		{
+			create: MetricFamilyToOpenMetrics,
+			in:     histogram,
+			prefix: "tenant_a_",
+			out: `# HELP tenant_a_request_duration_seconds Duration of requests.
+# TYPE tenant_a_request_duration_seconds histogram
+tenant_a_request_duration_seconds_bucket{code="200",le="1.0"} 2
+tenant_a_request_duration_seconds_bucket{code="200",le="+Inf"} 3
+tenant_a_request_duration_seconds_sum{code="200"} 1.5
+tenant_a_request_duration_seconds_count{code="200"} 3
+`,
+		},
+		{
+			create: MetricFamilyToOpenMetrics,
+			in:     counter,
+			prefix: "tenant_a_",
+			out: `# HELP tenant_a_requests Number of requests.
+# TYPE tenant_a_requests counter
+tenant_a_requests_total 42.0
+`,
+		},
+		{
+			// The prefixed name is no valid legacy name and gets quoted.
+			create: MetricFamilyToText,
+			in:     counter,
+			prefix: "tenant.a:",
+			out: `# HELP "tenant.a:requests_total" Number of requests.
+# TYPE "tenant.a:requests_total" counter
+{"tenant.a:requests_total"} 42
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var buff bytes.Buffer
+		if _, err := scenario.create(&buff, scenario.in, WithNamePrefix(scenario.prefix)); err != nil {
+			t.Fatalf("%d. error: %s", i, err)
+		}
+		if got := buff.String(); got != scenario.out {
+			t.Errorf("%d. expected %q, got %q", i, scenario.out, got)
+		}
+	}
+	if histogram.GetName() != "request_duration_seconds" {
+		t.Errorf("metric family was modified: %s", histogram.GetName())
+	}
+}
+
+func TestEncodeAlwaysHelp(t *testing.T) {
+	family := func(name string, help *string) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String(name),
+			Help: help,
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Gauge: &dto.Gauge{
+						Value: proto.Float64(1),
+					},
+				},
+			},
+		}
+	}
+
+	scenarios := []struct {
+		create  func(io.Writer, *dto.MetricFamily, ...EncoderOption) (int, error)
+		in      *dto.MetricFamily
+		options []EncoderOption
+		out     string
+	}{
+		{
+			create: MetricFamilyToText,
+			in:     family("foo", nil),
+			out: `# TYPE foo gauge
+foo 1
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			in:      family("foo", nil),
+			options: []EncoderOption{WithAlwaysHelp()},
+			out: `# HELP foo 
+# TYPE foo gauge
+foo 1
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			in:      family("foo", proto.String("")),
+			options: []EncoderOption{WithAlwaysHelp()},
+			out: `# HELP foo 
+# TYPE foo gauge
+foo 1
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			in:      family("foo", proto.String("Some\nhelp.")),
+			options: []EncoderOption{WithAlwaysHelp()},
+			out: `# HELP foo Some\nhelp.
+# TYPE foo gauge
+foo 1
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			in:      family("foo.bar", nil),
+			options: []EncoderOption{WithAlwaysHelp()},
+			out: `# HELP "foo.bar" 
+# TYPE "foo.bar" gauge
+{"foo.bar"} 1
+`,
+		},
+		{
+			create:  MetricFamilyToOpenMetrics,
+			in:      family("foo.bar", nil),
+			options: []EncoderOption{WithAlwaysHelp()},
+			out: `# HELP "foo.bar" 
+# TYPE "foo.bar" gauge
+{"foo.bar"} 1.0
+`,
+		},
+		{
+			create:  MetricFamilyToOpenMetrics,
+			in:      family("foo", proto.String("Some help.")),
+			options: []EncoderOption{WithAlwaysHelp()},
+			out: `# HELP foo Some help.
+# TYPE foo gauge
+foo 1.0
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var buff bytes.Buffer
+		if _, err := scenario.create(&buff, scenario.in, scenario.options...); err != nil {
+			t.Fatalf("%d. error: %s", i, err)
+		}
+		if got := buff.String(); got != scenario.out {
+			t.Errorf("%d. expected %q, got %q", i, scenario.out, got)
+		}
+	}
+}
+
+func TestEncodeNormalizedHelp(t *testing.T) {
+	family := &dto.MetricFamily{
+		Name: proto.String("name"),
+		Help: proto.String("two-line\n doc  str\\ing"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Counter: &dto.Counter{
+					Value: proto.Float64(42),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		create  func(io.Writer, *dto.MetricFamily, ...EncoderOption) (int, error)
+		in      *dto.MetricFamily
+		options []EncoderOption
+		out     string
+	}{
+		{
+			create: MetricFamilyToText,
+			in:     family,
+			out: `# HELP name two-line\n doc  str\\ing
+# TYPE name counter
+name 42
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			in:      family,
+			options: []EncoderOption{WithNormalizedHelp()},
+			out: `# HELP name two-line doc str\\ing
+# TYPE name counter
+name 42
+`,
+		},
+		{
+			create: MetricFamilyToText,
+			in: &dto.MetricFamily{
+				Name: proto.String("name"),
+				Help: proto.String(" \t\n "),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+				},
+			},
+			options: []EncoderOption{WithNormalizedHelp()},
+			out: `# HELP name 
+# TYPE name gauge
+name 1
+`,
+		},
+		{
+			create: MetricFamilyToOpenMetrics,
+			in: &dto.MetricFamily{
+				Name: proto.String("name"),
+				Help: proto.String("\tdoc\u00a0 with  non-ASCII ü\n"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+				},
+			},
+			options: []EncoderOption{WithNormalizedHelp(), WithLegacyASCII()},
+			out: `# HELP name doc with non-ASCII _
+# TYPE name gauge
+name 1.0
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var buff bytes.Buffer
+		if _, err := scenario.create(&buff, scenario.in, scenario.options...); err != nil {
+			t.Fatalf("%d. error: %s", i, err)
+		}
+		if got := buff.String(); got != scenario.out {
+			t.Errorf("%d. expected %q, got %q", i, scenario.out, got)
+		}
+	}
+}
+
+func TestEncodeBoundPrecision(t *testing.T) {
+	summary := &dto.MetricFamily{
+		Name: proto.String("rpc_duration_seconds"),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(10),
+					SampleSum:   proto.Float64(2),
+					Quantile: []*dto.Quantile{
+						{Quantile: proto.Float64(0.5), Value: proto.Float64(0.1)},
+						{Quantile: proto.Float64(0.9900000001), Value: proto.Float64(0.3)},
+						{Quantile: proto.Float64(0.999), Value: proto.Float64(0.4)},
+					},
+				},
+			},
+		},
+	}
+	histogram := &dto.MetricFamily{
+		Name: proto.String("latency_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(2),
+					SampleSum:   proto.Float64(0.3),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.25000000000000006), CumulativeCount: proto.Uint64(1)},
+					},
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		create  func(io.Writer, *dto.MetricFamily, ...EncoderOption) (int, error)
+		in      *dto.MetricFamily
+		options []EncoderOption
+		out     string
+	}{
+		{
+			create: MetricFamilyToText,
+			in:     summary,
+			out: `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.1
+rpc_duration_seconds{quantile="0.9900000001"} 0.3
+rpc_duration_seconds{quantile="0.999"} 0.4
+rpc_duration_seconds_sum 2
+rpc_duration_seconds_count 10
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			in:      summary,
+			options: []EncoderOption{WithBoundPrecision(3)},
+			out: `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.1
+rpc_duration_seconds{quantile="0.99"} 0.3
+rpc_duration_seconds{quantile="0.999"} 0.4
+rpc_duration_seconds_sum 2
+rpc_duration_seconds_count 10
+`,
+		},
+		{
+			create:  MetricFamilyToOpenMetrics,
+			in:      summary,
+			options: []EncoderOption{WithBoundPrecision(3)},
+			out: `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.1
+rpc_duration_seconds{quantile="0.99"} 0.3
+rpc_duration_seconds{quantile="0.999"} 0.4
+rpc_duration_seconds_sum 2.0
+rpc_duration_seconds_count 10
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			in:      histogram,
+			options: []EncoderOption{WithBoundPrecision(15)},
+			out: `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.25"} 1
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 0.3
+latency_seconds_count 2
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var buff bytes.Buffer
+		if _, err := scenario.create(&buff, scenario.in, scenario.options...); err != nil {
+			t.Fatalf("%d. error: %s", i, err)
+		}
+		if got := buff.String(); got != scenario.out {
+			t.Errorf("%d. expected %q, got %q", i, scenario.out, got)
+		}
+	}
+}
+
+func TestEncodeNilMetrics(t *testing.T) {
+	family := &dto.MetricFamily{
+		Name: proto.String("temperature"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(21)}},
+			nil,
+			{Gauge: &dto.Gauge{Value: proto.Float64(22)}},
+		},
+	}
+
+	scenarios := []struct {
+		create  func(io.Writer, *dto.MetricFamily, ...EncoderOption) (int, error)
+		options []EncoderOption
+		out     string
+		err     string
+	}{
+		{
+			create: MetricFamilyToText,
+			out: `# TYPE temperature gauge
+temperature 21
+temperature 22
+`,
+		},
+		{
+			create: MetricFamilyToOpenMetrics,
+			out: `# TYPE temperature gauge
+temperature 21.0
+temperature 22.0
+`,
+		},
+		{
+			create:  MetricFamilyToText,
+			options: []EncoderOption{WithNilMetricsError()},
+			err:     `metric 1 of MetricFamily "temperature" is nil`,
+		},
+		{
+			create:  MetricFamilyToOpenMetrics,
+			options: []EncoderOption{WithNilMetricsError()},
+			err:     `metric 1 of MetricFamily "temperature" is nil`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var buff bytes.Buffer
+		n, err := scenario.create(&buff, family, scenario.options...)
+		if scenario.err != "" {
+			if err == nil || err.Error() != scenario.err {
+				t.Errorf("%d. expected error %q, got %v", i, scenario.err, err)
+			}
+			if n != 0 || buff.Len() != 0 {
+				t.Errorf("%d. expected nothing to be written, got %q", i, buff.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. error: %s", i, err)
+		}
+		if got := buff.String(); got != scenario.out {
+			t.Errorf("%d. expected %q, got %q", i, scenario.out, got)
+		}
+	}
+}
+
+func TestEncodeChecksum(t *testing.T) {
+	families := []*dto.MetricFamily{
+		gaugeFamilyPart("up", "a", 1),
+		gaugeFamilyPart("temperature", "a", 21.5),
+	}
+	encode := func(format Format, options ...EncoderOption) string {
+		var buff bytes.Buffer
+		enc := NewEncoder(&buff, format, options...)
+		for _, mf := range families {
+			if err := enc.Encode(mf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.(Closer).Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buff.String()
+	}
+
+	for _, format := range []Format{FmtText, FmtOpenMetrics_1_0_0} {
+		plain := encode(format)
+		out := encode(format, WithChecksum())
+		body := strings.TrimSuffix(plain, "# EOF\n")
+		expected := fmt.Sprintf("%s# checksum sha256:%x\n", body, sha256.Sum256([]byte(body)))
+		if format != FmtText {
+			expected += "# EOF\n"
+		}
+		if out != expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", format, expected, out)
+		}
+	}
+
+	text := encode(FmtText, WithChecksum())
+	p := TextParser{VerifyChecksum: true}
+	mfs, err := p.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(mfs) != 2 || !proto.Equal(mfs["up"], families[0]) {
+		t.Errorf("unexpected families %v", mfs)
+	}
+
+	tampered := strings.Replace(text, "21.5", "21.6", 1)
+	if _, err := p.TextToMetricFamilies(strings.NewReader(tampered)); err == nil ||
+		!strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EscapeString escapes s like the text and OpenMetrics encoders escape label
+// values: '\' becomes '\\', a new line character '\n', and '"' '\"'. The result
+// may be put between double quotes as a label value. Note that HELP text in the
+// text format has the same escaping except for '"', which is written as is.
+func EscapeString(s string) string {
+	return quotedEscaper.Replace(s)
+}
+
+// UnescapeString reverses EscapeString, following the rules of the text parser
+// for label values: the escape sequences '\\', '\n', and '\"' are recognized,
+// any other escape sequence is an error, as are a trailing '\' and an
+// unescaped new line character or '"'.
+func UnescapeString(s string) (string, error) {
+	if strings.IndexAny(s, "\\\n\"") < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	escaped := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if escaped {
+			unescaped, ok := unescapeByte(c)
+			if !ok {
+				return "", fmt.Errorf("invalid escape sequence '\\%c' in %q", c, s)
+			}
+			b.WriteByte(unescaped)
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '\n':
+			return "", fmt.Errorf("unescaped new-line in %q", s)
+		case '"':
+			return "", fmt.Errorf("unescaped '\"' in %q", s)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if escaped {
+		return "", fmt.Errorf("unterminated escape sequence in %q", s)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestEscapeString(t *testing.T) {
+	scenarios := []struct {
+		in      string
+		escaped string
+	}{
+		{in: "", escaped: ""},
+		{in: "plain", escaped: "plain"},
+		{in: "two\nlines", escaped: `two\nlines`},
+		{in: `C:\temp\`, escaped: `C:\\temp\\`},
+		{in: `say "hi"`, escaped: `say \"hi\"`},
+		{in: "ünïcödé ✓ 日本", escaped: "ünïcödé ✓ 日本"},
+		{in: "\\n is not \n", escaped: `\\n is not \n`},
+	}
+
+	for i, scenario := range scenarios {
+		escaped := EscapeString(scenario.in)
+		if escaped != scenario.escaped {
+			t.Errorf("%d. expected %q, got %q", i, scenario.escaped, escaped)
+		}
+		unescaped, err := UnescapeString(escaped)
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if unescaped != scenario.in {
+			t.Errorf("%d. expected round trip to %q, got %q", i, scenario.in, unescaped)
+		}
+
+		// The encoder escapes label values the same way.
+		var out bytes.Buffer
+		_, err = MetricFamilyToText(&out, &dto.MetricFamily{
+			Name: proto.String("m"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{{Name: proto.String("l"), Value: proto.String(scenario.in)}},
+					Gauge: &dto.Gauge{Value: proto.Float64(1)},
+				},
+			},
+		})
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if want := `m{l="` + escaped + `"} 1`; !strings.Contains(out.String(), want) {
+			t.Errorf("%d. expected encoder output to contain %q, got %q", i, want, out.String())
+		}
+	}
+}
+
+func TestUnescapeStringError(t *testing.T) {
+	scenarios := []struct {
+		in  string
+		err string
+	}{
+		{in: `\t`, err: `invalid escape sequence '\t'`},
+		{in: `trailing\`, err: "unterminated escape sequence"},
+		{in: "raw\nline", err: "unescaped new-line"},
+		{in: `raw"quote`, err: `unescaped '"'`},
+	}
+
+	for i, scenario := range scenarios {
+		_, err := UnescapeString(scenario.in)
+		if err == nil || !strings.HasPrefix(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error starting with %q, got %v", i, scenario.err, err)
+		}
+	}
+}
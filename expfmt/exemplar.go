@@ -0,0 +1,109 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OTLPExemplar is a representation of an exemplar modeled after the exemplars
+// of the OpenTelemetry protocol (OTLP), independent of any protobuf types.
+type OTLPExemplar struct {
+	Value float64
+	// Timestamp is nil if the exemplar has no timestamp.
+	Timestamp *time.Time
+	// FilteredAttributes are the labels of the exemplar (e.g. trace_id),
+	// which are not part of the labels of the series the exemplar belongs to.
+	FilteredAttributes map[string]string
+}
+
+// ToOTLPExemplar converts e into an OTLPExemplar. It returns an error if e has
+// an invalid timestamp.
+func ToOTLPExemplar(e *dto.Exemplar) (OTLPExemplar, error) {
+	oe := OTLPExemplar{
+		Value:              e.GetValue(),
+		FilteredAttributes: make(map[string]string, len(e.GetLabel())),
+	}
+	for _, lp := range e.GetLabel() {
+		oe.FilteredAttributes[lp.GetName()] = lp.GetValue()
+	}
+	if e.Timestamp != nil {
+		if err := e.Timestamp.CheckValid(); err != nil {
+			return OTLPExemplar{}, fmt.Errorf("invalid exemplar timestamp: %w", err)
+		}
+		ts := e.Timestamp.AsTime()
+		oe.Timestamp = &ts
+	}
+	return oe, nil
+}
+
+// AttachExemplars attaches each of the exemplars to the bucket of the histogram
+// in mf it falls into, i.e. to the bucket with the smallest upper bound greater
+// than or equal to the value of the exemplar. If several exemplars fall into
+// the same bucket, or the bucket has an exemplar already, the one with the
+// latest timestamp is kept, where an exemplar without timestamp is considered
+// older than any with one. Between exemplars with the same timestamp, the one
+// attached last wins.
+//
+// mf has to be a histogram or gauge histogram family with exactly one metric,
+// as exemplars don't tell which series they belong to. An error is returned if
+// that isn't the case or if an exemplar doesn't fall into any bucket, e.g.
+// because there is no +Inf bucket. mf is only modified if no error is
+// returned. The exemplars are attached as they are, without copying them.
+func AttachExemplars(mf *dto.MetricFamily, exemplars []*dto.Exemplar) error {
+	if t := mf.GetType(); t != dto.MetricType_HISTOGRAM && t != dto.MetricType_GAUGE_HISTOGRAM {
+		return fmt.Errorf("cannot attach exemplars to metric family %q of type %s", mf.GetName(), typeName(t))
+	}
+	if len(mf.Metric) != 1 {
+		return fmt.Errorf("cannot attach exemplars to metric family %q with %d metrics, expected exactly one", mf.GetName(), len(mf.Metric))
+	}
+
+	buckets := sortedBuckets(mf.Metric[0].GetHistogram().GetBucket())
+	for len(buckets) > 0 && math.IsNaN(buckets[len(buckets)-1].GetUpperBound()) {
+		buckets = buckets[:len(buckets)-1] // Sorted last, no value falls into them.
+	}
+	targets := make([]*dto.Bucket, len(exemplars))
+	for i, e := range exemplars {
+		v := e.GetValue()
+		j := sort.Search(len(buckets), func(j int) bool {
+			return buckets[j].GetUpperBound() >= v
+		})
+		if j == len(buckets) || math.IsNaN(v) {
+			return fmt.Errorf("exemplar value %g doesn't fall into any bucket of histogram %q", v, mf.GetName())
+		}
+		targets[i] = buckets[j]
+	}
+	for i, e := range exemplars {
+		if b := targets[i]; b.Exemplar == nil || !newerExemplar(b.Exemplar, e) {
+			b.Exemplar = e
+		}
+	}
+	return nil
+}
+
+// newerExemplar returns whether a has a later timestamp than b.
+func newerExemplar(a, b *dto.Exemplar) bool {
+	switch {
+	case a.Timestamp == nil:
+		return false
+	case b.Timestamp == nil:
+		return true
+	}
+	return a.Timestamp.AsTime().After(b.Timestamp.AsTime())
+}
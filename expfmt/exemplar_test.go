@@ -0,0 +1,230 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestToOTLPExemplar(t *testing.T) {
+	ts := time.Unix(12345, 600000000).UTC()
+
+	scenarios := []struct {
+		in  *dto.Exemplar
+		out OTLPExemplar
+		err bool
+	}{
+		// 0: With timestamp.
+		{
+			in: &dto.Exemplar{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("trace_id"),
+						Value: proto.String("abc"),
+					},
+					{
+						Name:  proto.String("span_id"),
+						Value: proto.String("def"),
+					},
+				},
+				Value:     proto.Float64(119.9),
+				Timestamp: timestamppb.New(ts),
+			},
+			out: OTLPExemplar{
+				Value:              119.9,
+				Timestamp:          &ts,
+				FilteredAttributes: map[string]string{"trace_id": "abc", "span_id": "def"},
+			},
+		},
+		// 1: Without timestamp.
+		{
+			in: &dto.Exemplar{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("foo"),
+						Value: proto.String("bar"),
+					},
+				},
+				Value: proto.Float64(118),
+			},
+			out: OTLPExemplar{
+				Value:              118,
+				FilteredAttributes: map[string]string{"foo": "bar"},
+			},
+		},
+		// 2: Invalid timestamp.
+		{
+			in: &dto.Exemplar{
+				Value:     proto.Float64(1),
+				Timestamp: &timestamppb.Timestamp{Nanos: -1},
+			},
+			err: true,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out, err := ToOTLPExemplar(scenario.in)
+		if scenario.err {
+			if err == nil {
+				t.Errorf("%d. expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, scenario.out) {
+			t.Errorf("%d. expected %+v, got %+v", i, scenario.out, out)
+		}
+	}
+}
+
+func TestAttachExemplars(t *testing.T) {
+	// The histogram of scenario 7 of TestCreateOpenMetrics, with the buckets
+	// shuffled.
+	histogram := func() *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("request_duration_microseconds"),
+			Help: proto.String("The response latency."),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(2693),
+						SampleSum:   proto.Float64(1756047.3),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(120), CumulativeCount: proto.Uint64(412)},
+							{UpperBound: proto.Float64(100), CumulativeCount: proto.Uint64(123)},
+							{UpperBound: proto.Float64(144), CumulativeCount: proto.Uint64(592)},
+							{UpperBound: proto.Float64(172.8), CumulativeCount: proto.Uint64(1524)},
+							{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(2693)},
+						},
+					},
+				},
+			},
+		}
+	}
+	exemplar := func(v float64, sec int64, traceID string) *dto.Exemplar {
+		e := &dto.Exemplar{
+			Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String(traceID)}},
+			Value: proto.Float64(v),
+		}
+		if sec > 0 {
+			e.Timestamp = timestamppb.New(time.Unix(sec, 0))
+		}
+		return e
+	}
+
+	mf := histogram()
+	if err := AttachExemplars(mf, []*dto.Exemplar{
+		exemplar(99, 0, "a"),   // Bucket 100.
+		exemplar(100, 0, "b"),  // Bucket 100, replaces a (no timestamps).
+		exemplar(130, 20, "c"), // Bucket 144.
+		exemplar(140, 10, "d"), // Bucket 144, older than c.
+		exemplar(150, 0, "e"),  // Bucket 172.8.
+		exemplar(151, 5, "f"),  // Bucket 172.8, replaces e.
+		exemplar(1e6, 0, "g"),  // Bucket +Inf.
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[float64]string{100: "b", 120: "", 144: "c", 172.8: "f", math.Inf(+1): "g"}
+	for _, b := range mf.Metric[0].Histogram.Bucket {
+		var got string
+		if b.Exemplar != nil {
+			got = b.Exemplar.Label[0].GetValue()
+		}
+		if want := expected[b.GetUpperBound()]; got != want {
+			t.Errorf("bucket %g: expected exemplar %q, got %q", b.GetUpperBound(), want, got)
+		}
+	}
+
+	// An exemplar with a timestamp replaces an existing one without.
+	if err := AttachExemplars(mf, []*dto.Exemplar{exemplar(1e7, 1, "h")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mf.Metric[0].Histogram.Bucket[4].GetExemplar().Label[0].GetValue(); got != "h" {
+		t.Errorf("expected exemplar h in +Inf bucket, got %q", got)
+	}
+}
+
+func TestAttachExemplarsError(t *testing.T) {
+	noInf := &dto.MetricFamily{
+		Name: proto.String("latency"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+						{UpperBound: proto.Float64(2), CumulativeCount: proto.Uint64(2)},
+					},
+				},
+			},
+		},
+	}
+	twoMetrics := proto.Clone(noInf).(*dto.MetricFamily)
+	twoMetrics.Metric = append(twoMetrics.Metric, twoMetrics.Metric[0])
+	gauge := &dto.MetricFamily{
+		Name:   proto.String("temperature"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+	}
+
+	scenarios := []struct {
+		in        *dto.MetricFamily
+		exemplars []*dto.Exemplar
+		err       string
+	}{
+		{
+			in:        gauge,
+			exemplars: []*dto.Exemplar{{Value: proto.Float64(1)}},
+			err:       `cannot attach exemplars to metric family "temperature" of type gauge`,
+		},
+		{
+			in:        twoMetrics,
+			exemplars: []*dto.Exemplar{{Value: proto.Float64(1)}},
+			err:       `cannot attach exemplars to metric family "latency" with 2 metrics, expected exactly one`,
+		},
+		{
+			in:        noInf,
+			exemplars: []*dto.Exemplar{{Value: proto.Float64(1.5)}, {Value: proto.Float64(3)}},
+			err:       `exemplar value 3 doesn't fall into any bucket of histogram "latency"`,
+		},
+		{
+			in:        noInf,
+			exemplars: []*dto.Exemplar{{Value: proto.Float64(math.NaN())}},
+			err:       `exemplar value NaN doesn't fall into any bucket of histogram "latency"`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		err := AttachExemplars(scenario.in, scenario.exemplars)
+		if err == nil || err.Error() != scenario.err {
+			t.Errorf("%d. expected error %q, got %v", i, scenario.err, err)
+		}
+	}
+	for _, b := range noInf.Metric[0].Histogram.Bucket {
+		if b.Exemplar != nil {
+			t.Errorf("expected no exemplar to be attached on error, got %v", b.Exemplar)
+		}
+	}
+}
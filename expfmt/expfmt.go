@@ -14,6 +14,12 @@
 // Package expfmt contains tools for reading and writing Prometheus metrics.
 package expfmt
 
+import (
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
 // Format specifies the HTTP content type of the different wire protocols.
 type Format string
 
@@ -47,3 +53,36 @@ const (
 	hdrContentType = "Content-Type"
 	hdrAccept      = "Accept"
 )
+
+// WithEscapingScheme returns f with its escaping parameter set to the given
+// scheme, replacing any escaping parameter f has already.
+func (f Format) WithEscapingScheme(scheme model.EscapingScheme) Format {
+	return f.withoutEscaping() + Format("; "+model.EscapingKey+"="+scheme.String())
+}
+
+// ToEscapingScheme returns the escaping scheme denoted by the escaping
+// parameter of f. It returns model.NoEscaping if f has no valid escaping
+// parameter.
+func (f Format) ToEscapingScheme() model.EscapingScheme {
+	for _, term := range strings.Split(string(f), ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(term), model.EscapingKey+"="); ok {
+			if scheme, err := model.ToEscapingScheme(v); err == nil {
+				return scheme
+			}
+		}
+	}
+	return model.NoEscaping
+}
+
+// withoutEscaping returns f without its escaping parameter, so that it can be
+// compared to the Format constants.
+func (f Format) withoutEscaping() Format {
+	terms := strings.Split(string(f), ";")
+	kept := terms[:0]
+	for _, term := range terms {
+		if !strings.HasPrefix(strings.TrimSpace(term), model.EscapingKey+"=") {
+			kept = append(kept, term)
+		}
+	}
+	return Format(strings.Join(kept, ";"))
+}
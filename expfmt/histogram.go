@@ -0,0 +1,172 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"math"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/prometheus/common/model"
+)
+
+// HistogramRepresentation selects one of the representations a histogram in
+// the protobuf format may carry.
+type HistogramRepresentation int
+
+const (
+	// HistogramClassic is the representation as a list of cumulative
+	// buckets with explicit upper bounds.
+	HistogramClassic HistogramRepresentation = iota
+	// HistogramNative is the representation as exponential buckets,
+	// described by a schema, a zero bucket, and spans of buckets.
+	HistogramNative
+)
+
+// IsNativeHistogram returns whether h carries the native representation. As
+// in Prometheus, this is the case if h has a zero bucket (which includes a
+// zero threshold) or any bucket spans. The schema alone does not count as it
+// defaults to zero.
+func IsNativeHistogram(h *dto.Histogram) bool {
+	return h.GetZeroThreshold() > 0 || h.GetZeroCount() > 0 || h.GetZeroCountFloat() > 0 ||
+		len(h.GetPositiveSpan()) > 0 || len(h.GetNegativeSpan()) > 0
+}
+
+// IsClassicHistogram returns whether h carries the classic representation,
+// i.e. whether it has any classic buckets.
+func IsClassicHistogram(h *dto.Histogram) bool {
+	return len(h.GetBucket()) > 0
+}
+
+// SelectHistogramRepresentation returns a copy of mf in which every histogram
+// carrying both representations is reduced to the one selected by r. A
+// histogram in transition, which is exposed both ways, is thereby presented to
+// a consumer only in the way it understands. Histograms carrying a single
+// representation are kept as they are, so a consumer asking for the native
+// one still gets histograms that have not been converted yet. Count, sum, and
+// created timestamp are common to both representations and always kept. Note
+// that exemplars live in the classic buckets, so they are gone once the native
+// representation is selected. mf itself is never modified, and it is returned
+// as is if it doesn't contain any histogram with both representations.
+func SelectHistogramRepresentation(mf *dto.MetricFamily, r HistogramRepresentation) *dto.MetricFamily {
+	mixed := func(m *dto.Metric) bool {
+		h := m.GetHistogram()
+		return IsClassicHistogram(h) && IsNativeHistogram(h)
+	}
+	i := 0
+	for i < len(mf.GetMetric()) && !mixed(mf.Metric[i]) {
+		i++
+	}
+	if i == len(mf.GetMetric()) {
+		return mf
+	}
+
+	out := proto.Clone(mf).(*dto.MetricFamily)
+	// Metrics before the first mixed histogram need no attention.
+	for _, m := range out.Metric[i:] {
+		if !mixed(m) {
+			continue
+		}
+		h := m.Histogram
+		switch r {
+		case HistogramNative:
+			h.Bucket = nil
+		default:
+			h.Schema = nil
+			h.ZeroThreshold = nil
+			h.ZeroCount = nil
+			h.ZeroCountFloat = nil
+			h.NegativeSpan = nil
+			h.NegativeDelta = nil
+			h.NegativeCount = nil
+			h.PositiveSpan = nil
+			h.PositiveDelta = nil
+			h.PositiveCount = nil
+		}
+	}
+	return out
+}
+
+// HistogramToCounters splits the classic representation of the histograms in
+// mf into counter families, e.g. for storage backends only ingesting
+// counters: a `_bucket` family with one metric per bucket of each histogram,
+// labeled with its upper bound in the `le` label, as well as `_sum` and
+// `_count` families. The counters keep the help text, the labels, and the
+// timestamps of the histograms, as well as their created timestamps and the
+// exemplars of the buckets. A `+Inf` bucket is added if it is missing, like in
+// the text format. The native representation is lost. If mf isn't a histogram
+// family, nil is returned. mf itself is never modified.
+func HistogramToCounters(mf *dto.MetricFamily) []*dto.MetricFamily {
+	if mf.GetType() != dto.MetricType_HISTOGRAM {
+		return nil
+	}
+	counterFamily := func(suffix string) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String(mf.GetName() + suffix),
+			Help: mf.Help,
+			Type: dto.MetricType_COUNTER.Enum(),
+		}
+	}
+	var (
+		buckets = counterFamily("_bucket")
+		sum     = counterFamily("_sum")
+		count   = counterFamily("_count")
+	)
+	for _, m := range mf.Metric {
+		h := m.GetHistogram()
+		if h == nil {
+			continue
+		}
+		counter := func(value float64, exemplar *dto.Exemplar, extraLabels ...*dto.LabelPair) *dto.Metric {
+			labels := make([]*dto.LabelPair, 0, len(m.Label)+len(extraLabels))
+			for _, l := range m.Label {
+				labels = append(labels, proto.Clone(l).(*dto.LabelPair))
+			}
+			c := &dto.Metric{
+				Label:       append(labels, extraLabels...),
+				Counter:     &dto.Counter{Value: proto.Float64(value)},
+				TimestampMs: m.TimestampMs,
+			}
+			if h.CreatedTimestamp != nil {
+				c.Counter.CreatedTimestamp = proto.Clone(h.CreatedTimestamp).(*timestamppb.Timestamp)
+			}
+			if exemplar != nil {
+				c.Counter.Exemplar = proto.Clone(exemplar).(*dto.Exemplar)
+			}
+			return c
+		}
+		le := func(bound float64) *dto.LabelPair {
+			return &dto.LabelPair{
+				Name:  proto.String(model.BucketLabel),
+				Value: proto.String(strconv.FormatFloat(bound, 'g', -1, 64)),
+			}
+		}
+		infSeen := false
+		for _, b := range sortedBuckets(h.Bucket) {
+			buckets.Metric = append(buckets.Metric, counter(float64(b.GetCumulativeCount()), b.Exemplar, le(b.GetUpperBound())))
+			if math.IsInf(b.GetUpperBound(), +1) {
+				infSeen = true
+			}
+		}
+		if !infSeen {
+			buckets.Metric = append(buckets.Metric, counter(float64(h.GetSampleCount()), nil, le(math.Inf(+1))))
+		}
+		sum.Metric = append(sum.Metric, counter(h.GetSampleSum(), nil))
+		count.Metric = append(count.Metric, counter(float64(h.GetSampleCount()), nil))
+	}
+	return []*dto.MetricFamily{buckets, sum, count}
+}
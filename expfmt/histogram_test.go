@@ -0,0 +1,204 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func mixedHistogramFamily() *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String("rpc_duration_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("service"), Value: proto.String("mixed")}},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(5),
+					SampleSum:   proto.Float64(3.5),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(5)},
+					},
+					Schema:        proto.Int32(0),
+					ZeroThreshold: proto.Float64(1e-128),
+					ZeroCount:     proto.Uint64(1),
+					PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(-1), Length: proto.Uint32(2)}},
+					PositiveDelta: []int64{1, 2},
+				},
+			},
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("service"), Value: proto.String("classic")}},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(1),
+					SampleSum:   proto.Float64(0.25),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestProtoDecoderMixedHistogram(t *testing.T) {
+	in := mixedHistogramFamily()
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf, FmtProtoDelim).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+
+	var got dto.MetricFamily
+	if err := NewDecoder(&buf, FmtProtoDelim).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(in, &got) {
+		t.Fatalf("expected %v, got %v", in, &got)
+	}
+	h := got.Metric[0].GetHistogram()
+	if !IsClassicHistogram(h) || !IsNativeHistogram(h) {
+		t.Errorf("expected both representations, got classic %t, native %t", IsClassicHistogram(h), IsNativeHistogram(h))
+	}
+	h = got.Metric[1].GetHistogram()
+	if !IsClassicHistogram(h) || IsNativeHistogram(h) {
+		t.Errorf("expected only the classic representation, got classic %t, native %t", IsClassicHistogram(h), IsNativeHistogram(h))
+	}
+}
+
+func TestSelectHistogramRepresentation(t *testing.T) {
+	in := mixedHistogramFamily()
+
+	classic := SelectHistogramRepresentation(in, HistogramClassic)
+	h := classic.Metric[0].GetHistogram()
+	if !IsClassicHistogram(h) || IsNativeHistogram(h) || h.Schema != nil || h.PositiveDelta != nil {
+		t.Errorf("expected only the classic representation, got %v", h)
+	}
+	if h.GetSampleCount() != 5 || h.GetSampleSum() != 3.5 {
+		t.Errorf("expected count and sum to be kept, got %v", h)
+	}
+
+	native := SelectHistogramRepresentation(in, HistogramNative)
+	h = native.Metric[0].GetHistogram()
+	if IsClassicHistogram(h) || !IsNativeHistogram(h) || h.GetSchema() != 0 || len(h.PositiveDelta) != 2 {
+		t.Errorf("expected only the native representation, got %v", h)
+	}
+	if h.GetSampleCount() != 5 || h.GetSampleSum() != 3.5 {
+		t.Errorf("expected count and sum to be kept, got %v", h)
+	}
+	// A classic-only histogram stays as it is.
+	if !proto.Equal(native.Metric[1], in.Metric[1]) {
+		t.Errorf("expected %v, got %v", in.Metric[1], native.Metric[1])
+	}
+
+	if !proto.Equal(in, mixedHistogramFamily()) {
+		t.Errorf("input was modified: %v", in)
+	}
+	onlyClassic := &dto.MetricFamily{
+		Name:   in.Name,
+		Type:   in.Type,
+		Metric: in.Metric[1:],
+	}
+	if got := SelectHistogramRepresentation(onlyClassic, HistogramNative); got != onlyClassic {
+		t.Errorf("expected the input to be returned as is")
+	}
+}
+
+func TestHistogramToCounters(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("request_duration_microseconds"),
+		Help: proto.String("The response latency."),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(2693),
+					SampleSum:   proto.Float64(1756047.3),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(100), CumulativeCount: proto.Uint64(123)},
+						{UpperBound: proto.Float64(120), CumulativeCount: proto.Uint64(412)},
+						{UpperBound: proto.Float64(144), CumulativeCount: proto.Uint64(592)},
+						{UpperBound: proto.Float64(172.8), CumulativeCount: proto.Uint64(1524)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(2693)},
+					},
+				},
+			},
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("500")}},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(250),
+					Bucket: []*dto.Bucket{
+						{
+							UpperBound:      proto.Float64(100),
+							CumulativeCount: proto.Uint64(2),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+								Value: proto.Float64(42),
+							},
+						},
+					},
+				},
+				TimestampMs: proto.Int64(1234567),
+			},
+		},
+	}
+	orig := proto.Clone(mf)
+
+	families := HistogramToCounters(mf)
+	var out bytes.Buffer
+	for _, f := range families {
+		if f.GetType() != dto.MetricType_COUNTER {
+			t.Errorf("expected counter family, got %s", f.GetType())
+		}
+		if _, err := MetricFamilyToText(&out, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `# HELP request_duration_microseconds_bucket The response latency.
+# TYPE request_duration_microseconds_bucket counter
+request_duration_microseconds_bucket{le="100"} 123
+request_duration_microseconds_bucket{le="120"} 412
+request_duration_microseconds_bucket{le="144"} 592
+request_duration_microseconds_bucket{le="172.8"} 1524
+request_duration_microseconds_bucket{le="+Inf"} 2693
+request_duration_microseconds_bucket{code="500",le="100"} 2 1234567
+request_duration_microseconds_bucket{code="500",le="+Inf"} 3 1234567
+# HELP request_duration_microseconds_sum The response latency.
+# TYPE request_duration_microseconds_sum counter
+request_duration_microseconds_sum 1.7560473e+06
+request_duration_microseconds_sum{code="500"} 250 1234567
+# HELP request_duration_microseconds_count The response latency.
+# TYPE request_duration_microseconds_count counter
+request_duration_microseconds_count 2693
+request_duration_microseconds_count{code="500"} 3 1234567
+`
+	if got := out.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	if e := families[0].Metric[5].GetCounter().GetExemplar(); e.GetValue() != 42 {
+		t.Errorf("expected bucket exemplar to be kept, got %v", e)
+	}
+	if !proto.Equal(mf, orig) {
+		t.Error("input family modified")
+	}
+	if got := HistogramToCounters(gaugeFamilyPart("up", "a", 1)); got != nil {
+		t.Errorf("expected nil for a gauge family, got %v", got)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bufio"
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OpenMetricsBufferedEncoder writes metric families in the OpenMetrics format
+// through a buffer of fixed size, which is reused across families and flushed
+// to the underlying writer whenever it is full. The options are evaluated once,
+// rather than for every family as with MetricFamilyToOpenMetrics. This suits
+// scrape endpoints writing large numbers of series, as neither the memory
+// usage nor the allocations grow with the size of the exposition. The output
+// is identical to that of MetricFamilyToOpenMetrics followed by
+// FinalizeOpenMetrics.
+//
+// It implements Encoder and Closer and must not be used concurrently.
+type OpenMetricsBufferedEncoder struct {
+	buf  *bufio.Writer
+	opts *encoderOption
+}
+
+// NewOpenMetricsBufferedEncoder returns an OpenMetricsBufferedEncoder writing
+// to w in chunks of bufSize bytes with the given options. (Single label values
+// or help texts larger than bufSize may be written in larger chunks.) A
+// non-positive bufSize selects the default size of bufio.Writer.
+func NewOpenMetricsBufferedEncoder(w io.Writer, bufSize int, options ...EncoderOption) *OpenMetricsBufferedEncoder {
+	var buf *bufio.Writer
+	if bufSize > 0 {
+		buf = bufio.NewWriterSize(w, bufSize)
+	} else {
+		buf = bufio.NewWriter(w)
+	}
+	return &OpenMetricsBufferedEncoder{
+		buf:  buf,
+		opts: newEncoderOption(options),
+	}
+}
+
+// Encode implements Encoder. The family may remain in the buffer until the
+// buffer is full or Flush or Close is called.
+func (e *OpenMetricsBufferedEncoder) Encode(mf *dto.MetricFamily) error {
+	_, err := writeOpenMetricsFamily(e.buf, mf, e.opts)
+	return err
+}
+
+// Flush writes the buffered data to the underlying writer, e.g. to send the
+// families encoded so far to a client waiting for them.
+func (e *OpenMetricsBufferedEncoder) Flush() error {
+	return e.buf.Flush()
+}
+
+// Close implements Closer by writing the final `# EOF` line and flushing the
+// buffer. It doesn't close the underlying writer.
+func (e *OpenMetricsBufferedEncoder) Close() error {
+	if _, err := FinalizeOpenMetrics(e.buf); err != nil {
+		return err
+	}
+	return e.buf.Flush()
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// chunkRecorder records the sizes of the writes to it.
+type chunkRecorder struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (c *chunkRecorder) Write(p []byte) (int, error) {
+	c.sizes = append(c.sizes, len(p))
+	return c.Buffer.Write(p)
+}
+
+func TestOpenMetricsBufferedEncoder(t *testing.T) {
+	families := []*dto.MetricFamily{
+		benchmarkOpenMetricsFamily(),
+		{
+			Name: proto.String("foos_total"),
+			Help: proto.String("Number of foos."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+					Counter: &dto.Counter{Value: proto.Float64(42)},
+				},
+			},
+		},
+		{
+			Name: proto.String("name.with.dots"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(math.Inf(-1))}},
+			},
+		},
+	}
+	for _, options := range [][]EncoderOption{
+		nil,
+		{WithCompactFloats(), WithLabelSeparatorSpace()},
+	} {
+		var want bytes.Buffer
+		for _, mf := range families {
+			if _, err := MetricFamilyToOpenMetrics(&want, mf, options...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := FinalizeOpenMetrics(&want); err != nil {
+			t.Fatal(err)
+		}
+
+		var got chunkRecorder
+		enc := NewOpenMetricsBufferedEncoder(&got, 64, options...)
+		for _, mf := range families {
+			if err := enc.Encode(mf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("expected %q, got %q", want.String(), got.String())
+		}
+		for i, size := range got.sizes {
+			if size > 64 {
+				t.Errorf("write %d has %d bytes, exceeding the buffer size", i, size)
+			}
+		}
+		if len(got.sizes) < 2 {
+			t.Errorf("expected several writes, got %d", len(got.sizes))
+		}
+	}
+}
+
+func TestOpenMetricsBufferedEncoderError(t *testing.T) {
+	var out bytes.Buffer
+	enc := NewOpenMetricsBufferedEncoder(&out, 0)
+	err := enc.Encode(&dto.MetricFamily{Type: dto.MetricType_GAUGE.Enum()})
+	if err == nil || !strings.HasPrefix(err.Error(), "MetricFamily has no name") {
+		t.Errorf("expected error for family without name, got %v", err)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no output, got %q", out.String())
+	}
+}
+
+func BenchmarkOpenMetricsBufferedEncoder(b *testing.B) {
+	mf := benchmarkOpenMetricsFamily()
+	enc := NewOpenMetricsBufferedEncoder(io.Discard, 0)
+
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(mf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -16,15 +16,18 @@ package expfmt
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/prometheus/common/model"
 
 	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // MetricFamilyToOpenMetrics converts a MetricFamily proto message into the
@@ -47,6 +50,8 @@ import (
 // `foo{"bar"="baz"}`. As stated above, the input is assumed to be santized and
 // no error will be thrown in this case.
 //
+// The behavior can be adjusted by EncoderOptions, see their documentation.
+//
 // This function fulfills the type 'expfmt.encoder'.
 //
 // Note that OpenMetrics requires a final `# EOF` line. Since this function acts
@@ -62,22 +67,44 @@ import (
 //     the output, the suffix will be truncated from the `# TYPE` and `# HELP`
 //     line. A counter with a missing `_total` suffix is not an error. However,
 //     its type will be set to `unknown` in that case to avoid invalid OpenMetrics
-//     output.
+//     output. WithSuffixHandling(false) disables both, see there.
+//
+//   - A `_created` line is written after each counter (only if its name has
+//     the `_total` suffix), summary, and histogram (after its `_count` line)
+//     with a CreatedTimestamp set. An invalid CreatedTimestamp is an error.
+//
+//   - Families named in WithInfoFamilies are written with the info type, those
+//     named in WithStateSetFamilies with the stateset type.
+//
+//   - Names not conforming to the legacy validation pattern are written quoted
+//     (see model.NoEscaping) unless another scheme is chosen with
+//     WithEscapingScheme.
 //
-//   - No support for the following (optional) features: `# UNIT` line, `_created`
-//     line, info type, stateset type, gaugehistogram type.
+//   - A `# UNIT` line, between the HELP and TYPE lines, is only written for
+//     families given a unit with WithUnit.
 //
-//   - The size of exemplar labels is not checked (i.e. it's possible to create
-//     exemplars that are larger than allowed by the OpenMetrics specification).
+//   - Native histograms (see IsNativeHistogram) are written as a single sample
+//     with a composite value, as proposed for OpenMetrics 2.0, e.g.
+//     `foo {count:3,sum:1.5,schema:0,zero_threshold:0.001,zero_count:1,positive_spans:[0:2],positive_buckets:[1,1]}`.
+//     Bucket counts are written as absolute values rather than deltas. Spans
+//     and buckets are omitted for an empty side. A histogram with both
+//     representations is written as a native one if it has any bucket spans.
+//     Otherwise, its native part is just a zero bucket, and the classic
+//     buckets are written instead. Use SelectHistogramRepresentation to
+//     write the classic representation in any case.
+//
+//   - Gauge histograms are taken from the Histogram field of the metrics. Unlike
+//     with histograms, the float counts are used where set, so that bucket
+//     counts may decrease between scrapes or even be negative, as may the sum.
+//
+//   - Exemplars are written for counters and the buckets of classic
+//     histograms. Exemplar labels longer than the 128 UTF-8 characters allowed
+//     by the OpenMetrics specification are an error. WithMaxExemplars limits
+//     the number of exemplars written per family.
 //
 //   - The value of Counters is not checked. (OpenMetrics doesn't allow counters
 //     with a `NaN` value.)
-func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int, err error) {
-	name := in.GetName()
-	if name == "" {
-		return 0, fmt.Errorf("MetricFamily has no name: %s", in)
-	}
-
+func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...EncoderOption) (written int, err error) {
 	// Try the interface upgrade. If it doesn't work, we'll use a
 	// bufio.Writer from the sync.Pool.
 	w, ok := out.(enhancedWriter)
@@ -93,79 +120,123 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 			bufPool.Put(b)
 		}()
 	}
+	return writeOpenMetricsFamily(w, in, newEncoderOption(options))
+}
+
+// writeOpenMetricsFamily implements MetricFamilyToOpenMetrics for the given
+// enhancedWriter and options.
+func writeOpenMetricsFamily(w enhancedWriter, in *dto.MetricFamily, opts *encoderOption) (written int, err error) {
+	name := in.GetName()
+	if name == "" {
+		return 0, fmt.Errorf("MetricFamily has no name: %s", in)
+	}
+	if len(in.Metric) == 0 && opts.omitEmptyFamilies {
+		return 0, nil
+	}
+	name = opts.name(name)
+	if err := opts.checkNilMetrics(in); err != nil {
+		return 0, err
+	}
+	if in.GetType() == dto.MetricType_HISTOGRAM && opts.isGaugeHistogram(in.GetName()) {
+		in = &dto.MetricFamily{
+			Name:   in.Name,
+			Help:   in.Help,
+			Type:   dto.MetricType_GAUGE_HISTOGRAM.Enum(),
+			Metric: in.Metric,
+		}
+	}
 
 	var (
 		n          int
 		metricType = in.GetType()
 		shortName  = name
 	)
-	if metricType == dto.MetricType_COUNTER && strings.HasSuffix(shortName, "_total") {
+	if metricType == dto.MetricType_COUNTER && strings.HasSuffix(shortName, "_total") && !opts.verbatimCounterNames {
 		shortName = name[:len(name)-6]
 	}
-
-	// Comments, first HELP, then TYPE.
-	if in.Help != nil {
-		n, err = w.WriteString("# HELP ")
-		written += n
-		if err != nil {
-			return
+	isInfo := opts.isInfo(in.GetName())
+	if isInfo {
+		if metricType != dto.MetricType_GAUGE && metricType != dto.MetricType_UNTYPED {
+			return 0, fmt.Errorf("info metric family %q must be a gauge or untyped, not %s", in.GetName(), typeName(metricType))
 		}
-		n, err = writeName(w, shortName)
-		written += n
-		if err != nil {
-			return
-		}
-		err = w.WriteByte(' ')
-		written++
-		if err != nil {
-			return
-		}
-		n, err = writeEscapedString(w, *in.Help, true)
-		written += n
-		if err != nil {
-			return
-		}
-		err = w.WriteByte('\n')
-		written++
-		if err != nil {
-			return
+		if !strings.HasSuffix(name, "_info") {
+			return 0, fmt.Errorf("info metric family %q lacks the _info suffix", in.GetName())
 		}
+		shortName = name[:len(name)-5]
 	}
-	n, err = w.WriteString("# TYPE ")
-	written += n
-	if err != nil {
-		return
+	isStateSet := !isInfo && opts.isStateSet(in.GetName())
+	if isStateSet && metricType != dto.MetricType_GAUGE && metricType != dto.MetricType_UNTYPED {
+		return 0, fmt.Errorf("stateset metric family %q must be a gauge or untyped, not %s", in.GetName(), typeName(metricType))
 	}
-	n, err = writeName(w, shortName)
-	written += n
-	if err != nil {
-		return
+
+	if unit := opts.unit(in.GetName()); unit != "" && !strings.HasSuffix(shortName, "_"+unit) {
+		return 0, fmt.Errorf("metric family %q lacks the suffix of its unit %q", in.GetName(), unit)
 	}
-	switch metricType {
-	case dto.MetricType_COUNTER:
-		if strings.HasSuffix(name, "_total") {
-			n, err = w.WriteString(" counter\n")
-		} else {
-			n, err = w.WriteString(" unknown\n")
+	if opts.strict {
+		if err := checkStrictTimestamps(in); err != nil {
+			return 0, fmt.Errorf("strict validation failed for metric family %s: %w", name, err)
 		}
-	case dto.MetricType_GAUGE:
-		n, err = w.WriteString(" gauge\n")
-	case dto.MetricType_SUMMARY:
-		n, err = w.WriteString(" summary\n")
-	case dto.MetricType_UNTYPED:
-		n, err = w.WriteString(" unknown\n")
-	case dto.MetricType_HISTOGRAM:
-		n, err = w.WriteString(" histogram\n")
-	default:
-		return written, fmt.Errorf("unknown metric type %s", metricType.String())
 	}
-	written += n
-	if err != nil {
-		return
+	var keptExemplars map[*dto.Exemplar]struct{}
+	if opts.maxExemplars > 0 {
+		keptExemplars = selectExemplars(in, opts.maxExemplars, opts.exemplarPolicy)
+	}
+	if opts.escapingScheme != model.NoEscaping {
+		// Escape the name without the suffix, so that the suffix is still
+		// recognized by consumers unescaping the name.
+		suffix := name[len(shortName):]
+		shortName = opts.escapeName(shortName)
+		name = shortName + suffix
+	}
+
+	// Comments, first HELP, then TYPE.
+	if !opts.omitMetadata {
+		n, err = writeOpenMetricsMetadata(w, opts, in, shortName)
+		written += n
+		if err != nil {
+			return
+		}
 	}
 
 	// Finally the samples, one line for each.
 	for _, metric := range in.Metric {
+		if metric == nil {
+			continue // See WithNilMetricsError.
+		}
+		created := createdTimestamp(metric, metricType, name != shortName)
+		if created != nil && created.CheckValid() != nil {
+			return written, fmt.Errorf(
+				"expected valid created timestamp in metric %s %s", name, metric,
+			)
+		}
+		if err := checkMetricExemplars(metric, metricType); err != nil {
+			return written, fmt.Errorf(
+				"expected valid exemplar in metric %s %s: %w", name, metric, err,
+			)
+		}
+		if opts.strict {
+			if err := checkStrictMetric(opts, metric, metricType); err != nil {
+				return written, fmt.Errorf(
+					"strict validation failed for metric %s %s: %w", name, metric, err,
+				)
+			}
+		}
+		if isInfo {
+			n, err = writeOpenMetricsInfo(w, opts, name, metric)
+			written += n
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if isStateSet {
+			n, err = writeOpenMetricsStateSet(w, opts, name, in.GetName(), metric)
+			written += n
+			if err != nil {
+				return
+			}
+			continue
+		}
 		switch metricType {
 		case dto.MetricType_COUNTER:
 			if metric.Counter == nil {
@@ -177,9 +248,9 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 			// ends on `_total` or that the rendered type is
 			// `unknown`. Therefore, no `_total` must be added here.
 			n, err = writeOpenMetricsSample(
-				w, name, "", metric, "", 0,
+				w, opts, name, "", metric, "", 0,
 				metric.Counter.GetValue(), 0, false,
-				metric.Counter.Exemplar,
+				keptExemplar(keptExemplars, metric.Counter.Exemplar),
 			)
 		case dto.MetricType_GAUGE:
 			if metric.Gauge == nil {
@@ -188,7 +259,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 				)
 			}
 			n, err = writeOpenMetricsSample(
-				w, name, "", metric, "", 0,
+				w, opts, name, "", metric, "", 0,
 				metric.Gauge.GetValue(), 0, false,
 				nil,
 			)
@@ -199,7 +270,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 				)
 			}
 			n, err = writeOpenMetricsSample(
-				w, name, "", metric, "", 0,
+				w, opts, name, "", metric, "", 0,
 				metric.Untyped.GetValue(), 0, false,
 				nil,
 			)
@@ -211,7 +282,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 			}
 			for _, q := range metric.Summary.Quantile {
 				n, err = writeOpenMetricsSample(
-					w, name, "", metric,
+					w, opts, name, "", metric,
 					model.QuantileLabel, q.GetQuantile(),
 					q.GetValue(), 0, false,
 					nil,
@@ -222,7 +293,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 				}
 			}
 			n, err = writeOpenMetricsSample(
-				w, name, "_sum", metric, "", 0,
+				w, opts, name, "_sum", metric, "", 0,
 				metric.Summary.GetSampleSum(), 0, false,
 				nil,
 			)
@@ -231,7 +302,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 				return
 			}
 			n, err = writeOpenMetricsSample(
-				w, name, "_count", metric, "", 0,
+				w, opts, name, "_count", metric, "", 0,
 				0, metric.Summary.GetSampleCount(), true,
 				nil,
 			)
@@ -241,13 +312,17 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 					"expected histogram in metric %s %s", name, metric,
 				)
 			}
+			if writeAsNativeHistogram(metric.Histogram) {
+				n, err = writeOpenMetricsNativeHistogram(w, opts, name, metric)
+				break
+			}
 			infSeen := false
-			for _, b := range metric.Histogram.Bucket {
+			for _, b := range sortedBuckets(metric.Histogram.Bucket) {
 				n, err = writeOpenMetricsSample(
-					w, name, "_bucket", metric,
+					w, opts, name, "_bucket", metric,
 					model.BucketLabel, b.GetUpperBound(),
 					0, b.GetCumulativeCount(), true,
-					b.Exemplar,
+					keptExemplar(keptExemplars, b.Exemplar),
 				)
 				written += n
 				if err != nil {
@@ -259,7 +334,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 			}
 			if !infSeen {
 				n, err = writeOpenMetricsSample(
-					w, name, "_bucket", metric,
+					w, opts, name, "_bucket", metric,
 					model.BucketLabel, math.Inf(+1),
 					0, metric.Histogram.GetSampleCount(), true,
 					nil,
@@ -270,7 +345,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 				}
 			}
 			n, err = writeOpenMetricsSample(
-				w, name, "_sum", metric, "", 0,
+				w, opts, name, "_sum", metric, "", 0,
 				metric.Histogram.GetSampleSum(), 0, false,
 				nil,
 			)
@@ -279,10 +354,17 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 				return
 			}
 			n, err = writeOpenMetricsSample(
-				w, name, "_count", metric, "", 0,
+				w, opts, name, "_count", metric, "", 0,
 				0, metric.Histogram.GetSampleCount(), true,
 				nil,
 			)
+		case dto.MetricType_GAUGE_HISTOGRAM:
+			if metric.Histogram == nil {
+				return written, fmt.Errorf(
+					"expected gauge histogram in metric %s %s", name, metric,
+				)
+			}
+			n, err = writeOpenMetricsGaugeHistogram(w, opts, name, metric, keptExemplars)
 		default:
 			return written, fmt.Errorf(
 				"unexpected type in metric %s %s", name, metric,
@@ -292,7 +374,571 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily) (written int
 		if err != nil {
 			return
 		}
+		if created != nil {
+			n, err = writeOpenMetricsCreated(w, opts, shortName, metric, created)
+			written += n
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// writeOpenMetricsInfo writes the sample of an info metric, which is taken from
+// a gauge or untyped metric and has to have the value 1.
+func writeOpenMetricsInfo(
+	w enhancedWriter,
+	opts *encoderOption,
+	name string,
+	metric *dto.Metric,
+) (int, error) {
+	value, ok := gaugeOrUntypedValue(metric)
+	if !ok {
+		return 0, fmt.Errorf("expected gauge or untyped in info metric %s %s", name, metric)
+	}
+	if value != 1 {
+		return 0, fmt.Errorf("expected value 1 in info metric %s %s", name, metric)
+	}
+	return writeOpenMetricsSample(w, opts, name, "", metric, "", 0, 0, 1, true, nil)
+}
+
+// writeOpenMetricsStateSet writes the sample of a single state of a stateset,
+// which is taken from a gauge or untyped metric. The metric has to have a label
+// named like the family (stateLabel), holding the name of the state, and the
+// value 0 or 1.
+func writeOpenMetricsStateSet(
+	w enhancedWriter,
+	opts *encoderOption,
+	name, stateLabel string,
+	metric *dto.Metric,
+) (int, error) {
+	value, ok := gaugeOrUntypedValue(metric)
+	if !ok {
+		return 0, fmt.Errorf("expected gauge or untyped in stateset metric %s %s", name, metric)
+	}
+	if value != 0 && value != 1 {
+		return 0, fmt.Errorf("expected value 0 or 1 in stateset metric %s %s", name, metric)
+	}
+	hasState := false
+	for _, lp := range metric.Label {
+		if lp.GetName() == stateLabel {
+			hasState = true
+			break
+		}
+	}
+	if !hasState {
+		return 0, fmt.Errorf("expected label %q in stateset metric %s %s", stateLabel, name, metric)
+	}
+	return writeOpenMetricsSample(w, opts, name, "", metric, "", 0, 0, uint64(value), true, nil)
+}
+
+// gaugeOrUntypedValue returns the value of metric if it is a gauge or untyped.
+func gaugeOrUntypedValue(metric *dto.Metric) (float64, bool) {
+	switch {
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue(), true
+	case metric.Untyped != nil:
+		return metric.Untyped.GetValue(), true
+	default:
+		return 0, false
+	}
+}
+
+// checkMetricExemplars returns an error if any exemplar of metric to be written
+// for the given type exceeds the length allowed by OpenMetrics.
+func checkMetricExemplars(metric *dto.Metric, metricType dto.MetricType) error {
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		return checkExemplar(metric.GetCounter().GetExemplar())
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		for _, b := range metric.GetHistogram().GetBucket() {
+			if err := checkExemplar(b.GetExemplar()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkStrictMetric returns an error for the first violation of the
+// OpenMetrics specification in metric found by WithStrictValidation. The
+// labels are checked in the order they are written, i.e. after sorting them if
+// the options ask for it.
+func checkStrictMetric(opts *encoderOption, metric *dto.Metric, metricType dto.MetricType) error {
+	labels := opts.sortLabels(metric.Label)
+	for i, lp := range labels {
+		if i == 0 {
+			continue
+		}
+		switch prev := labels[i-1].GetName(); {
+		case lp.GetName() == prev:
+			return fmt.Errorf("duplicate label name %q", lp.GetName())
+		case lp.GetName() < prev:
+			return fmt.Errorf("label %q not sorted after label %q", lp.GetName(), prev)
+		}
+	}
+	switch metricType {
+	case dto.MetricType_SUMMARY:
+		for _, q := range metric.GetSummary().GetQuantile() {
+			if !(q.GetQuantile() >= 0 && q.GetQuantile() <= 1) {
+				return fmt.Errorf("quantile %g outside of [0,1]", q.GetQuantile())
+			}
+		}
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		h := metric.GetHistogram()
+		if writeAsNativeHistogram(h) {
+			return nil
+		}
+		for i, b := range h.GetBucket() {
+			if i == 0 {
+				continue
+			}
+			prev := h.Bucket[i-1]
+			if !(b.GetUpperBound() > prev.GetUpperBound()) {
+				return fmt.Errorf(
+					"bucket upper bound %g not sorted after %g",
+					b.GetUpperBound(), prev.GetUpperBound(),
+				)
+			}
+			// The buckets of gauge histograms are gauges and may decrease.
+			if metricType == dto.MetricType_HISTOGRAM && bucketCount(b) < bucketCount(prev) {
+				return fmt.Errorf(
+					"cumulative count %g of bucket %g less than %g of bucket %g",
+					bucketCount(b), b.GetUpperBound(), bucketCount(prev), prev.GetUpperBound(),
+				)
+			}
+		}
+		if n := len(h.GetBucket()); n == 0 || !math.IsInf(h.Bucket[n-1].GetUpperBound(), +1) {
+			return errors.New("missing +Inf bucket")
+		}
+	}
+	return nil
+}
+
+// bucketCount returns the cumulative count of b, preferring the float count
+// if set.
+func bucketCount(b *dto.Bucket) float64 {
+	if b.CumulativeCountFloat != nil {
+		return b.GetCumulativeCountFloat()
+	}
+	return float64(b.GetCumulativeCount())
+}
+
+// checkStrictTimestamps returns an error if two metrics of in belong to the
+// same series, i.e. have the same label set, without increasing timestamps, as
+// found by WithStrictValidation.
+func checkStrictTimestamps(in *dto.MetricFamily) error {
+	if len(in.Metric) < 2 {
+		return nil
+	}
+	last := make(map[string]*dto.Metric, len(in.Metric))
+	for _, metric := range in.Metric {
+		if metric == nil {
+			continue
+		}
+		series := labelsString(metric.Label)
+		prev, ok := last[series]
+		last[series] = metric
+		if !ok {
+			continue
+		}
+		if series == "" {
+			series = "{}"
+		}
+		if prev.TimestampMs == nil || metric.TimestampMs == nil {
+			return fmt.Errorf("duplicate series %s without timestamp", series)
+		}
+		if metric.GetTimestampMs() <= prev.GetTimestampMs() {
+			return fmt.Errorf(
+				"timestamp %d of series %s not after timestamp %d",
+				metric.GetTimestampMs(), series, prev.GetTimestampMs(),
+			)
+		}
+	}
+	return nil
+}
+
+// selectExemplars returns the at most n exemplars of the family to be written
+// by the OpenMetrics encoder, selected according to policy. Ties go to the
+// exemplar written first.
+func selectExemplars(in *dto.MetricFamily, n int, policy ExemplarPolicy) map[*dto.Exemplar]struct{} {
+	var exemplars []*dto.Exemplar
+	for _, metric := range in.Metric {
+		switch in.GetType() {
+		case dto.MetricType_COUNTER:
+			if e := metric.GetCounter().GetExemplar(); e != nil {
+				exemplars = append(exemplars, e)
+			}
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			if writeAsNativeHistogram(metric.GetHistogram()) {
+				continue
+			}
+			for _, b := range sortedBuckets(metric.GetHistogram().GetBucket()) {
+				if e := b.GetExemplar(); e != nil {
+					exemplars = append(exemplars, e)
+				}
+			}
+		}
+	}
+	switch policy {
+	case ExemplarsMostRecent:
+		sort.SliceStable(exemplars, func(i, j int) bool {
+			ti, tj := exemplars[i].GetTimestamp(), exemplars[j].GetTimestamp()
+			if ti == nil || tj == nil {
+				return tj == nil && ti != nil
+			}
+			return ti.AsTime().After(tj.AsTime())
+		})
+	default:
+		sort.SliceStable(exemplars, func(i, j int) bool {
+			return exemplars[i].GetValue() > exemplars[j].GetValue()
+		})
+	}
+	if len(exemplars) > n {
+		exemplars = exemplars[:n]
+	}
+	kept := make(map[*dto.Exemplar]struct{}, len(exemplars))
+	for _, e := range exemplars {
+		kept[e] = struct{}{}
+	}
+	return kept
+}
+
+// keptExemplar returns e if it is to be written, or nil if it has been dropped
+// by WithMaxExemplars, i.e. if it is not in kept, as returned by
+// selectExemplars. All exemplars are kept if kept is nil.
+func keptExemplar(kept map[*dto.Exemplar]struct{}, e *dto.Exemplar) *dto.Exemplar {
+	if kept == nil {
+		return e
+	}
+	if _, ok := kept[e]; !ok {
+		return nil
+	}
+	return e
+}
+
+// createdTimestamp returns the created timestamp of a counter (only if it has
+// the _total suffix, as indicated by hasTotal), summary, or histogram metric,
+// or nil if there is none.
+func createdTimestamp(metric *dto.Metric, metricType dto.MetricType, hasTotal bool) *timestamppb.Timestamp {
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		if hasTotal {
+			return metric.GetCounter().GetCreatedTimestamp()
+		}
+	case dto.MetricType_SUMMARY:
+		return metric.GetSummary().GetCreatedTimestamp()
+	case dto.MetricType_HISTOGRAM:
+		return metric.GetHistogram().GetCreatedTimestamp()
+	}
+	return nil
+}
+
+// writeOpenMetricsCreated writes the _created sample of metric, with the
+// created timestamp ts in seconds as its value. The timestamp of the metric
+// doesn't apply to it.
+func writeOpenMetricsCreated(
+	w enhancedWriter,
+	opts *encoderOption,
+	shortName string,
+	metric *dto.Metric,
+	ts *timestamppb.Timestamp,
+) (int, error) {
+	written, err := writeOpenMetricsNameAndLabelPairs(
+		w, opts, shortName, "_created", metric.Label, "", 0,
+	)
+	if err != nil {
+		return written, err
+	}
+	err = w.WriteByte(' ')
+	written++
+	if err != nil {
+		return written, err
+	}
+	// TODO(beorn7): Format this directly from components of ts to avoid
+	// overflow/underflow and precision issues of the float conversion.
+	n, err := writeOpenMetricsFloat(w, float64(ts.AsTime().UnixNano())/1e9)
+	written += n
+	if err != nil {
+		return written, err
+	}
+	err = w.WriteByte('\n')
+	written++
+	return written, err
+}
+
+// writeOpenMetricsMetadata writes the `# id` comment (if any), the HELP (if
+// any), UNIT (if any), and TYPE lines of in, using shortName as the name.
+func writeOpenMetricsMetadata(
+	w enhancedWriter,
+	opts *encoderOption,
+	in *dto.MetricFamily,
+	shortName string,
+) (written int, err error) {
+	var (
+		n          int
+		name       = in.GetName()
+		metricType = in.GetType()
+	)
+	n, err = writeMetricID(w, opts, name, shortName)
+	written += n
+	if err != nil {
+		return
+	}
+	if in.Help != nil || opts.alwaysHelp {
+		n, err = w.WriteString("# HELP ")
+		written += n
+		if err != nil {
+			return
+		}
+		n, err = writeName(w, shortName)
+		written += n
+		if err != nil {
+			return
+		}
+		err = w.WriteByte(' ')
+		written++
+		if err != nil {
+			return
+		}
+		n, err = writeEscapedString(w, opts.help(in.GetHelp()), true)
+		written += n
+		if err != nil {
+			return
+		}
+		err = w.WriteByte('\n')
+		written++
+		if err != nil {
+			return
+		}
+	}
+	if unit := opts.unit(name); unit != "" {
+		n, err = w.WriteString("# UNIT ")
+		written += n
+		if err != nil {
+			return
+		}
+		n, err = writeName(w, shortName)
+		written += n
+		if err != nil {
+			return
+		}
+		err = w.WriteByte(' ')
+		written++
+		if err != nil {
+			return
+		}
+		n, err = w.WriteString(unit)
+		written += n
+		if err != nil {
+			return
+		}
+		err = w.WriteByte('\n')
+		written++
+		if err != nil {
+			return
+		}
+	}
+	n, err = w.WriteString("# TYPE ")
+	written += n
+	if err != nil {
+		return
+	}
+	n, err = writeName(w, shortName)
+	written += n
+	if err != nil {
+		return
+	}
+	switch {
+	case opts.isInfo(name):
+		n, err = w.WriteString(" info\n")
+	case opts.isStateSet(name):
+		n, err = w.WriteString(" stateset\n")
+	case metricType == dto.MetricType_COUNTER:
+		if strings.HasSuffix(name, "_total") || opts.verbatimCounterNames {
+			n, err = w.WriteString(" counter\n")
+		} else {
+			n, err = w.WriteString(" unknown\n")
+		}
+	case metricType == dto.MetricType_GAUGE:
+		n, err = w.WriteString(" gauge\n")
+	case metricType == dto.MetricType_SUMMARY:
+		n, err = w.WriteString(" summary\n")
+	case metricType == dto.MetricType_UNTYPED:
+		n, err = w.WriteString(" unknown\n")
+	case metricType == dto.MetricType_HISTOGRAM:
+		n, err = w.WriteString(" histogram\n")
+	case metricType == dto.MetricType_GAUGE_HISTOGRAM:
+		n, err = w.WriteString(" gaugehistogram\n")
+	default:
+		return written, fmt.Errorf("unknown metric type %s", metricType.String())
+	}
+	written += n
+	return
+}
+
+// writeAsNativeHistogram returns whether h is written in its native
+// representation. The native one is preferred, but a histogram with classic
+// buckets falls back to them if its native part has no bucket spans.
+func writeAsNativeHistogram(h *dto.Histogram) bool {
+	if !IsClassicHistogram(h) {
+		return IsNativeHistogram(h)
+	}
+	return len(h.GetPositiveSpan()) > 0 || len(h.GetNegativeSpan()) > 0
+}
+
+// writeOpenMetricsNativeHistogram writes the native representation of the
+// histogram in metric as a single sample with a composite value. Float counts
+// are used if the histogram has any.
+func writeOpenMetricsNativeHistogram(
+	w enhancedWriter,
+	opts *encoderOption,
+	name string,
+	metric *dto.Metric,
+) (written int, err error) {
+	var (
+		n       int
+		h       = metric.Histogram
+		isFloat = h.GetSampleCountFloat() > 0 || h.GetZeroCountFloat() > 0 ||
+			len(h.GetPositiveCount()) > 0 || len(h.GetNegativeCount()) > 0
+	)
+	n, err = writeOpenMetricsNameAndLabelPairs(w, opts, name, "", metric.Label, "", 0)
+	written += n
+	if err != nil {
+		return
+	}
+
+	// Compose the value first, so that it can be written in one go.
+	var v bytes.Buffer
+	v.WriteString(" {count:")
+	if isFloat {
+		writeOpenMetricsFloat(&v, h.GetSampleCountFloat())
+	} else {
+		writeUint(&v, h.GetSampleCount())
+	}
+	v.WriteString(",sum:")
+	writeOpenMetricsFloat(&v, h.GetSampleSum())
+	v.WriteString(",schema:")
+	writeInt(&v, int64(h.GetSchema()))
+	v.WriteString(",zero_threshold:")
+	writeOpenMetricsFloat(&v, h.GetZeroThreshold())
+	v.WriteString(",zero_count:")
+	if isFloat {
+		writeOpenMetricsFloat(&v, h.GetZeroCountFloat())
+	} else {
+		writeUint(&v, h.GetZeroCount())
+	}
+	for _, side := range []struct {
+		prefix string
+		spans  []*dto.BucketSpan
+		deltas []int64
+		counts []float64
+	}{
+		{"negative", h.GetNegativeSpan(), h.GetNegativeDelta(), h.GetNegativeCount()},
+		{"positive", h.GetPositiveSpan(), h.GetPositiveDelta(), h.GetPositiveCount()},
+	} {
+		if len(side.spans) == 0 {
+			continue
+		}
+		v.WriteString("," + side.prefix + "_spans:[")
+		for i, span := range side.spans {
+			if i > 0 {
+				v.WriteByte(',')
+			}
+			writeInt(&v, int64(span.GetOffset()))
+			v.WriteByte(':')
+			writeUint(&v, uint64(span.GetLength()))
+		}
+		v.WriteString("]," + side.prefix + "_buckets:[")
+		if isFloat {
+			for i, c := range side.counts {
+				if i > 0 {
+					v.WriteByte(',')
+				}
+				writeOpenMetricsFloat(&v, c)
+			}
+		} else {
+			var count int64
+			for i, delta := range side.deltas {
+				if i > 0 {
+					v.WriteByte(',')
+				}
+				count += delta
+				writeInt(&v, count)
+			}
+		}
+		v.WriteByte(']')
+	}
+	v.WriteByte('}')
+	if metric.TimestampMs != nil {
+		v.WriteByte(' ')
+		writeOpenMetricsFloat(&v, float64(*metric.TimestampMs)/1000)
+	}
+	v.WriteByte('\n')
+	n, err = w.Write(v.Bytes())
+	written += n
+	return
+}
+
+// writeOpenMetricsGaugeHistogram writes the _bucket, _gsum, and _gcount samples
+// of a gauge histogram. Float counts are used where set, as they may be
+// negative for gauge histograms. Only the exemplars in keptExemplars are
+// written, unless it is nil (see keptExemplar).
+func writeOpenMetricsGaugeHistogram(
+	w enhancedWriter,
+	opts *encoderOption,
+	name string,
+	metric *dto.Metric,
+	keptExemplars map[*dto.Exemplar]struct{},
+) (written int, err error) {
+	var (
+		n       int
+		h       = metric.Histogram
+		infSeen = false
+	)
+	for _, b := range sortedBuckets(h.Bucket) {
+		n, err = writeOpenMetricsSample(
+			w, opts, name, "_bucket", metric,
+			model.BucketLabel, b.GetUpperBound(),
+			b.GetCumulativeCountFloat(), b.GetCumulativeCount(), b.CumulativeCountFloat == nil,
+			keptExemplar(keptExemplars, b.Exemplar),
+		)
+		written += n
+		if err != nil {
+			return
+		}
+		if math.IsInf(b.GetUpperBound(), +1) {
+			infSeen = true
+		}
+	}
+	if !infSeen {
+		n, err = writeOpenMetricsSample(
+			w, opts, name, "_bucket", metric,
+			model.BucketLabel, math.Inf(+1),
+			h.GetSampleCountFloat(), h.GetSampleCount(), h.SampleCountFloat == nil,
+			nil,
+		)
+		written += n
+		if err != nil {
+			return
+		}
 	}
+	n, err = writeOpenMetricsSample(
+		w, opts, name, "_gcount", metric, "", 0,
+		h.GetSampleCountFloat(), h.GetSampleCount(), h.SampleCountFloat == nil,
+		nil,
+	)
+	written += n
+	if err != nil {
+		return
+	}
+	n, err = writeOpenMetricsSample(
+		w, opts, name, "_gsum", metric, "", 0,
+		h.GetSampleSum(), 0, false,
+		nil,
+	)
+	written += n
 	return
 }
 
@@ -301,6 +947,38 @@ func FinalizeOpenMetrics(w io.Writer) (written int, err error) {
 	return w.Write([]byte("# EOF\n"))
 }
 
+// writeNameWithSuffix writes name followed by suffix, quoted and escaped as a
+// whole if quoted is true, like writeName does for names not passing the legacy
+// validity check.
+func writeNameWithSuffix(w enhancedWriter, name, suffix string, quoted bool) (int, error) {
+	if !quoted {
+		written, err := w.WriteString(name)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.WriteString(suffix)
+		return written + n, err
+	}
+	err := w.WriteByte('"')
+	written := 1
+	if err != nil {
+		return written, err
+	}
+	n, err := writeEscapedString(w, name, true)
+	written += n
+	if err != nil {
+		return written, err
+	}
+	n, err = w.WriteString(suffix)
+	written += n
+	if err != nil {
+		return written, err
+	}
+	err = w.WriteByte('"')
+	written++
+	return written, err
+}
+
 // writeOpenMetricsSample writes a single sample in OpenMetrics text format to
 // w, given the metric name, the metric proto message itself, optionally an
 // additional label name with a float64 value (use empty string as label name if
@@ -309,16 +987,25 @@ func FinalizeOpenMetrics(w io.Writer) (written int, err error) {
 // function returns the number of bytes written and any error encountered.
 func writeOpenMetricsSample(
 	w enhancedWriter,
+	opts *encoderOption,
 	name, suffix string,
 	metric *dto.Metric,
 	additionalLabelName string, additionalLabelValue float64,
 	floatValue float64, intValue uint64, useIntValue bool,
 	exemplar *dto.Exemplar,
 ) (int, error) {
-	written := 0
-	n, err := writeOpenMetricsNameAndLabelPairs(
-		w, name+suffix, metric.Label, additionalLabelName, additionalLabelValue,
+	var (
+		written int
+		n       int
+		err     error
 	)
+	if isLabelFree(name, metric, additionalLabelName) {
+		n, err = writeNameWithSuffix(w, name, suffix, false)
+	} else {
+		n, err = writeOpenMetricsNameAndLabelPairs(
+			w, opts, name, suffix, metric.Label, additionalLabelName, additionalLabelValue,
+		)
+	}
 	written += n
 	if err != nil {
 		return written, err
@@ -328,9 +1015,12 @@ func writeOpenMetricsSample(
 	if err != nil {
 		return written, err
 	}
-	if useIntValue {
+	switch {
+	case useIntValue:
 		n, err = writeUint(w, intValue)
-	} else {
+	case opts.compactFloats:
+		n, err = writeFloat(w, floatValue)
+	default:
 		n, err = writeOpenMetricsFloat(w, floatValue)
 	}
 	written += n
@@ -351,7 +1041,7 @@ func writeOpenMetricsSample(
 		}
 	}
 	if exemplar != nil {
-		n, err = writeExemplar(w, exemplar)
+		n, err = writeExemplar(w, exemplar, opts)
 		written += n
 		if err != nil {
 			return written, err
@@ -365,11 +1055,14 @@ func writeOpenMetricsSample(
 	return written, nil
 }
 
-// writeOpenMetricsNameAndLabelPairs works like writeOpenMetricsSample but
-// formats the float in OpenMetrics style.
+// writeOpenMetricsNameAndLabelPairs works like writeNameAndLabelPairs but
+// formats the float in OpenMetrics style. The suffix, which has to consist of
+// characters valid in legacy names, is appended to the name without
+// concatenating them first, saving an allocation per sample.
 func writeOpenMetricsNameAndLabelPairs(
 	w enhancedWriter,
-	name string,
+	opts *encoderOption,
+	name, suffix string,
 	in []*dto.LabelPair,
 	additionalLabelName string, additionalLabelValue float64,
 ) (int, error) {
@@ -392,7 +1085,7 @@ func writeOpenMetricsNameAndLabelPairs(
 			separator = ','
 		}
 
-		n, err := writeName(w, name)
+		n, err := writeNameWithSuffix(w, name, suffix, metricInsideBraces)
 		written += n
 		if err != nil {
 			return written, err
@@ -410,13 +1103,28 @@ func writeOpenMetricsNameAndLabelPairs(
 		return written, nil
 	}
 
-	for _, lp := range in {
-		err := w.WriteByte(separator)
-		written++
+	// With sorted labels, the additional label is written before the first
+	// label sorted after it.
+	pending := additionalLabelName != ""
+	for _, lp := range opts.sortLabels(in) {
+		if pending && opts.sortedLabels && lp.GetName() > additionalLabelName {
+			n, err := writeOpenMetricsAdditionalLabel(w, opts, separator, additionalLabelName, additionalLabelValue)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			separator, pending = ',', false
+		}
+		value, err := opts.labelValue(lp.GetValue())
+		if err != nil {
+			return written, err
+		}
+		n, err := writeLabelSeparator(w, opts, separator)
+		written += n
 		if err != nil {
 			return written, err
 		}
-		n, err := writeName(w, lp.GetName())
+		n, err = writeName(w, opts.escapeName(lp.GetName()))
 		written += n
 		if err != nil {
 			return written, err
@@ -426,7 +1134,7 @@ func writeOpenMetricsNameAndLabelPairs(
 		if err != nil {
 			return written, err
 		}
-		n, err = writeEscapedString(w, lp.GetValue(), true)
+		n, err = writeEscapedString(w, value, true)
 		written += n
 		if err != nil {
 			return written, err
@@ -438,32 +1146,12 @@ func writeOpenMetricsNameAndLabelPairs(
 		}
 		separator = ','
 	}
-	if additionalLabelName != "" {
-		err := w.WriteByte(separator)
-		written++
-		if err != nil {
-			return written, err
-		}
-		n, err := w.WriteString(additionalLabelName)
+	if pending {
+		n, err := writeOpenMetricsAdditionalLabel(w, opts, separator, additionalLabelName, additionalLabelValue)
 		written += n
 		if err != nil {
 			return written, err
 		}
-		n, err = w.WriteString(`="`)
-		written += n
-		if err != nil {
-			return written, err
-		}
-		n, err = writeOpenMetricsFloat(w, additionalLabelValue)
-		written += n
-		if err != nil {
-			return written, err
-		}
-		err = w.WriteByte('"')
-		written++
-		if err != nil {
-			return written, err
-		}
 	}
 	err := w.WriteByte('}')
 	written++
@@ -473,16 +1161,50 @@ func writeOpenMetricsNameAndLabelPairs(
 	return written, nil
 }
 
-// writeExemplar writes the provided exemplar in OpenMetrics format to w. The
+// writeOpenMetricsAdditionalLabel writes the separator and the `quantile` or
+// `le` label with the given name and value for writeOpenMetricsNameAndLabelPairs.
+func writeOpenMetricsAdditionalLabel(
+	w enhancedWriter,
+	opts *encoderOption,
+	separator byte,
+	name string, value float64,
+) (int, error) {
+	written, err := writeLabelSeparator(w, opts, separator)
+	if err != nil {
+		return written, err
+	}
+	n, err := w.WriteString(name)
+	written += n
+	if err != nil {
+		return written, err
+	}
+	n, err = w.WriteString(`="`)
+	written += n
+	if err != nil {
+		return written, err
+	}
+	n, err = writeOpenMetricsFloat(w, opts.bound(value))
+	written += n
+	if err != nil {
+		return written, err
+	}
+	err = w.WriteByte('"')
+	written++
+	return written, err
+}
+
+// writeExemplar writes the provided exemplar in OpenMetrics format to w. Its
+// timestamp is written unless nil (or omitted according to opts, see
+// WithZeroExemplarTimestampsOmitted), an epoch timestamp as `0.0`. The
 // function returns the number of bytes written and any error encountered.
-func writeExemplar(w enhancedWriter, e *dto.Exemplar) (int, error) {
+func writeExemplar(w enhancedWriter, e *dto.Exemplar, opts *encoderOption) (int, error) {
 	written := 0
 	n, err := w.WriteString(" # ")
 	written += n
 	if err != nil {
 		return written, err
 	}
-	n, err = writeOpenMetricsNameAndLabelPairs(w, "", e.Label, "", 0)
+	n, err = writeOpenMetricsNameAndLabelPairs(w, nil, "", "", e.Label, "", 0)
 	written += n
 	if err != nil {
 		return written, err
@@ -497,21 +1219,25 @@ func writeExemplar(w enhancedWriter, e *dto.Exemplar) (int, error) {
 	if err != nil {
 		return written, err
 	}
-	if e.Timestamp != nil {
+	if timestamp := opts.exemplarTimestamp(e); timestamp != nil {
 		err = w.WriteByte(' ')
 		written++
 		if err != nil {
 			return written, err
 		}
-		err = (*e).Timestamp.CheckValid()
+		err = timestamp.CheckValid()
 		if err != nil {
 			return written, err
 		}
-		ts := (*e).Timestamp.AsTime()
-		// TODO(beorn7): Format this directly from components of ts to
-		// avoid overflow/underflow and precision issues of the float
-		// conversion.
-		n, err = writeOpenMetricsFloat(w, float64(ts.UnixNano())/1e9)
+		if digits := opts.exemplarTimestampDigits(); digits > 0 {
+			n, err = writeFixedTimestamp(w, timestamp, digits)
+		} else {
+			ts := timestamp.AsTime()
+			// TODO(beorn7): Format this directly from components of ts to
+			// avoid overflow/underflow and precision issues of the float
+			// conversion.
+			n, err = writeOpenMetricsFloat(w, float64(ts.UnixNano())/1e9)
+		}
 		written += n
 		if err != nil {
 			return written, err
@@ -520,8 +1246,61 @@ func writeExemplar(w enhancedWriter, e *dto.Exemplar) (int, error) {
 	return written, nil
 }
 
+// writeFixedTimestamp writes ts as seconds since the Unix epoch with exactly
+// the given number of fractional digits (at most 9), formatted directly from
+// the seconds and nanos of ts rather than converted to a float first, so that
+// no precision is lost. The nanos are rounded half away from zero to the
+// requested number of digits.
+func writeFixedTimestamp(w enhancedWriter, ts *timestamppb.Timestamp, digits int) (int, error) {
+	if digits > 9 {
+		digits = 9
+	}
+	// Nanos are always non-negative, even for negative timestamps. Work with
+	// the absolute value of the timestamp instead.
+	sec, nanos := ts.GetSeconds(), int64(ts.GetNanos())
+	neg := sec < 0
+	if neg {
+		if nanos > 0 {
+			sec++
+			nanos = 1e9 - nanos
+		}
+		sec = -sec
+	}
+	unit, limit := int64(1), int64(1)
+	for i := digits; i < 9; i++ {
+		unit *= 10
+	}
+	for i := 0; i < digits; i++ {
+		limit *= 10
+	}
+	frac := (nanos + unit/2) / unit
+	if frac == limit {
+		sec++
+		frac = 0
+	}
+
+	bp := numBufPool.Get().(*[]byte)
+	b := (*bp)[:0]
+	if neg && (sec != 0 || frac != 0) {
+		b = append(b, '-')
+	}
+	b = strconv.AppendInt(b, sec, 10)
+	b = append(b, '.')
+	// Zero-pad the fraction by writing it with a leading 1 and dropping that.
+	start := len(b)
+	b = strconv.AppendInt(b, limit+frac, 10)
+	b = append(b[:start], b[start+1:]...)
+	*bp = b
+	written, err := w.Write(b)
+	numBufPool.Put(bp)
+	return written, err
+}
+
 // writeOpenMetricsFloat works like writeFloat but appends ".0" if the resulting
-// number would otherwise contain neither a "." nor an "e".
+// number would otherwise contain neither a "." nor an "e". Like writeFloat, it
+// writes the special values exactly as "NaN", "+Inf", and "-Inf", as required
+// by the OpenMetrics spec. It is used for all sample, exemplar, and timestamp
+// values.
 func writeOpenMetricsFloat(w enhancedWriter, f float64) (int, error) {
 	switch {
 	case f == 1:
@@ -15,7 +15,9 @@ package expfmt
 
 import (
 	"bytes"
+	"fmt"
 	"math"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -23,6 +25,8 @@ import (
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/prometheus/common/model"
+
 	dto "github.com/prometheus/client_model/go"
 )
 
@@ -33,8 +37,9 @@ func TestCreateOpenMetrics(t *testing.T) {
 	}
 
 	scenarios := []struct {
-		in  *dto.MetricFamily
-		out string
+		in      *dto.MetricFamily
+		options []EncoderOption
+		out     string
 	}{
 		// 0: Counter, timestamp given, no _total suffix.
 		{
@@ -536,180 +541,2109 @@ foos_total 42.0
 # TYPE name counter
 `,
 		},
-	}
-
-	for i, scenario := range scenarios {
-		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
-		n, err := MetricFamilyToOpenMetrics(out, scenario.in)
-		if err != nil {
-			t.Errorf("%d. error: %s", i, err)
-			continue
-		}
-		if expected, got := len(scenario.out), n; expected != got {
-			t.Errorf(
-				"%d. expected %d bytes written, got %d",
-				i, expected, got,
-			)
-		}
-		if expected, got := scenario.out, out.String(); expected != got {
-			t.Errorf(
-				"%d. expected out=%q, got %q",
-				i, expected, got,
-			)
-		}
-	}
-}
-
-func BenchmarkOpenMetricsCreate(b *testing.B) {
-	mf := &dto.MetricFamily{
-		Name: proto.String("request_duration_microseconds"),
-		Help: proto.String("The response latency."),
-		Type: dto.MetricType_HISTOGRAM.Enum(),
-		Metric: []*dto.Metric{
-			{
-				Label: []*dto.LabelPair{
+		// 12: Counter with created timestamp.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos_total"),
+				Help: proto.String("Number of foos."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
 					{
-						Name:  proto.String("name_1"),
-						Value: proto.String("val with\nnew line"),
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("a"),
+								Value: proto.String("b"),
+							},
+						},
+						Counter: &dto.Counter{
+							Value:            proto.Float64(42),
+							CreatedTimestamp: openMetricsTimestamp,
+						},
+						TimestampMs: proto.Int64(23456000),
 					},
 					{
-						Name:  proto.String("name_2"),
-						Value: proto.String("val with \\backslash and \"quotes\""),
+						Counter: &dto.Counter{
+							Value: proto.Float64(7),
+						},
 					},
+				},
+			},
+			out: `# HELP foos Number of foos.
+# TYPE foos counter
+foos_total{a="b"} 42.0 23456.0
+foos_created{a="b"} 12345.6
+foos_total 7.0
+`,
+		},
+		// 13: Counter without _total suffix, created timestamp ignored.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
 					{
-						Name:  proto.String("name_3"),
-						Value: proto.String("Just a quite long label value to test performance."),
+						Counter: &dto.Counter{
+							Value:            proto.Float64(42),
+							CreatedTimestamp: openMetricsTimestamp,
+						},
 					},
 				},
-				Histogram: &dto.Histogram{
-					SampleCount: proto.Uint64(2693),
-					SampleSum:   proto.Float64(1756047.3),
-					Bucket: []*dto.Bucket{
-						{
-							UpperBound:      proto.Float64(100),
-							CumulativeCount: proto.Uint64(123),
-						},
-						{
-							UpperBound:      proto.Float64(120),
-							CumulativeCount: proto.Uint64(412),
-						},
-						{
-							UpperBound:      proto.Float64(144),
-							CumulativeCount: proto.Uint64(592),
-						},
-						{
-							UpperBound:      proto.Float64(172.8),
-							CumulativeCount: proto.Uint64(1524),
-						},
-						{
-							UpperBound:      proto.Float64(math.Inf(+1)),
-							CumulativeCount: proto.Uint64(2693),
+			},
+			out: `# TYPE foos unknown
+foos 42.0
+`,
+		},
+		// 14: Summary with created timestamp.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("rpc_duration_seconds"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Summary: &dto.Summary{
+							SampleCount: proto.Uint64(2),
+							SampleSum:   proto.Float64(3),
+							Quantile: []*dto.Quantile{
+								{
+									Quantile: proto.Float64(0.5),
+									Value:    proto.Float64(1),
+								},
+							},
+							CreatedTimestamp: openMetricsTimestamp,
 						},
 					},
 				},
 			},
-			{
-				Label: []*dto.LabelPair{
+			out: `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 1.0
+rpc_duration_seconds_sum 3.0
+rpc_duration_seconds_count 2
+rpc_duration_seconds_created 12345.6
+`,
+		},
+		// 15: Histogram with created timestamp.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("request_duration_seconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
 					{
-						Name:  proto.String("name_1"),
-						Value: proto.String("Björn"),
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(2),
+							SampleSum:   proto.Float64(3),
+							Bucket: []*dto.Bucket{
+								{
+									UpperBound:      proto.Float64(1),
+									CumulativeCount: proto.Uint64(1),
+								},
+							},
+							CreatedTimestamp: openMetricsTimestamp,
+						},
 					},
+				},
+			},
+			out: `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="1.0"} 1
+request_duration_seconds_bucket{le="+Inf"} 2
+request_duration_seconds_sum 3.0
+request_duration_seconds_count 2
+request_duration_seconds_created 12345.6
+`,
+		},
+		// 16: Native histogram with negative buckets and a non-zero schema.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("request_duration_microseconds"),
+				Help: proto.String("The response latency."),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
 					{
-						Name:  proto.String("name_2"),
-						Value: proto.String("佖佥"),
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("code"),
+								Value: proto.String("200"),
+							},
+						},
+						Histogram: &dto.Histogram{
+							SampleCount:   proto.Uint64(12),
+							SampleSum:     proto.Float64(-47.5),
+							Schema:        proto.Int32(3),
+							ZeroThreshold: proto.Float64(1e-4),
+							ZeroCount:     proto.Uint64(2),
+							NegativeSpan: []*dto.BucketSpan{
+								{Offset: proto.Int32(-2), Length: proto.Uint32(2)},
+							},
+							NegativeDelta: []int64{1, 2},
+							PositiveSpan: []*dto.BucketSpan{
+								{Offset: proto.Int32(0), Length: proto.Uint32(2)},
+								{Offset: proto.Int32(3), Length: proto.Uint32(1)},
+							},
+							PositiveDelta: []int64{2, 1, -2},
+						},
+						TimestampMs: proto.Int64(1234567),
 					},
+				},
+			},
+			out: `# HELP request_duration_microseconds The response latency.
+# TYPE request_duration_microseconds histogram
+request_duration_microseconds{code="200"} {count:12,sum:-47.5,schema:3,zero_threshold:0.0001,zero_count:2,negative_spans:[-2:2],negative_buckets:[1,3],positive_spans:[0:2,3:1],positive_buckets:[2,3,1]} 1234.567
+`,
+		},
+		// 17: Histogram with classic buckets and native spans, the latter preferred.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("request_duration_microseconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
 					{
-						Name:  proto.String("name_3"),
-						Value: proto.String("Just a quite long label value to test performance."),
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(3),
+							SampleSum:   proto.Float64(7),
+							Bucket: []*dto.Bucket{
+								{
+									UpperBound:      proto.Float64(5),
+									CumulativeCount: proto.Uint64(2),
+								},
+							},
+							Schema:        proto.Int32(0),
+							ZeroThreshold: proto.Float64(1e-3),
+							PositiveSpan: []*dto.BucketSpan{
+								{Offset: proto.Int32(1), Length: proto.Uint32(2)},
+							},
+							PositiveDelta: []int64{2, -1},
+						},
 					},
 				},
-				Histogram: &dto.Histogram{
-					SampleCount: proto.Uint64(5699),
-					SampleSum:   proto.Float64(49484343543.4343),
-					Bucket: []*dto.Bucket{
-						{
-							UpperBound:      proto.Float64(100),
-							CumulativeCount: proto.Uint64(120),
-						},
-						{
-							UpperBound:      proto.Float64(120),
-							CumulativeCount: proto.Uint64(412),
-						},
-						{
-							UpperBound:      proto.Float64(144),
-							CumulativeCount: proto.Uint64(596),
-						},
-						{
-							UpperBound:      proto.Float64(172.8),
-							CumulativeCount: proto.Uint64(1535),
+			},
+			out: `# TYPE request_duration_microseconds histogram
+request_duration_microseconds {count:3,sum:7.0,schema:0,zero_threshold:0.001,zero_count:0,positive_spans:[1:2],positive_buckets:[2,1]}
+`,
+		},
+		// 18: Histogram with classic buckets and a schema but no native buckets.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("request_duration_microseconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(3),
+							SampleSum:   proto.Float64(7),
+							Bucket: []*dto.Bucket{
+								{
+									UpperBound:      proto.Float64(5),
+									CumulativeCount: proto.Uint64(2),
+								},
+							},
+							Schema: proto.Int32(2),
 						},
 					},
 				},
-				TimestampMs: proto.Int64(1234567890),
 			},
+			out: `# TYPE request_duration_microseconds histogram
+request_duration_microseconds_bucket{le="5.0"} 2
+request_duration_microseconds_bucket{le="+Inf"} 3
+request_duration_microseconds_sum 7.0
+request_duration_microseconds_count 3
+`,
 		},
-	}
-	out := bytes.NewBuffer(make([]byte, 0, 1024))
-
-	for i := 0; i < b.N; i++ {
-		_, err := MetricFamilyToOpenMetrics(out, mf)
-		if err != nil {
-			b.Fatal(err)
-		}
-		out.Reset()
-	}
-}
-
-func TestOpenMetricsCreateError(t *testing.T) {
-	scenarios := []struct {
-		in  *dto.MetricFamily
-		err string
-	}{
-		// 0: No metric name.
+		// 19: Histogram with classic buckets and a zero bucket but no native spans.
 		{
 			in: &dto.MetricFamily{
-				Help: proto.String("doc string"),
-				Type: dto.MetricType_UNTYPED.Enum(),
+				Name: proto.String("request_duration_microseconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
 				Metric: []*dto.Metric{
 					{
-						Untyped: &dto.Untyped{
-							Value: proto.Float64(math.Inf(-1)),
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(3),
+							SampleSum:   proto.Float64(7),
+							Bucket: []*dto.Bucket{
+								{
+									UpperBound:      proto.Float64(5),
+									CumulativeCount: proto.Uint64(2),
+								},
+							},
+							Schema:        proto.Int32(0),
+							ZeroThreshold: proto.Float64(1e-3),
+							ZeroCount:     proto.Uint64(1),
 						},
 					},
 				},
 			},
-			err: "MetricFamily has no name",
+			out: `# TYPE request_duration_microseconds histogram
+request_duration_microseconds_bucket{le="5.0"} 2
+request_duration_microseconds_bucket{le="+Inf"} 3
+request_duration_microseconds_sum 7.0
+request_duration_microseconds_count 3
+`,
 		},
-		// 1: Wrong type.
+		// 20: Native float histogram.
 		{
 			in: &dto.MetricFamily{
-				Name: proto.String("name"),
-				Help: proto.String("doc string"),
-				Type: dto.MetricType_COUNTER.Enum(),
+				Name: proto.String("request_duration_microseconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
 				Metric: []*dto.Metric{
 					{
-						Untyped: &dto.Untyped{
-							Value: proto.Float64(math.Inf(-1)),
+						Histogram: &dto.Histogram{
+							SampleCountFloat: proto.Float64(4.5),
+							SampleSum:        proto.Float64(10),
+							Schema:           proto.Int32(-1),
+							ZeroThreshold:    proto.Float64(1e-3),
+							ZeroCountFloat:   proto.Float64(0.5),
+							PositiveSpan: []*dto.BucketSpan{
+								{Offset: proto.Int32(0), Length: proto.Uint32(2)},
+							},
+							PositiveCount: []float64{1.5, 2.5},
 						},
 					},
 				},
 			},
-			err: "expected counter in metric",
+			out: `# TYPE request_duration_microseconds histogram
+request_duration_microseconds {count:4.5,sum:10.0,schema:-1,zero_threshold:0.001,zero_count:0.5,positive_spans:[0:2],positive_buckets:[1.5,2.5]}
+`,
 		},
-	}
-
-	for i, scenario := range scenarios {
-		var out bytes.Buffer
-		_, err := MetricFamilyToOpenMetrics(&out, scenario.in)
-		if err == nil {
-			t.Errorf("%d. expected error, got nil", i)
-			continue
-		}
-		if expected, got := scenario.err, err.Error(); strings.Index(got, expected) != 0 {
-			t.Errorf(
-				"%d. expected error starting with %q, got %q",
-				i, expected, got,
-			)
+		// 21: Counters with exemplars, with and without timestamp.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos_total"),
+				Help: proto.String("Number of foos."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("code"),
+								Value: proto.String("200"),
+							},
+						},
+						Counter: &dto.Counter{
+							Value: proto.Float64(42),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{
+									{
+										Name:  proto.String("trace_id"),
+										Value: proto.String("KOO5S4vxi0o"),
+									},
+								},
+								Value:     proto.Float64(0.67),
+								Timestamp: openMetricsTimestamp,
+							},
+						},
+					},
+					{
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("code"),
+								Value: proto.String("500"),
+							},
+						},
+						Counter: &dto.Counter{
+							Value: proto.Float64(3),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{
+									{
+										Name:  proto.String("trace_id"),
+										Value: proto.String("oHg5SJYRHA0"),
+									},
+								},
+								Value: proto.Float64(1),
+							},
+						},
+					},
+				},
+			},
+			out: `# HELP foos Number of foos.
+# TYPE foos counter
+foos_total{code="200"} 42.0 # {trace_id="KOO5S4vxi0o"} 0.67 12345.6
+foos_total{code="500"} 3.0 # {trace_id="oHg5SJYRHA0"} 1.0
+`,
+		},
+		// 22: Counter with unit.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("cpu_seconds_total"),
+				Help: proto.String("CPU time spent."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(4.2),
+						},
+					},
+				},
+			},
+			options: []EncoderOption{WithUnit("cpu_seconds_total", "seconds"), WithUnit("other", "bytes")},
+			out: `# HELP cpu_seconds CPU time spent.
+# UNIT cpu_seconds seconds
+# TYPE cpu_seconds counter
+cpu_seconds_total 4.2
+`,
+		},
+		// 23: Counter with _total suffix, suffix handling (the default).
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("http_requests_total"),
+				Help: proto.String("Requests served."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value:            proto.Float64(42),
+							CreatedTimestamp: &timestamppb.Timestamp{Seconds: 12345},
+						},
+					},
+				},
+			},
+			options: []EncoderOption{WithSuffixHandling(true)},
+			out: `# HELP http_requests Requests served.
+# TYPE http_requests counter
+http_requests_total 42.0
+http_requests_created 12345.0
+`,
+		},
+		// 24: Counter with _total suffix, verbatim.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("http_requests_total"),
+				Help: proto.String("Requests served."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value:            proto.Float64(42),
+							CreatedTimestamp: &timestamppb.Timestamp{Seconds: 12345},
+						},
+					},
+				},
+			},
+			options: []EncoderOption{WithSuffixHandling(false)},
+			out: `# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total 42.0
+`,
+		},
+		// 25: Counter without _total suffix, verbatim.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("http_requests"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(42),
+						},
+					},
+				},
+			},
+			options: []EncoderOption{WithSuffixHandling(false)},
+			out: `# TYPE http_requests counter
+http_requests 42.0
+`,
+		},
+		// 26: Labeled summary with created timestamp.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("rpc_duration_seconds"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("service"),
+								Value: proto.String("api"),
+							},
+						},
+						Summary: &dto.Summary{
+							SampleCount: proto.Uint64(4),
+							SampleSum:   proto.Float64(6),
+							Quantile: []*dto.Quantile{
+								{
+									Quantile: proto.Float64(0.5),
+									Value:    proto.Float64(1),
+								},
+								{
+									Quantile: proto.Float64(0.99),
+									Value:    proto.Float64(3),
+								},
+							},
+							CreatedTimestamp: openMetricsTimestamp,
+						},
+					},
+				},
+			},
+			out: `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{service="api",quantile="0.5"} 1.0
+rpc_duration_seconds{service="api",quantile="0.99"} 3.0
+rpc_duration_seconds_sum{service="api"} 6.0
+rpc_duration_seconds_count{service="api"} 4
+rpc_duration_seconds_created{service="api"} 12345.6
+`,
+		},
+		// 27: Summary with unsorted labels, sorted.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("rpc_duration_seconds"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("service"),
+								Value: proto.String("api"),
+							},
+							{
+								Name:  proto.String("code"),
+								Value: proto.String("200"),
+							},
+						},
+						Summary: &dto.Summary{
+							SampleCount: proto.Uint64(4),
+							SampleSum:   proto.Float64(6),
+							Quantile: []*dto.Quantile{
+								{
+									Quantile: proto.Float64(0.5),
+									Value:    proto.Float64(1),
+								},
+							},
+						},
+					},
+				},
+			},
+			options: []EncoderOption{WithSortedLabels(true)},
+			out: `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{code="200",quantile="0.5",service="api"} 1.0
+rpc_duration_seconds_sum{code="200",service="api"} 6.0
+rpc_duration_seconds_count{code="200",service="api"} 4
+`,
+		},
+		// 28: Histogram with unsorted labels, sorted.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("request_duration_seconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("zone"),
+								Value: proto.String("eu"),
+							},
+							{
+								Name:  proto.String("method"),
+								Value: proto.String("GET"),
+							},
+						},
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(2),
+							SampleSum:   proto.Float64(1.5),
+							Bucket: []*dto.Bucket{
+								{
+									UpperBound:      proto.Float64(1),
+									CumulativeCount: proto.Uint64(1),
+								},
+							},
+						},
+					},
+				},
+			},
+			options: []EncoderOption{WithSortedLabels(true)},
+			out: `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="1.0",method="GET",zone="eu"} 1
+request_duration_seconds_bucket{le="+Inf",method="GET",zone="eu"} 2
+request_duration_seconds_sum{method="GET",zone="eu"} 1.5
+request_duration_seconds_count{method="GET",zone="eu"} 2
+`,
+		},
+		// 29: Gauge with NaN value.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("temperature"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Gauge: &dto.Gauge{
+							Value: proto.Float64(math.NaN()),
+						},
+					},
+				},
+			},
+			out: `# TYPE temperature gauge
+temperature NaN
+`,
+		},
+		// 30: Summary with NaN sum and quantile values.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("rpc_latency"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Summary: &dto.Summary{
+							SampleCount: proto.Uint64(0),
+							SampleSum:   proto.Float64(math.NaN()),
+							Quantile: []*dto.Quantile{
+								{
+									Quantile: proto.Float64(0.5),
+									Value:    proto.Float64(math.NaN()),
+								},
+								{
+									Quantile: proto.Float64(0.99),
+									Value:    proto.Float64(math.Inf(+1)),
+								},
+							},
+						},
+					},
+				},
+			},
+			out: `# TYPE rpc_latency summary
+rpc_latency{quantile="0.5"} NaN
+rpc_latency{quantile="0.99"} +Inf
+rpc_latency_sum NaN
+rpc_latency_count 0
+`,
+		},
+		// 31: Counter with NaN exemplar value.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos_total"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(1),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{
+									{
+										Name:  proto.String("trace_id"),
+										Value: proto.String("KOO5S4vxi0o"),
+									},
+								},
+								Value: proto.Float64(math.NaN()),
+							},
+						},
+					},
+				},
+			},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} NaN
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, scenario.in, scenario.options...)
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf(
+				"%d. expected %d bytes written, got %d",
+				i, expected, got,
+			)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf(
+				"%d. expected out=%q, got %q",
+				i, expected, got,
+			)
+		}
+	}
+}
+
+// benchmarkOpenMetricsFamily returns the metric family the OpenMetrics
+// benchmarks encode.
+func benchmarkOpenMetricsFamily() *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String("request_duration_microseconds"),
+		Help: proto.String("The response latency."),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("name_1"),
+						Value: proto.String("val with\nnew line"),
+					},
+					{
+						Name:  proto.String("name_2"),
+						Value: proto.String("val with \\backslash and \"quotes\""),
+					},
+					{
+						Name:  proto.String("name_3"),
+						Value: proto.String("Just a quite long label value to test performance."),
+					},
+				},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(2693),
+					SampleSum:   proto.Float64(1756047.3),
+					Bucket: []*dto.Bucket{
+						{
+							UpperBound:      proto.Float64(100),
+							CumulativeCount: proto.Uint64(123),
+						},
+						{
+							UpperBound:      proto.Float64(120),
+							CumulativeCount: proto.Uint64(412),
+						},
+						{
+							UpperBound:      proto.Float64(144),
+							CumulativeCount: proto.Uint64(592),
+						},
+						{
+							UpperBound:      proto.Float64(172.8),
+							CumulativeCount: proto.Uint64(1524),
+						},
+						{
+							UpperBound:      proto.Float64(math.Inf(+1)),
+							CumulativeCount: proto.Uint64(2693),
+						},
+					},
+				},
+			},
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("name_1"),
+						Value: proto.String("Björn"),
+					},
+					{
+						Name:  proto.String("name_2"),
+						Value: proto.String("佖佥"),
+					},
+					{
+						Name:  proto.String("name_3"),
+						Value: proto.String("Just a quite long label value to test performance."),
+					},
+				},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(5699),
+					SampleSum:   proto.Float64(49484343543.4343),
+					Bucket: []*dto.Bucket{
+						{
+							UpperBound:      proto.Float64(100),
+							CumulativeCount: proto.Uint64(120),
+						},
+						{
+							UpperBound:      proto.Float64(120),
+							CumulativeCount: proto.Uint64(412),
+						},
+						{
+							UpperBound:      proto.Float64(144),
+							CumulativeCount: proto.Uint64(596),
+						},
+						{
+							UpperBound:      proto.Float64(172.8),
+							CumulativeCount: proto.Uint64(1535),
+						},
+					},
+				},
+				TimestampMs: proto.Int64(1234567890),
+			},
+		},
+	}
+}
+
+func TestCreateOpenMetricsStrictValidation(t *testing.T) {
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	}
+	// sample returns a counter metric with the given timestamp, none if
+	// negative.
+	sample := func(ts int64, labels ...*dto.LabelPair) *dto.Metric {
+		m := &dto.Metric{Label: labels, Counter: &dto.Counter{Value: proto.Float64(1)}}
+		if ts >= 0 {
+			m.TimestampMs = proto.Int64(ts)
+		}
+		return m
+	}
+	counter := func(metrics ...*dto.Metric) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name:   proto.String("foos_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: metrics,
+		}
+	}
+	histogram := func(bounds ...float64) *dto.MetricFamily {
+		buckets := make([]*dto.Bucket, len(bounds))
+		for i, b := range bounds {
+			buckets[i] = &dto.Bucket{UpperBound: proto.Float64(b), CumulativeCount: proto.Uint64(uint64(i))}
+		}
+		return &dto.MetricFamily{
+			Name: proto.String("request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:     []*dto.LabelPair{label("code", "200")},
+					Histogram: &dto.Histogram{SampleCount: proto.Uint64(3), SampleSum: proto.Float64(1), Bucket: buckets},
+				},
+			},
+		}
+	}
+	summary := func(quantile float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("rpc_duration_seconds"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Summary: &dto.Summary{
+						SampleCount: proto.Uint64(1),
+						SampleSum:   proto.Float64(1),
+						Quantile:    []*dto.Quantile{{Quantile: proto.Float64(quantile), Value: proto.Float64(1)}},
+					},
+				},
+			},
+		}
+	}
+	gauge := func(labels ...*dto.LabelPair) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name:   proto.String("temperature"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(21.5)}}},
+		}
+	}
+
+	scenarios := []struct {
+		in  *dto.MetricFamily
+		err string // Empty if valid.
+	}{
+		// 0: Valid histogram.
+		{
+			in: histogram(1, 2, math.Inf(+1)),
+		},
+		// 1: Unsorted buckets.
+		{
+			in:  histogram(2, 1, math.Inf(+1)),
+			err: "strict validation failed for metric request_duration_seconds",
+		},
+		// 2: Unsorted buckets, the violation.
+		{
+			in:  histogram(2, 1, math.Inf(+1)),
+			err: "bucket upper bound 1 not sorted after 2",
+		},
+		// 3: Duplicate bucket bounds.
+		{
+			in:  histogram(1, 1, math.Inf(+1)),
+			err: "bucket upper bound 1 not sorted after 1",
+		},
+		// 4: Missing +Inf bucket.
+		{
+			in:  histogram(1, 2),
+			err: "missing +Inf bucket",
+		},
+		// 5: Valid summary.
+		{
+			in: summary(0.99),
+		},
+		// 6: Quantile out of range.
+		{
+			in:  summary(1.5),
+			err: "strict validation failed for metric rpc_duration_seconds",
+		},
+		// 7: Quantile out of range, the violation.
+		{
+			in:  summary(-0.5),
+			err: "quantile -0.5 outside of [0,1]",
+		},
+		// 8: NaN quantile.
+		{
+			in:  summary(math.NaN()),
+			err: "quantile NaN outside of [0,1]",
+		},
+		// 9: Valid labels.
+		{
+			in: gauge(label("building", "a"), label("room", "1")),
+		},
+		// 10: Duplicate label names.
+		{
+			in:  gauge(label("room", "1"), label("room", "2")),
+			err: `duplicate label name "room"`,
+		},
+		// 11: Unsorted labels.
+		{
+			in:  gauge(label("room", "1"), label("building", "a")),
+			err: `strict validation failed for metric temperature`,
+		},
+		// 12: Unsorted labels, the violation.
+		{
+			in:  gauge(label("room", "1"), label("building", "a")),
+			err: `label "building" not sorted after label "room"`,
+		},
+		// 13: Series with increasing timestamps.
+		{
+			in: counter(
+				sample(1000, label("code", "200")),
+				sample(1000, label("code", "500")),
+				sample(2000, label("code", "200")),
+			),
+		},
+		// 14: Series with decreasing timestamps.
+		{
+			in: counter(
+				sample(2000, label("code", "200")),
+				sample(1000, label("code", "500")),
+				sample(1000, label("code", "200")),
+			),
+			err: `strict validation failed for metric family foos_total`,
+		},
+		// 15: Series with decreasing timestamps, the violation.
+		{
+			in: counter(
+				sample(2000, label("code", "200"), label("method", "get")),
+				sample(1000, label("method", "get"), label("code", "200")),
+			),
+			err: `timestamp 1000 of series {code="200",method="get"} not after timestamp 2000`,
+		},
+		// 16: Series with duplicate timestamps.
+		{
+			in:  counter(sample(1000), sample(1000)),
+			err: `timestamp 1000 of series {} not after timestamp 1000`,
+		},
+		// 17: Duplicate series without timestamps.
+		{
+			in:  counter(sample(-1, label("code", "200")), sample(1000, label("code", "200"))),
+			err: `duplicate series {code="200"} without timestamp`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		lenient := bytes.NewBuffer(make([]byte, 0, 256))
+		if _, err := MetricFamilyToOpenMetrics(lenient, scenario.in); err != nil {
+			t.Errorf("%d. unexpected error in lenient mode: %s", i, err)
+		}
+		out := bytes.NewBuffer(make([]byte, 0, 256))
+		_, err := MetricFamilyToOpenMetrics(out, scenario.in, WithStrictValidation())
+		if scenario.err == "" {
+			if err != nil {
+				t.Errorf("%d. unexpected error: %s", i, err)
+			}
+			if out.String() != lenient.String() {
+				t.Errorf("%d. expected strict output %q to equal lenient output %q", i, out.String(), lenient.String())
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%d. expected error containing %q, got output %q", i, scenario.err, out.String())
+			continue
+		}
+		if !strings.Contains(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error containing %q, got %q", i, scenario.err, err)
+		}
+		if strings.Contains(out.String(), `le="+Inf"`) {
+			t.Errorf("%d. expected no backfilled +Inf bucket, got output %q", i, out.String())
+		}
+	}
+}
+
+func TestCreateOpenMetricsSortedLabels(t *testing.T) {
+	family := func(names ...string) *dto.MetricFamily {
+		labels := make([]*dto.LabelPair, len(names))
+		for i, name := range names {
+			labels[i] = &dto.LabelPair{Name: proto.String(name), Value: proto.String("v" + name)}
+		}
+		return &dto.MetricFamily{
+			Name:   proto.String("temperature"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(21.5)}}},
+		}
+	}
+	const want = `# TYPE temperature gauge
+temperature{a="va",b="vb",c="vc"} 21.5
+`
+
+	for i, in := range []*dto.MetricFamily{
+		family("a", "b", "c"),
+		family("c", "b", "a"),
+		family("b", "c", "a"),
+	} {
+		orig := proto.Clone(in)
+		out := bytes.NewBuffer(make([]byte, 0, len(want)))
+		if _, err := MetricFamilyToOpenMetrics(out, in, WithSortedLabels(true)); err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		if got := out.String(); got != want {
+			t.Errorf("%d. expected out=%q, got %q", i, want, got)
+		}
+		if !proto.Equal(in, orig) {
+			t.Errorf("%d. expected input to be unmodified, got %v", i, in)
+		}
+	}
+
+	// Disabled, the labels are written in the given order.
+	out := bytes.NewBuffer(nil)
+	if _, err := MetricFamilyToOpenMetrics(out, family("c", "a"), WithSortedLabels(false)); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "# TYPE temperature gauge\ntemperature{c=\"vc\",a=\"va\"} 21.5\n", out.String(); got != want {
+		t.Errorf("expected out=%q, got %q", want, got)
+	}
+
+	// Strict validation checks the order of the labels as written, so unsorted
+	// labels only fail it if they are not sorted by the encoder.
+	out.Reset()
+	if _, err := MetricFamilyToOpenMetrics(out, family("c", "b", "a"), WithStrictValidation(), WithSortedLabels(true)); err != nil {
+		t.Errorf("unexpected error with sorted labels: %s", err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("expected out=%q, got %q", want, got)
+	}
+	if _, err := MetricFamilyToOpenMetrics(new(bytes.Buffer), family("c", "b", "a"), WithStrictValidation()); err == nil {
+		t.Error("expected error with unsorted labels")
+	}
+	if _, err := MetricFamilyToOpenMetrics(new(bytes.Buffer), family("b", "a", "b"), WithStrictValidation(), WithSortedLabels(true)); err == nil || !strings.Contains(err.Error(), `duplicate label name "b"`) {
+		t.Errorf("expected error for duplicate label name, got %v", err)
+	}
+}
+
+// largeHistogramFamily returns a histogram family with n buckets, without a
+// +Inf bucket, given in descending order of their upper bounds, so that they
+// have to be sorted.
+func largeHistogramFamily(n int) *dto.MetricFamily {
+	buckets := make([]*dto.Bucket, n)
+	for i := range buckets {
+		buckets[n-1-i] = &dto.Bucket{
+			UpperBound:      proto.Float64(float64(i + 1)),
+			CumulativeCount: proto.Uint64(uint64(i + 1)),
+		}
+	}
+	return &dto.MetricFamily{
+		Name: proto.String("large_histogram"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(uint64(n)),
+					SampleSum:   proto.Float64(float64(n)),
+					Bucket:      buckets,
+				},
+			},
+		},
+	}
+}
+
+func TestCreateOpenMetricsLargeHistogram(t *testing.T) {
+	const n = 50000
+	mf := largeHistogramFamily(n)
+	// Also with a +Inf bucket given in the middle.
+	withInf := largeHistogramFamily(n)
+	h := withInf.Metric[0].Histogram
+	h.Bucket = append(h.Bucket[:n/2], append([]*dto.Bucket{{
+		UpperBound:      proto.Float64(math.Inf(+1)),
+		CumulativeCount: proto.Uint64(n),
+	}}, h.Bucket[n/2:]...)...)
+
+	for i, in := range []*dto.MetricFamily{mf, withInf} {
+		out := bytes.NewBuffer(make([]byte, 0, 64*n))
+		if _, err := MetricFamilyToOpenMetrics(out, in); err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		var (
+			buckets []string
+			infSeen int
+		)
+		for _, line := range strings.Split(out.String(), "\n") {
+			if !strings.HasPrefix(line, "large_histogram_bucket{") {
+				continue
+			}
+			buckets = append(buckets, line)
+			if strings.Contains(line, `le="+Inf"`) {
+				infSeen++
+			}
+		}
+		if got, want := len(buckets), n+1; got != want {
+			t.Errorf("%d. expected %d bucket lines, got %d", i, want, got)
+		}
+		if infSeen != 1 {
+			t.Errorf("%d. expected +Inf bucket exactly once, got %d times", i, infSeen)
+		}
+		if last := buckets[len(buckets)-1]; last != fmt.Sprintf(`large_histogram_bucket{le="+Inf"} %d`, n) {
+			t.Errorf("%d. expected +Inf bucket last, got %q", i, last)
+		}
+		if first := buckets[0]; first != `large_histogram_bucket{le="1.0"} 1` {
+			t.Errorf("%d. expected smallest bucket first, got %q", i, first)
+		}
+	}
+}
+
+func BenchmarkOpenMetricsCreateLargeHistogram(b *testing.B) {
+	// The time per bucket should stay about the same as the number of
+	// buckets grows.
+	for _, n := range []int{500, 5000, 50000} {
+		mf := largeHistogramFamily(n)
+		out := bytes.NewBuffer(make([]byte, 0, 64*n))
+		b.Run(fmt.Sprintf("buckets=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := MetricFamilyToOpenMetrics(out, mf); err != nil {
+					b.Fatal(err)
+				}
+				out.Reset()
+			}
+		})
+	}
+}
+
+func BenchmarkOpenMetricsCreate(b *testing.B) {
+	mf := benchmarkOpenMetricsFamily()
+	out := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for i := 0; i < b.N; i++ {
+		_, err := MetricFamilyToOpenMetrics(out, mf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		out.Reset()
+	}
+}
+
+func TestOpenMetricsCreateError(t *testing.T) {
+	scenarios := []struct {
+		in      *dto.MetricFamily
+		options []EncoderOption
+		err     string
+	}{
+		// 0: No metric name.
+		{
+			in: &dto.MetricFamily{
+				Help: proto.String("doc string"),
+				Type: dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Untyped: &dto.Untyped{
+							Value: proto.Float64(math.Inf(-1)),
+						},
+					},
+				},
+			},
+			err: "MetricFamily has no name",
+		},
+		// 1: Wrong type.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("name"),
+				Help: proto.String("doc string"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Untyped: &dto.Untyped{
+							Value: proto.Float64(math.Inf(-1)),
+						},
+					},
+				},
+			},
+			err: "expected counter in metric",
+		},
+		// 2: Invalid created timestamp.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos_total"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value:            proto.Float64(42),
+							CreatedTimestamp: &timestamppb.Timestamp{Seconds: 1, Nanos: -1},
+						},
+					},
+				},
+			},
+			err: "expected valid created timestamp in metric",
+		},
+		// 3: Exemplar labels too long.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos_total"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(42),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{
+									{
+										Name:  proto.String("trace_id"),
+										Value: proto.String(strings.Repeat("ü", 121)),
+									},
+								},
+								Value: proto.Float64(1),
+							},
+						},
+					},
+				},
+			},
+			err: "expected valid exemplar in metric",
+		},
+		// 4: Unit not a suffix of the name.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("cpu_seconds_total"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(4.2),
+						},
+					},
+				},
+			},
+			options: []EncoderOption{WithUnit("cpu_seconds_total", "bytes")},
+			err:     `metric family "cpu_seconds_total" lacks the suffix of its unit "bytes"`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var out bytes.Buffer
+		_, err := MetricFamilyToOpenMetrics(&out, scenario.in, scenario.options...)
+		if err == nil {
+			t.Errorf("%d. expected error, got nil", i)
+			continue
+		}
+		if expected, got := scenario.err, err.Error(); strings.Index(got, expected) != 0 {
+			t.Errorf(
+				"%d. expected error starting with %q, got %q",
+				i, expected, got,
+			)
+		}
+	}
+}
+
+func TestCreateOpenMetricsGaugeHistogram(t *testing.T) {
+	scrape := func(counts []float64, sum float64) *dto.MetricFamily {
+		bounds := []float64{0, 10, math.Inf(+1)}
+		h := &dto.Histogram{
+			SampleCountFloat: proto.Float64(counts[len(counts)-1]),
+			SampleSum:        proto.Float64(sum),
+		}
+		for i, c := range counts {
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				UpperBound:           proto.Float64(bounds[i]),
+				CumulativeCountFloat: proto.Float64(c),
+			})
+		}
+		return &dto.MetricFamily{
+			Name:   proto.String("queue_items"),
+			Help:   proto.String("Items in the queue by age."),
+			Type:   dto.MetricType_GAUGE_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: h}},
+		}
+	}
+
+	scenarios := []struct {
+		in  *dto.MetricFamily
+		out string
+	}{
+		// 0: First scrape.
+		{
+			in: scrape([]float64{2, 5, 7}, 42),
+			out: `# HELP queue_items Items in the queue by age.
+# TYPE queue_items gaugehistogram
+queue_items_bucket{le="0.0"} 2.0
+queue_items_bucket{le="10.0"} 5.0
+queue_items_bucket{le="+Inf"} 7.0
+queue_items_gcount 7.0
+queue_items_gsum 42.0
+`,
+		},
+		// 1: Second scrape, counts decreased, partly below zero.
+		{
+			in: scrape([]float64{-1, 1, 3}, -4.5),
+			out: `# HELP queue_items Items in the queue by age.
+# TYPE queue_items gaugehistogram
+queue_items_bucket{le="0.0"} -1.0
+queue_items_bucket{le="10.0"} 1.0
+queue_items_bucket{le="+Inf"} 3.0
+queue_items_gcount 3.0
+queue_items_gsum -4.5
+`,
+		},
+		// 2: Integer counts, no +Inf bucket.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("queue_items"),
+				Type: dto.MetricType_GAUGE_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(3),
+							SampleSum:   proto.Float64(12),
+							Bucket: []*dto.Bucket{
+								{UpperBound: proto.Float64(10), CumulativeCount: proto.Uint64(1)},
+							},
+						},
+					},
+				},
+			},
+			out: `# TYPE queue_items gaugehistogram
+queue_items_bucket{le="10.0"} 1
+queue_items_bucket{le="+Inf"} 3
+queue_items_gcount 3
+queue_items_gsum 12.0
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, scenario.in)
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestCreateOpenMetricsGaugeHistogramFamilies(t *testing.T) {
+	// A histogram family of in-flight requests by age, whose bucket counts
+	// decrease.
+	family := func() *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("inflight_requests_age_seconds"),
+			Help: proto.String("In-flight requests by age."),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(2),
+						SampleSum:   proto.Float64(7.5),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(3)},
+							{UpperBound: proto.Float64(10), CumulativeCount: proto.Uint64(1)},
+							{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(2)},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	scenarios := []struct {
+		options []EncoderOption
+		out     string
+		err     string
+	}{
+		// 0: Histogram.
+		{
+			out: `# HELP inflight_requests_age_seconds In-flight requests by age.
+# TYPE inflight_requests_age_seconds histogram
+inflight_requests_age_seconds_bucket{le="1.0"} 3
+inflight_requests_age_seconds_bucket{le="10.0"} 1
+inflight_requests_age_seconds_bucket{le="+Inf"} 2
+inflight_requests_age_seconds_sum 7.5
+inflight_requests_age_seconds_count 2
+`,
+		},
+		// 1: Histogram, strict.
+		{
+			options: []EncoderOption{WithStrictValidation()},
+			err:     "cumulative count 1 of bucket 10 less than 3 of bucket 1",
+		},
+		// 2: Gauge histogram.
+		{
+			options: []EncoderOption{WithGaugeHistogramFamilies("inflight_requests_age_seconds")},
+			out: `# HELP inflight_requests_age_seconds In-flight requests by age.
+# TYPE inflight_requests_age_seconds gaugehistogram
+inflight_requests_age_seconds_bucket{le="1.0"} 3
+inflight_requests_age_seconds_bucket{le="10.0"} 1
+inflight_requests_age_seconds_bucket{le="+Inf"} 2
+inflight_requests_age_seconds_gcount 2
+inflight_requests_age_seconds_gsum 7.5
+`,
+		},
+		// 3: Gauge histogram, strict.
+		{
+			options: []EncoderOption{
+				WithGaugeHistogramFamilies("inflight_requests_age_seconds"),
+				WithStrictValidation(),
+			},
+			out: `# HELP inflight_requests_age_seconds In-flight requests by age.
+# TYPE inflight_requests_age_seconds gaugehistogram
+inflight_requests_age_seconds_bucket{le="1.0"} 3
+inflight_requests_age_seconds_bucket{le="10.0"} 1
+inflight_requests_age_seconds_bucket{le="+Inf"} 2
+inflight_requests_age_seconds_gcount 2
+inflight_requests_age_seconds_gsum 7.5
+`,
+		},
+		// 4: Other family.
+		{
+			options: []EncoderOption{WithGaugeHistogramFamilies("queue_items")},
+			out: `# HELP inflight_requests_age_seconds In-flight requests by age.
+# TYPE inflight_requests_age_seconds histogram
+inflight_requests_age_seconds_bucket{le="1.0"} 3
+inflight_requests_age_seconds_bucket{le="10.0"} 1
+inflight_requests_age_seconds_bucket{le="+Inf"} 2
+inflight_requests_age_seconds_sum 7.5
+inflight_requests_age_seconds_count 2
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		in := family()
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, in, scenario.options...)
+		if scenario.err != "" {
+			if err == nil || !strings.Contains(err.Error(), scenario.err) {
+				t.Errorf("%d. expected error containing %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+		if !proto.Equal(in, family()) {
+			t.Errorf("%d. metric family modified: %v", i, in)
+		}
+	}
+}
+
+func TestCreateOpenMetricsInfo(t *testing.T) {
+	scenarios := []struct {
+		in  *dto.MetricFamily
+		out string
+		err string
+	}{
+		// 0: Gauge with labels.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("target_info"),
+				Help: proto.String("Target metadata."),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("env"), Value: proto.String("prod")},
+							{Name: proto.String("version"), Value: proto.String("1.2.3")},
+						},
+						Gauge: &dto.Gauge{Value: proto.Float64(1)},
+					},
+				},
+			},
+			out: `# HELP target Target metadata.
+# TYPE target info
+target_info{env="prod",version="1.2.3"} 1
+`,
+		},
+		// 1: Untyped, several metrics.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("build_info"),
+				Type: dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label:   []*dto.LabelPair{{Name: proto.String("branch"), Value: proto.String("main")}},
+						Untyped: &dto.Untyped{Value: proto.Float64(1)},
+					},
+					{
+						Label:   []*dto.LabelPair{{Name: proto.String("branch"), Value: proto.String("dev")}},
+						Untyped: &dto.Untyped{Value: proto.Float64(1)},
+					},
+				},
+			},
+			out: `# TYPE build info
+build_info{branch="main"} 1
+build_info{branch="dev"} 1
+`,
+		},
+		// 2: Value other than 1.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("target_info"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{{Name: proto.String("env"), Value: proto.String("prod")}},
+						Gauge: &dto.Gauge{Value: proto.Float64(2)},
+					},
+				},
+			},
+			err: "expected value 1 in info metric target_info",
+		},
+		// 3: Counter.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("build_info"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{Counter: &dto.Counter{Value: proto.Float64(1)}},
+				},
+			},
+			err: `info metric family "build_info" must be a gauge or untyped, not counter`,
+		},
+		// 4: Missing _info suffix.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("target"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+				},
+			},
+			err: `info metric family "target" lacks the _info suffix`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, scenario.in, WithInfoFamilies("target_info", "target"), WithInfoFamilies("build_info"))
+		if scenario.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), scenario.err) {
+				t.Errorf("%d. expected error starting with %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestCreateOpenMetricsStateSet(t *testing.T) {
+	state := func(name string, value float64) *dto.Metric {
+		return &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("feature"), Value: proto.String(name)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(value)},
+		}
+	}
+
+	scenarios := []struct {
+		in  *dto.MetricFamily
+		out string
+		err string
+	}{
+		// 0: All states unset.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("feature"),
+				Help: proto.String("Feature flags."),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					state("dark_mode", 0),
+					state("beta_search", 0),
+				},
+			},
+			out: `# HELP feature Feature flags.
+# TYPE feature stateset
+feature{feature="dark_mode"} 0
+feature{feature="beta_search"} 0
+`,
+		},
+		// 1: Mixed states, untyped, with another label.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("feature"),
+				Type: dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("env"), Value: proto.String("prod")},
+							{Name: proto.String("feature"), Value: proto.String("dark_mode")},
+						},
+						Untyped: &dto.Untyped{Value: proto.Float64(1)},
+					},
+					{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("env"), Value: proto.String("prod")},
+							{Name: proto.String("feature"), Value: proto.String("beta_search")},
+						},
+						Untyped: &dto.Untyped{Value: proto.Float64(0)},
+					},
+				},
+			},
+			out: `# TYPE feature stateset
+feature{env="prod",feature="dark_mode"} 1
+feature{env="prod",feature="beta_search"} 0
+`,
+		},
+		// 2: Value other than 0 or 1.
+		{
+			in: &dto.MetricFamily{
+				Name:   proto.String("feature"),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{state("dark_mode", 0.5)},
+			},
+			err: "expected value 0 or 1 in stateset metric feature",
+		},
+		// 3: Missing state label.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("feature"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{{Name: proto.String("state"), Value: proto.String("dark_mode")}},
+						Gauge: &dto.Gauge{Value: proto.Float64(1)},
+					},
+				},
+			},
+			err: `expected label "feature" in stateset metric feature`,
+		},
+		// 4: Summary.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("feature"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{
+					{Summary: &dto.Summary{}},
+				},
+			},
+			err: `stateset metric family "feature" must be a gauge or untyped, not summary`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, scenario.in, WithStateSetFamilies("feature"))
+		if scenario.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), scenario.err) {
+				t.Errorf("%d. expected error starting with %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestCreateOpenMetricsMaxExemplars(t *testing.T) {
+	exemplar := func(value float64, sec int64) *dto.Exemplar {
+		return &dto.Exemplar{
+			Label:     []*dto.LabelPair{{Name: proto.String("id"), Value: proto.String(strconv.FormatInt(sec, 10))}},
+			Value:     proto.Float64(value),
+			Timestamp: &timestamppb.Timestamp{Seconds: sec},
+		}
+	}
+	in := &dto.MetricFamily{
+		Name: proto.String("request_duration_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(4),
+					SampleSum:   proto.Float64(5.8),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(1), Exemplar: exemplar(0.05, 40)},
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2), Exemplar: exemplar(0.5, 10)},
+						{UpperBound: proto.Float64(2), CumulativeCount: proto.Uint64(3), Exemplar: exemplar(1.5, 30)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(4), Exemplar: exemplar(3.75, 20)},
+					},
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		options []EncoderOption
+		out     string
+	}{
+		// 0: No limit.
+		{
+			out: `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 1 # {id="40"} 0.05 40.0
+request_duration_seconds_bucket{le="1.0"} 2 # {id="10"} 0.5 10.0
+request_duration_seconds_bucket{le="2.0"} 3 # {id="30"} 1.5 30.0
+request_duration_seconds_bucket{le="+Inf"} 4 # {id="20"} 3.75 20.0
+request_duration_seconds_sum 5.8
+request_duration_seconds_count 4
+`,
+		},
+		// 1: Highest values.
+		{
+			options: []EncoderOption{WithMaxExemplars(2, ExemplarsHighestValue)},
+			out: `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 1
+request_duration_seconds_bucket{le="1.0"} 2
+request_duration_seconds_bucket{le="2.0"} 3 # {id="30"} 1.5 30.0
+request_duration_seconds_bucket{le="+Inf"} 4 # {id="20"} 3.75 20.0
+request_duration_seconds_sum 5.8
+request_duration_seconds_count 4
+`,
+		},
+		// 2: Most recent.
+		{
+			options: []EncoderOption{WithMaxExemplars(2, ExemplarsMostRecent)},
+			out: `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 1 # {id="40"} 0.05 40.0
+request_duration_seconds_bucket{le="1.0"} 2
+request_duration_seconds_bucket{le="2.0"} 3 # {id="30"} 1.5 30.0
+request_duration_seconds_bucket{le="+Inf"} 4
+request_duration_seconds_sum 5.8
+request_duration_seconds_count 4
+`,
+		},
+		// 3: Limit above the number of exemplars.
+		{
+			options: []EncoderOption{WithMaxExemplars(5, ExemplarsMostRecent)},
+			out: `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 1 # {id="40"} 0.05 40.0
+request_duration_seconds_bucket{le="1.0"} 2 # {id="10"} 0.5 10.0
+request_duration_seconds_bucket{le="2.0"} 3 # {id="30"} 1.5 30.0
+request_duration_seconds_bucket{le="+Inf"} 4 # {id="20"} 3.75 20.0
+request_duration_seconds_sum 5.8
+request_duration_seconds_count 4
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, in, scenario.options...)
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestCreateOpenMetricsExemplarTimestamps(t *testing.T) {
+	counter := func(ts *timestamppb.Timestamp) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("foos_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Counter: &dto.Counter{
+						Value: proto.Float64(1),
+						Exemplar: &dto.Exemplar{
+							Label: []*dto.LabelPair{
+								{
+									Name:  proto.String("trace_id"),
+									Value: proto.String("KOO5S4vxi0o"),
+								},
+							},
+							Value:     proto.Float64(0.5),
+							Timestamp: ts,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	scenarios := []struct {
+		in      *dto.MetricFamily
+		options []EncoderOption
+		out     string
+	}{
+		// 0: Nil timestamp.
+		{
+			in: counter(nil),
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5
+`,
+		},
+		// 1: Epoch timestamp.
+		{
+			in: counter(&timestamppb.Timestamp{}),
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 0.0
+`,
+		},
+		// 2: Real timestamp.
+		{
+			in: counter(timestamppb.New(time.Unix(12345, 600000000))),
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 12345.6
+`,
+		},
+		// 3: Nil timestamp, zero timestamps omitted.
+		{
+			in:      counter(nil),
+			options: []EncoderOption{WithZeroExemplarTimestampsOmitted()},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5
+`,
+		},
+		// 4: Epoch timestamp, zero timestamps omitted.
+		{
+			in:      counter(&timestamppb.Timestamp{}),
+			options: []EncoderOption{WithZeroExemplarTimestampsOmitted()},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5
+`,
+		},
+		// 5: Real timestamp, zero timestamps omitted.
+		{
+			in:      counter(timestamppb.New(time.Unix(12345, 600000000))),
+			options: []EncoderOption{WithZeroExemplarTimestampsOmitted()},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 12345.6
+`,
+		},
+		// 6: Timestamp just after the epoch, zero timestamps omitted.
+		{
+			in:      counter(&timestamppb.Timestamp{Nanos: 500000000}),
+			options: []EncoderOption{WithZeroExemplarTimestampsOmitted()},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 0.5
+`,
+		},
+		// 7: Timestamp with nanos, shortest float form.
+		{
+			in: counter(&timestamppb.Timestamp{Seconds: 1700000000, Nanos: 123456789}),
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 1.7000000001234567e+09
+`,
+		},
+		// 8: Timestamp with nanos, nanosecond precision.
+		{
+			in:      counter(&timestamppb.Timestamp{Seconds: 1700000000, Nanos: 123456789}),
+			options: []EncoderOption{WithExemplarTimestampPrecision(9)},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 1700000000.123456789
+`,
+		},
+		// 9: Timestamp with nanos, millisecond precision.
+		{
+			in:      counter(&timestamppb.Timestamp{Seconds: 1700000000, Nanos: 123456789}),
+			options: []EncoderOption{WithExemplarTimestampPrecision(3)},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 1700000000.123
+`,
+		},
+		// 10: Millisecond precision, padded.
+		{
+			in:      counter(timestamppb.New(time.Unix(12345, 600000000))),
+			options: []EncoderOption{WithExemplarTimestampPrecision(3)},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 12345.600
+`,
+		},
+		// 11: Millisecond precision, rounded up into the seconds.
+		{
+			in:      counter(&timestamppb.Timestamp{Seconds: 12345, Nanos: 999600000}),
+			options: []EncoderOption{WithExemplarTimestampPrecision(3)},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 12346.000
+`,
+		},
+		// 12: Negative timestamp, millisecond precision.
+		{
+			in:      counter(&timestamppb.Timestamp{Seconds: -2, Nanos: 500000000}),
+			options: []EncoderOption{WithExemplarTimestampPrecision(3)},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 -1.500
+`,
+		},
+		// 13: Precision beyond nanoseconds.
+		{
+			in:      counter(&timestamppb.Timestamp{Seconds: 1, Nanos: 5}),
+			options: []EncoderOption{WithExemplarTimestampPrecision(12)},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 1.000000005
+`,
+		},
+		// 14: Epoch timestamp, millisecond precision.
+		{
+			in:      counter(&timestamppb.Timestamp{}),
+			options: []EncoderOption{WithExemplarTimestampPrecision(3)},
+			out: `# TYPE foos counter
+foos_total 1.0 # {trace_id="KOO5S4vxi0o"} 0.5 0.000
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, scenario.in, scenario.options...)
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestFinalizeOpenMetrics(t *testing.T) {
+	var out bytes.Buffer
+	for _, mf := range []*dto.MetricFamily{
+		{
+			Name: proto.String("foos_total"),
+			Help: proto.String("Number of foos."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{Counter: &dto.Counter{Value: proto.Float64(42)}},
+			},
+		},
+		{
+			Name: proto.String("temperature_celsius"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(-3.5)}},
+			},
+		},
+	} {
+		if _, err := MetricFamilyToOpenMetrics(&out, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs := ValidateExposition(bytes.NewReader(out.Bytes()), FmtOpenMetrics_1_0_0); len(errs) == 0 {
+		t.Error("expected an error for the exposition without # EOF")
+	}
+
+	n, err := FinalizeOpenMetrics(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := len("# EOF\n"); n != expected {
+		t.Errorf("expected %d bytes written, got %d", expected, n)
+	}
+	expected := `# HELP foos Number of foos.
+# TYPE foos counter
+foos_total 42.0
+# TYPE temperature_celsius gauge
+temperature_celsius -3.5
+# EOF
+`
+	if got := out.String(); got != expected {
+		t.Errorf("expected out=%q, got %q", expected, got)
+	}
+	if errs := ValidateExposition(bytes.NewReader(out.Bytes()), FmtOpenMetrics_1_0_0); len(errs) != 0 {
+		t.Errorf("expected a valid exposition, got %v", errs)
+	}
+}
+
+func TestCreateOpenMetricsCompactFloats(t *testing.T) {
+	gauge := func(values ...float64) *dto.MetricFamily {
+		mf := &dto.MetricFamily{
+			Name: proto.String("g"),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		for _, v := range values {
+			mf.Metric = append(mf.Metric, &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(v)}})
+		}
+		return mf
+	}
+
+	scenarios := []struct {
+		in      *dto.MetricFamily
+		options []EncoderOption
+		out     string
+	}{
+		// 0: Default.
+		{
+			in: gauge(0, 42, -7, 1, 2.5, 3.14e+42, math.Inf(+1), math.Inf(-1), math.NaN()),
+			out: `# TYPE g gauge
+g 0.0
+g 42.0
+g -7.0
+g 1.0
+g 2.5
+g 3.14e+42
+g +Inf
+g -Inf
+g NaN
+`,
+		},
+		// 1: Compact.
+		{
+			in:      gauge(0, 42, -7, 1, 2.5, 3.14e+42, math.Inf(+1), math.Inf(-1), math.NaN()),
+			options: []EncoderOption{WithCompactFloats()},
+			out: `# TYPE g gauge
+g 0
+g 42
+g -7
+g 1
+g 2.5
+g 3.14e+42
+g +Inf
+g -Inf
+g NaN
+`,
+		},
+		// 2: Compact, histogram with bounds and a timestamp untouched.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("h"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(2),
+							SampleSum:   proto.Float64(3),
+							Bucket: []*dto.Bucket{
+								{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+								{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(2)},
+							},
+						},
+						TimestampMs: proto.Int64(12000),
+					},
+				},
+			},
+			options: []EncoderOption{WithCompactFloats()},
+			out: `# TYPE h histogram
+h_bucket{le="1.0"} 1 12.0
+h_bucket{le="+Inf"} 2 12.0
+h_sum 3 12.0
+h_count 2 12.0
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, scenario.in, scenario.options...)
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestCreateOpenMetricsEscapingScheme(t *testing.T) {
+	gauge := &dto.MetricFamily{
+		Name: proto.String("name.with.dots"),
+		Help: proto.String("Dotted."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("name*2"), Value: proto.String("v")},
+					{Name: proto.String("code"), Value: proto.String("200")},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(1)},
+			},
+		},
+	}
+	counter := &dto.MetricFamily{
+		Name: proto.String("name.with.dots_total"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("name*2"), Value: proto.String("v")},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(3)},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		in      *dto.MetricFamily
+		options []EncoderOption
+		out     string
+	}{
+		// 0: Default.
+		{
+			in: gauge,
+			out: `# HELP "name.with.dots" Dotted.
+# TYPE "name.with.dots" gauge
+{"name.with.dots","name*2"="v",code="200"} 1.0
+`,
+		},
+		// 1: No escaping.
+		{
+			in:      gauge,
+			options: []EncoderOption{WithEscapingScheme(model.NoEscaping)},
+			out: `# HELP "name.with.dots" Dotted.
+# TYPE "name.with.dots" gauge
+{"name.with.dots","name*2"="v",code="200"} 1.0
+`,
+		},
+		// 2: Underscores.
+		{
+			in:      gauge,
+			options: []EncoderOption{WithEscapingScheme(model.UnderscoreEscaping)},
+			out: `# HELP name_with_dots Dotted.
+# TYPE name_with_dots gauge
+name_with_dots{name_2="v",code="200"} 1.0
+`,
+		},
+		// 3: Dots.
+		{
+			in:      gauge,
+			options: []EncoderOption{WithEscapingScheme(model.DotsEscaping)},
+			out: `# HELP name_dot_with_dot_dots Dotted.
+# TYPE name_dot_with_dot_dots gauge
+name_dot_with_dot_dots{name__2="v",code="200"} 1.0
+`,
+		},
+		// 4: Values.
+		{
+			in:      gauge,
+			options: []EncoderOption{WithEscapingScheme(model.ValueEncodingEscaping)},
+			out: `# HELP U__name_2e_with_2e_dots Dotted.
+# TYPE U__name_2e_with_2e_dots gauge
+U__name_2e_with_2e_dots{U__name_2a_2="v",code="200"} 1.0
+`,
+		},
+		// 5: Counter, the _total suffix is kept unescaped.
+		{
+			in:      counter,
+			options: []EncoderOption{WithEscapingScheme(model.DotsEscaping)},
+			out: `# TYPE name_dot_with_dot_dots counter
+name_dot_with_dot_dots_total{name__2="v"} 3.0
+`,
+		},
+		// 6: Counter, values.
+		{
+			in:      counter,
+			options: []EncoderOption{WithEscapingScheme(model.ValueEncodingEscaping)},
+			out: `# TYPE U__name_2e_with_2e_dots counter
+U__name_2e_with_2e_dots_total{U__name_2a_2="v"} 3.0
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		n, err := MetricFamilyToOpenMetrics(out, scenario.in, scenario.options...)
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := len(scenario.out), n; expected != got {
+			t.Errorf("%d. expected %d bytes written, got %d", i, expected, got)
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
 		}
 	}
 }
@@ -0,0 +1,51 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OpenMetricsEncoder writes metric families in the OpenMetrics format, one
+// after the other, like repeated calls of MetricFamilyToOpenMetrics. Its Close
+// method writes the final `# EOF` line required by the OpenMetrics format, so
+// that callers cannot forget it as long as they close the encoder, e.g.
+// deferred.
+//
+// It is a thin wrapper around the Encoder returned by NewEncoder for
+// FmtOpenMetrics_1_0_0 and behaves exactly like it, but provides the Close
+// method without a type assertion. It must not be used concurrently.
+type OpenMetricsEncoder struct {
+	enc encoderCloser
+}
+
+// NewOpenMetricsEncoder returns an OpenMetricsEncoder writing to w with the
+// given options. It is equivalent to
+// NewEncoder(w, FmtOpenMetrics_1_0_0, options...).
+func NewOpenMetricsEncoder(w io.Writer, options ...EncoderOption) *OpenMetricsEncoder {
+	return &OpenMetricsEncoder{enc: NewEncoder(w, FmtOpenMetrics_1_0_0, options...).(encoderCloser)}
+}
+
+// Encode implements Encoder.
+func (e *OpenMetricsEncoder) Encode(mf *dto.MetricFamily) error {
+	return e.enc.Encode(mf)
+}
+
+// Close implements Closer by writing the final `# EOF` line. It doesn't close
+// the underlying writer.
+func (e *OpenMetricsEncoder) Close() error {
+	return e.enc.Close()
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestOpenMetricsEncoder(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("foos_total"),
+			Help: proto.String("Number of foos."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+					Counter: &dto.Counter{Value: proto.Float64(42)},
+				},
+			},
+		},
+		{
+			Name: proto.String("temperature"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(21.5)}},
+			},
+		},
+		benchmarkOpenMetricsFamily(),
+	}
+
+	var want bytes.Buffer
+	for _, mf := range families {
+		if _, err := MetricFamilyToOpenMetrics(&want, mf, WithSortedLabels(true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := FinalizeOpenMetrics(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	enc := NewOpenMetricsEncoder(&out, WithSortedLabels(true))
+	var _ Encoder = enc
+	var _ Closer = enc
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.HasSuffix(out.Bytes(), []byte("# EOF\n")) {
+		t.Errorf("expected no EOF line before Close, got %q", out.String())
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := want.String(), out.String(); expected != got {
+		t.Errorf("expected out=%q, got %q", expected, got)
+	}
+	if expected, got := want.Len(), out.Len(); expected != got {
+		t.Errorf("expected %d bytes written, got %d", expected, got)
+	}
+	if !bytes.HasPrefix(out.Bytes(), []byte("# HELP foos Number of foos.\n# TYPE foos counter\nfoos_total{code=\"200\"} 42.0\n# TYPE temperature gauge\ntemperature 21.5\n")) {
+		t.Errorf("unexpected start of document %q", out.String())
+	}
+
+	// The encoder behaves exactly like the one returned by NewEncoder.
+	var viaNewEncoder bytes.Buffer
+	plain := NewEncoder(&viaNewEncoder, FmtOpenMetrics_1_0_0, WithSortedLabels(true))
+	for _, mf := range families {
+		if err := plain.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := plain.(Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := viaNewEncoder.String(), out.String(); expected != got {
+		t.Errorf("expected out=%q, got %q", expected, got)
+	}
+}
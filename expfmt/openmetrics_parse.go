@@ -0,0 +1,384 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OpenMetricsToMetricFamilies reads a complete exposition in the OpenMetrics
+// text format from 'in' and returns the metric families in it, like
+// TextParser.TextToMetricFamilies does for the text format. The exposition has
+// to end with a `# EOF` line. Otherwise, it is considered truncated, and an
+// error is returned, as it is for empty lines, content after the `# EOF` line,
+// invalid exemplars, and all syntax errors found by the TextParser.
+//
+// The OpenMetrics-specific constructs are read as follows:
+//
+//   - Exemplars are set on the counters and histogram buckets they are given
+//     for. Exemplars of other samples, which OpenMetrics doesn't allow, are
+//     dropped.
+//   - `_created` samples of counters, summaries, and histograms are set as the
+//     CreatedTimestamp of the metrics with the same labels. This includes
+//     summaries with only `_sum`, `_count`, and `_created` samples, which
+//     are returned without quantiles.
+//   - Gauge histograms are returned with the GAUGE_HISTOGRAM type, their
+//     `_gcount` and `_gsum` samples as SampleCount and SampleSum.
+//   - Info families, which dto.MetricFamily has no type for, are returned as
+//     gauges named with the `_info` suffix, statesets as gauges.
+//   - `# UNIT` lines are ignored, as dto.MetricFamily has no field for them.
+//   - Quoted metric and label names, as written for names not passing the
+//     legacy validation check, are unquoted (see TextParser.QuotedNames).
+//
+// Counters are named with their `_total` suffix, as the text format does.
+func OpenMetricsToMetricFamilies(in io.Reader) (map[string]*dto.MetricFamily, error) {
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	families, violations, err := parseOpenMetrics(b)
+	if len(violations) > 0 {
+		return nil, violations[0]
+	}
+	if err != nil {
+		return nil, err
+	}
+	mfs := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		mfs[mf.GetName()] = mf
+	}
+	return mfs, nil
+}
+
+// parseOpenMetrics reads the complete OpenMetrics exposition in as described
+// for OpenMetricsToMetricFamilies. It returns the metric families in the order
+// they appear in, all violations of OpenMetrics rules that don't keep the
+// families from being read (see openMetricsToText), including families
+// appearing more than once, and the first error that does.
+func parseOpenMetrics(in []byte) ([]*dto.MetricFamily, []error, error) {
+	b, gaugeHistograms := openMetricsTypesToText(in)
+	b, exemplars, violations := openMetricsToText(b)
+	p := TextParser{QuotedNames: true}
+	mfs, err := p.TextToMetricFamilies(bytes.NewReader(b))
+	if err != nil {
+		return nil, violations, err
+	}
+	for name := range gaugeHistograms {
+		if mf, ok := mfs[name]; ok && mf.GetType() == dto.MetricType_HISTOGRAM {
+			mf.Type = dto.MetricType_GAUGE_HISTOGRAM.Enum()
+		}
+	}
+	index := seriesIndex{}
+	if err := setCreatedTimestamps(mfs, index); err != nil {
+		return nil, violations, err
+	}
+	lines := strings.Split(string(b), "\n")
+	buckets := bucketIndex{}
+	for i, e := range exemplars {
+		setExemplar(mfs, index, buckets, lines[i], e)
+	}
+	families, repeated := familyOrder(mfs, lines)
+	for _, name := range repeated {
+		violations = append(violations, fmt.Errorf("metric family %q appears more than once", name))
+	}
+	return families, violations, nil
+}
+
+// familyOrder returns the families of mfs in the order they first appear in
+// the lines of the text format they have been parsed from, and the names of
+// the families that appear again after other families. Lines are attributed
+// to families like the TextParser does, e.g. `_bucket` samples to their
+// histogram, and `_created` samples to the family they have been set on by
+// setCreatedTimestamps.
+func familyOrder(mfs map[string]*dto.MetricFamily, lines []string) ([]*dto.MetricFamily, []string) {
+	var (
+		families = make([]*dto.MetricFamily, 0, len(mfs))
+		repeated []string
+		seen     = make(map[*dto.MetricFamily]bool, len(mfs))
+		prev     *dto.MetricFamily
+	)
+	for _, line := range lines {
+		var (
+			name string
+			ok   bool
+		)
+		if line = strings.TrimLeft(line, " \t"); strings.HasPrefix(line, "#") {
+			_, name, _, _, ok = splitMetadata(line)
+		} else {
+			name, _, _, ok = sampleName(line)
+		}
+		if !ok {
+			continue
+		}
+		mf := lineFamily(mfs, name)
+		switch {
+		case mf == nil || mf == prev:
+			continue
+		case seen[mf]:
+			repeated = append(repeated, mf.GetName())
+		default:
+			families = append(families, mf)
+			seen[mf] = true
+		}
+		prev = mf
+	}
+	return families, repeated
+}
+
+// lineFamily returns the family of mfs a line with the given metric name
+// belongs to, or nil if there is none.
+func lineFamily(mfs map[string]*dto.MetricFamily, name string) *dto.MetricFamily {
+	if mf, ok := mfs[name]; ok {
+		return mf
+	}
+	if mf, ok := mfs[summaryMetricName(name)]; ok && mf.GetType() == dto.MetricType_SUMMARY {
+		return mf
+	}
+	if mf, ok := mfs[histogramMetricName(name)]; ok {
+		if t := mf.GetType(); t == dto.MetricType_HISTOGRAM || t == dto.MetricType_GAUGE_HISTOGRAM {
+			return mf
+		}
+	}
+	if base, ok := strings.CutSuffix(name, "_created"); ok {
+		if mf, ok := mfs[base+"_total"]; ok {
+			return mf
+		}
+		return mfs[base]
+	}
+	return nil
+}
+
+// openMetricsTypesToText translates the metadata and samples of the
+// OpenMetrics-only types into the text format line by line, so that line
+// numbers are kept: Gauge histograms become histograms, with their `_gcount`
+// and `_gsum` samples renamed accordingly, info families gauges with the
+// `_info` suffix in their metadata, and statesets gauges. It returns the names
+// of the gauge histograms.
+func openMetricsTypesToText(in []byte) ([]byte, map[string]bool) {
+	lines := strings.Split(string(in), "\n")
+	types := map[string]string{}
+	for _, line := range lines {
+		if keyword, name, _, end, ok := splitMetadata(line); ok && keyword == "TYPE" {
+			switch t := metadataType(line[end:]); t {
+			case "gaugehistogram", "info", "stateset":
+				types[name] = t
+			}
+		}
+	}
+	if len(types) == 0 {
+		return in, nil
+	}
+	gaugeHistograms := map[string]bool{}
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			keyword, name, start, end, ok := splitMetadata(line)
+			if !ok {
+				continue
+			}
+			token := line[start:end]
+			switch types[name] {
+			case "gaugehistogram":
+				gaugeHistograms[name] = true
+				if keyword == "TYPE" {
+					lines[i] = "# TYPE " + token + " histogram"
+				}
+			case "info":
+				if keyword == "TYPE" {
+					lines[i] = "# TYPE " + renameToken(token, name+"_info") + " gauge"
+				} else {
+					lines[i] = line[:start] + renameToken(token, name+"_info") + line[end:]
+				}
+			case "stateset":
+				if keyword == "TYPE" {
+					lines[i] = "# TYPE " + token + " gauge"
+				}
+			}
+			continue
+		}
+		name, start, end, ok := sampleName(line)
+		if !ok {
+			continue
+		}
+		for _, s := range []struct{ om, text string }{{"_gcount", "_count"}, {"_gsum", "_sum"}} {
+			if base, ok := strings.CutSuffix(name, s.om); ok && types[base] == "gaugehistogram" {
+				lines[i] = line[:start] + renameToken(line[start:end], base+s.text) + line[end:]
+			}
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), gaugeHistograms
+}
+
+// setCreatedTimestamps moves the samples of the `_created` families without
+// metadata in mfs into the CreatedTimestamp of the metrics with the same labels
+// of the counter, summary, or histogram they belong to, and removes the
+// `_created` families.
+func setCreatedTimestamps(mfs map[string]*dto.MetricFamily, index seriesIndex) error {
+	for name, created := range mfs {
+		base, ok := strings.CutSuffix(name, "_created")
+		if !ok || created.GetType() != dto.MetricType_UNTYPED || created.Help != nil {
+			continue
+		}
+		// A nil family has the COUNTER type, as it is the zero value.
+		mf, ok := mfs[base+"_total"]
+		if !ok || mf.GetType() != dto.MetricType_COUNTER {
+			mf, ok = mfs[base]
+			if t := mf.GetType(); !ok || (t != dto.MetricType_SUMMARY && t != dto.MetricType_HISTOGRAM) {
+				continue
+			}
+		}
+		for _, c := range created.Metric {
+			m := index.find(mf, c.Label)
+			if m == nil {
+				return fmt.Errorf("created timestamp for unknown series %s%s", name, labelsString(c.Label))
+			}
+			ts := createdTimestampFromSeconds(c.GetUntyped().GetValue())
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				m.GetCounter().CreatedTimestamp = ts
+			case dto.MetricType_SUMMARY:
+				m.GetSummary().CreatedTimestamp = ts
+			case dto.MetricType_HISTOGRAM:
+				m.GetHistogram().CreatedTimestamp = ts
+			}
+		}
+		delete(mfs, name)
+	}
+	return nil
+}
+
+// createdTimestampFromSeconds converts seconds since the epoch, as written in
+// `_created` samples, into a Timestamp, rounded to microseconds to compensate
+// for the limited precision of the float.
+func createdTimestampFromSeconds(s float64) *timestamppb.Timestamp {
+	sec := math.Floor(s)
+	nanos := math.Round((s-sec)*1e6) * 1e3
+	if nanos >= 1e9 {
+		sec, nanos = sec+1, 0
+	}
+	return &timestamppb.Timestamp{Seconds: int64(sec), Nanos: int32(nanos)}
+}
+
+// setExemplar sets e on the counter or histogram bucket of mfs the sample line
+// (in the text format) it was removed from belongs to. If there is none, e is
+// dropped.
+func setExemplar(
+	mfs map[string]*dto.MetricFamily,
+	index seriesIndex,
+	buckets bucketIndex,
+	line string,
+	e *dto.Exemplar,
+) {
+	p := TextParser{QuotedNames: true}
+	sample, err := p.TextToMetricFamilies(strings.NewReader(line + "\n"))
+	if err != nil {
+		return // Cannot happen, as the line has been parsed before.
+	}
+	var name string
+	var labels []*dto.LabelPair
+	for _, mf := range sample {
+		name, labels = mf.GetName(), mf.Metric[0].Label
+	}
+	if mf, ok := mfs[name]; ok && mf.GetType() == dto.MetricType_COUNTER {
+		if m := index.find(mf, labels); m != nil {
+			m.Counter.Exemplar = e
+		}
+		return
+	}
+	if base, ok := strings.CutSuffix(name, "_bucket"); ok {
+		mf := mfs[base]
+		if t := mf.GetType(); t == dto.MetricType_HISTOGRAM || t == dto.MetricType_GAUGE_HISTOGRAM {
+			var (
+				le     = math.NaN()
+				others = make([]*dto.LabelPair, 0, len(labels))
+			)
+			for _, l := range labels {
+				if l.GetName() == model.BucketLabel {
+					le, _ = parseFloat(l.GetValue())
+					continue
+				}
+				others = append(others, l)
+			}
+			if m := index.find(mf, others); m != nil {
+				if b := buckets.find(m.Histogram, le); b != nil {
+					b.Exemplar = e
+				}
+			}
+		}
+	}
+}
+
+// seriesIndex maps the metrics of metric families by their labels (as returned
+// by labelsString), built lazily per family.
+type seriesIndex map[*dto.MetricFamily]map[string]*dto.Metric
+
+// find returns the metric of mf with the given labels, in any order, or nil if
+// there is none.
+func (idx seriesIndex) find(mf *dto.MetricFamily, labels []*dto.LabelPair) *dto.Metric {
+	metrics, ok := idx[mf]
+	if !ok {
+		metrics = make(map[string]*dto.Metric, len(mf.GetMetric()))
+		for _, m := range mf.GetMetric() {
+			metrics[labelsString(m.Label)] = m
+		}
+		idx[mf] = metrics
+	}
+	return metrics[labelsString(labels)]
+}
+
+// bucketIndex maps the buckets of histograms by their upper bound, built lazily
+// per histogram, so that setting an exemplar on every bucket of a histogram
+// stays linear in the number of buckets.
+type bucketIndex map[*dto.Histogram]map[float64]*dto.Bucket
+
+// find returns the bucket of h with the given upper bound, or nil if there is
+// none.
+func (idx bucketIndex) find(h *dto.Histogram, upperBound float64) *dto.Bucket {
+	buckets, ok := idx[h]
+	if !ok {
+		buckets = make(map[float64]*dto.Bucket, len(h.GetBucket()))
+		for _, b := range h.GetBucket() {
+			if _, ok := buckets[b.GetUpperBound()]; !ok {
+				buckets[b.GetUpperBound()] = b
+			}
+		}
+		idx[h] = buckets
+	}
+	return buckets[upperBound]
+}
+
+// labelsString returns the labels sorted by name in the text format, e.g.
+// `{a="1",b="2"}`, or "" if there are none.
+func labelsString(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"="+strconv.Quote(l.GetValue()))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,377 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestOpenMetricsToMetricFamiliesRoundTrip(t *testing.T) {
+	scenarios := []struct {
+		in      string
+		options []EncoderOption
+	}{
+		// 0: Counter with created timestamp and exemplar.
+		{
+			in: `# HELP foos Number of foos.
+# TYPE foos counter
+foos_total{a="1"} 42.0 # {trace_id="abc"} 1.0 12345.6
+foos_created{a="1"} 12345.6
+foos_total{a="2"} 7.0
+`,
+		},
+		// 1: Gauge with timestamps.
+		{
+			in: `# HELP name two-line\n doc  str\\ing
+# TYPE name gauge
+name{labelname="val1",basename="basevalue"} 42.0 123.456
+name{labelname="val2",basename="basevalue"} 0.23 1.23456789e+06
+`,
+		},
+		// 2: Summary with created timestamp.
+		{
+			in: `# HELP request_duration_microseconds The response latency.
+# TYPE request_duration_microseconds summary
+request_duration_microseconds{code="200",quantile="0.5"} 84.0
+request_duration_microseconds{code="200",quantile="0.9"} 120.0
+request_duration_microseconds_sum{code="200"} 1.7560473e+06
+request_duration_microseconds_count{code="200"} 2693
+request_duration_microseconds_created{code="200"} 12345.6
+`,
+		},
+		// 3: Histogram with exemplars on its buckets and created timestamp.
+		{
+			in: `# HELP request_duration_microseconds The response latency.
+# TYPE request_duration_microseconds histogram
+request_duration_microseconds_bucket{le="100.0"} 123
+request_duration_microseconds_bucket{le="120.0"} 412 # {foo="bar"} 119.9 12345.6
+request_duration_microseconds_bucket{le="144.0"} 592
+request_duration_microseconds_bucket{le="172.8"} 1524 # {dings="bums"} 140.0
+request_duration_microseconds_bucket{le="+Inf"} 2693
+request_duration_microseconds_sum 1.7560473e+06
+request_duration_microseconds_count 2693
+request_duration_microseconds_created 12345.6
+`,
+		},
+		// 4: Gauge histogram.
+		{
+			in: `# HELP name doc string
+# TYPE name gaugehistogram
+name_bucket{le="1.0"} 2
+name_bucket{le="+Inf"} 3 # {foo="bar"} 0.5
+name_gcount 3
+name_gsum 4.0
+`,
+		},
+		// 5: Info.
+		{
+			in: `# HELP build Build information.
+# TYPE build info
+build_info{version="1.2.3"} 1
+`,
+			options: []EncoderOption{WithInfoFamilies("build_info")},
+		},
+		// 6: Stateset.
+		{
+			in: `# TYPE state stateset
+state{state="a"} 1
+state{state="b"} 0
+`,
+			options: []EncoderOption{WithStateSetFamilies("state")},
+		},
+		// 7: Unknown.
+		{
+			in: `# TYPE name unknown
+name 1.0
+`,
+		},
+		// 8: Dots in name, like scenario 1 of TestCreateOpenMetrics.
+		{
+			in: `# HELP "name.with.dots" boring help
+# TYPE "name.with.dots" unknown
+{"name.with.dots",labelname="val1",basename="basevalue"} 42.0
+{"name.with.dots",labelname="val2",basename="basevalue"} 0.23 1.23456789e+06
+`,
+		},
+		// 9: Dots in name, no labels, like scenario 2 of TestCreateOpenMetrics.
+		{
+			in: `# HELP "name.with.dots" boring help
+# TYPE "name.with.dots" unknown
+{"name.with.dots"} 42.0
+{"name.with.dots"} 0.23 1.23456789e+06
+`,
+		},
+		// 10: Quoted metric and label names with escaping, like scenario 4 of
+		// TestCreateOpenMetrics.
+		{
+			in: `# HELP "gauge.name\"" gauge\ndoc\nstr\"ing
+# TYPE "gauge.name\"" gauge
+{"gauge.name\"","name.1"="val with\nnew line","name*2"="val with \\backslash and \"quotes\""} +Inf
+{"gauge.name\"","name.1"="Björn","name*2"="佖佥"} 3.14e+42
+`,
+		},
+		// 11: Counter with quoted name, created timestamp, and exemplar.
+		{
+			in: `# TYPE "foos.total" counter
+{"foos.total_total",a="1"} 42.0 # {trace_id="abc"} 1.0
+{"foos.total_created",a="1"} 12345.6
+`,
+		},
+		// 12: Gauge histogram with quoted name.
+		{
+			in: `# TYPE "name.with.dots" gaugehistogram
+{"name.with.dots_bucket",le="1.0"} 2
+{"name.with.dots_bucket",le="+Inf"} 3
+{"name.with.dots_gcount"} 3
+{"name.with.dots_gsum"} 4.0
+`,
+		},
+		// 13: Summaries without quantiles, with and without created
+		// timestamp.
+		{
+			in: `# HELP rpc_duration_seconds RPC latency.
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds_sum{code="200"} 12.5
+rpc_duration_seconds_count{code="200"} 42
+rpc_duration_seconds_created{code="200"} 12345.6
+rpc_duration_seconds_sum{code="500"} 0.0
+rpc_duration_seconds_count{code="500"} 0
+`,
+		},
+		// 14: Summary without labels and quantiles, with created timestamp.
+		{
+			in: `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds_sum 1.5
+rpc_duration_seconds_count 3
+rpc_duration_seconds_created 12345.6
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		mfs, err := OpenMetricsToMetricFamilies(strings.NewReader(scenario.in + "# EOF\n"))
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if len(mfs) != 1 {
+			t.Errorf("%d. expected 1 metric family, got %d: %v", i, len(mfs), mfs)
+			continue
+		}
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.in)))
+		for _, mf := range mfs {
+			if _, err := MetricFamilyToOpenMetrics(out, mf, scenario.options...); err != nil {
+				t.Errorf("%d. unexpected error re-encoding %v: %s", i, mf, err)
+			}
+		}
+		if got := out.String(); got != scenario.in {
+			t.Errorf(
+				"%d. expected round trip of:\n%s\ngot:\n%s",
+				i, scenario.in, got,
+			)
+		}
+	}
+}
+
+func TestOpenMetricsToMetricFamiliesSummaryWithoutQuantiles(t *testing.T) {
+	in := `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds_sum 1.5
+rpc_duration_seconds_count 3
+rpc_duration_seconds_created 12345.6
+# EOF
+`
+	want := &dto.MetricFamily{
+		Name: proto.String("rpc_duration_seconds"),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Summary: &dto.Summary{
+					SampleCount:      proto.Uint64(3),
+					SampleSum:        proto.Float64(1.5),
+					CreatedTimestamp: timestamppb.New(time.Unix(12345, 600000000)),
+				},
+			},
+		},
+	}
+
+	mfs, err := OpenMetricsToMetricFamilies(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mfs["rpc_duration_seconds"]; len(mfs) != 1 || !proto.Equal(want, got) {
+		t.Errorf("expected %v, got %v", want, mfs)
+	}
+	for _, options := range [][]EncoderOption{nil, {WithStrictValidation()}} {
+		out := bytes.NewBuffer(make([]byte, 0, len(in)))
+		if _, err := MetricFamilyToOpenMetrics(out, want, options...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := FinalizeOpenMetrics(out); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := in, out.String(); expected != got {
+			t.Errorf("expected out=%q, got %q", expected, got)
+		}
+	}
+}
+
+func TestOpenMetricsToMetricFamiliesExemplars(t *testing.T) {
+	in := `# TYPE foos counter
+foos_total 42.0 # {trace_id="abc"} 1.0
+# TYPE request_duration_microseconds histogram
+request_duration_microseconds_bucket{le="100.0"} 123
+request_duration_microseconds_bucket{le="120.0"} 412 # {foo="bar"} 119.9 12345.6
+request_duration_microseconds_bucket{le="+Inf"} 2693
+request_duration_microseconds_sum 1.7560473e+06
+request_duration_microseconds_count 2693
+# EOF
+`
+	mfs, err := OpenMetricsToMetricFamilies(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Without timestamp.
+	got := mfs["foos_total"].GetMetric()[0].GetCounter().GetExemplar()
+	want := &dto.Exemplar{
+		Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+		Value: proto.Float64(1),
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("expected counter exemplar %v, got %v", want, got)
+	}
+
+	// With timestamp, on the second bucket only.
+	buckets := mfs["request_duration_microseconds"].GetMetric()[0].GetHistogram().GetBucket()
+	if len(buckets) != 3 {
+		t.Fatalf("expected 3 buckets, got %v", buckets)
+	}
+	want = &dto.Exemplar{
+		Label:     []*dto.LabelPair{{Name: proto.String("foo"), Value: proto.String("bar")}},
+		Value:     proto.Float64(119.9),
+		Timestamp: timestamppb.New(time.Unix(12345, 600000000)),
+	}
+	for i, b := range buckets {
+		if got := b.GetExemplar(); i == 1 && !proto.Equal(got, want) {
+			t.Errorf("expected bucket exemplar %v, got %v", want, got)
+		} else if i != 1 && got != nil {
+			t.Errorf("%d. expected no exemplar on bucket, got %v", i, got)
+		}
+	}
+}
+
+func TestOpenMetricsToMetricFamiliesError(t *testing.T) {
+	scenarios := []struct {
+		in  string
+		err string
+	}{
+		// 0: No EOF.
+		{
+			in: `# TYPE foos counter
+foos_total 42.0
+`,
+			err: "EOF",
+		},
+		// 1: Content after EOF.
+		{
+			in: `# TYPE foos counter
+foos_total 42.0
+# EOF
+foos_total 43.0
+`,
+			err: "EOF",
+		},
+		// 2: Invalid exemplar.
+		{
+			in: `# TYPE foos counter
+foos_total 42.0 # {trace_id="abc"
+# EOF
+`,
+			err: "exemplar",
+		},
+		// 3: Exemplar without value.
+		{
+			in: `# TYPE foos counter
+foos_total 42.0 # {trace_id="abc"}
+# EOF
+`,
+			err: `line 2: missing value in exemplar`,
+		},
+		// 4: Exemplar label set exceeding 128 runes.
+		{
+			in: `# TYPE foos counter
+foos_total 42.0 # {trace_id="` + strings.Repeat("x", 121) + `"} 1.0
+# EOF
+`,
+			err: "line 2: exemplar labels have 129 runes, exceeding the limit of 128",
+		},
+		// 5: Created timestamp without series.
+		{
+			in: `# TYPE foos counter
+foos_total{a="1"} 42.0
+foos_created{a="2"} 12345.6
+# EOF
+`,
+			err: "created timestamp for unknown series",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		_, err := OpenMetricsToMetricFamilies(strings.NewReader(scenario.in))
+		if err == nil {
+			t.Errorf("%d. expected error, got nil", i)
+			continue
+		}
+		if !strings.Contains(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error containing %q, got %q", i, scenario.err, err)
+		}
+	}
+}
+
+func BenchmarkOpenMetricsToMetricFamiliesLargeHistogram(b *testing.B) {
+	// With an exemplar on every bucket, the time per bucket should stay
+	// about the same as the number of buckets grows.
+	for _, n := range []int{500, 5000, 50000} {
+		mf := largeHistogramFamily(n)
+		for _, bucket := range mf.Metric[0].Histogram.Bucket {
+			bucket.Exemplar = &dto.Exemplar{
+				Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+				Value: proto.Float64(bucket.GetUpperBound()),
+			}
+		}
+		var in bytes.Buffer
+		if _, err := MetricFamilyToOpenMetrics(&in, mf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := FinalizeOpenMetrics(&in); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("buckets=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := OpenMetricsToMetricFamilies(bytes.NewReader(in.Bytes())); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
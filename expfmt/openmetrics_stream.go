@@ -0,0 +1,82 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"fmt"
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OpenMetricsStreamEncoder writes metric families in the OpenMetrics format
+// as they come, merging consecutive families of the same name into one. This
+// suits producers emitting a family in several parts, one after the other,
+// without having to collect the parts first.
+//
+// To keep memory usage low, only the name and type of the preceding family are
+// kept, but no metadata. A family with the same name as the preceding one is
+// written without HELP and TYPE lines (its HELP is ignored). A family skipped
+// for being empty, see WithoutEmptyFamilies, doesn't count as written. As no
+// other names are remembered, a family whose name appeared before, but not
+// immediately before, cannot be detected and is written with its metadata
+// again, which is invalid OpenMetrics. It is up to the producer to emit the
+// parts of a family adjacently.
+//
+// It implements Encoder and Closer and must not be used concurrently.
+type OpenMetricsStreamEncoder struct {
+	w        io.Writer
+	options  []EncoderOption
+	prevName string // Empty as long as no family has been written.
+	prevType dto.MetricType
+}
+
+// NewOpenMetricsStreamEncoder returns an OpenMetricsStreamEncoder writing to w
+// with the given options.
+func NewOpenMetricsStreamEncoder(w io.Writer, options ...EncoderOption) *OpenMetricsStreamEncoder {
+	return &OpenMetricsStreamEncoder{
+		w:       w,
+		options: options,
+	}
+}
+
+// Encode implements Encoder.
+func (e *OpenMetricsStreamEncoder) Encode(mf *dto.MetricFamily) error {
+	name := mf.GetName()
+	if e.prevName != "" && name == e.prevName {
+		if mf.GetType() != e.prevType {
+			return fmt.Errorf(
+				"metric family %q of type %s follows one of type %s",
+				name, typeName(mf.GetType()), typeName(e.prevType),
+			)
+		}
+		options := append(e.options[:len(e.options):len(e.options)], func(o *encoderOption) {
+			o.omitMetadata = true
+		})
+		_, err := MetricFamilyToOpenMetrics(e.w, mf, options...)
+		return err
+	}
+	written, err := MetricFamilyToOpenMetrics(e.w, mf, e.options...)
+	if err != nil || written == 0 { // Nothing written, see WithoutEmptyFamilies.
+		return err
+	}
+	e.prevName, e.prevType = name, mf.GetType()
+	return nil
+}
+
+// Close implements Closer by writing the final `# EOF` line.
+func (e *OpenMetricsStreamEncoder) Close() error {
+	_, err := FinalizeOpenMetrics(e.w)
+	return err
+}
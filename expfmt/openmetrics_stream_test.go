@@ -0,0 +1,136 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeFamilyPart(name, instance string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String("Help for " + name + "."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("instance"), Value: proto.String(instance)}},
+				Gauge: &dto.Gauge{Value: proto.Float64(value)},
+			},
+		},
+	}
+}
+
+func TestOpenMetricsStreamEncoder(t *testing.T) {
+	var out bytes.Buffer
+	enc := NewOpenMetricsStreamEncoder(&out)
+	for _, mf := range []*dto.MetricFamily{
+		gaugeFamilyPart("up", "a", 1),
+		gaugeFamilyPart("up", "b", 0),
+		gaugeFamilyPart("temperature", "a", 21.5),
+		gaugeFamilyPart("temperature", "b", 22),
+		gaugeFamilyPart("temperature", "c", 23),
+	} {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP up Help for up.
+# TYPE up gauge
+up{instance="a"} 1.0
+up{instance="b"} 0.0
+# HELP temperature Help for temperature.
+# TYPE temperature gauge
+temperature{instance="a"} 21.5
+temperature{instance="b"} 22.0
+temperature{instance="c"} 23.0
+# EOF
+`
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestOpenMetricsStreamEncoderEmptyPart(t *testing.T) {
+	empty := gaugeFamilyPart("up", "a", 1)
+	empty.Metric = nil
+
+	var out bytes.Buffer
+	enc := NewOpenMetricsStreamEncoder(&out, WithoutEmptyFamilies())
+	for _, mf := range []*dto.MetricFamily{
+		empty,
+		gaugeFamilyPart("up", "b", 0),
+	} {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The skipped empty part must not suppress the metadata of the next one.
+	expected := `# HELP up Help for up.
+# TYPE up gauge
+up{instance="b"} 0.0
+# EOF
+`
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestOpenMetricsStreamEncoderError(t *testing.T) {
+	counter := gaugeFamilyPart("up", "b", 0)
+	counter.Type = dto.MetricType_COUNTER.Enum()
+	counter.Metric[0].Counter = &dto.Counter{Value: proto.Float64(1)}
+
+	scenarios := []struct {
+		in  []*dto.MetricFamily
+		err string
+	}{
+		// 0: Adjacent duplicate of a different type.
+		{
+			in: []*dto.MetricFamily{
+				gaugeFamilyPart("up", "a", 1),
+				counter,
+			},
+			err: `metric family "up" of type counter follows one of type gauge`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var (
+			out bytes.Buffer
+			enc = NewOpenMetricsStreamEncoder(&out)
+			err error
+		)
+		for _, mf := range scenario.in {
+			if err = enc.Encode(mf); err != nil {
+				break
+			}
+		}
+		if err == nil || err.Error() != scenario.err {
+			t.Errorf("%d. expected error %q, got %v", i, scenario.err, err)
+		}
+	}
+}
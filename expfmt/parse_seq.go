@@ -0,0 +1,58 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+
+package expfmt
+
+import (
+	"errors"
+	"io"
+	"iter"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// errStopSeq stops the parsing of ParseSeq once the caller stops iterating.
+var errStopSeq = errors.New("sequence stopped")
+
+// ParseSeq returns a sequence of the metric families parsed from 'in' in the
+// text-based exchange format, for use in a range loop:
+//
+//	for mf, err := range expfmt.ParseSeq(r) {
+//		if err != nil {
+//			return err
+//		}
+//		// Use mf.
+//	}
+//
+// Each family is yielded as soon as it is complete (see
+// TextParser.StreamMetricFamilies). If parsing fails, the error is yielded
+// with a nil family as the last element. Parsing stops as soon as the loop is
+// left, so 'in' is only read as far as needed for the families consumed (plus
+// the buffered read-ahead of the parser). Each iteration parses 'in' anew,
+// which only makes sense if 'in' can be read again.
+func ParseSeq(in io.Reader) iter.Seq2[*dto.MetricFamily, error] {
+	return func(yield func(*dto.MetricFamily, error) bool) {
+		var p TextParser
+		err := p.StreamMetricFamilies(in, func(mf *dto.MetricFamily) error {
+			if !yield(mf, nil) {
+				return errStopSeq
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopSeq) {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+
+package expfmt
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestParseSeq(t *testing.T) {
+	in := `# TYPE a counter
+a 1
+# TYPE b gauge
+b{x="1"} 2
+b{x="2"} 3
+c 4
+`
+	var names []string
+	for mf, err := range ParseSeq(strings.NewReader(in)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, fmt.Sprintf("%s:%d", mf.GetName(), len(mf.GetMetric())))
+	}
+	if got, want := strings.Join(names, ","), "a:1,b:2,c:1"; got != want {
+		t.Errorf("expected families %s, got %s", want, got)
+	}
+}
+
+func TestParseSeqError(t *testing.T) {
+	in := `a 1
+b{x=} 2
+`
+	var (
+		names []string
+		errs  []error
+	)
+	for mf, err := range ParseSeq(strings.NewReader(in)) {
+		if err != nil {
+			if mf != nil {
+				t.Errorf("expected nil family with error, got %s", mf)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		names = append(names, mf.GetName())
+	}
+	if got, want := strings.Join(names, ","), "a"; got != want {
+		t.Errorf("expected families %s, got %s", want, got)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected one error, got %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "label value") {
+		t.Errorf("unexpected error: %s", errs[0])
+	}
+}
+
+func TestParseSeqBreak(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&b, "# TYPE m%d gauge\nm%d %d\n", i, i, i)
+	}
+	r := &countingReader{r: strings.NewReader(b.String())}
+
+	n := 0
+	for _, err := range ParseSeq(r) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 families, got %d", n)
+	}
+	// Only the read-ahead of the parser may have been consumed.
+	if r.n > 8192 {
+		t.Errorf("expected at most 8192 bytes read after breaking, got %d of %d", r.n, b.Len())
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DecodeResponse reads all metric families from the body of resp, which it
+// closes in any case. It returns an error for a response with a status code
+// other than 2xx. The body is decompressed according to its Content-Encoding
+// (gzip or deflate) and parsed in the format indicated by its Content-Type
+// (see ResponseFormat), falling back to the text format if the format is
+// unknown. Names are unescaped according to the escaping parameter of the
+// Content-Type (see NewDecoder). The metric families are returned in the order
+// they appear in.
+//
+// OpenMetrics input is read like OpenMetricsToMetricFamilies reads it, so
+// exemplars, created timestamps, and gauge histograms are kept. An OpenMetrics
+// exposition lacking its `# EOF` line is considered truncated and leads to an
+// error. Other violations of OpenMetrics rules are tolerated, see
+// ValidateExposition to find them.
+func DecodeResponse(resp *http.Response) ([]*dto.MetricFamily, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	switch enc := strings.ToLower(resp.Header.Get("Content-Encoding")); enc {
+	case "", "identity":
+	case "gzip":
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip encoded body: %w", err)
+		}
+		defer gr.Close()
+		body = gr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading deflate encoded body: %w", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+
+	var (
+		families []*dto.MetricFamily
+		format   = ResponseFormat(resp.Header)
+	)
+	if format.withoutEscaping() == FmtProtoDelim {
+		dec := NewDecoder(body, format)
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err != nil {
+				if errors.Is(err, io.EOF) {
+					return families, nil
+				}
+				return nil, err
+			}
+			families = append(families, mf)
+		}
+	}
+
+	scheme := format.ToEscapingScheme()
+	if strings.HasPrefix(string(format), OpenMetricsType) {
+		in, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		// Only a missing EOF line hints at a broken exposition. The
+		// remaining violations are left to ValidateExposition.
+		families, violations, err := parseOpenMetrics(in)
+		for _, v := range violations {
+			if errors.Is(v, errMissingEOF) {
+				return nil, v
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, mf := range families {
+			unescapeMetricFamily(mf, scheme)
+		}
+		return families, nil
+	}
+	var p TextParser
+	if err := p.StreamMetricFamilies(body, func(mf *dto.MetricFamily) error {
+		unescapeMetricFamily(mf, scheme)
+		families = append(families, mf)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func newResponse(status int, header map[string]string, body []byte) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+	for k, v := range header {
+		resp.Header.Set(k, v)
+	}
+	return resp
+}
+
+func TestDecodeResponse(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	if _, err := gw.Write([]byte(`# TYPE requests counter
+requests_total{code="200"} 10.0 # {trace_id="abc"} 1.0
+requests_created{code="200"} 1600000000.0
+# TYPE temperature gauge
+temperature 21.5 1700000000.5
+# EOF
+`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		resp *http.Response
+		out  []*dto.MetricFamily
+	}{
+		{
+			resp: newResponse(200, map[string]string{"Content-Type": string(FmtText)}, []byte(`# HELP up Whether the target is up.
+# TYPE up gauge
+up 1
+`)),
+			out: []*dto.MetricFamily{
+				{
+					Name: proto.String("up"),
+					Help: proto.String("Whether the target is up."),
+					Type: dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{
+						{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+					},
+				},
+			},
+		},
+		{
+			resp: newResponse(200, map[string]string{
+				"Content-Type":     string(FmtOpenMetrics_1_0_0),
+				"Content-Encoding": "gzip",
+			}, gzipped.Bytes()),
+			out: []*dto.MetricFamily{
+				{
+					Name: proto.String("requests_total"),
+					Type: dto.MetricType_COUNTER.Enum(),
+					Metric: []*dto.Metric{
+						{
+							Label: []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+							Counter: &dto.Counter{
+								Value: proto.Float64(10),
+								Exemplar: &dto.Exemplar{
+									Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+									Value: proto.Float64(1),
+								},
+								CreatedTimestamp: timestamppb.New(time.Unix(1600000000, 0)),
+							},
+						},
+					},
+				},
+				{
+					Name: proto.String("temperature"),
+					Type: dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{
+						{
+							Gauge:       &dto.Gauge{Value: proto.Float64(21.5)},
+							TimestampMs: proto.Int64(1700000000500),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out, err := DecodeResponse(scenario.resp)
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if len(out) != len(scenario.out) {
+			t.Errorf("%d. expected %d families, got %d: %v", i, len(scenario.out), len(out), out)
+			continue
+		}
+		for j := range out {
+			if !proto.Equal(out[j], scenario.out[j]) {
+				t.Errorf("%d.%d. expected %v, got %v", i, j, scenario.out[j], out[j])
+			}
+		}
+	}
+}
+
+func TestDecodeResponseError(t *testing.T) {
+	scenarios := []struct {
+		resp *http.Response
+		err  string
+	}{
+		{
+			resp: newResponse(500, nil, []byte("up 1\n")),
+			err:  "server returned HTTP status 500 Internal Server Error",
+		},
+		{
+			resp: newResponse(200, map[string]string{"Content-Encoding": "br"}, []byte("up 1\n")),
+			err:  `unsupported Content-Encoding "br"`,
+		},
+		{
+			resp: newResponse(200, map[string]string{"Content-Encoding": "gzip"}, []byte("up 1\n")),
+			err:  "reading gzip encoded body",
+		},
+		{
+			resp: newResponse(200, map[string]string{"Content-Type": string(FmtOpenMetrics_1_0_0)}, []byte("up 1\n")),
+			err:  "missing # EOF line",
+		},
+		{
+			resp: newResponse(200, map[string]string{"Content-Type": string(FmtText)}, []byte("up{ 1\n")),
+			err:  "text format parsing error in line 1",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		closed := false
+		body := scenario.resp.Body
+		scenario.resp.Body = closeRecorder{body, &closed}
+		_, err := DecodeResponse(scenario.resp)
+		if err == nil || !strings.Contains(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error containing %q, got %v", i, scenario.err, err)
+		}
+		if !closed {
+			t.Errorf("%d. body was not closed", i)
+		}
+	}
+}
+
+type closeRecorder struct {
+	io.ReadCloser
+	closed *bool
+}
+
+func (c closeRecorder) Close() error {
+	*c.closed = true
+	return c.ReadCloser.Close()
+}
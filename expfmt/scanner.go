@@ -0,0 +1,178 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"errors"
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TokenKind is the kind of a Token yielded by a Scanner.
+type TokenKind int
+
+// The kinds of tokens. Empty lines don't yield any token.
+const (
+	TokenComment  TokenKind = iota + 1 // A generic comment.
+	TokenHelp                          // A HELP line.
+	TokenType                          // A TYPE line.
+	TokenUnit                          // A UNIT line, as used by OpenMetrics.
+	TokenSample                        // A sample line.
+	TokenEOF                           // An EOF line, as used by OpenMetrics.
+	TokenExemplar                      // An exemplar, as used by OpenMetrics.
+)
+
+var tokenKindNames = map[TokenKind]string{
+	TokenComment:  "comment",
+	TokenHelp:     "help",
+	TokenType:     "type",
+	TokenUnit:     "unit",
+	TokenSample:   "sample",
+	TokenEOF:      "eof",
+	TokenExemplar: "exemplar",
+}
+
+// String returns the lower-case name of k.
+func (k TokenKind) String() string {
+	if name, ok := tokenKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Token is a single line of the text-based exchange format, as yielded by a
+// Scanner, along with its parsed fields. Which fields are set depends on Kind.
+type Token struct {
+	Kind TokenKind
+	Line int    // 1-based line number within the input.
+	Raw  string // The line as read, without the trailing newline.
+
+	// Name is the metric name of a HELP, TYPE, UNIT or sample line. For
+	// samples and exemplars, it is the name as it appears on the sample
+	// line, e.g. including a _sum or _bucket suffix.
+	Name string
+	Help string         // The unescaped docstring of a HELP line.
+	Type dto.MetricType // The type of a TYPE line.
+	Unit string         // The unit of a UNIT line.
+
+	// Labels are the labels of a sample line in the order in which they
+	// appear, including any 'quantile' or 'le' label.
+	Labels      []*dto.LabelPair
+	Value       float64
+	TimestampMs *int64 // Nil if the sample has no timestamp.
+
+	Exemplar *dto.Exemplar // The exemplar of an exemplar token.
+}
+
+// setKeyword sets the kind of a comment according to its keyword, i.e. the
+// first word after the '#'.
+func (t *Token) setKeyword(keyword string) {
+	switch keyword {
+	case "HELP":
+		t.Kind = TokenHelp
+	case "TYPE":
+		t.Kind = TokenType
+	case "UNIT":
+		t.Kind = TokenUnit
+	case "EOF":
+		t.Kind = TokenEOF
+	}
+}
+
+// Scanner reads the text-based exchange format line by line, yielding a typed
+// Token for each non-empty line without materializing whole metric families.
+// It is meant for tools like linters and formatters that need low-level
+// control. Successive calls to Scan step through the tokens, like with a
+// bufio.Scanner.
+//
+// The Scanner runs the same state machine as TextParser, so it accepts the
+// input TextParser accepts, and scanning stops at the first error TextParser
+// would return. On top of that, it recognizes the units and exemplars of
+// OpenMetrics, which the text format lacks: UNIT lines yield a TokenUnit
+// without being validated further, and a sample line ending in an exemplar,
+// e.g. `foo 1 # {trace_id="abc"} 1`, yields a TokenSample followed by a
+// TokenExemplar for the same line.
+type Scanner struct {
+	p        TextParser
+	next     stateFn
+	line     Token // The line currently scanned, filled in by p.
+	token    Token
+	exemplar *Token // The exemplar token to yield after the sample token.
+	err      error
+}
+
+// NewScanner returns a Scanner reading from r.
+func NewScanner(r io.Reader) *Scanner {
+	s := &Scanner{}
+	s.p.ErrorContext = true // The lines are tracked anyway.
+	s.p.reset(r)
+	// Forget about families once they are complete, as in streaming mode.
+	s.p.onFamily = func(*dto.MetricFamily, int64, int64) error { return nil }
+	s.p.token = &s.line
+	s.next = s.p.startOfLine
+	return s
+}
+
+// Scan advances the Scanner to the next token, which is then available
+// through the Token method. It returns false once the input is exhausted or
+// an error has occurred. After Scan returns false, the Err method returns the
+// error, if any.
+func (s *Scanner) Scan() bool {
+	if s.exemplar != nil {
+		s.token, s.exemplar = *s.exemplar, nil
+		return true
+	}
+	for s.next != nil {
+		s.next = s.next()
+		if s.line.Line > 0 {
+			// The state machine has moved on to the next line.
+			token := s.line
+			s.line = Token{}
+			if token.Kind != 0 {
+				if token.Exemplar != nil {
+					s.exemplar = &Token{
+						Kind:     TokenExemplar,
+						Line:     token.Line,
+						Raw:      token.Raw,
+						Name:     token.Name,
+						Exemplar: token.Exemplar,
+					}
+					token.Exemplar = nil
+				}
+				s.token = token
+				return true
+			}
+		}
+	}
+	if s.p.err != nil && s.err == nil {
+		s.err = s.p.err
+		if errors.Is(s.err, io.EOF) {
+			s.p.parseError("unexpected end of input stream")
+			s.err = s.p.err
+		}
+	}
+	return false
+}
+
+// Token returns the most recent token yielded by Scan.
+func (s *Scanner) Token() Token {
+	return s.token
+}
+
+// Err returns the first error encountered by the Scanner, or nil if the input
+// has been scanned completely.
+func (s *Scanner) Err() error {
+	return s.err
+}
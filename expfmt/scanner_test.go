@@ -0,0 +1,183 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestScanner(t *testing.T) {
+	in := `# A generic comment.
+# HELP rpc_duration_seconds RPC duration\nin seconds.
+# TYPE rpc_duration_seconds summary
+# UNIT rpc_duration_seconds seconds
+
+rpc_duration_seconds{service="a",quantile="0.5"} 0.25 1700000000000
+rpc_duration_seconds_sum{service="a"} 12.5
+	rpc_duration_seconds_count{service="a"} 50
+up 1
+requests_total 3 # {trace_id="a\\b\"c"} 1
+requests_total{code="500"} 1 1700000000000	# {trace_id="def"} 1 1700000000
+# EOF
+`
+	expected := []Token{
+		{Kind: TokenComment, Line: 1, Raw: "# A generic comment."},
+		{
+			Kind: TokenHelp, Line: 2, Raw: `# HELP rpc_duration_seconds RPC duration\nin seconds.`,
+			Name: "rpc_duration_seconds", Help: "RPC duration\nin seconds.",
+		},
+		{
+			Kind: TokenType, Line: 3, Raw: "# TYPE rpc_duration_seconds summary",
+			Name: "rpc_duration_seconds", Type: dto.MetricType_SUMMARY,
+		},
+		{
+			Kind: TokenUnit, Line: 4, Raw: "# UNIT rpc_duration_seconds seconds",
+			Name: "rpc_duration_seconds", Unit: "seconds",
+		},
+		{
+			Kind: TokenSample, Line: 6, Raw: `rpc_duration_seconds{service="a",quantile="0.5"} 0.25 1700000000000`,
+			Name: "rpc_duration_seconds",
+			Labels: []*dto.LabelPair{
+				{Name: proto.String("service"), Value: proto.String("a")},
+				{Name: proto.String("quantile"), Value: proto.String("0.5")},
+			},
+			Value: 0.25, TimestampMs: proto.Int64(1700000000000),
+		},
+		{
+			Kind: TokenSample, Line: 7, Raw: `rpc_duration_seconds_sum{service="a"} 12.5`,
+			Name:   "rpc_duration_seconds_sum",
+			Labels: []*dto.LabelPair{{Name: proto.String("service"), Value: proto.String("a")}},
+			Value:  12.5,
+		},
+		{
+			Kind: TokenSample, Line: 8, Raw: "\t" + `rpc_duration_seconds_count{service="a"} 50`,
+			Name:   "rpc_duration_seconds_count",
+			Labels: []*dto.LabelPair{{Name: proto.String("service"), Value: proto.String("a")}},
+			Value:  50,
+		},
+		{Kind: TokenSample, Line: 9, Raw: "up 1", Name: "up", Value: 1},
+		{Kind: TokenSample, Line: 10, Raw: `requests_total 3 # {trace_id="a\\b\"c"} 1`, Name: "requests_total", Value: 3},
+		{
+			Kind: TokenExemplar, Line: 10, Raw: `requests_total 3 # {trace_id="a\\b\"c"} 1`,
+			Name: "requests_total",
+			Exemplar: &dto.Exemplar{
+				Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String(`a\b"c`)}},
+				Value: proto.Float64(1),
+			},
+		},
+		{
+			Kind: TokenSample, Line: 11, Raw: `requests_total{code="500"} 1 1700000000000	# {trace_id="def"} 1 1700000000`,
+			Name:   "requests_total",
+			Labels: []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("500")}},
+			Value:  1, TimestampMs: proto.Int64(1700000000000),
+		},
+		{
+			Kind: TokenExemplar, Line: 11, Raw: `requests_total{code="500"} 1 1700000000000	# {trace_id="def"} 1 1700000000`,
+			Name: "requests_total",
+			Exemplar: &dto.Exemplar{
+				Label:     []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("def")}},
+				Value:     proto.Float64(1),
+				Timestamp: timestamppb.New(time.Unix(1700000000, 0)),
+			},
+		},
+		{Kind: TokenEOF, Line: 12, Raw: "# EOF"},
+	}
+
+	s := NewScanner(strings.NewReader(in))
+	var got []Token
+	for s.Scan() {
+		got = append(got, s.Token())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d tokens, got %d: %v", len(expected), len(got), got)
+	}
+	for i, e := range expected {
+		if !tokensEqual(e, got[i]) {
+			t.Errorf("%d. expected token %+v, got %+v", i, e, got[i])
+		}
+	}
+}
+
+func TestScannerError(t *testing.T) {
+	scenarios := []struct {
+		in     string
+		tokens []TokenKind
+		err    string
+	}{
+		{
+			in:     "# TYPE up gauge\nup{a=\"1\" 1\n",
+			tokens: []TokenKind{TokenType},
+			err:    `text format parsing error in line 2, column 7: unexpected end of label value "1"`,
+		},
+		{
+			in:     "up 1\nup",
+			tokens: []TokenKind{TokenSample},
+			err:    "text format parsing error in line 2, column 1: unexpected end of input stream",
+		},
+		{
+			in:     "# UNIT up ratio\nup 1 # {a=\"b\"} x\n",
+			tokens: []TokenKind{TokenUnit},
+			err:    `text format parsing error in line 2, column 6: expected float as value in exemplar`,
+		},
+		{
+			in:     "up 1\nmetric 1 123 \n",
+			tokens: []TokenKind{TokenSample},
+			err:    `text format parsing error in line 2, column 13: spurious string after timestamp: " "`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		s := NewScanner(strings.NewReader(scenario.in))
+		var kinds []TokenKind
+		for s.Scan() {
+			kinds = append(kinds, s.Token().Kind)
+		}
+		if len(kinds) != len(scenario.tokens) {
+			t.Errorf("%d. expected tokens %v, got %v", i, scenario.tokens, kinds)
+		}
+		err := s.Err()
+		if err == nil || !strings.HasPrefix(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error %q, got %v", i, scenario.err, err)
+		}
+		if s.Scan() {
+			t.Errorf("%d. expected Scan to keep returning false", i)
+		}
+	}
+}
+
+func tokensEqual(a, b Token) bool {
+	if a.Kind != b.Kind || a.Line != b.Line || a.Raw != b.Raw ||
+		a.Name != b.Name || a.Help != b.Help || a.Type != b.Type || a.Unit != b.Unit ||
+		a.Value != b.Value || a.TimestampMs == nil != (b.TimestampMs == nil) ||
+		a.TimestampMs != nil && *a.TimestampMs != *b.TimestampMs ||
+		!proto.Equal(a.Exemplar, b.Exemplar) || len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for i := range a.Labels {
+		if !proto.Equal(a.Labels[i], b.Labels[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -74,16 +75,27 @@ var (
 // `foo{"bar"="baz"}`. As stated above, the input is assumed to be santized and
 // no error will be thrown in this case.
 //
+// The behavior can be adjusted by EncoderOptions, see their documentation.
+//
 // This method fulfills the type 'prometheus.encoder'.
-func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err error) {
+func MetricFamilyToText(out io.Writer, in *dto.MetricFamily, options ...EncoderOption) (written int, err error) {
+	opts := newEncoderOption(options)
+
 	// Fail-fast checks.
 	if len(in.Metric) == 0 {
+		if opts.omitEmptyFamilies {
+			return 0, nil
+		}
 		return 0, fmt.Errorf("MetricFamily has no metrics: %s", in)
 	}
 	name := in.GetName()
 	if name == "" {
 		return 0, fmt.Errorf("MetricFamily has no name: %s", in)
 	}
+	name = opts.name(name)
+	if err := opts.checkNilMetrics(in); err != nil {
+		return 0, err
+	}
 
 	// Try the interface upgrade. If it doesn't work, we'll use a
 	// bufio.Writer from the sync.Pool.
@@ -101,68 +113,25 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 		}()
 	}
 
-	var n int
+	var (
+		n          int
+		metricType = in.GetType()
+	)
 
 	// Comments, first HELP, then TYPE.
-	if in.Help != nil {
-		n, err = w.WriteString("# HELP ")
+	if !opts.omitMetadata {
+		n, err = writeTextMetadata(w, opts, in, name)
 		written += n
 		if err != nil {
 			return
 		}
-		n, err = writeName(w, name)
-		written += n
-		if err != nil {
-			return
-		}
-		err = w.WriteByte(' ')
-		written++
-		if err != nil {
-			return
-		}
-		n, err = writeEscapedString(w, *in.Help, false)
-		written += n
-		if err != nil {
-			return
-		}
-		err = w.WriteByte('\n')
-		written++
-		if err != nil {
-			return
-		}
-	}
-	n, err = w.WriteString("# TYPE ")
-	written += n
-	if err != nil {
-		return
-	}
-	n, err = writeName(w, name)
-	written += n
-	if err != nil {
-		return
-	}
-	metricType := in.GetType()
-	switch metricType {
-	case dto.MetricType_COUNTER:
-		n, err = w.WriteString(" counter\n")
-	case dto.MetricType_GAUGE:
-		n, err = w.WriteString(" gauge\n")
-	case dto.MetricType_SUMMARY:
-		n, err = w.WriteString(" summary\n")
-	case dto.MetricType_UNTYPED:
-		n, err = w.WriteString(" untyped\n")
-	case dto.MetricType_HISTOGRAM:
-		n, err = w.WriteString(" histogram\n")
-	default:
-		return written, fmt.Errorf("unknown metric type %s", metricType.String())
-	}
-	written += n
-	if err != nil {
-		return
 	}
 
 	// Finally the samples, one line for each.
 	for _, metric := range in.Metric {
+		if metric == nil {
+			continue // See WithNilMetricsError.
+		}
 		switch metricType {
 		case dto.MetricType_COUNTER:
 			if metric.Counter == nil {
@@ -171,8 +140,8 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				)
 			}
 			n, err = writeSample(
-				w, name, "", metric, "", 0,
-				metric.Counter.GetValue(),
+				w, opts, name, "", metric, "", 0,
+				metric.Counter.GetValue(), opts.rawFloat(metric.Counter.Value),
 			)
 		case dto.MetricType_GAUGE:
 			if metric.Gauge == nil {
@@ -181,8 +150,8 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				)
 			}
 			n, err = writeSample(
-				w, name, "", metric, "", 0,
-				metric.Gauge.GetValue(),
+				w, opts, name, "", metric, "", 0,
+				metric.Gauge.GetValue(), opts.rawFloat(metric.Gauge.Value),
 			)
 		case dto.MetricType_UNTYPED:
 			if metric.Untyped == nil {
@@ -191,8 +160,8 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				)
 			}
 			n, err = writeSample(
-				w, name, "", metric, "", 0,
-				metric.Untyped.GetValue(),
+				w, opts, name, "", metric, "", 0,
+				metric.Untyped.GetValue(), opts.rawFloat(metric.Untyped.Value),
 			)
 		case dto.MetricType_SUMMARY:
 			if metric.Summary == nil {
@@ -202,9 +171,9 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 			}
 			for _, q := range metric.Summary.Quantile {
 				n, err = writeSample(
-					w, name, "", metric,
+					w, opts, name, "", metric,
 					model.QuantileLabel, q.GetQuantile(),
-					q.GetValue(),
+					q.GetValue(), opts.rawFloat(q.Value),
 				)
 				written += n
 				if err != nil {
@@ -212,16 +181,16 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				}
 			}
 			n, err = writeSample(
-				w, name, "_sum", metric, "", 0,
-				metric.Summary.GetSampleSum(),
+				w, opts, name, "_sum", metric, "", 0,
+				metric.Summary.GetSampleSum(), opts.rawFloat(metric.Summary.SampleSum),
 			)
 			written += n
 			if err != nil {
 				return
 			}
 			n, err = writeSample(
-				w, name, "_count", metric, "", 0,
-				float64(metric.Summary.GetSampleCount()),
+				w, opts, name, "_count", metric, "", 0,
+				float64(metric.Summary.GetSampleCount()), opts.rawUint(metric.Summary.SampleCount),
 			)
 		case dto.MetricType_HISTOGRAM:
 			if metric.Histogram == nil {
@@ -230,11 +199,11 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				)
 			}
 			infSeen := false
-			for _, b := range metric.Histogram.Bucket {
+			for _, b := range sortedBuckets(metric.Histogram.Bucket) {
 				n, err = writeSample(
-					w, name, "_bucket", metric,
+					w, opts, name, "_bucket", metric,
 					model.BucketLabel, b.GetUpperBound(),
-					float64(b.GetCumulativeCount()),
+					float64(b.GetCumulativeCount()), opts.rawUint(b.CumulativeCount),
 				)
 				written += n
 				if err != nil {
@@ -246,9 +215,9 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 			}
 			if !infSeen {
 				n, err = writeSample(
-					w, name, "_bucket", metric,
+					w, opts, name, "_bucket", metric,
 					model.BucketLabel, math.Inf(+1),
-					float64(metric.Histogram.GetSampleCount()),
+					float64(metric.Histogram.GetSampleCount()), "",
 				)
 				written += n
 				if err != nil {
@@ -256,16 +225,16 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				}
 			}
 			n, err = writeSample(
-				w, name, "_sum", metric, "", 0,
-				metric.Histogram.GetSampleSum(),
+				w, opts, name, "_sum", metric, "", 0,
+				metric.Histogram.GetSampleSum(), opts.rawFloat(metric.Histogram.SampleSum),
 			)
 			written += n
 			if err != nil {
 				return
 			}
 			n, err = writeSample(
-				w, name, "_count", metric, "", 0,
-				float64(metric.Histogram.GetSampleCount()),
+				w, opts, name, "_count", metric, "", 0,
+				float64(metric.Histogram.GetSampleCount()), opts.rawUint(metric.Histogram.SampleCount),
 			)
 		default:
 			return written, fmt.Errorf(
@@ -280,6 +249,131 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 	return
 }
 
+// sortedBuckets returns the buckets sorted numerically by their upper bound,
+// so that e.g. 1e-9 comes before 1 and +Inf comes last. The buckets are
+// returned as is if they are sorted already. Otherwise, a sorted copy is
+// returned, leaving the metric untouched. Buckets with a NaN upper bound are
+// moved to the end.
+func sortedBuckets(buckets []*dto.Bucket) []*dto.Bucket {
+	less := func(bs []*dto.Bucket) func(i, j int) bool {
+		return func(i, j int) bool {
+			a, b := bs[i].GetUpperBound(), bs[j].GetUpperBound()
+			return a < b || (!math.IsNaN(a) && math.IsNaN(b))
+		}
+	}
+	if sort.SliceIsSorted(buckets, less(buckets)) {
+		return buckets
+	}
+	sorted := make([]*dto.Bucket, len(buckets))
+	copy(sorted, buckets)
+	sort.SliceStable(sorted, less(sorted))
+	return sorted
+}
+
+// writeMetricID writes the `# id` comment of the family with the given name,
+// as written in its HELP and TYPE lines, if WithMetricIDs has an ID for
+// familyName.
+func writeMetricID(w enhancedWriter, opts *encoderOption, familyName, name string) (written int, err error) {
+	id, ok := opts.metricID(familyName)
+	if !ok {
+		return 0, nil
+	}
+	var n int
+	n, err = w.WriteString("# id ")
+	written += n
+	if err != nil {
+		return
+	}
+	n, err = writeName(w, name)
+	written += n
+	if err != nil {
+		return
+	}
+	err = w.WriteByte(' ')
+	written++
+	if err != nil {
+		return
+	}
+	n, err = writeInt(w, int64(id))
+	written += n
+	if err != nil {
+		return
+	}
+	err = w.WriteByte('\n')
+	written++
+	return
+}
+
+// writeTextMetadata writes the `# id` comment (if any), the HELP (if any), and
+// the TYPE lines of in, using name as the name.
+func writeTextMetadata(
+	w enhancedWriter,
+	opts *encoderOption,
+	in *dto.MetricFamily,
+	name string,
+) (written int, err error) {
+	var n int
+	n, err = writeMetricID(w, opts, in.GetName(), name)
+	written += n
+	if err != nil {
+		return
+	}
+	// Comments, first HELP, then TYPE.
+	if in.Help != nil || opts.alwaysHelp {
+		n, err = w.WriteString("# HELP ")
+		written += n
+		if err != nil {
+			return
+		}
+		n, err = writeName(w, name)
+		written += n
+		if err != nil {
+			return
+		}
+		err = w.WriteByte(' ')
+		written++
+		if err != nil {
+			return
+		}
+		n, err = writeEscapedString(w, opts.help(in.GetHelp()), false)
+		written += n
+		if err != nil {
+			return
+		}
+		err = w.WriteByte('\n')
+		written++
+		if err != nil {
+			return
+		}
+	}
+	n, err = w.WriteString("# TYPE ")
+	written += n
+	if err != nil {
+		return
+	}
+	n, err = writeName(w, name)
+	written += n
+	if err != nil {
+		return
+	}
+	switch metricType := in.GetType(); metricType {
+	case dto.MetricType_COUNTER:
+		n, err = w.WriteString(" counter\n")
+	case dto.MetricType_GAUGE:
+		n, err = w.WriteString(" gauge\n")
+	case dto.MetricType_SUMMARY:
+		n, err = w.WriteString(" summary\n")
+	case dto.MetricType_UNTYPED:
+		n, err = w.WriteString(" untyped\n")
+	case dto.MetricType_HISTOGRAM:
+		n, err = w.WriteString(" histogram\n")
+	default:
+		return written, fmt.Errorf("unknown metric type %s", metricType.String())
+	}
+	written += n
+	return
+}
+
 // writeSample writes a single sample in text format to w, given the metric
 // name, the metric proto message itself, optionally an additional label name
 // with a float64 value (use empty string as label name if not required), and
@@ -287,15 +381,24 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 // encountered.
 func writeSample(
 	w enhancedWriter,
+	opts *encoderOption,
 	name, suffix string,
 	metric *dto.Metric,
 	additionalLabelName string, additionalLabelValue float64,
-	value float64,
+	value float64, raw string,
 ) (int, error) {
-	written := 0
-	n, err := writeNameAndLabelPairs(
-		w, name+suffix, metric.Label, additionalLabelName, additionalLabelValue,
+	var (
+		written int
+		n       int
+		err     error
 	)
+	if isLabelFree(name, metric, additionalLabelName) {
+		n, err = writeNameWithSuffix(w, name, suffix, false)
+	} else {
+		n, err = writeNameAndLabelPairs(
+			w, opts, name+suffix, metric.Label, additionalLabelName, additionalLabelValue,
+		)
+	}
 	written += n
 	if err != nil {
 		return written, err
@@ -305,7 +408,11 @@ func writeSample(
 	if err != nil {
 		return written, err
 	}
-	n, err = writeFloat(w, value)
+	if raw != "" {
+		n, err = w.WriteString(raw)
+	} else {
+		n, err = writeFloat(w, value)
+	}
 	written += n
 	if err != nil {
 		return written, err
@@ -330,6 +437,17 @@ func writeSample(
 	return written, nil
 }
 
+// isLabelFree returns whether a sample of metric with the given name and no
+// additional label can take the fast path of being written without any label
+// handling, i.e. whether the metric has no labels and name is a legacy metric
+// name, which is never quoted. The suffixes appended to name are legacy names
+// themselves, so name and suffix can be written one after the other without
+// concatenating them first.
+func isLabelFree(name string, metric *dto.Metric, additionalLabelName string) bool {
+	return len(metric.Label) == 0 && additionalLabelName == "" &&
+		model.IsValidLegacyMetricName(model.LabelValue(name))
+}
+
 // writeNameAndLabelPairs converts a slice of LabelPair proto messages plus the
 // explicitly given metric name and additional label pair into text formatted as
 // required by the text format and writes it to 'w'. An empty slice in
@@ -338,9 +456,10 @@ func writeSample(
 // the text format, and enclosed in '{...}'. The function returns the number of
 // bytes written and any error encountered. If the metric name is not
 // legacy-valid, it will be put inside the brackets as well. Legacy-invalid
-// label names will also be quoted.
+// label names will also be quoted. Label values are subject to opts.
 func writeNameAndLabelPairs(
 	w enhancedWriter,
+	opts *encoderOption,
 	name string,
 	in []*dto.LabelPair,
 	additionalLabelName string, additionalLabelValue float64,
@@ -382,12 +501,16 @@ func writeNameAndLabelPairs(
 	}
 
 	for _, lp := range in {
-		err := w.WriteByte(separator)
-		written++
+		value, err := opts.labelValue(lp.GetValue())
+		if err != nil {
+			return written, err
+		}
+		n, err := writeLabelSeparator(w, opts, separator)
+		written += n
 		if err != nil {
 			return written, err
 		}
-		n, err := writeName(w, lp.GetName())
+		n, err = writeName(w, lp.GetName())
 		written += n
 		if err != nil {
 			return written, err
@@ -397,7 +520,7 @@ func writeNameAndLabelPairs(
 		if err != nil {
 			return written, err
 		}
-		n, err = writeEscapedString(w, lp.GetValue(), true)
+		n, err = writeEscapedString(w, value, true)
 		written += n
 		if err != nil {
 			return written, err
@@ -410,12 +533,12 @@ func writeNameAndLabelPairs(
 		separator = ','
 	}
 	if additionalLabelName != "" {
-		err := w.WriteByte(separator)
-		written++
+		n, err := writeLabelSeparator(w, opts, separator)
+		written += n
 		if err != nil {
 			return written, err
 		}
-		n, err := w.WriteString(additionalLabelName)
+		n, err = w.WriteString(additionalLabelName)
 		written += n
 		if err != nil {
 			return written, err
@@ -425,7 +548,7 @@ func writeNameAndLabelPairs(
 		if err != nil {
 			return written, err
 		}
-		n, err = writeFloat(w, additionalLabelValue)
+		n, err = writeFloat(w, opts.bound(additionalLabelValue))
 		written += n
 		if err != nil {
 			return written, err
@@ -444,6 +567,16 @@ func writeNameAndLabelPairs(
 	return written, nil
 }
 
+// writeLabelSeparator writes the given separator preceding a label pair. A
+// comma is followed by a space if requested by opts.
+func writeLabelSeparator(w enhancedWriter, opts *encoderOption, separator byte) (int, error) {
+	err := w.WriteByte(separator)
+	if err != nil || separator != ',' || opts == nil || !opts.labelSeparatorSpace {
+		return 1, err
+	}
+	return 2, w.WriteByte(' ')
+}
+
 // writeEscapedString replaces '\' by '\\', new line character by '\n', and - if
 // includeDoubleQuote is true - '"' by '\"'.
 var (
@@ -401,6 +401,75 @@ name -Inf
 	}
 }
 
+func TestCreateSortsBuckets(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("latency"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(4),
+					SampleSum:   proto.Float64(1001),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(1e3), CumulativeCount: proto.Uint64(3)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(4)},
+						{UpperBound: proto.Float64(1e-9), CumulativeCount: proto.Uint64(1)},
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+					},
+				},
+			},
+		},
+	}
+	scenarios := []struct {
+		create func(*bytes.Buffer) error
+		out    string
+	}{
+		{
+			create: func(out *bytes.Buffer) error {
+				_, err := MetricFamilyToText(out, mf)
+				return err
+			},
+			out: `# TYPE latency histogram
+latency_bucket{le="1e-09"} 1
+latency_bucket{le="1"} 2
+latency_bucket{le="1000"} 3
+latency_bucket{le="+Inf"} 4
+latency_sum 1001
+latency_count 4
+`,
+		},
+		{
+			create: func(out *bytes.Buffer) error {
+				_, err := MetricFamilyToOpenMetrics(out, mf)
+				return err
+			},
+			out: `# TYPE latency histogram
+latency_bucket{le="1e-09"} 1
+latency_bucket{le="1.0"} 2
+latency_bucket{le="1000.0"} 3
+latency_bucket{le="+Inf"} 4
+latency_sum 1001.0
+latency_count 4
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := &bytes.Buffer{}
+		if err := scenario.create(out); err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if expected, got := scenario.out, out.String(); expected != got {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+	// The metric itself must not be modified.
+	if got := mf.Metric[0].Histogram.Bucket[0].GetUpperBound(); got != 1e3 {
+		t.Errorf("expected buckets of the metric to keep their order, first upper bound is %g", got)
+	}
+}
+
 func BenchmarkCreate(b *testing.B) {
 	mf := &dto.MetricFamily{
 		Name: proto.String("request_duration_microseconds"),
@@ -602,3 +671,212 @@ func TestCreateError(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateMetricIDs(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("requests_total"),
+			Help: proto.String("Number of requests."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{Counter: &dto.Counter{Value: proto.Float64(3)}},
+			},
+		},
+		{
+			Name: proto.String("temperature"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(21.5)}},
+			},
+		},
+		{
+			Name: proto.String("name.with.dots"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			},
+		},
+	}
+	ids := WithMetricIDs(map[string]int{
+		"requests_total": 42,
+		"name.with.dots": 7,
+		"unknown":        1,
+	})
+
+	scenarios := []struct {
+		create func(*bytes.Buffer, *dto.MetricFamily) error
+		parse  func(*bytes.Buffer) (map[string]*dto.MetricFamily, error)
+		out    string
+	}{
+		// 0: Text format.
+		{
+			create: func(out *bytes.Buffer, mf *dto.MetricFamily) error {
+				_, err := MetricFamilyToText(out, mf, ids)
+				return err
+			},
+			parse: func(in *bytes.Buffer) (map[string]*dto.MetricFamily, error) {
+				p := TextParser{QuotedNames: true}
+				return p.TextToMetricFamilies(in)
+			},
+			out: `# id requests_total 42
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total 3
+# TYPE temperature gauge
+temperature 21.5
+# id "name.with.dots" 7
+# TYPE "name.with.dots" gauge
+{"name.with.dots"} 1
+`,
+		},
+		// 1: OpenMetrics, using the name of the HELP and TYPE lines.
+		{
+			create: func(out *bytes.Buffer, mf *dto.MetricFamily) error {
+				_, err := MetricFamilyToOpenMetrics(out, mf, ids)
+				return err
+			},
+			parse: func(in *bytes.Buffer) (map[string]*dto.MetricFamily, error) {
+				if _, err := FinalizeOpenMetrics(in); err != nil {
+					return nil, err
+				}
+				return OpenMetricsToMetricFamilies(in)
+			},
+			out: `# id requests 42
+# HELP requests Number of requests.
+# TYPE requests counter
+requests_total 3.0
+# TYPE temperature gauge
+temperature 21.5
+# id "name.with.dots" 7
+# TYPE "name.with.dots" gauge
+{"name.with.dots"} 1.0
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.out)))
+		for _, mf := range families {
+			if err := scenario.create(out, mf); err != nil {
+				t.Fatalf("%d. unexpected error: %s", i, err)
+			}
+		}
+		if got := out.String(); got != scenario.out {
+			t.Errorf("%d. expected out=%q, got %q", i, scenario.out, got)
+		}
+		mfs, err := scenario.parse(out)
+		if err != nil {
+			t.Errorf("%d. unexpected error parsing the output: %s", i, err)
+			continue
+		}
+		for _, mf := range families {
+			if !proto.Equal(mfs[mf.GetName()], mf) {
+				t.Errorf("%d. expected parsed family %v, got %v", i, mf, mfs[mf.GetName()])
+			}
+		}
+	}
+}
+
+func TestLabelFreeFastPath(t *testing.T) {
+	scenarios := []struct {
+		name, suffix string
+		labelFree    bool
+	}{
+		{name: "up", labelFree: true},
+		{name: "rpc_duration_seconds", suffix: "_sum", labelFree: true},
+		{name: "rpc_duration_seconds", suffix: "_bucket", labelFree: true},
+		{name: "foos", suffix: "_total", labelFree: true},
+		{name: "name:with:colons_1", suffix: "_count", labelFree: true},
+		{name: "name.with.dots", suffix: "_sum"},
+		{name: "1starts_with_digit"},
+		{name: ""},
+	}
+
+	for i, scenario := range scenarios {
+		if got := isLabelFree(scenario.name, &dto.Metric{}, ""); got != scenario.labelFree {
+			t.Errorf("%d. expected label-free %t, got %t", i, scenario.labelFree, got)
+		}
+		if isLabelFree(scenario.name, &dto.Metric{}, "le") {
+			t.Errorf("%d. expected not label-free with additional label", i)
+		}
+		if !scenario.labelFree {
+			continue
+		}
+		var fast, text, openMetrics bytes.Buffer
+		if _, err := writeNameWithSuffix(&fast, scenario.name, scenario.suffix, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writeNameAndLabelPairs(&text, nil, scenario.name+scenario.suffix, nil, "", 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writeOpenMetricsNameAndLabelPairs(&openMetrics, nil, scenario.name, scenario.suffix, nil, "", 0); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := text.String(), fast.String(); expected != got {
+			t.Errorf("%d. expected text %q, got %q", i, expected, got)
+		}
+		if expected, got := openMetrics.String(), fast.String(); expected != got {
+			t.Errorf("%d. expected OpenMetrics %q, got %q", i, expected, got)
+		}
+	}
+}
+
+// labelFreeFamily returns a summary without labels or quantiles, all samples
+// of which are written on the label-free fast path.
+func labelFreeFamily() *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String("process_cpu_seconds"),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(42),
+					SampleSum:   proto.Float64(3.14),
+				},
+			},
+		},
+	}
+}
+
+func BenchmarkLabelFree(b *testing.B) {
+	out := bytes.NewBuffer(make([]byte, 0, 1024))
+	b.Run("names/general", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := writeNameAndLabelPairs(out, nil, "process_cpu_seconds"+"_count", nil, "", 0); err != nil {
+				b.Fatal(err)
+			}
+			out.Reset()
+		}
+	})
+	b.Run("names/fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if isLabelFree("process_cpu_seconds", &dto.Metric{}, "") {
+				if _, err := writeNameWithSuffix(out, "process_cpu_seconds", "_count", false); err != nil {
+					b.Fatal(err)
+				}
+			}
+			out.Reset()
+		}
+	})
+	mf := labelFreeFamily()
+	b.Run("text", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := MetricFamilyToText(out, mf); err != nil {
+				b.Fatal(err)
+			}
+			out.Reset()
+		}
+	})
+	b.Run("openmetrics", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := MetricFamilyToOpenMetrics(out, mf); err != nil {
+				b.Fatal(err)
+			}
+			out.Reset()
+		}
+	})
+}
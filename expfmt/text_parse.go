@@ -16,16 +16,24 @@ package expfmt
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/prometheus/common/model"
 )
@@ -36,21 +44,134 @@ import (
 // by nil.
 type stateFn func() stateFn
 
+// RawValues records the original text of the sample values parsed by a
+// TextParser. The values are identified by the pointers to them in the parsed
+// metric families, so a value is only found as long as the pointer isn't
+// replaced, and its text is only used as long as it still denotes the value,
+// i.e. not after the value has been modified in place. Only the values of the
+// most recent parse are kept, each parse starts afresh. Its zero value is ready
+// to use. It must not be used concurrently.
+type RawValues struct {
+	floats map[*float64]string
+	uints  map[*uint64]string
+}
+
+// float returns the text recorded for v or "" if there is none or it doesn't
+// denote the current value of v anymore. It is safe to call on a nil
+// RawValues.
+func (r *RawValues) float(v *float64) string {
+	if r == nil || v == nil {
+		return ""
+	}
+	raw := r.floats[v]
+	if raw == "" {
+		return ""
+	}
+	if f, err := parseFloat(raw); err != nil || (f != *v && !(math.IsNaN(f) && math.IsNaN(*v))) {
+		return ""
+	}
+	return raw
+}
+
+// uint returns the text recorded for v or "" if there is none or it doesn't
+// denote the current value of v anymore. It is safe to call on a nil
+// RawValues.
+func (r *RawValues) uint(v *uint64) string {
+	if r == nil || v == nil {
+		return ""
+	}
+	raw := r.uints[v]
+	if raw == "" {
+		return ""
+	}
+	if f, err := parseFloat(raw); err != nil || uint64(f) != *v {
+		return ""
+	}
+	return raw
+}
+
 // ParseError signals errors while parsing the simple and flat text-based
 // exchange format.
 type ParseError struct {
 	Line int
 	Msg  string
+	// Column and Context are only set if the TextParser has ErrorContext
+	// enabled. Column is the 1-based byte offset of the failing token within
+	// the line. Context is the offending line, followed by a line with a
+	// caret pointing at the failing token.
+	Column  int
+	Context string
 }
 
 // Error implements the error interface.
 func (e ParseError) Error() string {
+	if e.Context != "" {
+		return fmt.Sprintf("text format parsing error in line %d, column %d: %s\n%s", e.Line, e.Column, e.Msg, e.Context)
+	}
 	return fmt.Sprintf("text format parsing error in line %d: %s", e.Line, e.Msg)
 }
 
 // TextParser is used to parse the simple and flat text-based exchange format. Its
-// zero value is ready to use.
+// zero value is ready to use. Lines may end with "\n" or "\r\n".
 type TextParser struct {
+	// ErrorContext makes the parser keep track of the line currently parsed
+	// so that a ParseError can point at the failing token, like a compiler
+	// diagnostic. This is meant for debugging malformed input and comes with
+	// a small performance cost.
+	ErrorContext bool
+	// RequireSummarySumAndCount makes the parser return an error for any
+	// summary lacking its _sum or _count sample. By default, such summaries
+	// are accepted, leaving SampleSum or SampleCount unset.
+	RequireSummarySumAndCount bool
+	// RawValues, if set, receives the original text of every sample value
+	// parsed, so that it can be written out again byte by byte with the
+	// WithRawValues EncoderOption.
+	RawValues *RawValues
+	// MaxResultBytes, if positive, caps the size of the parsed metric
+	// families, so that compact input expanding in memory cannot exceed a
+	// hard limit. The size is measured incrementally as the protobuf
+	// encoded size of the metric families, which approximates their memory
+	// usage. Parsing fails once the cumulative size exceeds the budget.
+	// When streaming, families handed over still count towards it.
+	MaxResultBytes int
+	// OnFamilyError, if set, makes streaming (see StreamMetricFamilies)
+	// resilient against malformed families. Instead of failing, a syntax
+	// error within a family is handed to OnFamilyError, along with the
+	// 0-based index of the family among all families in the input and the
+	// byte offset of its first line. The family is dropped, and parsing
+	// resumes at the next empty line or HELP or TYPE line of another family.
+	// A malformed line not naming any family counts as a family of its
+	// own. The same applies to summaries rejected because of
+	// RequireSummarySumAndCount. Errors reading the input, a premature end
+	// of the input, an exceeded MaxResultBytes, and errors returned by the
+	// streaming callback still abort parsing. OnFamilyError has no effect
+	// on TextToMetricFamilies.
+	OnFamilyError func(index int, start int64, err error)
+	// VerifyChecksum makes the parser require a `# checksum sha256:<hex>`
+	// comment, as written by encoders created with the WithChecksum
+	// EncoderOption, and verify it against the SHA-256 hash of all bytes
+	// preceding it. Only generic comments, like the `# EOF` of OpenMetrics,
+	// may follow the checksum. A missing or mismatching checksum is an
+	// error. Note that when streaming, all families but the last one are
+	// handed over before the checksum is verified.
+	VerifyChecksum bool
+	// DefaultMetricType, if set, is the type assumed for metric families
+	// without a TYPE line, e.g. when migrating legacy exporters that omit
+	// them. Only COUNTER, GAUGE, and UNTYPED are supported. If it is nil,
+	// such families are untyped.
+	DefaultMetricType *dto.MetricType
+	// QuotedNames makes the parser accept metric and label names quoted
+	// like label values, as written by the encoders for names not passing
+	// the legacy validation check, e.g. names starting with a digit or
+	// containing dots. In samples, the quoted metric name is the first
+	// element of the label set, like `{"2xx_responses",code="200"} 1` or
+	// `{"2xx_responses"} 1`, in HELP and TYPE lines, it takes the place of
+	// the name, like `# TYPE "2xx_responses" counter`. Quoted label names
+	// take the place of the label name, like `{"name.1"="value"}`. Quoted
+	// names may be any non-empty UTF-8 string, including purely numeric
+	// ones.
+	QuotedNames bool
+
 	metricFamiliesByName map[string]*dto.MetricFamily
 	buf                  *bufio.Reader // Where the parsed input is read through.
 	err                  error         // Most recent error.
@@ -60,15 +181,37 @@ type TextParser struct {
 	currentMF            *dto.MetricFamily
 	currentMetric        *dto.Metric
 	currentLabelPair     *dto.LabelPair
+	currentLine          []byte // Only tracked if ErrorContext is true.
+	currentTokenStart    int    // Offset of the current token in currentLine.
+
+	// Only used when streaming.
+	onFamily    func(mf *dto.MetricFamily, start, end int64) error
+	offset      int64 // Number of bytes read from the input.
+	lineStart   int64 // Offset of the current line.
+	familyStart int64 // Offset of the first line of currentMF.
+	familyIndex int   // Index of currentMF among all families.
+	mfLine      int   // Line in which currentMF was last named.
+	recoverable bool  // Whether p.err is a syntax error confined to a family.
+
+	resultBytes int // Size of the parsed results, only tracked if MaxResultBytes > 0.
+
+	token *Token // Token of the current line, only used by Scanner.
+
+	// Only used if VerifyChecksum is true.
+	checksum     hash.Hash // Hash of all lines before the current one.
+	lineRaw      []byte    // Bytes of the current line, not hashed yet.
+	checksumSeen bool
 
 	// The remaining member variables are only used for summaries/histograms.
 	currentLabels map[string]string // All labels including '__name__' but excluding 'quantile'/'le'
 	// Summary specific.
-	summaries       map[uint64]*dto.Metric // Key is created with LabelsToSignature.
-	currentQuantile float64
+	summaries          map[uint64]*dto.Metric // Key is created with LabelsToSignature.
+	currentQuantile    float64
+	currentHasQuantile bool // Needed as the quantile itself might be NaN.
 	// Histogram specific.
-	histograms    map[uint64]*dto.Metric // Key is created with LabelsToSignature.
-	currentBucket float64
+	histograms       map[uint64]*dto.Metric // Key is created with LabelsToSignature.
+	currentBucket    float64
+	currentHasBucket bool // Needed as the bucket bound itself might be NaN.
 	// These tell us if the currently processed line ends on '_count' or
 	// '_sum' respectively and belong to a summary/histogram, representing the sample
 	// count and sum of that summary/histogram.
@@ -100,16 +243,106 @@ type TextParser struct {
 // This method must not be called concurrently. If you want to parse different
 // input concurrently, instantiate a separate Parser for each goroutine.
 func (p *TextParser) TextToMetricFamilies(in io.Reader) (map[string]*dto.MetricFamily, error) {
-	p.reset(in)
-	for nextState := p.startOfLine; nextState != nil; nextState = nextState() {
-		// Magic happens here...
-	}
+	p.onFamily = nil
+	p.parse(in)
 	// Get rid of empty metric families.
 	for k, mf := range p.metricFamiliesByName {
 		if len(mf.GetMetric()) == 0 {
 			delete(p.metricFamiliesByName, k)
 		}
 	}
+	if p.err == nil && p.RequireSummarySumAndCount {
+		names := make([]string, 0, len(p.metricFamiliesByName))
+		for name := range p.metricFamiliesByName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if p.err = p.checkSummary(p.metricFamiliesByName[name]); p.err != nil {
+				break
+			}
+		}
+	}
+	return p.metricFamiliesByName, p.err
+}
+
+// StreamMetricFamilies reads 'in' like TextToMetricFamilies but hands each
+// MetricFamily to fn as soon as it is complete, i.e. once the parser has moved
+// on to the next family or reached the end of the input. The families are
+// handed over in the order in which they appear in the input, and families
+// without any metrics are skipped. Parsing stops at the first error, including
+// an error returned by fn, which is then returned.
+//
+// Only the family currently being parsed is kept in memory. As a consequence,
+// the metrics of a family have to be presented contiguously (as required by the
+// exposition format anyway). Should a family re-appear later in the input, it
+// is handed over once more as a separate MetricFamily, and any leading _sum or
+// _count samples of a summary or histogram are not recognized as such.
+//
+// This method must not be called concurrently.
+func (p *TextParser) StreamMetricFamilies(in io.Reader, fn func(*dto.MetricFamily) error) error {
+	return p.StreamMetricFamiliesWithOffsets(in, func(mf *dto.MetricFamily, _, _ int64) error {
+		return fn(mf)
+	})
+}
+
+// StreamMetricFamiliesWithOffsets works like StreamMetricFamilies but also
+// hands the byte offsets [start, end) of each family within 'in' to fn, e.g.
+// to build an index for re-reading single families later. The range starts
+// with the first line of the family (usually its HELP or TYPE line) and ends
+// where the next family starts (or at the end of the input), so it includes
+// any generic comments and empty lines following the family. Parsing the
+// range on its own yields the same family.
+func (p *TextParser) StreamMetricFamiliesWithOffsets(in io.Reader, fn func(mf *dto.MetricFamily, start, end int64) error) error {
+	p.onFamily = fn
+	defer func() { p.onFamily = nil }()
+	p.parse(in)
+	if p.err == nil && p.currentMF != nil {
+		p.err = p.handOver(p.currentMF, p.offset)
+	}
+	return p.err
+}
+
+// ParseToChannel parses 'in' in the text-based exchange format in a separate
+// goroutine and sends each MetricFamily on the returned family channel as soon
+// as it is complete (see TextParser.StreamMetricFamilies). Both channels are
+// closed once the input is exhausted. If parsing fails, the error is sent on
+// the error channel before the channels are closed. The error channel is
+// buffered, so the goroutine never blocks on it, but the caller has to drain
+// the family channel for the goroutine to finish.
+func ParseToChannel(in io.Reader) (<-chan *dto.MetricFamily, <-chan error) {
+	var (
+		families = make(chan *dto.MetricFamily)
+		errs     = make(chan error, 1)
+	)
+	go func() {
+		defer close(errs)
+		defer close(families)
+		var p TextParser
+		if err := p.StreamMetricFamilies(in, func(mf *dto.MetricFamily) error {
+			families <- mf
+			return nil
+		}); err != nil {
+			errs <- err
+		}
+	}()
+	return families, errs
+}
+
+// parse runs the state machine over 'in', leaving the result in p.
+func (p *TextParser) parse(in io.Reader) {
+	p.reset(in)
+	if t := p.DefaultMetricType; t != nil &&
+		*t != dto.MetricType_COUNTER && *t != dto.MetricType_GAUGE && *t != dto.MetricType_UNTYPED {
+		p.err = fmt.Errorf("unsupported default metric type %s", t)
+		return
+	}
+	for nextState := p.startOfLine; nextState != nil; {
+		// Magic happens here...
+		if nextState = nextState(); nextState == nil && p.err != nil {
+			nextState = p.recoverFamily()
+		}
+	}
 	// If p.err is io.EOF now, we have run into a premature end of the input
 	// stream. Turn this error into something nicer and more
 	// meaningful. (io.EOF is often used as a signal for the legitimate end
@@ -117,7 +350,151 @@ func (p *TextParser) TextToMetricFamilies(in io.Reader) (map[string]*dto.MetricF
 	if p.err != nil && errors.Is(p.err, io.EOF) {
 		p.parseError("unexpected end of input stream")
 	}
-	return p.metricFamiliesByName, p.err
+	if p.err == nil && p.VerifyChecksum && !p.checksumSeen {
+		p.checksumError("missing checksum")
+	}
+}
+
+// handOver passes mf, which ends at the given offset, to p.onFamily (unless it
+// has no metrics) and forgets about it.
+func (p *TextParser) handOver(mf *dto.MetricFamily, end int64) error {
+	if p.metricFamiliesByName[mf.GetName()] == mf {
+		delete(p.metricFamiliesByName, mf.GetName())
+	}
+	if len(mf.GetMetric()) == 0 {
+		return nil
+	}
+	if err := p.checkSummary(mf); err != nil {
+		if p.OnFamilyError == nil {
+			return err
+		}
+		p.OnFamilyError(p.familyIndex, p.familyStart, err)
+		return nil
+	}
+	return p.onFamily(mf, p.familyStart, end)
+}
+
+// recoverFamily is called once the state machine has stopped with p.err set.
+// If OnFamilyError is set and the error is a syntax error, it reports the
+// error, drops the family it occurred in, and returns the state to resume
+// parsing with at the start of the next family. Otherwise, it returns nil.
+func (p *TextParser) recoverFamily() stateFn {
+	if p.OnFamilyError == nil || p.onFamily == nil || !p.recoverable {
+		return nil
+	}
+	err := p.err
+	lineDone := p.ErrorContext || p.currentByte == '\n' // errorContext reads the whole line.
+	p.err, p.recoverable = nil, false
+
+	var badName string
+	if p.currentMF != nil && p.mfLine == p.lineCount {
+		// The failing line belongs to the current family.
+		badName = p.currentMF.GetName()
+		if p.metricFamiliesByName[badName] == p.currentMF {
+			delete(p.metricFamiliesByName, badName)
+		}
+		p.OnFamilyError(p.familyIndex, p.familyStart, err)
+	} else {
+		// The failing line doesn't name any family, so the current
+		// family ends before it.
+		if p.currentMF != nil {
+			if p.err = p.handOver(p.currentMF, p.lineStart); p.err != nil {
+				return nil
+			}
+		}
+		p.familyIndex++
+		p.OnFamilyError(p.familyIndex, p.lineStart, err)
+	}
+	p.currentMF = nil
+
+	if !lineDone {
+		if p.skipLine(); p.err != nil {
+			return nil
+		}
+	}
+	for !p.atFamilyBoundary(badName) {
+		p.lineCount++
+		p.currentLine = p.currentLine[:0]
+		if p.skipLine(); p.err != nil {
+			return nil
+		}
+	}
+	return p.startOfLine
+}
+
+// skipLine reads up to and including the next '\n'. Reaching the end of the
+// input is not considered an error.
+func (p *TextParser) skipLine() {
+	for {
+		if p.currentByte, p.err = p.readByte(); p.err != nil {
+			if errors.Is(p.err, io.EOF) {
+				p.err = nil
+				p.currentByte = '\n'
+			}
+			return
+		}
+		if p.currentByte == '\n' {
+			return
+		}
+	}
+}
+
+// atFamilyBoundary returns whether the next line is empty or a HELP or TYPE
+// line of a family other than badName. It also returns true at the end of the
+// input (or on a read error), leaving it to startOfLine to deal with.
+func (p *TextParser) atFamilyBoundary(badName string) bool {
+	const prefixLen = len("# HELP ")
+	next, _ := p.buf.Peek(prefixLen + len(badName) + 1)
+	switch {
+	case len(next) == 0:
+		return true
+	case next[0] == '\n', bytes.HasPrefix(next, []byte("\r\n")):
+		return true
+	case !bytes.HasPrefix(next, []byte("# HELP ")) && !bytes.HasPrefix(next, []byte("# TYPE ")):
+		return false
+	case badName == "":
+		return true
+	}
+	name := next[prefixLen:]
+	if !bytes.HasPrefix(name, []byte(badName)) {
+		return true
+	}
+	if len(name) == len(badName) {
+		return false // The input ends after the name.
+	}
+	end := name[len(badName)]
+	return !isBlankOrTab(end) && end != '\n' && end != '\r'
+}
+
+// checkSummary returns an error if RequireSummarySumAndCount is set and mf is a
+// summary with a metric lacking its sum or count.
+func (p *TextParser) checkSummary(mf *dto.MetricFamily) error {
+	if !p.RequireSummarySumAndCount || mf.GetType() != dto.MetricType_SUMMARY {
+		return nil
+	}
+	for _, m := range mf.Metric {
+		var (
+			missing string
+			summary = m.GetSummary()
+		)
+		switch {
+		case summary == nil || summary.SampleSum == nil:
+			missing = "_sum"
+		case summary.SampleCount == nil:
+			missing = "_count"
+		default:
+			continue
+		}
+		labels := make(model.LabelSet, len(m.Label))
+		for _, l := range m.Label {
+			labels[model.LabelName(l.GetName())] = model.LabelValue(l.GetValue())
+		}
+		return ParseError{
+			Line: p.lineCount,
+			Msg:  fmt.Sprintf("summary %s%s is missing its %s sample", mf.GetName(), labels, missing),
+		}
+	}
+	return nil
 }
 
 func (p *TextParser) reset(in io.Reader) {
@@ -129,6 +506,17 @@ func (p *TextParser) reset(in io.Reader) {
 	}
 	p.err = nil
 	p.lineCount = 0
+	p.currentMF = nil
+	if p.RawValues != nil {
+		p.RawValues.floats, p.RawValues.uints = nil, nil
+	}
+	p.resultBytes = 0
+	p.offset = 0
+	p.lineStart = 0
+	p.familyStart = 0
+	p.familyIndex = -1
+	p.mfLine = 0
+	p.recoverable = false
 	if p.summaries == nil || len(p.summaries) > 0 {
 		p.summaries = map[uint64]*dto.Metric{}
 	}
@@ -136,13 +524,34 @@ func (p *TextParser) reset(in io.Reader) {
 		p.histograms = map[uint64]*dto.Metric{}
 	}
 	p.currentQuantile = math.NaN()
+	p.currentHasQuantile = false
 	p.currentBucket = math.NaN()
+	p.currentHasBucket = false
+	if p.VerifyChecksum {
+		if p.checksum == nil {
+			p.checksum = sha256.New()
+		} else {
+			p.checksum.Reset()
+		}
+	}
+	p.lineRaw = p.lineRaw[:0]
+	p.checksumSeen = false
 }
 
 // startOfLine represents the state where the next byte read from p.buf is the
 // start of a line (or whitespace leading up to it).
 func (p *TextParser) startOfLine() stateFn {
+	if p.token != nil {
+		p.token.Line = p.lineCount
+		p.token.Raw = strings.TrimSuffix(string(p.currentLine), "\n")
+	}
+	if p.VerifyChecksum {
+		p.checksum.Write(p.lineRaw)
+		p.lineRaw = p.lineRaw[:0]
+	}
 	p.lineCount++
+	p.currentLine = p.currentLine[:0]
+	p.lineStart = p.offset
 	if p.skipBlankTab(); p.err != nil {
 		// This is the only place that we expect to see io.EOF,
 		// which is not an error but the signal that we are done.
@@ -159,12 +568,19 @@ func (p *TextParser) startOfLine() stateFn {
 	case '\n':
 		return p.startOfLine // Empty line, start the next one.
 	}
+	if p.checksumSeen {
+		p.checksumError("unexpected sample after checksum")
+		return nil
+	}
 	return p.readingMetricName
 }
 
 // startComment represents the state where the next byte read from p.buf is the
 // start of a comment (or whitespace leading up to it).
 func (p *TextParser) startComment() stateFn {
+	if p.token != nil {
+		p.token.Kind = TokenComment
+	}
 	if p.skipBlankTab(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
@@ -174,16 +590,31 @@ func (p *TextParser) startComment() stateFn {
 	if p.readTokenUntilWhitespace(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
+	if p.token != nil {
+		p.token.setKeyword(p.currentToken.String())
+	}
+	if p.VerifyChecksum {
+		switch keyword := p.currentToken.String(); {
+		case keyword == "checksum":
+			return p.readingChecksum
+		case p.checksumSeen && (keyword == "HELP" || keyword == "TYPE"):
+			p.checksumError(fmt.Sprintf("unexpected %s line after checksum", keyword))
+			return nil
+		}
+	}
 	// If we have hit the end of line already, there is nothing left
 	// to do. This is not considered a syntax error.
 	if p.currentByte == '\n' {
 		return p.startOfLine
 	}
 	keyword := p.currentToken.String()
+	if keyword == "UNIT" && p.token != nil {
+		return p.readingUnit
+	}
 	if keyword != "HELP" && keyword != "TYPE" {
 		// Generic comment, ignore by fast forwarding to end of line.
 		for p.currentByte != '\n' {
-			if p.currentByte, p.err = p.buf.ReadByte(); p.err != nil {
+			if p.currentByte, p.err = p.readByte(); p.err != nil {
 				return nil // Unexpected end of input.
 			}
 		}
@@ -193,7 +624,11 @@ func (p *TextParser) startComment() stateFn {
 	if p.skipBlankTab(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
-	if p.readTokenAsMetricName(); p.err != nil {
+	if p.QuotedNames && p.currentByte == '"' {
+		if p.readTokenAsQuotedName(); p.err != nil {
+			return nil
+		}
+	} else if p.readTokenAsMetricName(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
 	if p.currentByte == '\n' {
@@ -205,7 +640,12 @@ func (p *TextParser) startComment() stateFn {
 		p.parseError("invalid metric name in comment")
 		return nil
 	}
-	p.setOrCreateCurrentMF()
+	if p.token != nil {
+		p.token.Name = p.currentToken.String()
+	}
+	if p.setOrCreateCurrentMF(); p.err != nil {
+		return nil
+	}
 	if p.skipBlankTab(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
@@ -224,19 +664,37 @@ func (p *TextParser) startComment() stateFn {
 }
 
 // readingMetricName represents the state where the last byte read (now in
-// p.currentByte) is the first byte of a metric name.
+// p.currentByte) is the first byte of a metric name, or the '{' of a label set
+// starting with the quoted metric name if QuotedNames is set.
 func (p *TextParser) readingMetricName() stateFn {
-	if p.readTokenAsMetricName(); p.err != nil {
+	quoted := p.QuotedNames && p.currentByte == '{'
+	if quoted {
+		if p.skipBlankTab(); p.err != nil {
+			return nil // Unexpected end of input.
+		}
+		if p.readTokenAsQuotedName(); p.err != nil {
+			return nil
+		}
+	} else if p.readTokenAsMetricName(); p.err != nil {
 		return nil
 	}
 	if p.currentToken.Len() == 0 {
 		p.parseError("invalid metric name")
 		return nil
 	}
-	p.setOrCreateCurrentMF()
+	if p.token != nil {
+		p.token.Kind = TokenSample
+		p.token.Name = p.currentToken.String()
+	}
+	if p.setOrCreateCurrentMF(); p.err != nil {
+		return nil
+	}
 	// Now is the time to fix the type if it hasn't happened yet.
 	if p.currentMF.Type == nil {
 		p.currentMF.Type = dto.MetricType_UNTYPED.Enum()
+		if p.DefaultMetricType != nil {
+			p.currentMF.Type = p.DefaultMetricType.Enum()
+		}
 	}
 	p.currentMetric = &dto.Metric{}
 	// Do not append the newly created currentMetric to
@@ -246,6 +704,9 @@ func (p *TextParser) readingMetricName() stateFn {
 	if p.skipBlankTabIfCurrentBlankTab(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
+	if quoted {
+		return p.readingLabelsAfterQuotedName
+	}
 	return p.readingLabels
 }
 
@@ -253,19 +714,44 @@ func (p *TextParser) readingMetricName() stateFn {
 // p.currentByte) is either the first byte of the label set (i.e. a '{'), or the
 // first byte of the value (otherwise).
 func (p *TextParser) readingLabels() stateFn {
-	// Summaries/histograms are special. We have to reset the
-	// currentLabels map, currentQuantile and currentBucket before starting to
-	// read labels.
+	p.resetCurrentLabels()
+	if p.currentByte != '{' {
+		return p.readingValue
+	}
+	return p.startLabelName
+}
+
+// readingLabelsAfterQuotedName represents the state where the last byte read
+// (now in p.currentByte) follows the quoted metric name at the start of the
+// label set, i.e. it is either a ',' followed by the labels, or the closing
+// '}'.
+func (p *TextParser) readingLabelsAfterQuotedName() stateFn {
+	p.resetCurrentLabels()
+	switch p.currentByte {
+	case ',':
+		return p.startLabelName
+	case '}':
+		if p.skipBlankTab(); p.err != nil {
+			return nil // Unexpected end of input.
+		}
+		return p.readingValue
+	}
+	p.parseError(fmt.Sprintf("expected ',' or '}' after quoted metric name, found %q", p.currentByte))
+	return nil
+}
+
+// resetCurrentLabels prepares reading the labels of a sample. Summaries and
+// histograms are special. We have to reset the currentLabels map,
+// currentQuantile and currentBucket before starting to read labels.
+func (p *TextParser) resetCurrentLabels() {
 	if p.currentMF.GetType() == dto.MetricType_SUMMARY || p.currentMF.GetType() == dto.MetricType_HISTOGRAM {
 		p.currentLabels = map[string]string{}
 		p.currentLabels[string(model.MetricNameLabel)] = p.currentMF.GetName()
 		p.currentQuantile = math.NaN()
+		p.currentHasQuantile = false
 		p.currentBucket = math.NaN()
+		p.currentHasBucket = false
 	}
-	if p.currentByte != '{' {
-		return p.readingValue
-	}
-	return p.startLabelName
 }
 
 // startLabelName represents the state where the next byte read from p.buf is
@@ -280,7 +766,11 @@ func (p *TextParser) startLabelName() stateFn {
 		}
 		return p.readingValue
 	}
-	if p.readTokenAsLabelName(); p.err != nil {
+	if p.QuotedNames && p.currentByte == '"' {
+		if p.readTokenAsQuotedName(); p.err != nil {
+			return nil
+		}
+	} else if p.readTokenAsLabelName(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
 	if p.currentToken.Len() == 0 {
@@ -337,6 +827,12 @@ func (p *TextParser) startLabelValue() stateFn {
 		return nil
 	}
 	p.currentLabelPair.Value = proto.String(p.currentToken.String())
+	if p.token != nil {
+		p.token.Labels = append(p.token.Labels, &dto.LabelPair{
+			Name:  proto.String(p.currentLabelPair.GetName()),
+			Value: proto.String(p.currentLabelPair.GetValue()),
+		})
+	}
 	// Special treatment of summaries:
 	// - Quantile labels are special, will result in dto.Quantile later.
 	// - Other labels have to be added to currentLabels for signature calculation.
@@ -347,6 +843,7 @@ func (p *TextParser) startLabelValue() stateFn {
 				p.parseError(fmt.Sprintf("expected float as value for 'quantile' label, got %q", p.currentLabelPair.GetValue()))
 				return nil
 			}
+			p.currentHasQuantile = true
 		} else {
 			p.currentLabels[p.currentLabelPair.GetName()] = p.currentLabelPair.GetValue()
 		}
@@ -359,6 +856,7 @@ func (p *TextParser) startLabelValue() stateFn {
 				p.parseError(fmt.Sprintf("expected float as value for 'le' label, got %q", p.currentLabelPair.GetValue()))
 				return nil
 			}
+			p.currentHasBucket = true
 		} else {
 			p.currentLabels[p.currentLabelPair.GetName()] = p.currentLabelPair.GetValue()
 		}
@@ -387,10 +885,12 @@ func (p *TextParser) readingValue() stateFn {
 	// When we are here, we have read all the labels, so for the
 	// special case of a summary/histogram, we can finally find out
 	// if the metric already exists.
+	isNew := true
 	if p.currentMF.GetType() == dto.MetricType_SUMMARY {
 		signature := model.LabelsToSignature(p.currentLabels)
 		if summary := p.summaries[signature]; summary != nil {
 			p.currentMetric = summary
+			isNew = false
 		} else {
 			p.summaries[signature] = p.currentMetric
 			p.currentMF.Metric = append(p.currentMF.Metric, p.currentMetric)
@@ -399,6 +899,7 @@ func (p *TextParser) readingValue() stateFn {
 		signature := model.LabelsToSignature(p.currentLabels)
 		if histogram := p.histograms[signature]; histogram != nil {
 			p.currentMetric = histogram
+			isNew = false
 		} else {
 			p.histograms[signature] = p.currentMetric
 			p.currentMF.Metric = append(p.currentMF.Metric, p.currentMetric)
@@ -409,19 +910,23 @@ func (p *TextParser) readingValue() stateFn {
 	if p.readTokenUntilWhitespace(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
-	value, err := parseFloat(p.currentToken.String())
+	raw := p.currentToken.String()
+	value, err := parseFloat(raw)
 	if err != nil {
 		// Create a more helpful error message.
-		p.parseError(fmt.Sprintf("expected float as value, got %q", p.currentToken.String()))
+		p.parseError(fmt.Sprintf("expected float as value, got %q", raw))
 		return nil
 	}
+	if p.token != nil {
+		p.token.Value = value
+	}
 	switch p.currentMF.GetType() {
 	case dto.MetricType_COUNTER:
-		p.currentMetric.Counter = &dto.Counter{Value: proto.Float64(value)}
+		p.currentMetric.Counter = &dto.Counter{Value: p.floatValue(value, raw)}
 	case dto.MetricType_GAUGE:
-		p.currentMetric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		p.currentMetric.Gauge = &dto.Gauge{Value: p.floatValue(value, raw)}
 	case dto.MetricType_UNTYPED:
-		p.currentMetric.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+		p.currentMetric.Untyped = &dto.Untyped{Value: p.floatValue(value, raw)}
 	case dto.MetricType_SUMMARY:
 		// *sigh*
 		if p.currentMetric.Summary == nil {
@@ -429,15 +934,15 @@ func (p *TextParser) readingValue() stateFn {
 		}
 		switch {
 		case p.currentIsSummaryCount:
-			p.currentMetric.Summary.SampleCount = proto.Uint64(uint64(value))
+			p.currentMetric.Summary.SampleCount = p.uintValue(value, raw)
 		case p.currentIsSummarySum:
-			p.currentMetric.Summary.SampleSum = proto.Float64(value)
-		case !math.IsNaN(p.currentQuantile):
+			p.currentMetric.Summary.SampleSum = p.floatValue(value, raw)
+		case p.currentHasQuantile:
 			p.currentMetric.Summary.Quantile = append(
 				p.currentMetric.Summary.Quantile,
 				&dto.Quantile{
 					Quantile: proto.Float64(p.currentQuantile),
-					Value:    proto.Float64(value),
+					Value:    p.floatValue(value, raw),
 				},
 			)
 		}
@@ -448,33 +953,103 @@ func (p *TextParser) readingValue() stateFn {
 		}
 		switch {
 		case p.currentIsHistogramCount:
-			p.currentMetric.Histogram.SampleCount = proto.Uint64(uint64(value))
+			p.currentMetric.Histogram.SampleCount = p.uintValue(value, raw)
 		case p.currentIsHistogramSum:
-			p.currentMetric.Histogram.SampleSum = proto.Float64(value)
-		case !math.IsNaN(p.currentBucket):
+			p.currentMetric.Histogram.SampleSum = p.floatValue(value, raw)
+		case p.currentHasBucket:
 			p.currentMetric.Histogram.Bucket = append(
 				p.currentMetric.Histogram.Bucket,
 				&dto.Bucket{
 					UpperBound:      proto.Float64(p.currentBucket),
-					CumulativeCount: proto.Uint64(uint64(value)),
+					CumulativeCount: p.uintValue(value, raw),
 				},
 			)
 		}
 	default:
 		p.err = fmt.Errorf("unexpected type for metric name %q", p.currentMF.GetName())
 	}
+	if !p.account(func() int { return p.sampleSize(isNew) }) {
+		return nil
+	}
 	if p.currentByte == '\n' {
 		return p.startOfLine
 	}
 	return p.startTimestamp
 }
 
+// sampleSize returns the number of bytes the sample just parsed has added to
+// the results, given whether it created a new metric.
+func (p *TextParser) sampleSize(isNew bool) int {
+	const fieldSize = 1 + 8 // Tag and fixed64 or (at most) varint.
+	switch {
+	case isNew:
+		size := proto.Size(p.currentMetric)
+		return protowire.SizeBytes(size) + 1
+	case p.currentHasQuantile && !p.currentIsSummaryCount && !p.currentIsSummarySum:
+		q := p.currentMetric.Summary.Quantile
+		return protowire.SizeBytes(proto.Size(q[len(q)-1])) + 1
+	case p.currentHasBucket && !p.currentIsHistogramCount && !p.currentIsHistogramSum:
+		b := p.currentMetric.Histogram.Bucket
+		return protowire.SizeBytes(proto.Size(b[len(b)-1])) + 1
+	}
+	return fieldSize
+}
+
+// account adds the number of bytes returned by size to the size of the parsed
+// results. If that exceeds MaxResultBytes, it sets a parse error and returns
+// false. size is only called if MaxResultBytes is set, so that the results are
+// not measured in vain.
+func (p *TextParser) account(size func() int) bool {
+	if p.MaxResultBytes <= 0 {
+		return true
+	}
+	p.resultBytes += size()
+	if p.resultBytes > p.MaxResultBytes {
+		p.parseError(fmt.Sprintf("parsed metric families exceed the budget of %d bytes", p.MaxResultBytes))
+		p.recoverable = false
+		return false
+	}
+	return true
+}
+
+// floatValue returns a pointer to v, recording raw as its text if RawValues is
+// set.
+func (p *TextParser) floatValue(v float64, raw string) *float64 {
+	ptr := proto.Float64(v)
+	if p.RawValues != nil {
+		if p.RawValues.floats == nil {
+			p.RawValues.floats = map[*float64]string{}
+		}
+		p.RawValues.floats[ptr] = raw
+	}
+	return ptr
+}
+
+// uintValue returns a pointer to v converted to uint64, recording raw as its
+// text if RawValues is set.
+func (p *TextParser) uintValue(v float64, raw string) *uint64 {
+	ptr := proto.Uint64(uint64(v))
+	if p.RawValues != nil {
+		if p.RawValues.uints == nil {
+			p.RawValues.uints = map[*uint64]string{}
+		}
+		p.RawValues.uints[ptr] = raw
+	}
+	return ptr
+}
+
 // startTimestamp represents the state where the next byte read from p.buf is
 // the start of the timestamp (or whitespace leading up to it).
 func (p *TextParser) startTimestamp() stateFn {
 	if p.skipBlankTab(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
+	if p.token != nil && p.currentByte == '#' {
+		if p.readTokenUntilNewlineVerbatim(); p.err != nil {
+			return nil // Unexpected end of input.
+		}
+		return p.readingExemplar(p.currentToken.String())
+	}
 	if p.readTokenUntilWhitespace(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
@@ -485,16 +1060,42 @@ func (p *TextParser) startTimestamp() stateFn {
 		return nil
 	}
 	p.currentMetric.TimestampMs = proto.Int64(timestamp)
-	if p.readTokenUntilNewline(false); p.err != nil {
+	if p.token != nil {
+		p.token.TimestampMs = proto.Int64(timestamp)
+	}
+	if p.token != nil {
+		// The rest of the line might be an exemplar, whose label values
+		// have to keep their backslashes.
+		p.readTokenUntilNewlineVerbatim()
+	} else {
+		p.readTokenUntilNewline(false)
+	}
+	if p.err != nil {
 		return nil // Unexpected end of input.
 	}
 	if p.currentToken.Len() > 0 {
+		if rest := strings.TrimLeft(p.currentToken.String(), " \t"); p.token != nil && rest != "" && rest[0] == '#' {
+			return p.readingExemplar(rest)
+		}
 		p.parseError(fmt.Sprintf("spurious string after timestamp: %q", p.currentToken.String()))
 		return nil
 	}
 	return p.startOfLine
 }
 
+// readingExemplar parses the exemplar at the end of a sample line, i.e. rest
+// starting with '#', into p.token and returns the state for the next line. The
+// text format knows no exemplars, so only a Scanner gets here.
+func (p *TextParser) readingExemplar(rest string) stateFn {
+	e, err := parseExemplar(strings.TrimLeft(rest[1:], " \t"))
+	if err != nil {
+		p.parseError(err.Error())
+		return nil
+	}
+	p.token.Exemplar = e
+	return p.startOfLine
+}
+
 // readingHelp represents the state where the last byte read (now in
 // p.currentByte) is the first byte of the docstring after 'HELP'.
 func (p *TextParser) readingHelp() stateFn {
@@ -507,6 +1108,12 @@ func (p *TextParser) readingHelp() stateFn {
 		return nil // Unexpected end of input.
 	}
 	p.currentMF.Help = proto.String(p.currentToken.String())
+	if p.token != nil {
+		p.token.Help = p.currentMF.GetHelp()
+	}
+	if !p.account(func() int { return protowire.SizeBytes(len(*p.currentMF.Help)) + 1 }) {
+		return nil
+	}
 	return p.startOfLine
 }
 
@@ -527,23 +1134,156 @@ func (p *TextParser) readingType() stateFn {
 		return nil
 	}
 	p.currentMF.Type = dto.MetricType(metricType).Enum()
+	if p.token != nil {
+		p.token.Type = p.currentMF.GetType()
+	}
 	return p.startOfLine
 }
 
+// readingUnit represents the state where the last byte read (now in
+// p.currentByte) follows the 'UNIT' keyword of a comment. The text format
+// knows no units, so only a Scanner gets here, and the line is taken apart
+// without being validated. Otherwise, UNIT lines are generic comments.
+func (p *TextParser) readingUnit() stateFn {
+	if p.skipBlankTab(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	if p.currentByte == '\n' {
+		return p.startOfLine
+	}
+	if p.readTokenUntilWhitespace(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	p.token.Name = p.currentToken.String()
+	if p.skipBlankTabIfCurrentBlankTab(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	if p.readTokenUntilNewline(false); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	p.token.Unit = strings.TrimRight(p.currentToken.String(), " \t")
+	return p.startOfLine
+}
+
+// readingChecksum represents the state where the last byte read (now in
+// p.currentByte) follows the 'checksum' keyword of a comment.
+func (p *TextParser) readingChecksum() stateFn {
+	if p.checksumSeen {
+		p.checksumError("second checksum line")
+		return nil
+	}
+	computed := hex.EncodeToString(p.checksum.Sum(nil))
+	if p.skipBlankTabIfCurrentBlankTab(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	if p.readTokenUntilNewline(false); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	value := strings.TrimRight(p.currentToken.String(), " \t")
+	algorithm, sum, ok := strings.Cut(value, ":")
+	if !ok || algorithm != "sha256" {
+		p.checksumError(fmt.Sprintf("invalid checksum %q, expected sha256:<hex>", value))
+		return nil
+	}
+	if sum != computed {
+		p.checksumError(fmt.Sprintf("checksum mismatch, expected sha256:%s", computed))
+		return nil
+	}
+	p.checksumSeen = true
+	return p.startOfLine
+}
+
+// checksumError works like parseError, but the error is never recoverable
+// (see OnFamilyError), as it concerns the input as a whole.
+func (p *TextParser) checksumError(msg string) {
+	p.parseError(msg)
+	p.recoverable = false
+}
+
 // parseError sets p.err to a ParseError at the current line with the given
 // message.
 func (p *TextParser) parseError(msg string) {
-	p.err = ParseError{
+	err := ParseError{
 		Line: p.lineCount,
 		Msg:  msg,
 	}
+	if p.ErrorContext {
+		err.Column, err.Context = p.errorContext()
+	}
+	p.err = err
+	p.recoverable = true
+}
+
+// errorContext reads the remainder of the current line and returns the column
+// of the current token and the line with a caret pointing at that column.
+func (p *TextParser) errorContext() (int, string) {
+	if n := len(p.currentLine); n == 0 || p.currentLine[n-1] != '\n' {
+		for {
+			if b, err := p.readByte(); err != nil || b == '\n' {
+				break
+			}
+		}
+	}
+	line := strings.TrimSuffix(string(p.currentLine), "\n")
+	start := p.currentTokenStart
+	if start > len(line) {
+		start = len(line)
+	}
+	var caret strings.Builder
+	// Preserve tabs so that the caret lines up with the token.
+	for _, r := range line[:start] {
+		if r == '\t' {
+			caret.WriteByte('\t')
+		} else {
+			caret.WriteByte(' ')
+		}
+	}
+	caret.WriteByte('^')
+	return start + 1, line + "\n" + caret.String()
+}
+
+// readByte reads the next byte from p.buf, folding "\r\n" into "\n". It keeps
+// track of the offset and, if ErrorContext is enabled or a Scanner is used, of
+// the current line.
+func (p *TextParser) readByte() (byte, error) {
+	b, err := p.buf.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	p.offset++
+	if p.VerifyChecksum {
+		p.lineRaw = append(p.lineRaw, b)
+	}
+	if b == '\r' {
+		// Treat "\r\n" like "\n".
+		if next, _ := p.buf.Peek(1); len(next) == 1 && next[0] == '\n' {
+			b, _ = p.buf.ReadByte()
+			p.offset++
+			if p.VerifyChecksum {
+				p.lineRaw = append(p.lineRaw, b)
+			}
+		}
+	}
+	if p.ErrorContext || p.token != nil {
+		p.currentLine = append(p.currentLine, b)
+	}
+	return b, err
+}
+
+// startToken records that the current token starts at the current byte (or
+// at the next byte if next is true).
+func (p *TextParser) startToken(next bool) {
+	p.currentTokenStart = len(p.currentLine)
+	if !next {
+		p.currentTokenStart--
+	}
 }
 
 // skipBlankTab reads (and discards) bytes from p.buf until it encounters a byte
 // that is neither ' ' nor '\t'. That byte is left in p.currentByte.
 func (p *TextParser) skipBlankTab() {
 	for {
-		if p.currentByte, p.err = p.buf.ReadByte(); p.err != nil || !isBlankOrTab(p.currentByte) {
+		if p.currentByte, p.err = p.readByte(); p.err != nil || !isBlankOrTab(p.currentByte) {
 			return
 		}
 	}
@@ -563,9 +1303,10 @@ func (p *TextParser) skipBlankTabIfCurrentBlankTab() {
 // into p.currentToken.
 func (p *TextParser) readTokenUntilWhitespace() {
 	p.currentToken.Reset()
+	p.startToken(false)
 	for p.err == nil && !isBlankOrTab(p.currentByte) && p.currentByte != '\n' {
 		p.currentToken.WriteByte(p.currentByte)
-		p.currentByte, p.err = p.buf.ReadByte()
+		p.currentByte, p.err = p.readByte()
 	}
 }
 
@@ -577,6 +1318,7 @@ func (p *TextParser) readTokenUntilWhitespace() {
 // All other escape sequences are invalid and cause an error.
 func (p *TextParser) readTokenUntilNewline(recognizeEscapeSequence bool) {
 	p.currentToken.Reset()
+	p.startToken(false)
 	escaped := false
 	for p.err == nil {
 		if recognizeEscapeSequence && escaped {
@@ -600,7 +1342,18 @@ func (p *TextParser) readTokenUntilNewline(recognizeEscapeSequence bool) {
 				p.currentToken.WriteByte(p.currentByte)
 			}
 		}
-		p.currentByte, p.err = p.buf.ReadByte()
+		p.currentByte, p.err = p.readByte()
+	}
+}
+
+// readTokenUntilNewlineVerbatim works like readTokenUntilNewline but copies
+// backslashes like any other byte.
+func (p *TextParser) readTokenUntilNewlineVerbatim() {
+	p.currentToken.Reset()
+	p.startToken(false)
+	for p.err == nil && p.currentByte != '\n' {
+		p.currentToken.WriteByte(p.currentByte)
+		p.currentByte, p.err = p.readByte()
 	}
 }
 
@@ -610,30 +1363,51 @@ func (p *TextParser) readTokenUntilNewline(recognizeEscapeSequence bool) {
 // but not into p.currentToken.
 func (p *TextParser) readTokenAsMetricName() {
 	p.currentToken.Reset()
+	p.startToken(false)
 	if !isValidMetricNameStart(p.currentByte) {
 		return
 	}
 	for {
 		p.currentToken.WriteByte(p.currentByte)
-		p.currentByte, p.err = p.buf.ReadByte()
+		p.currentByte, p.err = p.readByte()
 		if p.err != nil || !isValidMetricNameContinuation(p.currentByte) {
 			return
 		}
 	}
 }
 
+// readTokenAsQuotedName copies a metric or label name quoted like a label value
+// from p.buf into p.currentToken, unescaping it. The first byte considered is
+// the byte already read (now in p.currentByte), which has to be the opening
+// '"'. The byte following the closing '"' is copied into p.currentByte.
+func (p *TextParser) readTokenAsQuotedName() {
+	if p.currentByte != '"' {
+		p.parseError(fmt.Sprintf("expected '\"' at start of quoted name, found %q", p.currentByte))
+		return
+	}
+	if p.readTokenAsLabelValue(); p.err != nil {
+		return
+	}
+	if p.currentToken.Len() == 0 || !utf8.Valid(p.currentToken.Bytes()) {
+		p.parseError(fmt.Sprintf("invalid quoted name %q", p.currentToken.String()))
+		return
+	}
+	p.currentByte, p.err = p.readByte()
+}
+
 // readTokenAsLabelName copies a label name from p.buf into p.currentToken.
 // The first byte considered is the byte already read (now in p.currentByte).
 // The first byte not part of a label name is still copied into p.currentByte,
 // but not into p.currentToken.
 func (p *TextParser) readTokenAsLabelName() {
 	p.currentToken.Reset()
+	p.startToken(false)
 	if !isValidLabelNameStart(p.currentByte) {
 		return
 	}
 	for {
 		p.currentToken.WriteByte(p.currentByte)
-		p.currentByte, p.err = p.buf.ReadByte()
+		p.currentByte, p.err = p.readByte()
 		if p.err != nil || !isValidLabelNameContinuation(p.currentByte) {
 			return
 		}
@@ -647,21 +1421,19 @@ func (p *TextParser) readTokenAsLabelName() {
 // is still copied into p.currentByte, but not into p.currentToken.
 func (p *TextParser) readTokenAsLabelValue() {
 	p.currentToken.Reset()
+	p.startToken(true)
 	escaped := false
 	for {
-		if p.currentByte, p.err = p.buf.ReadByte(); p.err != nil {
+		if p.currentByte, p.err = p.readByte(); p.err != nil {
 			return
 		}
 		if escaped {
-			switch p.currentByte {
-			case '"', '\\':
-				p.currentToken.WriteByte(p.currentByte)
-			case 'n':
-				p.currentToken.WriteByte('\n')
-			default:
+			unescaped, ok := unescapeByte(p.currentByte)
+			if !ok {
 				p.parseError(fmt.Sprintf("invalid escape sequence '\\%c'", p.currentByte))
 				return
 			}
+			p.currentToken.WriteByte(unescaped)
 			escaped = false
 			continue
 		}
@@ -679,7 +1451,190 @@ func (p *TextParser) readTokenAsLabelValue() {
 	}
 }
 
+// parseExemplar parses an exemplar in OpenMetrics notation without the leading
+// "# ", i.e. `{labels} value [timestamp]`, where the timestamp is in seconds.
+// Label names and values are tokenized like those of samples, so the same
+// escape sequences are recognized in label values. The exemplar is read from
+// in directly rather than through a TextParser, which would allocate a
+// bufio.Reader and its maps for every exemplar.
+func parseExemplar(in string) (*dto.Exemplar, error) {
+	r := exemplarReader{in: in}
+	if r.done() || r.peek() != '{' {
+		return nil, fmt.Errorf("expected '{' at start of exemplar %q", in)
+	}
+	r.pos++
+	e := &dto.Exemplar{}
+	for {
+		if r.skipBlankTab(); r.done() {
+			return nil, fmt.Errorf("unexpected end of exemplar %q", in)
+		}
+		if r.peek() == '}' {
+			break
+		}
+		name := r.readLabelName()
+		if name == "" || r.done() {
+			return nil, fmt.Errorf("invalid label name in exemplar %q", in)
+		}
+		if r.skipBlankTab(); r.done() || r.peek() != '=' {
+			return nil, fmt.Errorf("expected '=' after label name in exemplar %q", in)
+		}
+		r.pos++
+		if r.skipBlankTab(); r.done() || r.peek() != '"' {
+			return nil, fmt.Errorf("expected '\"' at start of label value in exemplar %q", in)
+		}
+		r.pos++
+		value, err := r.readLabelValue()
+		if err != nil {
+			return nil, fmt.Errorf("%s in exemplar %q", err, in)
+		}
+		e.Label = append(e.Label, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value),
+		})
+		if r.skipBlankTab(); r.done() {
+			return nil, fmt.Errorf("unexpected end of exemplar %q", in)
+		}
+		if r.peek() == '}' {
+			break
+		}
+		if r.peek() != ',' {
+			return nil, fmt.Errorf("unexpected %q after label value in exemplar %q", r.peek(), in)
+		}
+		r.pos++
+	}
+	r.pos++ // Skip the '}'.
+	if r.skipBlankTab(); r.done() {
+		return nil, fmt.Errorf("missing value in exemplar %q", in)
+	}
+	token := r.readTokenUntilWhitespace()
+	value, err := parseFloat(token)
+	if err != nil {
+		return nil, fmt.Errorf("expected float as value in exemplar %q, got %q", in, token)
+	}
+	e.Value = proto.Float64(value)
+	if r.skipBlankTab(); r.done() {
+		return e, nil // No timestamp.
+	}
+	token = r.readTokenUntilWhitespace()
+	ts, err := parseFloat(token)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return nil, fmt.Errorf("expected float as timestamp in exemplar %q, got %q", in, token)
+	}
+	if r.skipBlankTab(); !r.done() {
+		return nil, fmt.Errorf("spurious string after timestamp in exemplar %q", in)
+	}
+	sec, frac := math.Modf(ts)
+	e.Timestamp = timestamppb.New(time.Unix(int64(sec), int64(math.Round(frac*1e9))))
+	return e, nil
+}
+
+// exemplarReader reads the tokens of an exemplar from a string.
+type exemplarReader struct {
+	in  string
+	pos int
+}
+
+func (r *exemplarReader) done() bool {
+	return r.pos >= len(r.in)
+}
+
+func (r *exemplarReader) peek() byte {
+	return r.in[r.pos]
+}
+
+func (r *exemplarReader) skipBlankTab() {
+	for !r.done() && isBlankOrTab(r.peek()) {
+		r.pos++
+	}
+}
+
+// readLabelName returns the label name starting at the current position, or
+// "" if there is none.
+func (r *exemplarReader) readLabelName() string {
+	start := r.pos
+	if r.done() || !isValidLabelNameStart(r.peek()) {
+		return ""
+	}
+	for r.pos++; !r.done() && isValidLabelNameContinuation(r.peek()); r.pos++ {
+	}
+	return r.in[start:r.pos]
+}
+
+// readLabelValue returns the unescaped label value following the opening '"'
+// and skips the closing '"'. Escape sequences are resolved by unescapeByte,
+// like in readTokenAsLabelValue.
+func (r *exemplarReader) readLabelValue() (string, error) {
+	start := r.pos
+	var b *strings.Builder // Only used once an escape sequence is seen.
+	for ; !r.done(); r.pos++ {
+		c := r.peek()
+		switch c {
+		case '"':
+			r.pos++
+			if b == nil {
+				return r.in[start : r.pos-1], nil
+			}
+			return b.String(), nil
+		case '\n':
+			return "", fmt.Errorf("label value %q contains unescaped new-line", r.in[start:r.pos])
+		case '\\':
+			if b == nil {
+				b = &strings.Builder{}
+				b.WriteString(r.in[start:r.pos])
+			}
+			if r.pos++; r.done() {
+				break
+			}
+			unescaped, ok := unescapeByte(r.peek())
+			if !ok {
+				return "", fmt.Errorf("invalid escape sequence '\\%c'", r.peek())
+			}
+			b.WriteByte(unescaped)
+		default:
+			if b != nil {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return "", errors.New("unexpected end of label value")
+}
+
+// readTokenUntilWhitespace returns the token up to the next blank, tab, or
+// new-line.
+func (r *exemplarReader) readTokenUntilWhitespace() string {
+	start := r.pos
+	for !r.done() && !isBlankOrTab(r.peek()) && r.peek() != '\n' {
+		r.pos++
+	}
+	return r.in[start:r.pos]
+}
+
 func (p *TextParser) setOrCreateCurrentMF() {
+	prev := p.currentMF
+	if p.findOrCreateCurrentMF(); p.err != nil {
+		return
+	}
+	p.mfLine = p.lineCount
+	if p.onFamily != nil && p.currentMF != prev {
+		// When streaming, a new family means the previous one is
+		// complete. Only the metrics of the current family are tracked
+		// so that no metric is modified after its family has been
+		// handed over.
+		if prev != nil {
+			p.err = p.handOver(prev, p.lineStart)
+		}
+		p.familyStart = p.lineStart
+		p.familyIndex++
+		if len(p.summaries) > 0 {
+			p.summaries = map[uint64]*dto.Metric{}
+		}
+		if len(p.histograms) > 0 {
+			p.histograms = map[uint64]*dto.Metric{}
+		}
+	}
+}
+
+func (p *TextParser) findOrCreateCurrentMF() {
 	p.currentIsSummaryCount = false
 	p.currentIsSummarySum = false
 	p.currentIsHistogramCount = false
@@ -715,6 +1670,7 @@ func (p *TextParser) setOrCreateCurrentMF() {
 	}
 	p.currentMF = &dto.MetricFamily{Name: proto.String(name)}
 	p.metricFamiliesByName[name] = p.currentMF
+	p.account(func() int { return proto.Size(p.currentMF) })
 }
 
 func isValidLabelNameStart(b byte) bool {
@@ -733,6 +1689,20 @@ func isValidMetricNameContinuation(b byte) bool {
 	return isValidLabelNameContinuation(b) || b == ':'
 }
 
+// unescapeByte returns the byte the escape sequence '\c' stands for in a label
+// value, and false if '\c' is not a valid escape sequence. It is shared by the
+// TextParser, the exemplar parser, and UnescapeString, so that they all
+// recognize the same escape sequences.
+func unescapeByte(c byte) (byte, bool) {
+	switch c {
+	case '"', '\\':
+		return c, true
+	case 'n':
+		return '\n', true
+	}
+	return 0, false
+}
+
 func isBlankOrTab(b byte) bool {
 	return b == ' ' || b == '\t'
 }
@@ -773,6 +1743,10 @@ func histogramMetricName(name string) string {
 	}
 }
 
+// parseFloat parses s as a sample value, bucket bound, or quantile. Apart from
+// the usual decimal and exponent notations, the special values "+Inf", "-Inf",
+// "Inf", and "NaN" are accepted (case-insensitively, as by strconv.ParseFloat).
+// Hexadecimal notation and underscores are rejected.
 func parseFloat(s string) (float64, error) {
 	if strings.ContainsAny(s, "pP_") {
 		return 0, fmt.Errorf("unsupported character in float")
@@ -14,13 +14,19 @@
 package expfmt
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"math"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func testTextParse(t testing.TB) {
@@ -428,6 +434,100 @@ func BenchmarkTextParse(b *testing.B) {
 	}
 }
 
+func TestTextParseSpecialFloats(t *testing.T) {
+	specials := []struct {
+		text  string
+		value float64
+	}{
+		{"+Inf", math.Inf(+1)},
+		{"-Inf", math.Inf(-1)},
+		{"Inf", math.Inf(+1)},
+		{"NaN", math.NaN()},
+	}
+	sameFloat := func(a, b float64) bool {
+		return a == b || (math.IsNaN(a) && math.IsNaN(b))
+	}
+
+	for _, special := range specials {
+		t.Run(special.text, func(t *testing.T) {
+			var parser TextParser
+			fams, err := parser.TextToMetricFamilies(strings.NewReader(
+				"# TYPE gauge gauge\n" +
+					"gauge " + special.text + "\n" +
+					"untyped " + special.text + "\n" +
+					"# TYPE histogram histogram\n" +
+					`histogram_bucket{le="` + special.text + `"} 1` + "\n",
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fams["gauge"].Metric[0].GetGauge().GetValue(); !sameFloat(got, special.value) {
+				t.Errorf("expected gauge value %v, got %v", special.value, got)
+			}
+			if got := fams["untyped"].Metric[0].GetUntyped().GetValue(); !sameFloat(got, special.value) {
+				t.Errorf("expected untyped value %v, got %v", special.value, got)
+			}
+			if got := fams["histogram"].Metric[0].GetHistogram().Bucket[0].GetUpperBound(); !sameFloat(got, special.value) {
+				t.Errorf("expected bucket bound %v, got %v", special.value, got)
+			}
+
+			// Round-trip the gauge through the text format.
+			var out bytes.Buffer
+			if _, err := MetricFamilyToText(&out, fams["gauge"]); err != nil {
+				t.Fatal(err)
+			}
+			fams, err = parser.TextToMetricFamilies(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fams["gauge"].Metric[0].GetGauge().GetValue(); !sameFloat(got, special.value) {
+				t.Errorf("expected round-tripped gauge value %v, got %v", special.value, got)
+			}
+		})
+	}
+
+	// Round-trip special bucket upper bounds through the text format. The
+	// bounds are listed in the order they are written, i.e. with NaN last.
+	// Note that -0 is written as 0, which compares equal to it.
+	t.Run("histogram bounds", func(t *testing.T) {
+		bounds := []float64{math.Inf(-1), math.Copysign(0, -1), math.Inf(+1), math.NaN()}
+		h := &dto.Histogram{
+			SampleCount: proto.Uint64(4),
+			SampleSum:   proto.Float64(0),
+		}
+		for i, bound := range bounds {
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(bound),
+				CumulativeCount: proto.Uint64(uint64(i + 1)),
+			})
+		}
+		in := &dto.MetricFamily{
+			Name:   proto.String("histogram"),
+			Type:   dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: h}},
+		}
+
+		var out bytes.Buffer
+		if _, err := MetricFamilyToText(&out, in); err != nil {
+			t.Fatal(err)
+		}
+		var parser TextParser
+		fams, err := parser.TextToMetricFamilies(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := fams["histogram"].Metric[0].GetHistogram().GetBucket()
+		if len(got) != len(bounds) {
+			t.Fatalf("expected %d buckets, got %d", len(bounds), len(got))
+		}
+		for i, bound := range bounds {
+			if b := got[i].GetUpperBound(); !sameFloat(b, bound) {
+				t.Errorf("%d. expected bucket bound %v, got %v", i, bound, b)
+			}
+		}
+	})
+}
+
 func testTextParseError(t testing.TB) {
 	scenarios := []struct {
 		in  string
@@ -641,6 +741,13 @@ metric{quantile="0x1p-3"} 3.14
 			in:  `metric{label="bla",label="bla"} 3.14`,
 			err: "text format parsing error in line 1: duplicate label names for metric",
 		},
+		// 34: Exemplars are unknown to the text format.
+		{
+			in: `# UNIT metric seconds
+metric 3.14 # {trace_id="abc"} 1
+`,
+			err: `text format parsing error in line 2: expected integer as timestamp, got "#"`,
+		},
 	}
 
 	for i, scenario := range scenarios {
@@ -658,6 +765,163 @@ metric{quantile="0x1p-3"} 3.14
 	}
 }
 
+func TestTextParseSummaryWithoutSum(t *testing.T) {
+	in := `# TYPE rpc_duration summary
+rpc_duration{service="a",quantile="0.5"} 0.2
+rpc_duration_count{service="a"} 10
+rpc_duration{service="b",quantile="0.5"} 0.3
+rpc_duration_sum{service="b"} 4
+rpc_duration_count{service="b"} 12
+`
+
+	// Accepted by default, leaving the sum unset.
+	var p TextParser
+	families, err := p.TextToMetricFamilies(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	metrics := families["rpc_duration"].GetMetric()
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	if s := metrics[0].GetSummary(); s.SampleSum != nil || s.GetSampleCount() != 10 {
+		t.Errorf("expected unset sum and count 10, got %v", s)
+	}
+	if s := metrics[1].GetSummary(); s.GetSampleSum() != 4 || s.GetSampleCount() != 12 {
+		t.Errorf("expected sum 4 and count 12, got %v", s)
+	}
+
+	// Rejected if required, both when parsing at once and when streaming.
+	p = TextParser{RequireSummarySumAndCount: true}
+	expected := `text format parsing error in line 7: summary rpc_duration{service="a"} is missing its _sum sample`
+	if _, err := p.TextToMetricFamilies(strings.NewReader(in)); err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+	err = p.StreamMetricFamilies(strings.NewReader(in), func(*dto.MetricFamily) error {
+		t.Error("unexpected family handed over")
+		return nil
+	})
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q when streaming, got %v", expected, err)
+	}
+}
+
+func TestTextParseRawValues(t *testing.T) {
+	in := `# TYPE requests_total counter
+requests_total{code="200"} 1.50e3
+# TYPE temperature gauge
+temperature 21.10 1395066363000
+temperature{room="cellar"} +Inf
+# TYPE rpc_duration summary
+rpc_duration{quantile="0.99"} 0.10
+rpc_duration_sum 1E-3
+rpc_duration_count 3.0
+# TYPE latency histogram
+latency_bucket{le="1"} 02
+latency_bucket{le="+Inf"} 3e0
+latency_sum 0.0
+latency_count 3.
+`
+
+	var (
+		raw = &RawValues{}
+		p   = TextParser{RawValues: raw}
+	)
+	for _, options := range [][]EncoderOption{nil, {WithRawValues(raw)}} {
+		var out bytes.Buffer
+		if err := p.StreamMetricFamilies(strings.NewReader(in), func(mf *dto.MetricFamily) error {
+			_, err := MetricFamilyToText(&out, mf, options...)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if options == nil {
+			if out.String() == in {
+				t.Error("expected values to be reformatted without raw values")
+			}
+			continue
+		}
+		if out.String() != in {
+			t.Errorf("expected exact round trip %q, got %q", in, out.String())
+		}
+	}
+
+	// Modified values are formatted anew.
+	p = TextParser{RawValues: &RawValues{}}
+	families, err := p.TextToMetricFamilies(strings.NewReader("up 1.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	families["up"].Metric[0].Untyped.Value = proto.Float64(2)
+	var out bytes.Buffer
+	if _, err := MetricFamilyToText(&out, families["up"], WithRawValues(p.RawValues)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# TYPE up untyped\nup 2\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+
+	// So are values modified in place.
+	*families["up"].Metric[0].Untyped.Value = 3
+	out.Reset()
+	if _, err := MetricFamilyToText(&out, families["up"], WithRawValues(p.RawValues)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# TYPE up untyped\nup 3\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+
+	// Each parse starts afresh.
+	if _, err := p.TextToMetricFamilies(strings.NewReader("down 0.0\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.RawValues.floats); n != 1 {
+		t.Errorf("expected 1 raw value after the second parse, got %d", n)
+	}
+}
+
+func TestTextParseMaxResultBytes(t *testing.T) {
+	var in strings.Builder
+	in.WriteString("# HELP requests_total Requests.\n# TYPE requests_total counter\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&in, "requests_total{id=\"%d\"} 1\n", i)
+	}
+
+	// Everything fits into a large enough budget.
+	p := TextParser{MaxResultBytes: 1 << 20}
+	families, err := p.TextToMetricFamilies(strings.NewReader(in.String()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(families["requests_total"].GetMetric()); n != 1000 {
+		t.Fatalf("expected 1000 metrics, got %d", n)
+	}
+	size := proto.Size(families["requests_total"])
+
+	// The measured size is close to the encoded size of the result.
+	p = TextParser{MaxResultBytes: size}
+	if _, err := p.TextToMetricFamilies(strings.NewReader(in.String())); err != nil {
+		t.Errorf("unexpected error with a budget of exactly %d bytes: %s", size, err)
+	}
+
+	// Many small series exceed a budget much smaller than the input.
+	p = TextParser{MaxResultBytes: in.Len() / 4}
+	_, err = p.TextToMetricFamilies(strings.NewReader(in.String()))
+	var parseErr ParseError
+	if !errors.As(err, &parseErr) || !strings.Contains(parseErr.Msg, "exceed the budget") {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	if parseErr.Line >= 1002 {
+		t.Errorf("expected parsing to stop early, stopped in line %d", parseErr.Line)
+	}
+
+	// The same applies when streaming.
+	err = p.StreamMetricFamilies(strings.NewReader(in.String()), func(*dto.MetricFamily) error { return nil })
+	if !errors.As(err, &parseErr) || !strings.Contains(parseErr.Msg, "exceed the budget") {
+		t.Errorf("expected budget error when streaming, got %v", err)
+	}
+}
+
 func TestTextParseError(t *testing.T) {
 	testTextParseError(t)
 }
@@ -668,6 +932,157 @@ func BenchmarkParseError(b *testing.B) {
 	}
 }
 
+func TestTextParseErrorContext(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		in      string
+		line    int
+		column  int
+		context string
+	}{
+		{
+			name:    "bad value",
+			in:      "metric{label=\"value\"} 1.2.3 42\nother 1\n",
+			line:    1,
+			column:  23,
+			context: "metric{label=\"value\"} 1.2.3 42\n                      ^",
+		},
+		{
+			name:    "bad label name",
+			in:      "# TYPE metric gauge\nmetric{label=\"value\",\t2label=\"value\"} 1\n",
+			line:    2,
+			column:  23,
+			context: "metric{label=\"value\",\t2label=\"value\"} 1\n                     \t^",
+		},
+		{
+			name:    "bad label value with multi-byte characters",
+			in:      "metric{label=\"Björn\",other=\"佖佥\\x\"} 1",
+			line:    1,
+			column:  30,
+			context: "metric{label=\"Björn\",other=\"佖佥\\x\"} 1\n                            ^",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			parser := TextParser{ErrorContext: true}
+			_, err := parser.TextToMetricFamilies(strings.NewReader(scenario.in))
+			var parseErr ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("expected ParseError, got %v", err)
+			}
+			if parseErr.Line != scenario.line {
+				t.Errorf("expected line %d, got %d", scenario.line, parseErr.Line)
+			}
+			if parseErr.Column != scenario.column {
+				t.Errorf("expected column %d, got %d", scenario.column, parseErr.Column)
+			}
+			if parseErr.Context != scenario.context {
+				t.Errorf("expected context\n%s\ngot\n%s", scenario.context, parseErr.Context)
+			}
+			if !strings.HasSuffix(err.Error(), "\n"+scenario.context) {
+				t.Errorf("expected error message to end with the context, got %q", err.Error())
+			}
+		})
+	}
+
+	// Without ErrorContext, no context is provided.
+	var parser TextParser
+	_, err := parser.TextToMetricFamilies(strings.NewReader(scenarios[0].in))
+	var parseErr ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected ParseError, got %v", err)
+	}
+	if parseErr.Column != 0 || parseErr.Context != "" {
+		t.Errorf("expected no context, got column %d and context %q", parseErr.Column, parseErr.Context)
+	}
+}
+
+func TestParseExemplar(t *testing.T) {
+	scenarios := []struct {
+		in  string
+		out *dto.Exemplar
+		err string
+	}{
+		{
+			in: `{foo="bar"} 119.9 12345.6`,
+			out: &dto.Exemplar{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("foo"),
+						Value: proto.String("bar"),
+					},
+				},
+				Value:     proto.Float64(119.9),
+				Timestamp: timestamppb.New(time.Unix(12345, 600000000)),
+			},
+		},
+		{
+			in: `{ trace_id = "say \"hi\"\nand\\bye" , span_id="佖佥"} -Inf `,
+			out: &dto.Exemplar{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("trace_id"),
+						Value: proto.String("say \"hi\"\nand\\bye"),
+					},
+					{
+						Name:  proto.String("span_id"),
+						Value: proto.String("佖佥"),
+					},
+				},
+				Value: proto.Float64(math.Inf(-1)),
+			},
+		},
+		{
+			in: `{} 1`,
+			out: &dto.Exemplar{
+				Value: proto.Float64(1),
+			},
+		},
+		{
+			in:  `{foo="bar\x"} 1`,
+			err: `invalid escape sequence '\x' in exemplar "{foo=\"bar\\x\"} 1"`,
+		},
+		{
+			in:  `{foo="bar\`,
+			err: `unexpected end of label value in exemplar "{foo=\"bar\\"`,
+		},
+		{
+			in:  `{foo="bar",`,
+			err: `unexpected end of exemplar "{foo=\"bar\","`,
+		},
+		{
+			in:  `{foo="bar"}`,
+			err: `missing value in exemplar "{foo=\"bar\"}"`,
+		},
+		{
+			in:  `{foo="bar"} 1 2 3`,
+			err: `spurious string after timestamp in exemplar "{foo=\"bar\"} 1 2 3"`,
+		},
+		{
+			in:  `foo="bar"} 1`,
+			err: `expected '{' at start of exemplar "foo=\"bar\"} 1"`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		e, err := parseExemplar(scenario.in)
+		if scenario.err != "" {
+			if err == nil || err.Error() != scenario.err {
+				t.Errorf("%d. expected error %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if !proto.Equal(e, scenario.out) {
+			t.Errorf("%d. expected %v, got %v", i, scenario.out, e)
+		}
+	}
+}
+
 func TestTextParserStartOfLine(t *testing.T) {
 	t.Run("EOF", func(t *testing.T) {
 		p := TextParser{}
@@ -703,3 +1118,513 @@ type errReader struct {
 func (r *errReader) Read(p []byte) (int, error) {
 	return 0, r.err
 }
+
+func TestStreamMetricFamiliesWithOffsets(t *testing.T) {
+	in := "# A generic comment.\r\n" +
+		"# HELP temperature Temperatur in °C.\r\n" +
+		"# TYPE temperature gauge\r\n" +
+		"temperature{room=\"Küche\"} 21.5\r\n" +
+		"temperature{room=\"客厅\"} 22\r\n" +
+		"\r\n" +
+		"# TYPE latency summary\n" +
+		"latency{quantile=\"0.9\"} 0.25\r\n" +
+		"latency_sum 3.5\r\n" +
+		"latency_count 7\r\n" +
+		"requests_total{path=\"/ü\"} 12\r\n"
+
+	type indexed struct {
+		mf         *dto.MetricFamily
+		start, end int64
+	}
+	var got []indexed
+	var p TextParser
+	if err := p.StreamMetricFamiliesWithOffsets(strings.NewReader(in), func(mf *dto.MetricFamily, start, end int64) error {
+		got = append(got, indexed{mf, start, end})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNames := []string{"temperature", "latency", "requests_total"}
+	if len(got) != len(expectedNames) {
+		t.Fatalf("expected %d families, got %d", len(expectedNames), len(got))
+	}
+	var lastEnd int64
+	for i, fam := range got {
+		if fam.mf.GetName() != expectedNames[i] {
+			t.Errorf("%d. expected family %q, got %q", i, expectedNames[i], fam.mf.GetName())
+		}
+		if fam.start < lastEnd || fam.end <= fam.start || fam.end > int64(len(in)) {
+			t.Errorf("%d. invalid offsets [%d,%d)", i, fam.start, fam.end)
+			continue
+		}
+		lastEnd = fam.end
+
+		var reparser TextParser
+		reparsed, err := reparser.TextToMetricFamilies(strings.NewReader(in[fam.start:fam.end]))
+		if err != nil {
+			t.Errorf("%d. error re-parsing %q: %s", i, in[fam.start:fam.end], err)
+			continue
+		}
+		if len(reparsed) != 1 || !proto.Equal(reparsed[fam.mf.GetName()], fam.mf) {
+			t.Errorf("%d. expected %q to re-parse to %v, got %v", i, in[fam.start:fam.end], fam.mf, reparsed)
+		}
+	}
+	if got[0].start != int64(len("# A generic comment.\r\n")) {
+		t.Errorf("expected first family to start after the generic comment, got offset %d", got[0].start)
+	}
+	if lastEnd != int64(len(in)) {
+		t.Errorf("expected last family to end at %d, got %d", len(in), lastEnd)
+	}
+}
+
+func TestStreamMetricFamiliesOnFamilyError(t *testing.T) {
+	const (
+		good1 = "# HELP a First.\n# TYPE a counter\na 1\n"
+		good2 = "# TYPE c gauge\nc{x=\"1\"} 3\n"
+	)
+	type familyError struct {
+		index int
+		start int64
+	}
+	scenarios := []struct {
+		in     string
+		parser TextParser
+		errs   []familyError
+		names  []string
+	}{
+		{
+			// A broken label set in the middle family.
+			in:    good1 + "# TYPE b gauge\nb{x=\"1\" 2\nb{x=\"2\"} 2\n" + good2,
+			errs:  []familyError{{1, int64(len(good1))}},
+			names: []string{"a", "c"},
+		},
+		{
+			// A broken TYPE line, followed by a HELP line of the same
+			// family, which must be skipped, too.
+			in:    good1 + "# TYPE b bogus\n# HELP b Second.\nb 2\n" + good2,
+			errs:  []familyError{{1, int64(len(good1))}},
+			names: []string{"a", "c"},
+		},
+		{
+			// Resync at an empty line.
+			in:    good1 + "b 2 x\nb 3\n\nd 4\n" + good2,
+			errs:  []familyError{{1, int64(len(good1))}},
+			names: []string{"a", "d", "c"},
+		},
+		{
+			// A line without a valid name is a family of its own.
+			in:    good1 + "1b 2\na 5\n" + good2,
+			errs:  []familyError{{1, int64(len(good1))}},
+			names: []string{"a", "c"},
+		},
+		{
+			// Errors in the first and in the last family.
+			in:    "b{ 2\n" + good1 + good2 + "d 1 2 3\n",
+			errs:  []familyError{{0, 0}, {3, int64(len("b{ 2\n" + good1 + good2))}},
+			names: []string{"a", "c"},
+		},
+		{
+			// With ErrorContext, the failing line is read up to its end.
+			in:     good1 + "# TYPE b gauge\nb{x=\"1\" 2\n" + good2,
+			parser: TextParser{ErrorContext: true},
+			errs:   []familyError{{1, int64(len(good1))}},
+			names:  []string{"a", "c"},
+		},
+		{
+			in:     good1 + "# TYPE b summary\nb{quantile=\"0.5\"} 1\nb_count 1\n" + good2,
+			parser: TextParser{RequireSummarySumAndCount: true},
+			errs:   []familyError{{1, int64(len(good1))}},
+			names:  []string{"a", "c"},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var (
+			errs  []familyError
+			names []string
+			p     = scenario.parser
+		)
+		p.OnFamilyError = func(index int, start int64, err error) {
+			if !errors.As(err, &ParseError{}) {
+				t.Errorf("%d. expected a ParseError, got %v", i, err)
+			}
+			errs = append(errs, familyError{index, start})
+		}
+		if err := p.StreamMetricFamilies(strings.NewReader(scenario.in), func(mf *dto.MetricFamily) error {
+			names = append(names, mf.GetName())
+			return nil
+		}); err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(errs, scenario.errs) {
+			t.Errorf("%d. expected family errors %v, got %v", i, scenario.errs, errs)
+		}
+		if !reflect.DeepEqual(names, scenario.names) {
+			t.Errorf("%d. expected families %v, got %v", i, scenario.names, names)
+		}
+	}
+}
+
+func TestStreamMetricFamiliesOnFamilyErrorAbort(t *testing.T) {
+	fnErr := errors.New("stop")
+	scenarios := []struct {
+		in     string
+		parser TextParser
+		fn     func(*dto.MetricFamily) error
+		err    string
+	}{
+		{
+			// A premature end of the input.
+			in:  "a 1\nb{x=\"1\"",
+			err: "unexpected end of input stream",
+		},
+		{
+			in:     "a 1\nb 2\nc 3\n",
+			parser: TextParser{MaxResultBytes: 20},
+			err:    "exceed the budget",
+		},
+		{
+			in:  "a 1\nb 2\n",
+			fn:  func(*dto.MetricFamily) error { return fnErr },
+			err: "stop",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		p := scenario.parser
+		p.OnFamilyError = func(index int, start int64, err error) {
+			t.Errorf("%d. unexpected family error %d at %d: %s", i, index, start, err)
+		}
+		fn := scenario.fn
+		if fn == nil {
+			fn = func(*dto.MetricFamily) error { return nil }
+		}
+		err := p.StreamMetricFamilies(strings.NewReader(scenario.in), fn)
+		if err == nil || !strings.Contains(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error containing %q, got %v", i, scenario.err, err)
+		}
+	}
+}
+
+func TestParseToChannel(t *testing.T) {
+	in := `# TYPE a counter
+a{x="1"} 1
+a{x="2"} 2
+# HELP b Some summary.
+# TYPE b summary
+b{quantile="0.5"} 3
+b_sum 10
+b_count 4
+# HELP empty Family without metrics.
+c_bucket{le="+Inf"} 5
+`
+	families, errs := ParseToChannel(strings.NewReader(in))
+	var got []*dto.MetricFamily
+	for mf := range families {
+		got = append(got, mf)
+	}
+	if err, ok := <-errs; ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []*dto.MetricFamily{
+		{
+			Name: proto.String("a"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("x"), Value: proto.String("1")}},
+					Counter: &dto.Counter{Value: proto.Float64(1)},
+				},
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("x"), Value: proto.String("2")}},
+					Counter: &dto.Counter{Value: proto.Float64(2)},
+				},
+			},
+		},
+		{
+			Name: proto.String("b"),
+			Help: proto.String("Some summary."),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Summary: &dto.Summary{
+						SampleCount: proto.Uint64(4),
+						SampleSum:   proto.Float64(10),
+						Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(3)}},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("c_bucket"),
+			Type: dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("le"), Value: proto.String("+Inf")}},
+					Untyped: &dto.Untyped{Value: proto.Float64(5)},
+				},
+			},
+		},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d families, got %d: %v", len(want), len(got), got)
+	}
+	for i := range want {
+		if !proto.Equal(want[i], got[i]) {
+			t.Errorf("%d. expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestParseToChannelError(t *testing.T) {
+	in := `a 1
+b 2
+c{ 3
+d 4
+`
+	families, errs := ParseToChannel(strings.NewReader(in))
+	var got []string
+	for mf := range families {
+		got = append(got, mf.GetName())
+	}
+	if want := []string{"a", "b"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected families %v before the error, got %v", want, got)
+	}
+	err, ok := <-errs
+	if !ok {
+		t.Fatal("expected an error, error channel was closed")
+	}
+	var parseErr ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 3 {
+		t.Errorf("expected a parse error in line 3, got %v", err)
+	}
+	if _, ok := <-errs; ok {
+		t.Error("expected the error channel to be closed after a single error")
+	}
+}
+
+func TestTextParseVerifyChecksum(t *testing.T) {
+	withChecksum := func(body string) string {
+		return fmt.Sprintf("%s# checksum sha256:%x\n", body, sha256.Sum256([]byte(body)))
+	}
+	body := "# TYPE up gauge\nup 1\n"
+
+	scenarios := []struct {
+		in  string
+		err string
+	}{
+		{
+			in: withChecksum(body),
+		},
+		{
+			in: withChecksum("# TYPE up gauge\r\nup 1\r\n"),
+		},
+		{
+			in: withChecksum(body) + "# EOF\n\n",
+		},
+		{
+			in:  body,
+			err: "text format parsing error in line 3: missing checksum",
+		},
+		{
+			in:  withChecksum(body) + "up 2\n",
+			err: "text format parsing error in line 4: unexpected sample after checksum",
+		},
+		{
+			in:  withChecksum(body) + "# HELP up Up.\n",
+			err: "text format parsing error in line 4: unexpected HELP line after checksum",
+		},
+		{
+			in:  withChecksum(body) + withChecksum(""),
+			err: "text format parsing error in line 4: second checksum line",
+		},
+		{
+			in:  body + "# checksum md5:abc\n",
+			err: `text format parsing error in line 3: invalid checksum "md5:abc", expected sha256:<hex>`,
+		},
+		{
+			in:  strings.Replace(withChecksum(body), "up 1", "up 2", 1),
+			err: "text format parsing error in line 3: checksum mismatch",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		p := TextParser{VerifyChecksum: true}
+		_, err := p.TextToMetricFamilies(strings.NewReader(scenario.in))
+		if scenario.err == "" {
+			if err != nil {
+				t.Errorf("%d. unexpected error: %s", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error %q, got %v", i, scenario.err, err)
+		}
+	}
+}
+
+func TestTextParseDefaultMetricType(t *testing.T) {
+	in := `# HELP temperature Legacy gauge without TYPE line.
+temperature{room="a"} 21.5
+# TYPE requests counter
+requests 3
+`
+	scenarios := []struct {
+		defaultType *dto.MetricType
+		expected    dto.MetricType
+	}{
+		{
+			defaultType: nil,
+			expected:    dto.MetricType_UNTYPED,
+		},
+		{
+			defaultType: dto.MetricType_UNTYPED.Enum(),
+			expected:    dto.MetricType_UNTYPED,
+		},
+		{
+			defaultType: dto.MetricType_GAUGE.Enum(),
+			expected:    dto.MetricType_GAUGE,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		p := TextParser{DefaultMetricType: scenario.defaultType}
+		mfs, err := p.TextToMetricFamilies(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		temperature := mfs["temperature"]
+		if got := temperature.GetType(); got != scenario.expected {
+			t.Errorf("%d. expected type %s, got %s", i, scenario.expected, got)
+		}
+		m := temperature.GetMetric()[0]
+		value := m.GetUntyped().GetValue()
+		if scenario.expected == dto.MetricType_GAUGE {
+			value = m.GetGauge().GetValue()
+		}
+		if value != 21.5 {
+			t.Errorf("%d. expected value 21.5, got %v", i, m)
+		}
+		if got := mfs["requests"].GetType(); got != dto.MetricType_COUNTER {
+			t.Errorf("%d. expected explicit type counter, got %s", i, got)
+		}
+	}
+
+	p := TextParser{DefaultMetricType: dto.MetricType_SUMMARY.Enum()}
+	if _, err := p.TextToMetricFamilies(strings.NewReader(in)); err == nil ||
+		err.Error() != "unsupported default metric type SUMMARY" {
+		t.Errorf("expected unsupported default type error, got %v", err)
+	}
+}
+
+func TestTextParseQuotedNames(t *testing.T) {
+	scenarios := []struct {
+		in   string
+		name string
+		// Written by MetricFamilyToOpenMetrics, also quoting the name.
+		openMetrics string
+	}{
+		// 0: Name starting with a digit, with labels.
+		{
+			in: `# HELP "2xx_responses" Number of successful responses.
+# TYPE "2xx_responses" counter
+{"2xx_responses",code="200"} 3
+{"2xx_responses",code="204"} 1
+`,
+			name: "2xx_responses",
+			openMetrics: `# HELP "2xx_responses" Number of successful responses.
+# TYPE "2xx_responses" unknown
+{"2xx_responses",code="200"} 3.0
+{"2xx_responses",code="204"} 1.0
+`,
+		},
+		// 1: Purely numeric name, without labels.
+		{
+			in: `# TYPE "123" gauge
+{"123"} 1.5
+`,
+			name: "123",
+			openMetrics: `# TYPE "123" gauge
+{"123"} 1.5
+`,
+		},
+		// 2: Escaped quote and backslash.
+		{
+			in: `# TYPE "a\"b\\c" untyped
+{"a\"b\\c",x="y"} 2
+`,
+			name: `a"b\c`,
+			openMetrics: `# TYPE "a\"b\\c" unknown
+{"a\"b\\c",x="y"} 2.0
+`,
+		},
+		// 3: Quoted label names, like in scenario 4 of TestCreateOpenMetrics.
+		{
+			in: `# HELP "gauge.name\"" gauge\ndoc\nstr"ing
+# TYPE "gauge.name\"" gauge
+{"gauge.name\"","name.1"="val with\nnew line","name*2"="val with \\backslash and \"quotes\""} +Inf
+{"gauge.name\"","name.1"="Björn","name*2"="佖佥"} 3.14e+42
+`,
+			name: `gauge.name"`,
+			openMetrics: `# HELP "gauge.name\"" gauge\ndoc\nstr\"ing
+# TYPE "gauge.name\"" gauge
+{"gauge.name\"","name.1"="val with\nnew line","name*2"="val with \\backslash and \"quotes\""} +Inf
+{"gauge.name\"","name.1"="Björn","name*2"="佖佥"} 3.14e+42
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		p := TextParser{QuotedNames: true}
+		mfs, err := p.TextToMetricFamilies(strings.NewReader(scenario.in))
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		mf, ok := mfs[scenario.name]
+		if !ok || len(mfs) != 1 {
+			t.Errorf("%d. expected only metric family %q, got %v", i, scenario.name, mfs)
+			continue
+		}
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.in)))
+		if _, err := MetricFamilyToText(out, mf); err != nil {
+			t.Errorf("%d. unexpected error writing %v: %s", i, mf, err)
+			continue
+		}
+		if got := out.String(); got != scenario.in {
+			t.Errorf("%d. expected round trip of:\n%s\ngot:\n%s", i, scenario.in, got)
+		}
+		out.Reset()
+		if _, err := MetricFamilyToOpenMetrics(out, mf); err != nil {
+			t.Errorf("%d. unexpected error writing %v: %s", i, mf, err)
+			continue
+		}
+		if got := out.String(); got != scenario.openMetrics {
+			t.Errorf("%d. expected OpenMetrics:\n%s\ngot:\n%s", i, scenario.openMetrics, got)
+		}
+
+		var strict TextParser
+		if _, err := strict.TextToMetricFamilies(strings.NewReader(scenario.in)); err == nil {
+			t.Errorf("%d. expected error without QuotedNames", i)
+		}
+	}
+
+	for i, in := range []string{
+		`{""} 1` + "\n",
+		`{"foo" bar="baz"} 1` + "\n",
+		`{foo} 1` + "\n",
+		`{"fo` + "\n",
+		`# TYPE "" counter` + "\n",
+		`{"` + "\xff" + `"} 1` + "\n",
+		`{"foo",""="bar"} 1` + "\n",
+		`{"foo","bar"} 1` + "\n",
+	} {
+		p := TextParser{QuotedNames: true}
+		if _, err := p.TextToMetricFamilies(strings.NewReader(in)); err == nil {
+			t.Errorf("%d. expected error for %q", i, in)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TranscodeToText reads metric families in the text format from in and writes
+// them in the text format (as created by MetricFamilyToText with the given
+// options) to out, one family at a time. It returns the number of bytes
+// written and any error encountered.
+//
+// The output always follows the rules of the classic text format: every line,
+// including the last one, ends with a newline, and there is no `# EOF` marker.
+// The input may be OpenMetrics as far as it is also understood by the
+// TextParser. In particular, the final `# EOF` line (with or without a
+// trailing newline) is dropped like any other comment. Note that OpenMetrics
+// specifics like the _total suffix of counter samples, units, and exemplars are
+// not understood. In particular, exemplars are lost.
+func TranscodeToText(out io.Writer, in io.Reader, options ...EncoderOption) (written int, err error) {
+	var p TextParser
+	err = p.StreamMetricFamilies(&newlineTerminatedReader{r: in}, func(mf *dto.MetricFamily) error {
+		n, err := MetricFamilyToText(out, mf, options...)
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// TranscodeToOpenMetrics reads metric families in the given format from in and
+// writes them in the OpenMetrics format (as created by
+// MetricFamilyToOpenMetrics with the given options) to out, one family at a
+// time, followed by the final `# EOF` line. It returns the number of bytes
+// written and any error encountered. Supported input formats are FmtText and
+// FmtProtoDelim, each optionally with an escaping parameter (see
+// Format.WithEscapingScheme), which is reversed as far as possible.
+//
+// Exemplars are preserved where the input format carries them, i.e. for
+// FmtProtoDelim, so the exemplars of counters and histogram buckets appear in
+// the output. The text format cannot carry exemplars, so the output of
+// transcoding it has none.
+func TranscodeToOpenMetrics(out io.Writer, in io.Reader, format Format, options ...EncoderOption) (written int, err error) {
+	encode := func(mf *dto.MetricFamily) error {
+		n, err := MetricFamilyToOpenMetrics(out, mf, options...)
+		written += n
+		return err
+	}
+	switch format.withoutEscaping() {
+	case FmtText:
+		var (
+			p      TextParser
+			scheme = format.ToEscapingScheme()
+		)
+		err = p.StreamMetricFamilies(&newlineTerminatedReader{r: in}, func(mf *dto.MetricFamily) error {
+			unescapeMetricFamily(mf, scheme)
+			return encode(mf)
+		})
+	case FmtProtoDelim:
+		dec := NewDecoder(in, format)
+		for {
+			mf := &dto.MetricFamily{}
+			if err = dec.Decode(mf); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				break
+			}
+			if err = encode(mf); err != nil {
+				break
+			}
+		}
+	default:
+		return 0, fmt.Errorf("expfmt.TranscodeToOpenMetrics: unsupported format %q", format)
+	}
+	if err != nil {
+		return written, err
+	}
+	n, err := FinalizeOpenMetrics(out)
+	return written + n, err
+}
+
+// newlineTerminatedReader passes through the content of r, appending a newline
+// should the content not end with one already.
+type newlineTerminatedReader struct {
+	r        io.Reader
+	last     byte // The last byte read, 0 if nothing has been read yet.
+	appended bool
+}
+
+// Read implements io.Reader.
+func (r *newlineTerminatedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.last = p[n-1]
+	}
+	if !errors.Is(err, io.EOF) || r.appended || r.last == 0 || r.last == '\n' {
+		return n, err
+	}
+	r.appended = true
+	r.r = strings.NewReader("\n")
+	if n > 0 {
+		return n, nil
+	}
+	return r.r.Read(p)
+}
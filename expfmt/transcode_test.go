@@ -0,0 +1,190 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTranscodeToText(t *testing.T) {
+	expected := `# HELP temperature The temperature.
+# TYPE temperature gauge
+temperature{room="kitchen"} 21.5
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="1"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 3.5
+latency_count 3
+`
+	scenarios := []struct {
+		in string
+	}{
+		{
+			in: `# HELP temperature The temperature.
+# TYPE temperature gauge
+temperature{room="kitchen"} 21.5
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="1.0"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 3.5
+latency_count 3
+# EOF
+`,
+		},
+		// The newline after the EOF marker is optional in OpenMetrics.
+		{
+			in: `# HELP temperature The temperature.
+# TYPE temperature gauge
+temperature{room="kitchen"} 21.5
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="1.0"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 3.5
+latency_count 3
+# EOF`,
+		},
+		// Text input without a trailing newline.
+		{
+			in: strings.TrimSuffix(expected, "\n"),
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var out bytes.Buffer
+		n, err := TranscodeToText(&out, strings.NewReader(scenario.in))
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+		if n != out.Len() {
+			t.Errorf("%d. expected %d bytes written, got %d", i, out.Len(), n)
+		}
+		got := out.String()
+		if strings.Contains(got, "# EOF") {
+			t.Errorf("%d. unexpected EOF marker in %q", i, got)
+		}
+		if !strings.HasSuffix(got, "\n") || strings.HasSuffix(got, "\n\n") {
+			t.Errorf("%d. expected exactly one trailing newline in %q", i, got)
+		}
+		if got != expected {
+			t.Errorf("%d. expected out=%q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestTranscodeToOpenMetrics(t *testing.T) {
+	histogram := &dto.MetricFamily{
+		Name: proto.String("latency"),
+		Help: proto.String("The latency."),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(3.5),
+					Bucket: []*dto.Bucket{
+						{
+							UpperBound:      proto.Float64(0.5),
+							CumulativeCount: proto.Uint64(1),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{
+									{Name: proto.String("trace_id"), Value: proto.String("abc")},
+								},
+								Value:     proto.Float64(0.25),
+								Timestamp: timestamppb.New(time.Unix(12345, 600000000)),
+							},
+						},
+						{
+							UpperBound:      proto.Float64(1),
+							CumulativeCount: proto.Uint64(2),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{
+									{Name: proto.String("trace_id"), Value: proto.String("def")},
+								},
+								Value: proto.Float64(0.75),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	var in bytes.Buffer
+	for _, mf := range []*dto.MetricFamily{gaugeFamilyPart("up", "a", 1), histogram} {
+		if _, err := protodelim.MarshalTo(&in, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := `# HELP up Help for up.
+# TYPE up gauge
+up{instance="a"} 1.0
+# HELP latency The latency.
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1 # {trace_id="abc"} 0.25 12345.6
+latency_bucket{le="1.0"} 2 # {trace_id="def"} 0.75
+latency_bucket{le="+Inf"} 3
+latency_sum 3.5
+latency_count 3
+# EOF
+`
+	var out bytes.Buffer
+	n, err := TranscodeToOpenMetrics(&out, &in, FmtProtoDelim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != out.Len() {
+		t.Errorf("expected %d bytes written, got %d", out.Len(), n)
+	}
+	if got := out.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// The text format carries no exemplars.
+	var text bytes.Buffer
+	if _, err := MetricFamilyToText(&text, histogram); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if _, err := TranscodeToOpenMetrics(&out, &text, FmtText); err != nil {
+		t.Fatal(err)
+	}
+	expected = `# HELP latency The latency.
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="1.0"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 3.5
+latency_count 3
+# EOF
+`
+	if got := out.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	if _, err := TranscodeToOpenMetrics(&out, &text, FmtOpenMetrics_1_0_0); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
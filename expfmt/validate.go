@@ -0,0 +1,494 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/common/model"
+)
+
+// CheckNameSuffix checks whether the name of mf follows the naming conventions
+// for its type and returns a warning for every mismatch: Counters should end on
+// "_total", which no other type should. Summaries and histograms should not end
+// on one of the suffixes their samples get, i.e. "_sum", "_count", or
+// "_bucket". Untyped metric families are not checked.
+//
+// The warnings do not render the metric family invalid. They are meant for
+// linters rather than to reject input.
+func CheckNameSuffix(mf *dto.MetricFamily) []error {
+	var (
+		warnings []error
+		name     = mf.GetName()
+		typ      = mf.GetType()
+	)
+	switch typ {
+	case dto.MetricType_UNTYPED:
+		return nil
+	case dto.MetricType_COUNTER:
+		if !strings.HasSuffix(name, "_total") {
+			warnings = append(warnings, fmt.Errorf("counter %q should have the suffix \"_total\"", name))
+		}
+		return warnings
+	}
+	if strings.HasSuffix(name, "_total") {
+		warnings = append(warnings, fmt.Errorf("%s %q has the suffix \"_total\" reserved for counters", typeName(typ), name))
+	}
+	if typ == dto.MetricType_SUMMARY || typ == dto.MetricType_HISTOGRAM || typ == dto.MetricType_GAUGE_HISTOGRAM {
+		for _, suffix := range []string{"_sum", "_count", "_bucket"} {
+			if strings.HasSuffix(name, suffix) {
+				warnings = append(warnings, fmt.Errorf("%s %q has the suffix %q used for its samples", typeName(typ), name, suffix))
+			}
+		}
+	}
+	return warnings
+}
+
+// typeName returns the name of t as used in the text format.
+func typeName(t dto.MetricType) string {
+	return strings.ToLower(t.String())
+}
+
+// exemplarMaxRunes is the maximum combined length of the label names and
+// values of an exemplar allowed by OpenMetrics.
+const exemplarMaxRunes = 128
+
+// openMetricsOnlyTypes are the metric types of OpenMetrics the TextParser
+// doesn't know.
+var openMetricsOnlyTypes = map[string]bool{
+	"unknown":        true,
+	"gaugehistogram": true,
+	"info":           true,
+	"stateset":       true,
+}
+
+// ValidateExposition reads a complete exposition in the given format from r
+// and returns all violations found, or nil if there are none. It is meant as
+// the single entry point for conformance tests. The following is checked:
+//
+//   - The exposition can be parsed. Parsing stops at the first syntax error,
+//     which is returned along with the violations found up to then.
+//   - Each metric family appears only once, with one set of metadata.
+//   - Metric names are valid.
+//   - The cumulative counts of histogram buckets don't decrease.
+//   - Exemplars are well-formed and their labels don't exceed the 128 runes
+//     allowed by OpenMetrics.
+//   - For OpenMetrics, the exposition ends with a `# EOF` line and doesn't
+//     contain empty lines.
+//
+// OpenMetrics input is read like OpenMetricsToMetricFamilies reads it. As the
+// families are only checked once the whole exposition has been read, a syntax
+// error in OpenMetrics input is returned without checking any family. Formats
+// other than the text, OpenMetrics, and delimited protobuf formats are
+// validated as text.
+func ValidateExposition(r io.Reader, format Format) []error {
+	var (
+		errs  []error
+		seen  = map[string]bool{}
+		check = func(mf *dto.MetricFamily) {
+			if seen[mf.GetName()] {
+				errs = append(errs, fmt.Errorf("metric family %q appears more than once", mf.GetName()))
+			}
+			seen[mf.GetName()] = true
+			errs = append(errs, validateMetricFamily(mf)...)
+		}
+	)
+
+	if format == FmtProtoDelim {
+		dec := NewDecoder(bufio.NewReader(r), format)
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err != nil {
+				if !errors.Is(err, io.EOF) {
+					errs = append(errs, err)
+				}
+				return errs
+			}
+			check(mf)
+		}
+	}
+
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return []error{err}
+	}
+	if strings.HasPrefix(string(format), OpenMetricsType) {
+		families, violations, err := parseOpenMetrics(in)
+		errs = append(errs, violations...)
+		if err != nil {
+			return append(errs, err)
+		}
+		for _, mf := range families {
+			check(mf)
+		}
+		return errs
+	}
+	var p TextParser
+	if err := p.StreamMetricFamilies(bytes.NewReader(in), func(mf *dto.MetricFamily) error {
+		check(mf)
+		return nil
+	}); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// validateMetricFamily checks the name, the histogram buckets, and the
+// exemplars of mf.
+func validateMetricFamily(mf *dto.MetricFamily) []error {
+	var errs []error
+	name := mf.GetName()
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		errs = append(errs, fmt.Errorf("invalid metric name %q", name))
+	}
+	for _, m := range mf.Metric {
+		if err := checkExemplar(m.GetCounter().GetExemplar()); err != nil {
+			errs = append(errs, fmt.Errorf("metric family %q: %w", name, err))
+		}
+		if m.Histogram == nil {
+			continue
+		}
+		errs = append(errs, checkBucketCounts(name, m.Histogram)...)
+		for _, b := range m.Histogram.Bucket {
+			if err := checkExemplar(b.GetExemplar()); err != nil {
+				errs = append(errs, fmt.Errorf("metric family %q: %w", name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkBucketCounts returns an error for every bucket of h whose cumulative
+// count is lower than that of the preceding bucket.
+func checkBucketCounts(name string, h *dto.Histogram) []error {
+	var (
+		errs []error
+		prev *dto.Bucket
+	)
+	for _, b := range sortedBuckets(h.Bucket) {
+		if prev != nil && b.GetCumulativeCount() < prev.GetCumulativeCount() {
+			errs = append(errs, fmt.Errorf(
+				"histogram %q: cumulative count %d of bucket %g is lower than count %d of bucket %g",
+				name, b.GetCumulativeCount(), b.GetUpperBound(), prev.GetCumulativeCount(), prev.GetUpperBound(),
+			))
+		}
+		prev = b
+	}
+	return errs
+}
+
+// CheckOpenMetrics runs all checks MetricFamilyToOpenMetrics would run on mf
+// with the given options, without writing anything, and returns all errors
+// found, or nil if there are none. Unlike the encoder, which stops at the first
+// error, it reports the error of every metric in mf. If mf is rejected as a
+// whole, e.g. because it has no name or its type doesn't fit the options, only
+// that error is returned. In addition, the cumulative counts of the buckets of
+// (non-gauge) histograms are checked not to decrease, which the encoder
+// doesn't check.
+func CheckOpenMetrics(mf *dto.MetricFamily, options ...EncoderOption) []error {
+	var errs []error
+	if _, err := MetricFamilyToOpenMetrics(io.Discard, mf, options...); err != nil {
+		family := &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+		if _, famErr := MetricFamilyToOpenMetrics(io.Discard, family, options...); famErr != nil {
+			return []error{err}
+		}
+		for _, m := range mf.Metric {
+			family.Metric = []*dto.Metric{m}
+			if _, err := MetricFamilyToOpenMetrics(io.Discard, family, options...); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if mf.GetType() == dto.MetricType_HISTOGRAM {
+		for _, m := range mf.Metric {
+			if m.GetHistogram() != nil && !IsNativeHistogram(m.Histogram) {
+				errs = append(errs, checkBucketCounts(mf.GetName(), m.Histogram)...)
+			}
+		}
+	}
+	return errs
+}
+
+// checkExemplar returns an error if the labels of e (which may be nil) exceed
+// the length allowed by OpenMetrics.
+func checkExemplar(e *dto.Exemplar) error {
+	if e == nil {
+		return nil
+	}
+	runes := 0
+	for _, l := range e.Label {
+		runes += utf8.RuneCountInString(l.GetName()) + utf8.RuneCountInString(l.GetValue())
+	}
+	if runes > exemplarMaxRunes {
+		return fmt.Errorf("exemplar labels have %d runes, exceeding the limit of %d", runes, exemplarMaxRunes)
+	}
+	return nil
+}
+
+// errMissingEOF is returned by openMetricsToText for an OpenMetrics exposition
+// that doesn't end with a `# EOF` line, e.g. because it has been truncated.
+var errMissingEOF = errors.New("missing # EOF line at the end of the exposition")
+
+// openMetricsToText translates an OpenMetrics exposition into the text format
+// line by line, so that line numbers are kept. It returns the exemplars removed
+// from the sample lines by line index (starting at 0) and the violations of
+// OpenMetrics rules found on the way: a missing `# EOF` line, content after
+// it, empty lines, and invalid exemplars.
+func openMetricsToText(in []byte) ([]byte, map[int]*dto.Exemplar, []error) {
+	var (
+		errs      []error
+		exemplars map[int]*dto.Exemplar
+		lines     = strings.Split(string(in), "\n")
+		eof       = -1 // Index of the EOF line.
+	)
+	if lines[len(lines)-1] == "" {
+		// The exposition ended with a newline.
+		lines = lines[:len(lines)-1]
+	}
+	// The metadata of a counter omits the _total suffix of its samples,
+	// which the TextParser expects in the metadata, too.
+	counters := map[string]bool{}
+	for _, line := range lines {
+		if keyword, name, _, end, ok := splitMetadata(line); ok && keyword == "TYPE" && metadataType(line[end:]) == "counter" {
+			counters[name] = true
+		}
+	}
+	for i, line := range lines {
+		switch {
+		case line == "# EOF":
+			eof = i
+		case line == "":
+			errs = append(errs, fmt.Errorf("line %d: empty lines are not allowed in OpenMetrics", i+1))
+		case line[0] == '#':
+			keyword, name, start, end, ok := splitMetadata(line)
+			if !ok {
+				continue
+			}
+			token, rest := line[start:end], line[end:]
+			if keyword == "TYPE" && openMetricsOnlyTypes[metadataType(rest)] {
+				lines[i] = "# TYPE " + token + " untyped"
+				continue
+			}
+			if counters[name] {
+				token = renameToken(token, name+"_total")
+			}
+			if keyword == "HELP" {
+				rest = openMetricsHelpToText(rest)
+			}
+			lines[i] = line[:start] + token + rest
+		default:
+			var (
+				e   *dto.Exemplar
+				err error
+			)
+			if lines[i], e, err = openMetricsSampleToText(line); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", i+1, err))
+			}
+			if e != nil {
+				if exemplars == nil {
+					exemplars = map[int]*dto.Exemplar{}
+				}
+				exemplars[i] = e
+			}
+		}
+		if eof >= 0 {
+			break
+		}
+	}
+	switch {
+	case eof < 0:
+		errs = append(errs, errMissingEOF)
+	case eof < len(lines)-1:
+		errs = append(errs, fmt.Errorf("line %d: content after the # EOF line", eof+2))
+		lines = lines[:eof+1]
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), exemplars, errs
+}
+
+// openMetricsSampleToText removes the exemplar from an OpenMetrics sample line
+// and converts its timestamp from seconds to milliseconds. The exemplar is
+// checked and returned if it is valid, and an error is returned otherwise.
+// Lines that cannot be taken apart are returned as is for the TextParser to
+// report.
+func openMetricsSampleToText(line string) (string, *dto.Exemplar, error) {
+	end := seriesEnd(line)
+	if end < 0 {
+		return line, nil, nil
+	}
+	series, rest := line[:end], line[end:]
+
+	var (
+		e   *dto.Exemplar
+		err error
+	)
+	if i := strings.Index(rest, " # "); i >= 0 {
+		if e, err = parseExemplar(rest[i+3:]); err == nil {
+			err = checkExemplar(e)
+		}
+		if err != nil {
+			e = nil
+		}
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 2 {
+		if ts, tsErr := strconv.ParseFloat(fields[1], 64); tsErr == nil {
+			fields[1] = strconv.FormatInt(int64(math.Round(ts*1000)), 10)
+		}
+	}
+	return series + " " + strings.Join(fields, " "), e, err
+}
+
+// splitMetadata returns the keyword of a HELP or TYPE line and the metric name
+// in it, unquoted and unescaped if it is quoted, along with the start and end
+// index of the name as written in line. ok is false for other lines and if the
+// name cannot be read.
+func splitMetadata(line string) (keyword, name string, start, end int, ok bool) {
+	rest := strings.TrimLeft(line, " \t")
+	if !strings.HasPrefix(rest, "#") {
+		return "", "", 0, 0, false
+	}
+	rest = strings.TrimLeft(rest[1:], " \t")
+	switch {
+	case strings.HasPrefix(rest, "HELP"):
+		keyword = "HELP"
+	case strings.HasPrefix(rest, "TYPE"):
+		keyword = "TYPE"
+	default:
+		return "", "", 0, 0, false
+	}
+	rest = rest[len(keyword):]
+	if trimmed := strings.TrimLeft(rest, " \t"); len(trimmed) < len(rest) {
+		rest = trimmed
+	} else {
+		return "", "", 0, 0, false // The keyword is followed by anything but a blank.
+	}
+	start = len(line) - len(rest)
+	name, end, ok = readName(line, start)
+	return keyword, name, start, end, ok
+}
+
+// openMetricsHelpToText translates the escaping of an OpenMetrics docstring,
+// which allows `\"` in addition to the `\\` and `\n` of the text format.
+func openMetricsHelpToText(help string) string {
+	if !strings.Contains(help, `\"`) {
+		return help
+	}
+	var b strings.Builder
+	for i := 0; i < len(help); i++ {
+		if help[i] == '\\' && i+1 < len(help) {
+			if help[i+1] != '"' {
+				b.WriteByte('\\')
+			}
+			i++
+		}
+		b.WriteByte(help[i])
+	}
+	return b.String()
+}
+
+// metadataType returns the type in the remainder of a TYPE line following the
+// metric name, or "" if it isn't a single word.
+func metadataType(rest string) string {
+	if fields := strings.Fields(rest); len(fields) == 1 {
+		return fields[0]
+	}
+	return ""
+}
+
+// sampleName returns the metric name of a sample line, unquoted and unescaped
+// if it is quoted as the first element of the label set, along with the start
+// and end index of the name as written in line. ok is false if the name cannot
+// be read.
+func sampleName(line string) (name string, start, end int, ok bool) {
+	if !strings.HasPrefix(line, "{") {
+		end = strings.IndexAny(line, "{ ")
+		if end < 0 {
+			return "", 0, 0, false
+		}
+		return line[:end], 0, end, true
+	}
+	start = len(line) - len(strings.TrimLeft(line[1:], " \t"))
+	name, end, ok = readName(line, start)
+	return name, start, end, ok
+}
+
+// readName reads a metric name starting at index start of line, which is
+// either quoted and escaped like a label value or ends at the first blank or
+// '{'. It returns the name, unquoted and unescaped, and the index right after
+// it.
+func readName(line string, start int) (name string, end int, ok bool) {
+	if !strings.HasPrefix(line[start:], `"`) {
+		end = strings.IndexAny(line[start:], " \t{")
+		if end < 0 {
+			end = len(line) - start
+		}
+		return line[start : start+end], start + end, end > 0
+	}
+	escaped := false
+	for end = start + 1; end < len(line); end++ {
+		switch c := line[end]; {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			name, err := UnescapeString(line[start+1 : end])
+			return name, end + 1, err == nil
+		}
+	}
+	return "", 0, false
+}
+
+// renameToken returns newName written like token, the name as written in an
+// exposition, i.e. quoted and escaped if token is quoted.
+func renameToken(token, newName string) string {
+	if strings.HasPrefix(token, `"`) {
+		return `"` + EscapeString(newName) + `"`
+	}
+	return newName
+}
+
+// seriesEnd returns the index in a sample line right after the metric name
+// and, if present, the label set, or -1 if it cannot be found.
+func seriesEnd(line string) int {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 || line[end] == ' ' {
+		return end
+	}
+	inQuotes, escaped := false, false
+	for end++; end < len(line); end++ {
+		switch c := line[end]; {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = inQuotes
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '}' && !inQuotes:
+			return end + 1
+		}
+	}
+	return -1
+}
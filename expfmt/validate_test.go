@@ -0,0 +1,350 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCheckNameSuffix(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		typ      dto.MetricType
+		warnings []string
+	}{
+		{
+			name: "http_requests_total",
+			typ:  dto.MetricType_COUNTER,
+		},
+		{
+			name: "temperature_celsius",
+			typ:  dto.MetricType_GAUGE,
+		},
+		{
+			name: "whatever_total",
+			typ:  dto.MetricType_UNTYPED,
+		},
+		{
+			name:     "queue_length_total",
+			typ:      dto.MetricType_GAUGE,
+			warnings: []string{`gauge "queue_length_total" has the suffix "_total" reserved for counters`},
+		},
+		{
+			name:     "http_requests",
+			typ:      dto.MetricType_COUNTER,
+			warnings: []string{`counter "http_requests" should have the suffix "_total"`},
+		},
+		{
+			name:     "request_duration_seconds_bucket",
+			typ:      dto.MetricType_HISTOGRAM,
+			warnings: []string{`histogram "request_duration_seconds_bucket" has the suffix "_bucket" used for its samples`},
+		},
+		{
+			name:     "rpc_duration_seconds_count",
+			typ:      dto.MetricType_SUMMARY,
+			warnings: []string{`summary "rpc_duration_seconds_count" has the suffix "_count" used for its samples`},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		warnings := CheckNameSuffix(&dto.MetricFamily{
+			Name: proto.String(scenario.name),
+			Type: scenario.typ.Enum(),
+		})
+		if len(warnings) != len(scenario.warnings) {
+			t.Errorf("%d. expected %d warnings, got %v", i, len(scenario.warnings), warnings)
+			continue
+		}
+		for j, w := range warnings {
+			if w.Error() != scenario.warnings[j] {
+				t.Errorf("%d. expected warning %q, got %q", i, scenario.warnings[j], w.Error())
+			}
+		}
+	}
+}
+
+func TestValidateExposition(t *testing.T) {
+	long := strings.Repeat("x", 130)
+	scenarios := []struct {
+		in     string
+		format Format
+		errs   []string
+	}{
+		// 0: Clean text.
+		{
+			in: `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 1027 1395066363000
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="1"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 3.5
+latency_count 3
+`,
+			format: FmtText,
+		},
+		// 1: Clean OpenMetrics.
+		{
+			in: `# HELP http_requests Total requests.
+# TYPE http_requests counter
+http_requests_total{code="200"} 1027 1395066363.5 # {trace_id="abc"} 1.0 1395066363.1
+# TYPE queue_length unknown
+queue_length 5.0
+# TYPE latency histogram
+latency_bucket{le="0.5",path="/a # b"} 1 # {trace_id="def"} 0.3
+latency_bucket{le="+Inf",path="/a # b"} 3
+latency_sum{path="/a # b"} 3.5
+latency_count{path="/a # b"} 3
+# EOF
+`,
+			format: FmtOpenMetrics_1_0_0,
+		},
+		// 2: OpenMetrics without EOF, with an empty line, and an
+		// oversized exemplar.
+		{
+			in: `# TYPE http_requests counter
+http_requests_total 1 # {trace_id="` + long + `"} 1.0
+
+`,
+			format: FmtOpenMetrics_1_0_0,
+			errs: []string{
+				"line 2: exemplar labels have 138 runes, exceeding the limit of 128",
+				"line 3: empty lines are not allowed in OpenMetrics",
+				"missing # EOF line at the end of the exposition",
+			},
+		},
+		// 3: Content after EOF.
+		{
+			in: `# TYPE up gauge
+up 1
+# EOF
+up 0
+`,
+			format: FmtOpenMetrics_1_0_0,
+			errs:   []string{"line 4: content after the # EOF line"},
+		},
+		// 4: Decreasing buckets and a family appearing twice.
+		{
+			in: `# TYPE latency histogram
+latency_bucket{le="0.5"} 2
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 3
+latency_sum 3.5
+latency_count 3
+up 1
+down 0
+up 0
+`,
+			format: FmtText,
+			errs: []string{
+				`histogram "latency": cumulative count 1 of bucket 1 is lower than count 2 of bucket 0.5`,
+				`metric family "up" appears more than once`,
+			},
+		},
+		// 5: OpenMetrics with created timestamps between the samples of a
+		// counter and a family appearing twice.
+		{
+			in: `# TYPE requests counter
+requests_total{code="200"} 1.0
+requests_created{code="200"} 1600000000.0
+requests_total{code="500"} 2.0
+requests_created{code="500"} 1600000000.0
+# TYPE up gauge
+up 1.0
+# TYPE down gauge
+down 0.0
+up{instance="b"} 0.0
+# EOF
+`,
+			format: FmtOpenMetrics_1_0_0,
+			errs:   []string{`metric family "up" appears more than once`},
+		},
+		// 6: Second metadata for the same family.
+		{
+			in: `# TYPE up gauge
+# TYPE up counter
+up 1
+`,
+			format: FmtText,
+			errs: []string{
+				`text format parsing error in line 2: second TYPE line for metric name "up", or TYPE reported after samples`,
+			},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		errs := ValidateExposition(strings.NewReader(scenario.in), scenario.format)
+		if len(errs) != len(scenario.errs) {
+			t.Errorf("%d. expected %d errors, got %v", i, len(scenario.errs), errs)
+			continue
+		}
+		for j, err := range errs {
+			if err.Error() != scenario.errs[j] {
+				t.Errorf("%d. expected error %q, got %q", i, scenario.errs[j], err.Error())
+			}
+		}
+	}
+}
+
+func TestValidateExpositionProto(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, FmtProtoDelim)
+	for _, mf := range []*dto.MetricFamily{
+		{
+			Name: proto.String("latency"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(3),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(3)},
+							{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(2)},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("up"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			},
+		},
+	} {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := ValidateExposition(&buf, FmtProtoDelim)
+	expected := `histogram "latency": cumulative count 2 of bucket +Inf is lower than count 3 of bucket 1`
+	if len(errs) != 1 || errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, errs)
+	}
+}
+
+func TestCheckOpenMetrics(t *testing.T) {
+	longExemplar := &dto.Exemplar{
+		Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String(strings.Repeat("x", 130))}},
+		Value: proto.Float64(1),
+	}
+	scenarios := []struct {
+		in      *dto.MetricFamily
+		options []EncoderOption
+		errs    []string
+	}{
+		// 0: Valid.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos_total"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{Counter: &dto.Counter{Value: proto.Float64(1)}},
+				},
+			},
+		},
+		// 1: No name.
+		{
+			in: &dto.MetricFamily{
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{Counter: &dto.Counter{Value: proto.Float64(1)}},
+				},
+			},
+			errs: []string{"MetricFamily has no name"},
+		},
+		// 2: Type mismatch and exemplar too long, in separate metrics.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("foos_total"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+					{Counter: &dto.Counter{Value: proto.Float64(1)}},
+					{Counter: &dto.Counter{Value: proto.Float64(1), Exemplar: longExemplar}},
+				},
+			},
+			errs: []string{"expected counter in metric", "expected valid exemplar in metric"},
+		},
+		// 3: Decreasing bucket counts.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("latency_seconds"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(3),
+							SampleSum:   proto.Float64(1),
+							Bucket: []*dto.Bucket{
+								{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+								{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+							},
+						},
+					},
+				},
+			},
+			errs: []string{`histogram "latency_seconds": cumulative count 1 of bucket 1 is lower than count 2 of bucket 0.1`},
+		},
+		// 4: Family rejected as a whole due to the options.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("build"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{Gauge: &dto.Gauge{Value: proto.Float64(2)}},
+					{Gauge: &dto.Gauge{Value: proto.Float64(3)}},
+				},
+			},
+			options: []EncoderOption{WithInfoFamilies("build")},
+			errs:    []string{`info metric family "build" lacks the _info suffix`},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		before := proto.Clone(scenario.in)
+		errs := CheckOpenMetrics(scenario.in, scenario.options...)
+		if len(errs) != len(scenario.errs) {
+			t.Errorf("%d. expected %d errors, got %v", i, len(scenario.errs), errs)
+			continue
+		}
+		for j, err := range errs {
+			if !strings.HasPrefix(err.Error(), scenario.errs[j]) {
+				t.Errorf("%d. expected error %d to start with %q, got %q", i, j, scenario.errs[j], err)
+			}
+		}
+		if !proto.Equal(before, scenario.in) {
+			t.Errorf("%d. metric family modified", i)
+		}
+
+		// The encoder returns the first of the errors.
+		var out bytes.Buffer
+		_, err := MetricFamilyToOpenMetrics(&out, scenario.in, scenario.options...)
+		switch {
+		case len(errs) == 0 && err != nil:
+			t.Errorf("%d. unexpected encoder error: %s", i, err)
+		case len(errs) > 0 && scenario.in.GetType() != dto.MetricType_HISTOGRAM && (err == nil || err.Error() != errs[0].Error()):
+			t.Errorf("%d. expected encoder error %q, got %v", i, errs[0], err)
+		}
+	}
+}
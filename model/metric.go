@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -137,9 +138,178 @@ func IsValidLegacyMetricName(n LabelValue) bool {
 		return false
 	}
 	for i, b := range n {
-		if !((b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || b == ':' || (b >= '0' && b <= '9' && i > 0)) {
+		if !isValidLegacyRune(b, i) {
 			return false
 		}
 	}
 	return true
 }
+
+// isValidLegacyRune returns whether r is allowed at index i of a metric name
+// conforming to the legacy validation pattern.
+func isValidLegacyRune(r rune, i int) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || r == ':' || (r >= '0' && r <= '9' && i > 0)
+}
+
+// EscapingScheme determines how metric and label names not conforming to the
+// legacy validation pattern are transformed into conforming names, so that
+// they can be exposed to consumers not supporting UTF-8 names.
+type EscapingScheme int
+
+const (
+	// NoEscaping leaves names as they are, requiring a consumer
+	// supporting UTF-8 names.
+	NoEscaping EscapingScheme = iota
+
+	// UnderscoreEscaping replaces every character not allowed in legacy
+	// names by an underscore. It cannot be reversed.
+	UnderscoreEscaping
+
+	// DotsEscaping replaces dots by "_dot_" and underscores by "__", and
+	// every other character not allowed in legacy names by "__". Only
+	// names without such other characters can be recovered exactly.
+	DotsEscaping
+
+	// ValueEncodingEscaping prefixes names that need escaping with "U__",
+	// replaces underscores by "__", and every character not allowed in
+	// legacy names by its code point in hexadecimal, enclosed in
+	// underscores, e.g. "_2e_" for a dot. It can be reversed exactly.
+	ValueEncodingEscaping
+)
+
+// The values of the escaping parameter of a Content-Type header, denoting the
+// escaping schemes.
+const (
+	EscapingKey = "escaping"
+
+	AllowUTF8         = "allow-utf-8"
+	EscapeUnderscores = "underscores"
+	EscapeDots        = "dots"
+	EscapeValues      = "values"
+)
+
+// String returns the value of the escaping parameter of a Content-Type header
+// denoting e.
+func (e EscapingScheme) String() string {
+	switch e {
+	case NoEscaping:
+		return AllowUTF8
+	case UnderscoreEscaping:
+		return EscapeUnderscores
+	case DotsEscaping:
+		return EscapeDots
+	case ValueEncodingEscaping:
+		return EscapeValues
+	default:
+		panic(fmt.Sprintf("unknown escaping scheme %d", e))
+	}
+}
+
+// ToEscapingScheme returns the EscapingScheme denoted by s, the value of the
+// escaping parameter of a Content-Type header.
+func ToEscapingScheme(s string) (EscapingScheme, error) {
+	switch s {
+	case AllowUTF8:
+		return NoEscaping, nil
+	case EscapeUnderscores:
+		return UnderscoreEscaping, nil
+	case EscapeDots:
+		return DotsEscaping, nil
+	case EscapeValues:
+		return ValueEncodingEscaping, nil
+	default:
+		return NoEscaping, fmt.Errorf("unknown escaping scheme %q", s)
+	}
+}
+
+// EscapeName escapes name according to scheme. Names conforming to the legacy
+// validation pattern are returned as they are, except for DotsEscaping, which
+// always escapes underscores so that the name can be unescaped.
+func EscapeName(name string, scheme EscapingScheme) string {
+	if name == "" || scheme == NoEscaping {
+		return name
+	}
+	if scheme != DotsEscaping && IsValidLegacyMetricName(LabelValue(name)) {
+		return name
+	}
+	var escaped strings.Builder
+	if scheme == ValueEncodingEscaping {
+		escaped.WriteString("U__")
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' && scheme != UnderscoreEscaping:
+			escaped.WriteString("__")
+		case isValidLegacyRune(r, i):
+			escaped.WriteRune(r)
+		case scheme == UnderscoreEscaping:
+			escaped.WriteByte('_')
+		case scheme == DotsEscaping && r == '.':
+			escaped.WriteString("_dot_")
+		case scheme == DotsEscaping:
+			escaped.WriteString("__")
+		case r == utf8.RuneError:
+			// Invalid UTF-8 is escaped as the replacement character.
+			escaped.WriteString("_FFFD_")
+		default:
+			escaped.WriteByte('_')
+			escaped.WriteString(strconv.FormatInt(int64(r), 16))
+			escaped.WriteByte('_')
+		}
+	}
+	return escaped.String()
+}
+
+// UnescapeName reverses EscapeName as far as possible. Names escaped with
+// UnderscoreEscaping are returned as they are. Names that cannot have been
+// created by EscapeName with the given scheme are returned as they are, too.
+func UnescapeName(name string, scheme EscapingScheme) string {
+	switch scheme {
+	case DotsEscaping:
+		var unescaped strings.Builder
+		for i := 0; i < len(name); i++ {
+			switch {
+			case strings.HasPrefix(name[i:], "__"):
+				unescaped.WriteByte('_')
+				i++
+			case strings.HasPrefix(name[i:], "_dot_"):
+				unescaped.WriteByte('.')
+				i += len("_dot_") - 1
+			default:
+				unescaped.WriteByte(name[i])
+			}
+		}
+		return unescaped.String()
+	case ValueEncodingEscaping:
+		escaped, found := strings.CutPrefix(name, "U__")
+		if !found {
+			return name
+		}
+		var unescaped strings.Builder
+		for i := 0; i < len(escaped); i++ {
+			if escaped[i] != '_' {
+				unescaped.WriteByte(escaped[i])
+				continue
+			}
+			if strings.HasPrefix(escaped[i:], "__") {
+				unescaped.WriteByte('_')
+				i++
+				continue
+			}
+			// A code point, enclosed in underscores.
+			end := strings.IndexByte(escaped[i+1:], '_')
+			if end < 1 || end > 6 {
+				return name
+			}
+			code, err := strconv.ParseUint(escaped[i+1:i+1+end], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return name
+			}
+			unescaped.WriteRune(rune(code))
+			i += end + 1
+		}
+		return unescaped.String()
+	default:
+		return name
+	}
+}
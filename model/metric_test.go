@@ -223,3 +223,108 @@ func TestMetricToString(t *testing.T) {
 		})
 	}
 }
+
+func TestEscapeName(t *testing.T) {
+	scenarios := []struct {
+		name        string
+		underscores string
+		dots        string
+		values      string
+		// Unescaping is lossy for these schemes and names.
+		dotsLossy bool
+	}{
+		{
+			name:        "",
+			underscores: "",
+			dots:        "",
+			values:      "",
+		},
+		{
+			name:        "no_escaping_required",
+			underscores: "no_escaping_required",
+			dots:        "no__escaping__required",
+			values:      "no_escaping_required",
+		},
+		{
+			name:        "http.status:sum",
+			underscores: "http_status:sum",
+			dots:        "http_dot_status:sum",
+			values:      "U__http_2e_status:sum",
+		},
+		{
+			name:        "label with 😱",
+			underscores: "label_with__",
+			dots:        "label__with____",
+			values:      "U__label_20_with_20__1f631_",
+			dotsLossy:   true,
+		},
+		{
+			name:        "_dot_.__",
+			underscores: "_dot____",
+			dots:        "__dot___dot_____",
+			values:      "U____dot___2e_____",
+		},
+		{
+			name:        "1st",
+			underscores: "_st",
+			dots:        "__st",
+			values:      "U___31_st",
+			dotsLossy:   true,
+		},
+	}
+
+	for i, s := range scenarios {
+		for _, c := range []struct {
+			scheme  EscapingScheme
+			escaped string
+			lossy   bool
+		}{
+			{UnderscoreEscaping, s.underscores, true},
+			{DotsEscaping, s.dots, s.dotsLossy},
+			{ValueEncodingEscaping, s.values, false},
+		} {
+			got := EscapeName(s.name, c.scheme)
+			if got != c.escaped {
+				t.Errorf("%d. %s: expected %q to escape to %q, got %q", i, c.scheme, s.name, c.escaped, got)
+			}
+			if got != "" && !IsValidLegacyMetricName(LabelValue(got)) {
+				t.Errorf("%d. %s: escaped name %q is not a valid legacy name", i, c.scheme, got)
+			}
+			if c.lossy {
+				continue
+			}
+			if unescaped := UnescapeName(got, c.scheme); unescaped != s.name {
+				t.Errorf("%d. %s: expected %q to unescape to %q, got %q", i, c.scheme, got, s.name, unescaped)
+			}
+		}
+		if got := EscapeName(s.name, NoEscaping); got != s.name {
+			t.Errorf("%d. expected %q to be kept, got %q", i, s.name, got)
+		}
+	}
+}
+
+func TestUnescapeNameInvalid(t *testing.T) {
+	for _, name := range []string{
+		"U__no_closing_underscore",
+		"U__too_long_1234567_",
+		"U__not_hex_xyz_",
+		"U__surrogate_d800_",
+		"no_prefix_2e_",
+	} {
+		if got := UnescapeName(name, ValueEncodingEscaping); got != name {
+			t.Errorf("expected %q to be returned as is, got %q", name, got)
+		}
+	}
+}
+
+func TestToEscapingScheme(t *testing.T) {
+	for _, scheme := range []EscapingScheme{NoEscaping, UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping} {
+		got, err := ToEscapingScheme(scheme.String())
+		if err != nil || got != scheme {
+			t.Errorf("expected %s to round-trip, got %s, %v", scheme, got, err)
+		}
+	}
+	if _, err := ToEscapingScheme("bogus"); err == nil {
+		t.Error("expected an error for an unknown scheme")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import "bytes"
+
+const esc = 0x1b
+
+// StripColor returns b with all ANSI escape sequences removed, e.g. the color
+// codes of log output written to a terminal. It is meant for tests asserting
+// on captured log output independently of whether it is colorized. All other
+// bytes, including invalid UTF-8, are preserved. If b contains no escape
+// character, b itself is returned.
+//
+// Control sequences (ESC [ ... final byte), operating system commands (ESC ]
+// ... terminated by BEL or ESC \) and other two-byte escapes are recognized.
+// An escape sequence truncated by the end of b is removed, too.
+func StripColor(b []byte) []byte {
+	i := bytes.IndexByte(b, esc)
+	if i < 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for i >= 0 {
+		out = append(out, b[:i]...)
+		b = b[i+escapeLen(b[i:]):]
+		i = bytes.IndexByte(b, esc)
+	}
+	return append(out, b...)
+}
+
+// escapeLen returns the length of the escape sequence at the start of b, which
+// must start with ESC.
+func escapeLen(b []byte) int {
+	if len(b) < 2 {
+		return len(b)
+	}
+	switch b[1] {
+	case '[':
+		// Parameter and intermediate bytes, followed by one final byte.
+		for i := 2; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				return i + 1
+			}
+			if b[i] < 0x20 || b[i] > 0x3f {
+				return i // Malformed, keep the offending byte.
+			}
+		}
+		return len(b)
+	case ']':
+		for i := 2; i < len(b); i++ {
+			switch {
+			case b[i] == '\a':
+				return i + 1
+			case b[i] == esc && i+1 < len(b) && b[i+1] == '\\':
+				return i + 2
+			}
+		}
+		return len(b)
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import "testing"
+
+func TestStripColor(t *testing.T) {
+	scenarios := []struct {
+		in, expected string
+	}{
+		{
+			in:       "level=info msg=hello\n",
+			expected: "level=info msg=hello\n",
+		},
+		{
+			in:       "\x1b[34mlevel=info\x1b[0m msg=hello\n",
+			expected: "level=info msg=hello\n",
+		},
+		{
+			in:       "\x1b[1;31mlevel=error\x1b[m msg=\"bad \xff\xfe\" city=Zürich\n",
+			expected: "level=error msg=\"bad \xff\xfe\" city=Zürich\n",
+		},
+		{
+			in:       "\x1b]0;title\amsg=a \x1b]8;;http://example.com\x1b\\link\x1b]8;;\x1b\\\n",
+			expected: "msg=a link\n",
+		},
+		{
+			in:       "\x1bcmsg=reset \x1b[?25lcursor\x1b[?25h\n",
+			expected: "msg=reset cursor\n",
+		},
+		{
+			in:       "\x1b[3\nmsg=malformed",
+			expected: "\nmsg=malformed",
+		},
+		{
+			in:       "msg=truncated\x1b[3",
+			expected: "msg=truncated",
+		},
+		{
+			in:       "msg=truncated\x1b",
+			expected: "msg=truncated",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		in := []byte(scenario.in)
+		got := StripColor(in)
+		if string(got) != scenario.expected {
+			t.Errorf("%d. expected %q, got %q", i, scenario.expected, got)
+		}
+		if string(in) != scenario.in {
+			t.Errorf("%d. input modified to %q", i, in)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// dedupSeenKey is the key of the number of lines coalesced into a summary line
+// by a DedupRule.
+const dedupSeenKey = "seen"
+
+// DedupRule configures the deduplication of log lines by the value logged
+// under Key (before the KeyPrefix is applied), e.g. "error_code", to collapse
+// bursts of the same error even if other fields, like the details, differ. The
+// first line with a given value is logged. Further lines with the same value
+// within Interval are dropped. At the end of the Interval, if lines were
+// dropped, the last of them is logged as a summary with an additional "seen"
+// field holding the number of lines with the value during the Interval,
+// including the first one. The next line with the value after the Interval is
+// logged again and starts a new Interval. Lines without a value under Key are
+// always logged. An empty Key or an Interval of 0 or less disables the
+// deduplication.
+type DedupRule struct {
+	Key      string
+	Interval time.Duration
+}
+
+// dedupLogger drops log lines according to a DedupRule.
+type dedupLogger struct {
+	next      log.Logger
+	rule      DedupRule
+	afterFunc func(time.Duration, func()) // Runs the summary at the end of an interval.
+
+	mtx     sync.Mutex
+	windows map[string]*dedupWindow // By value under rule.Key.
+}
+
+// dedupWindow tracks the lines with one value during an interval.
+type dedupWindow struct {
+	seen int
+	last []interface{} // The last dropped line, if any.
+}
+
+// withDedup wraps l in a dedupLogger if config asks for it.
+func withDedup(l log.Logger, config *Config) log.Logger {
+	if config.Dedup == nil || config.Dedup.Key == "" || config.Dedup.Interval <= 0 {
+		return l
+	}
+	return &dedupLogger{
+		next:      l,
+		rule:      *config.Dedup,
+		afterFunc: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		windows:   map[string]*dedupWindow{},
+	}
+}
+
+// Log implements log.Logger.
+func (d *dedupLogger) Log(keyvals ...interface{}) error {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] != d.rule.Key {
+			continue
+		}
+		value := fmt.Sprint(keyvals[i+1])
+		d.mtx.Lock()
+		if w, ok := d.windows[value]; ok {
+			w.seen++
+			w.last = append(w.last[:0], keyvals...)
+			d.mtx.Unlock()
+			return nil
+		}
+		d.windows[value] = &dedupWindow{seen: 1}
+		d.mtx.Unlock()
+		d.afterFunc(d.rule.Interval, func() { d.summarize(value) })
+		break
+	}
+	return d.next.Log(keyvals...)
+}
+
+// summarize ends the interval of value, logging the summary line if lines were
+// dropped.
+func (d *dedupLogger) summarize(value string) {
+	d.mtx.Lock()
+	w := d.windows[value]
+	delete(d.windows, value)
+	d.mtx.Unlock()
+	if w == nil || w.seen < 2 {
+		return
+	}
+	_ = d.next.Log(append(w.last, dedupSeenKey, w.seen)...)
+}
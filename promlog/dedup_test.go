@@ -0,0 +1,169 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// lineRecorder records the key/value pairs of all lines logged to it.
+type lineRecorder struct {
+	mtx   sync.Mutex
+	lines [][]interface{}
+}
+
+func (r *lineRecorder) Log(keyvals ...interface{}) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.lines = append(r.lines, keyvals)
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func TestDedup(t *testing.T) {
+	var (
+		recorder = &lineRecorder{}
+		timers   []func()
+		logger   = withDedup(recorder, &Config{Dedup: &DedupRule{Key: "error_code", Interval: time.Minute}}).(*dedupLogger)
+	)
+	logger.afterFunc = func(d time.Duration, f func()) {
+		if d != time.Minute {
+			t.Errorf("expected interval %s, got %s", time.Minute, d)
+		}
+		timers = append(timers, f)
+	}
+
+	// A burst of two error codes, differing in the details, interleaved with
+	// lines without an error code.
+	for i := 0; i < 100; i++ {
+		if err := logger.Log("msg", "request failed", "error_code", 500+i%2, "detail", i); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			if err := logger.Log("msg", "request served"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if expected, got := 2+10, len(recorder.lines); expected != got {
+		t.Fatalf("expected %d lines, got %d: %v", expected, got, recorder.lines)
+	}
+	if expected, got := fmt.Sprint([]interface{}{"msg", "request failed", "error_code", 500, "detail", 0}), fmt.Sprint(recorder.lines[0]); expected != got {
+		t.Errorf("expected first line %s, got %s", expected, got)
+	}
+	if expected, got := fmt.Sprint([]interface{}{"msg", "request failed", "error_code", 501, "detail", 1}), fmt.Sprint(recorder.lines[2]); expected != got {
+		t.Errorf("expected first line %s, got %s", expected, got)
+	}
+	if len(timers) != 2 {
+		t.Fatalf("expected 2 intervals, got %d", len(timers))
+	}
+
+	// The end of the intervals logs the last dropped lines as summaries.
+	recorder.lines = nil
+	for _, f := range timers {
+		f()
+	}
+	if expected, got := fmt.Sprint([][]interface{}{
+		{"msg", "request failed", "error_code", 500, "detail", 98, "seen", 50},
+		{"msg", "request failed", "error_code", 501, "detail", 99, "seen", 50},
+	}), fmt.Sprint(recorder.lines); expected != got {
+		t.Errorf("expected summaries %s, got %s", expected, got)
+	}
+
+	// The next lines start new intervals. Without dropped lines, there is no
+	// summary.
+	recorder.lines, timers = nil, nil
+	for _, code := range []int{500, 501} {
+		if err := logger.Log("msg", "request failed", "error_code", code, "detail", "again"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range timers {
+		f()
+	}
+	if expected, got := 2, len(recorder.lines); expected != got {
+		t.Errorf("expected %d lines, got %d: %v", expected, got, recorder.lines)
+	}
+}
+
+func TestDedupDisabled(t *testing.T) {
+	for i, rule := range []*DedupRule{
+		nil,
+		{Interval: time.Minute},
+		{Key: "error_code"},
+	} {
+		if _, ok := withDedup(log.NewNopLogger(), &Config{Dedup: rule}).(*dedupLogger); ok {
+			t.Errorf("%d. expected no deduplication", i)
+		}
+	}
+}
+
+func TestDedupConfig(t *testing.T) {
+	w := &syncBuffer{}
+	config := &Config{
+		Level:     &AllowedLevel{},
+		KeyPrefix: "db.",
+		Dedup:     &DedupRule{Key: "error_code", Interval: 10 * time.Millisecond},
+	}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+	logger := NewDynamicWithWriter(w, config)
+	for i := 0; i < 10; i++ {
+		if err := level.Error(logger).Log("error_code", "E42", "detail", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out := w.String()
+		if strings.Contains(out, "db.seen=10") {
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			if len(lines) != 2 || !strings.Contains(lines[0], "db.detail=0") || !strings.Contains(lines[1], "db.detail=9") {
+				t.Errorf("expected first line and summary, got %q", out)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected summary, got %q", out)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// LevelEnvVar is the environment variable consulted by ApplyEnv for the
+	// log level.
+	LevelEnvVar = "PROMLOG_LEVEL"
+	// FormatEnvVar is the environment variable consulted by ApplyEnv for
+	// the log format.
+	FormatEnvVar = "PROMLOG_FORMAT"
+)
+
+// ApplyEnv sets the level and the format of c from the environment variables
+// PROMLOG_LEVEL and PROMLOG_FORMAT, respectively. Only unset fields (nil or
+// set to an empty string) are changed, so that explicit configuration wins
+// over the environment. Empty environment variables are ignored. An error is
+// returned if a variable holds an invalid value, in which case c is left
+// unchanged.
+func (c *Config) ApplyEnv() error {
+	var (
+		lvl *AllowedLevel
+		f   *AllowedFormat
+	)
+	if v := os.Getenv(LevelEnvVar); v != "" && (c.Level == nil || c.Level.s == "") {
+		lvl = &AllowedLevel{}
+		if err := lvl.Set(v); err != nil {
+			return fmt.Errorf("invalid %s: %w", LevelEnvVar, err)
+		}
+	}
+	if v := os.Getenv(FormatEnvVar); v != "" && (c.Format == nil || c.Format.s == "") {
+		f = &AllowedFormat{}
+		if err := f.Set(v); err != nil {
+			return fmt.Errorf("invalid %s: %w", FormatEnvVar, err)
+		}
+	}
+	if lvl != nil {
+		c.Level = lvl
+	}
+	if f != nil {
+		c.Format = f
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	explicitLevel := &AllowedLevel{}
+	if err := explicitLevel.Set("error"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		level, format  string
+		config         *Config
+		expectedLevel  string
+		expectedFormat string
+		expectErr      bool
+	}{
+		{
+			name:           "unset config",
+			level:          "debug",
+			format:         "json",
+			config:         &Config{},
+			expectedLevel:  "debug",
+			expectedFormat: "json",
+		},
+		{
+			name:           "empty config values",
+			level:          "warn",
+			format:         "json",
+			config:         &Config{Level: &AllowedLevel{}, Format: &AllowedFormat{}},
+			expectedLevel:  "warn",
+			expectedFormat: "json",
+		},
+		{
+			name:           "explicit config wins",
+			level:          "debug",
+			format:         "json",
+			config:         &Config{Level: explicitLevel},
+			expectedLevel:  "error",
+			expectedFormat: "json",
+		},
+		{
+			name:   "no env vars",
+			config: &Config{},
+		},
+		{
+			name:      "bad level",
+			level:     "verbose",
+			format:    "json",
+			config:    &Config{},
+			expectErr: true,
+		},
+		{
+			name:      "bad format",
+			level:     "debug",
+			format:    "xml",
+			config:    &Config{},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(LevelEnvVar, test.level)
+			t.Setenv(FormatEnvVar, test.format)
+
+			err := test.config.ApplyEnv()
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if test.config.Level != nil || test.config.Format != nil {
+					t.Errorf("expected config to be unchanged on error, got %+v", test.config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lvl, format string
+			if test.config.Level != nil {
+				lvl = test.config.Level.String()
+			}
+			if test.config.Format != nil {
+				format = test.config.Format.String()
+			}
+			if lvl != test.expectedLevel {
+				t.Errorf("expected level %q, got %q", test.expectedLevel, lvl)
+			}
+			if format != test.expectedFormat {
+				t.Errorf("expected format %q, got %q", test.expectedFormat, format)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"os"
+	"sync"
+)
+
+// Reopener is implemented by log destinations that can be reopened, e.g. after
+// the underlying file has been rotated.
+type Reopener interface {
+	Reopen() error
+}
+
+// FileWriter is an io.Writer appending to a file. It implements Reopener so
+// that the file can be reopened after it has been moved away by logrotate or
+// similar tools. It is safe for concurrent use.
+type FileWriter struct {
+	path string
+	mtx  sync.Mutex
+	f    *os.File
+}
+
+// OpenFile returns a FileWriter appending to the file at path, which is created
+// if it doesn't exist.
+func OpenFile(path string) (*FileWriter, error) {
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileWriter{path: path, f: f}, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// Write implements io.Writer.
+func (w *FileWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.f.Write(p)
+}
+
+// Reopen implements Reopener. It opens the file at the original path anew and
+// closes the previous one. If the file cannot be opened, writing continues to
+// the previous one.
+func (w *FileWriter) Reopen() error {
+	f, err := openLogFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	old := w.f
+	w.f = f
+	return old.Close()
+}
+
+// Close closes the file.
+func (w *FileWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.f.Close()
+}
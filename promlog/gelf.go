@@ -0,0 +1,183 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// gelfChunkSize is the maximum size of a GELF datagram, including the
+	// chunk header, as recommended by the GELF specification.
+	gelfChunkSize = 8192
+	// gelfChunkHeaderSize is the size of the header of a GELF chunk: two
+	// magic bytes, an eight byte message ID, the sequence number, and the
+	// sequence count.
+	gelfChunkHeaderSize = 12
+	// gelfMaxChunks is the maximum number of chunks a GELF message may be
+	// split into.
+	gelfMaxChunks = 128
+)
+
+// gelfInvalidKeyChars matches the characters not allowed in the names of
+// additional GELF fields.
+var gelfInvalidKeyChars = regexp.MustCompile(`[^\w.\-]`)
+
+// GELFLogger is a log.Logger sending each log line as a Graylog Extended Log
+// Format (GELF) message over UDP. Use it as the logger passed to NewWithLogger
+// or NewDynamicWithLogger, which add the timestamp, level, and other fields as
+// usual. It is safe for concurrent use.
+//
+// The "msg" field becomes the short_message ("-" if there is none), the "ts"
+// field the timestamp, and the level the GELF level, which follows the syslog
+// severities (debug is 7, info is 6, warn is 4, and error is 3). All other
+// fields are sent as additional fields, prefixed with "_". Messages larger than
+// a datagram are split into chunks.
+type GELFLogger struct {
+	conn net.Conn
+	host string
+}
+
+// NewGELFLogger returns a GELFLogger sending to the given UDP address, e.g.
+// "graylog:12201". The host field of the messages is set to host, or to the
+// hostname reported by the kernel if host is empty.
+func NewGELFLogger(addr, host string) (*GELFLogger, error) {
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &GELFLogger{conn: conn, host: host}, nil
+}
+
+// Close closes the UDP connection.
+func (g *GELFLogger) Close() error {
+	return g.conn.Close()
+}
+
+// Log implements log.Logger.
+func (g *GELFLogger) Log(keyvals ...interface{}) error {
+	msg, err := json.Marshal(g.message(keyvals))
+	if err != nil {
+		return err
+	}
+	if len(msg) <= gelfChunkSize {
+		_, err = g.conn.Write(msg)
+		return err
+	}
+	return g.writeChunked(msg)
+}
+
+// message returns the GELF message for the given key/value pairs.
+func (g *GELFLogger) message(keyvals []interface{}) map[string]interface{} {
+	m := map[string]interface{}{
+		"version":       "1.1",
+		"host":          g.host,
+		"short_message": "-",
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = log.ErrMissingValue
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		switch {
+		case key == "msg":
+			m["short_message"] = fmt.Sprint(value)
+			continue
+		case key == "ts":
+			if ts, err := time.Parse(timestampLayout, fmt.Sprint(value)); err == nil {
+				m["timestamp"] = float64(ts.UnixMilli()) / 1000
+				continue
+			}
+		case keyvals[i] == level.Key():
+			if severity, ok := severities[fmt.Sprint(value)]; ok {
+				m["level"] = severity
+				continue
+			}
+		case key == severityKey:
+			if severity, ok := value.(int); ok {
+				m["level"] = severity
+				continue
+			}
+		}
+		m[gelfFieldName(key)] = gelfFieldValue(value)
+	}
+	return m
+}
+
+// gelfFieldName returns the name of the additional GELF field for key.
+func gelfFieldName(key string) string {
+	name := "_" + gelfInvalidKeyChars.ReplaceAllString(key, "_")
+	if name == "_id" {
+		// Reserved by GELF.
+		name = "_id_"
+	}
+	return name
+}
+
+// gelfFieldValue returns the value of an additional GELF field, which has to
+// be a string or a number.
+func gelfFieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeChunked sends msg in chunks, as specified by GELF.
+func (g *GELFLogger) writeChunked(msg []byte) error {
+	const dataSize = gelfChunkSize - gelfChunkHeaderSize
+	count := (len(msg) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return fmt.Errorf("GELF message of %d bytes exceeds %d chunks", len(msg), gelfMaxChunks)
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	chunk := make([]byte, 0, gelfChunkSize)
+	for seq := 0; seq < count; seq++ {
+		end := (seq + 1) * dataSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+		chunk = append(chunk[:0], 0x1e, 0x0f)
+		chunk = append(chunk, id[:]...)
+		chunk = append(chunk, byte(seq), byte(count))
+		chunk = append(chunk, msg[seq*dataSize:end]...)
+		if _, err := g.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
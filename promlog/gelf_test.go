@@ -0,0 +1,171 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// listenGELF returns a UDP listener for a GELFLogger to send to.
+func listenGELF(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// readGELF reads a single datagram from pc.
+func readGELF(t *testing.T, pc net.PacketConn) []byte {
+	t.Helper()
+	buf := make([]byte, gelfChunkSize)
+	if err := pc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestGELFLogger(t *testing.T) {
+	pc := listenGELF(t)
+	gelf, err := NewGELFLogger(pc.LocalAddr().String(), "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gelf.Close()
+
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 250000000, time.UTC)}
+	config := &Config{Level: &AllowedLevel{}, DisableCaller: true, Clock: clock}
+	if err := config.Level.Set("debug"); err != nil {
+		t.Fatal(err)
+	}
+	l := NewWithLogger(gelf, config)
+
+	scenarios := []struct {
+		log  func() error
+		want map[string]interface{}
+	}{
+		{
+			log: func() error {
+				return level.Error(l).Log("msg", "request failed", "err", errors.New("timeout"), "status", 503, "id", "r1", "http.path", "/api", "user agent", "curl")
+			},
+			want: map[string]interface{}{
+				"version":       "1.1",
+				"host":          "web-1",
+				"short_message": "request failed",
+				"timestamp":     1709294400.25,
+				"level":         3.0,
+				"_err":          "timeout",
+				"_status":       503.0,
+				"_id_":          "r1",
+				"_http.path":    "/api",
+				"_user_agent":   "curl",
+			},
+		},
+		{
+			log:  func() error { return level.Warn(l).Log("msg", "slow") },
+			want: map[string]interface{}{"version": "1.1", "host": "web-1", "short_message": "slow", "timestamp": 1709294400.25, "level": 4.0},
+		},
+		{
+			log:  func() error { return level.Info(l).Log("msg", "started") },
+			want: map[string]interface{}{"version": "1.1", "host": "web-1", "short_message": "started", "timestamp": 1709294400.25, "level": 6.0},
+		},
+		{
+			log:  func() error { return level.Debug(l).Log("component", "tsdb") },
+			want: map[string]interface{}{"version": "1.1", "host": "web-1", "short_message": "-", "timestamp": 1709294400.25, "level": 7.0, "_component": "tsdb"},
+		},
+		{
+			log:  func() error { return l.Log("msg", "no level") },
+			want: map[string]interface{}{"version": "1.1", "host": "web-1", "short_message": "no level", "timestamp": 1709294400.25},
+		},
+	}
+
+	for i, s := range scenarios {
+		if err := s.log(); err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(readGELF(t, pc), &got); err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		if !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%d. expected %v, got %v", i, s.want, got)
+		}
+	}
+}
+
+func TestGELFLoggerChunking(t *testing.T) {
+	pc := listenGELF(t)
+	gelf, err := NewGELFLogger(pc.LocalAddr().String(), "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gelf.Close()
+
+	long := strings.Repeat("x", 20000)
+	if err := gelf.Log("msg", long); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		msg   []byte
+		id    []byte
+		count = -1
+	)
+	for seq := 0; seq != count; seq++ {
+		chunk := readGELF(t, pc)
+		if len(chunk) > gelfChunkSize {
+			t.Fatalf("chunk %d has %d bytes, more than %d", seq, len(chunk), gelfChunkSize)
+		}
+		if chunk[0] != 0x1e || chunk[1] != 0x0f {
+			t.Fatalf("chunk %d lacks the magic bytes: %x", seq, chunk[:2])
+		}
+		if id == nil {
+			id = chunk[2:10]
+			count = int(chunk[11])
+		}
+		if !bytes.Equal(chunk[2:10], id) {
+			t.Errorf("chunk %d has message ID %x, expected %x", seq, chunk[2:10], id)
+		}
+		if int(chunk[10]) != seq || int(chunk[11]) != count {
+			t.Errorf("chunk %d has sequence %d/%d, expected %d/%d", seq, chunk[10], chunk[11], seq, count)
+		}
+		msg = append(msg, chunk[gelfChunkHeaderSize:]...)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 chunks, got %d", count)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(msg, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["short_message"] != long {
+		t.Errorf("expected the reassembled short_message to have %d bytes, got %q", len(long), got["short_message"])
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// hookLogger calls a hook for each log line before passing it on.
+type hookLogger struct {
+	next log.Logger
+	hook func(level string, keyvals []interface{})
+}
+
+// withHook wraps l in a hookLogger if config asks for it.
+func withHook(l log.Logger, config *Config) log.Logger {
+	if config.Hook == nil {
+		return l
+	}
+	return hookLogger{next: l, hook: config.Hook}
+}
+
+// Log implements log.Logger.
+func (h hookLogger) Log(keyvals ...interface{}) error {
+	var lvl string
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] == level.Key() {
+			if v, ok := keyvals[i+1].(level.Value); ok {
+				lvl = v.String()
+			}
+			break
+		}
+	}
+	h.hook(lvl, keyvals)
+	return h.next.Log(keyvals...)
+}
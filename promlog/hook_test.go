@@ -0,0 +1,70 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+func TestHook(t *testing.T) {
+	type call struct {
+		level   string
+		keyvals map[string]interface{}
+	}
+	var calls []call
+	config := &Config{
+		Level: &AllowedLevel{},
+		Hook: func(lvl string, keyvals []interface{}) {
+			c := call{level: lvl, keyvals: map[string]interface{}{}}
+			for i := 0; i < len(keyvals)-1; i += 2 {
+				c.keyvals[keyvals[i].(string)] = keyvals[i+1]
+			}
+			calls = append(calls, c)
+		},
+	}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, logger := range []log.Logger{
+		NewWithLogger(log.NewNopLogger(), config),
+		NewDynamicWithLogger(log.NewNopLogger(), config),
+	} {
+		calls = nil
+		if err := level.Debug(logger).Log("msg", "filtered"); err != nil {
+			t.Fatal(err)
+		}
+		if err := level.Error(logger).Log("msg", "failed", "attempt", 3); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(calls) != 1 {
+			t.Fatalf("expected 1 hook call, got %d: %v", len(calls), calls)
+		}
+		if calls[0].level != "error" {
+			t.Errorf("expected level error, got %q", calls[0].level)
+		}
+		if calls[0].keyvals["msg"] != "failed" || calls[0].keyvals["attempt"] != 3 {
+			t.Errorf("unexpected keyvals %v", calls[0].keyvals)
+		}
+		for _, key := range []string{"ts", "caller"} {
+			if _, ok := calls[0].keyvals[key]; !ok {
+				t.Errorf("expected key %q in keyvals %v", key, calls[0].keyvals)
+			}
+		}
+	}
+}
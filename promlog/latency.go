@@ -0,0 +1,83 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// LatencySamplingRule configures the sampling of log lines by the latency
+// logged with them, e.g. for access logs: Lines with a latency of at least
+// Threshold are always logged. Of the faster ones, only every Thereafter-th
+// is logged, so that a Thereafter of 10 amounts to a sampling rate of 10%. A
+// Thereafter of 0 or 1 disables sampling.
+//
+// The latency is the value logged under Key (before the KeyPrefix is
+// applied), "duration" if Key is empty. It has to be a time.Duration or a
+// float64 in seconds. Lines without such a value are always logged.
+type LatencySamplingRule struct {
+	Key        string
+	Threshold  time.Duration
+	Thereafter uint64
+}
+
+// latencySamplingLogger drops fast log lines according to a
+// LatencySamplingRule.
+type latencySamplingLogger struct {
+	next  log.Logger
+	rule  LatencySamplingRule
+	count *uint64
+}
+
+// withLatencySampling wraps l in a latencySamplingLogger if config asks for
+// it.
+func withLatencySampling(l log.Logger, config *Config) log.Logger {
+	if config.LatencySampling == nil || config.LatencySampling.Thereafter <= 1 {
+		return l
+	}
+	rule := *config.LatencySampling
+	if rule.Key == "" {
+		rule.Key = "duration"
+	}
+	return latencySamplingLogger{next: l, rule: rule, count: new(uint64)}
+}
+
+// Log implements log.Logger.
+func (s latencySamplingLogger) Log(keyvals ...interface{}) error {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] != s.rule.Key {
+			continue
+		}
+		var latency time.Duration
+		switch v := keyvals[i+1].(type) {
+		case time.Duration:
+			latency = v
+		case float64:
+			latency = time.Duration(v * float64(time.Second))
+		default:
+			return s.next.Log(keyvals...)
+		}
+		if latency >= s.rule.Threshold {
+			break
+		}
+		if n := atomic.AddUint64(s.count, 1); (n-1)%s.rule.Thereafter != 0 {
+			return nil
+		}
+		break
+	}
+	return s.next.Log(keyvals...)
+}
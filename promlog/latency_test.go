@@ -0,0 +1,96 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+func TestLatencySampling(t *testing.T) {
+	scenarios := []struct {
+		rule    LatencySamplingRule
+		keyvals func(i int) []interface{}
+		want    int
+	}{
+		// 0: Slow requests are always logged.
+		{
+			rule: LatencySamplingRule{Threshold: time.Second, Thereafter: 10},
+			keyvals: func(i int) []interface{} {
+				return []interface{}{"msg", "request", "duration", time.Second + time.Duration(i)*time.Millisecond}
+			},
+			want: 100,
+		},
+		// 1: Fast requests are logged at the configured rate.
+		{
+			rule: LatencySamplingRule{Threshold: time.Second, Thereafter: 10},
+			keyvals: func(i int) []interface{} {
+				return []interface{}{"msg", "request", "duration", time.Duration(i) * time.Millisecond}
+			},
+			want: 10,
+		},
+		// 2: Latency in seconds under a custom key.
+		{
+			rule: LatencySamplingRule{Key: "took", Threshold: 500 * time.Millisecond, Thereafter: 4},
+			keyvals: func(i int) []interface{} {
+				return []interface{}{"msg", "request", "took", float64(i) / 100}
+			},
+			want: 50 + 13, // 0.5s and above, and every 4th of the 50 below.
+		},
+		// 3: Lines without a latency are always logged.
+		{
+			rule: LatencySamplingRule{Threshold: time.Second, Thereafter: 10},
+			keyvals: func(i int) []interface{} {
+				return []interface{}{"msg", "request", "duration", "fast"}
+			},
+			want: 100,
+		},
+		// 4: Sampling disabled.
+		{
+			rule: LatencySamplingRule{Threshold: time.Second, Thereafter: 1},
+			keyvals: func(i int) []interface{} {
+				return []interface{}{"msg", "request", "duration", time.Millisecond}
+			},
+			want: 100,
+		},
+	}
+
+	counter := levelCounter{}
+	for i, scenario := range scenarios {
+		rule := scenario.rule
+		config := &Config{Level: &AllowedLevel{}, LatencySampling: &rule}
+		if err := config.Level.Set("info"); err != nil {
+			t.Fatal(err)
+		}
+		for _, logger := range []log.Logger{
+			NewWithLogger(counter, config),
+			NewDynamicWithLogger(counter, config),
+		} {
+			for k := range counter {
+				delete(counter, k)
+			}
+			for j := 0; j < 100; j++ {
+				if err := level.Info(logger).Log(scenario.keyvals(j)...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if counter["info"] != scenario.want {
+				t.Errorf("%d. expected %d lines, got %d", i, scenario.want, counter["info"])
+			}
+		}
+	}
+}
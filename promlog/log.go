@@ -17,8 +17,12 @@
 package promlog
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"sort"
 	"sync"
 	"time"
 
@@ -26,19 +30,31 @@ import (
 	"github.com/go-kit/log/level"
 )
 
-var (
-	// This timestamp format differs from RFC3339Nano by using .000 instead
-	// of .999999999 which changes the timestamp from 9 variable to 3 fixed
-	// decimals (.130 instead of .130987456).
-	timestampFormat = log.TimestampFormat(
-		func() time.Time { return time.Now().UTC() },
-		"2006-01-02T15:04:05.000Z07:00",
-	)
+// This timestamp format differs from RFC3339Nano by using .000 instead of
+// .999999999 which changes the timestamp from 9 variable to 3 fixed decimals
+// (.130 instead of .130987456).
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
 
+var (
 	LevelFlagOptions  = []string{"debug", "info", "warn", "error"}
 	FormatFlagOptions = []string{"logfmt, json"}
 )
 
+// Clock is the source of the timestamps of log lines. Sharing a fake Clock
+// between the logger and other subsystems keeps their notions of time
+// consistent in tests and simulations.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock used if Config.Clock is nil.
+type systemClock struct{}
+
+// Now implements Clock.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
 // AllowedLevel is a settable identifier for the minimum level a log entry
 // must be have.
 type AllowedLevel struct {
@@ -107,50 +123,343 @@ func (f *AllowedFormat) Set(s string) error {
 
 // Config is a struct containing configurable settings for the logger
 type Config struct {
-	Level  *AllowedLevel
+	Level *AllowedLevel
+	// Format selects logfmt (the default) or json. The json format writes
+	// non-ASCII characters as UTF-8 and doesn't escape '<', '>', and '&', so
+	// values like "Björn" remain readable.
 	Format *AllowedFormat
+	// DefaultFields are key/value pairs added to every log line last among
+	// the default fields, i.e. after the timestamp, the caller, the version
+	// and runtime fields, the run ID, and the resource attributes. Values
+	// implementing log.Valuer are evaluated anew for each line rather than
+	// once at construction, which allows fields like the current number of
+	// goroutines.
+	DefaultFields []interface{}
+	// KeyPrefix is prepended to every key, e.g. "db." to namespace the
+	// lines of a subsystem. The reserved keys "ts", "level", "severity",
+	// and "caller" are only prefixed if PrefixReservedKeys is set, too.
+	KeyPrefix          string
+	PrefixReservedKeys bool
+	// Sampling maps the levels "debug" and "info" to the sampling applied
+	// to their log lines. Lines of the levels warn and error are never
+	// sampled.
+	Sampling map[string]SamplingRule
+	// LatencySampling, if set, samples log lines by the latency logged
+	// with them, e.g. to log every slow request but only some of the fast
+	// ones. It applies to all levels. See LatencySamplingRule.
+	LatencySampling *LatencySamplingRule
+	// Dedup, if set, collapses bursts of log lines with the same value
+	// under a key, e.g. the same error code, into the first line and a
+	// periodic summary. It applies to all levels. See DedupRule.
+	Dedup *DedupRule
+	// WriteTimeout limits the time writing a single log line may block, e.g.
+	// because stderr is a pipe whose reader doesn't keep up. A line not
+	// written in time fails with os.ErrDeadlineExceeded (and may be written
+	// partially). It only takes effect for destinations supporting write
+	// deadlines, like pipes. For all other destinations, including regular
+	// files and, usually, a stderr inherited from a shell, it is silently
+	// ignored, so writes may still block.
+	WriteTimeout time.Duration
+	// OnDroppedLine, if set, is called for each line dropped because of the
+	// WriteTimeout, e.g. to count them.
+	OnDroppedLine func()
+	// Multiline determines how values spanning multiple lines, like stack
+	// traces, are logged. See MultilineMode.
+	Multiline MultilineMode
+	// Hook, if set, is called for each log line that passed the level
+	// filter and the sampling, right before it is written, e.g. to count
+	// error lines. It receives the level ("" for lines without one) and all
+	// key/value pairs of the line, including the timestamp and caller. The
+	// hook is called synchronously, so it must return quickly. It must
+	// neither modify nor retain keyvals, and it must not log through the
+	// same logger.
+	Hook func(level string, keyvals []interface{})
+	// Severity determines whether the level is rendered as a numeric
+	// severity, too, or instead. The level filter is not affected by it.
+	Severity SeverityMode
+	// ShortLevel renders the level as a single uppercase character, i.e.
+	// "D", "I", "W", or "E", for dense console output. The level filter,
+	// the sampling, and the Hook still see the full level. It only applies
+	// to the logfmt format and is ignored for json.
+	ShortLevel bool
+	// DisableCaller omits the caller field, saving the runtime lookup of
+	// the caller for each line.
+	DisableCaller bool
+	// FieldOrder, if not nil, fixes the order of the leading fields of each
+	// log line: "ts", "level", and "caller" come first, followed by the keys
+	// listed in FieldOrder (before the KeyPrefix is applied), followed by all
+	// other fields in call order. Set it to an empty slice to only order
+	// the timestamp, level, and caller.
+	FieldOrder []string
+	// Version, Revision, and Branch, if not empty, are added to every log
+	// line under the keys "version", "revision", and "branch", right after
+	// the timestamp and caller, to correlate logs with releases. They are
+	// typically set to version.Version, version.GetRevision(), and
+	// version.Branch of the github.com/prometheus/common/version package,
+	// using the same keys as version.Info.
+	Version  string
+	Revision string
+	Branch   string
+	// RuntimeInfo adds the Go version, operating system, and architecture
+	// the binary runs with to every log line under the keys "go_version",
+	// "goos", and "goarch", right after the version fields. The values are
+	// taken from the runtime package once, when the logger is created.
+	RuntimeInfo bool
+	// RunID adds a random ID, generated once when the logger is created, to
+	// every log line under the key "run_id", right after the runtime info,
+	// to correlate all lines of one run of a process even if its PID is
+	// reused, e.g. in containers. Loggers created separately get different
+	// IDs. The Reconfigure method of dynamic loggers keeps the ID.
+	RunID bool
+	runID string // Generated by withRunID.
+	// ResourceAttributes are added to every log line after the version and
+	// runtime fields and the run ID, e.g. the OpenTelemetry resource
+	// attributes "service.name" and "deployment.environment" for an
+	// OpenTelemetry log pipeline. With the json format (as set in Format),
+	// they are nested in an object under the key "resource". As logfmt
+	// cannot nest values, they are flattened into keys prefixed with
+	// "resource." instead. Setting ResourceAttributesPrefix flattens them
+	// with the given prefix in both formats.
+	ResourceAttributes       map[string]string
+	ResourceAttributesPrefix string
+	// Clock, if set, provides the timestamps of the log lines instead of
+	// time.Now. The timestamps are always rendered in UTC.
+	Clock Clock
+	// Writer, if set, is where New, NewDynamic, and the Reconfigure method
+	// of dynamic loggers write the log lines to instead of stderr, e.g. a
+	// file, a custom sink, or a bytes.Buffer in tests.
+	Writer io.Writer
+}
+
+// writer returns the writer to write the log lines to.
+func (c *Config) writer() io.Writer {
+	if c.Writer != nil {
+		return c.Writer
+	}
+	return os.Stderr
+}
+
+// validate returns an error if c cannot be used to build a logger.
+func (c *Config) validate() error {
+	if c.Level != nil && c.Level.o == nil {
+		return errors.New("log level not set")
+	}
+	switch c.Multiline {
+	case MultilineKeep, MultilineBase64, MultilineSplit:
+	default:
+		return fmt.Errorf("unrecognized multiline mode %q", c.Multiline)
+	}
+	switch c.Severity {
+	case SeverityOff, SeverityAdd, SeverityReplace:
+	default:
+		return fmt.Errorf("unrecognized severity mode %q", c.Severity)
+	}
+	return nil
+}
+
+// timestamp returns a Valuer for the "ts" field, using the configured Clock.
+func (c *Config) timestamp() log.Valuer {
+	return log.TimestampFormat(c.now, timestampLayout)
+}
+
+// now returns the current time in UTC, using the configured Clock.
+func (c *Config) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock.Now().UTC()
+	}
+	return systemClock{}.Now().UTC()
+}
+
+// defaultKeyvals returns the key/value pairs every log line is annotated
+// with, using the given caller Valuer unless the caller is disabled.
+func (c *Config) defaultKeyvals(caller log.Valuer) []interface{} {
+	keyvals := []interface{}{"ts", c.timestamp()}
+	if !c.DisableCaller {
+		keyvals = append(keyvals, "caller", caller)
+	}
+	return append(keyvals, c.staticKeyvals()...)
+}
+
+// staticKeyvals returns the key/value pairs every log line is annotated with
+// after the timestamp and caller, i.e. the version, runtime, and resource
+// fields, the run ID, and the DefaultFields.
+func (c *Config) staticKeyvals() []interface{} {
+	var keyvals []interface{}
+	for _, kv := range []struct{ key, value string }{
+		{"version", c.Version},
+		{"revision", c.Revision},
+		{"branch", c.Branch},
+	} {
+		if kv.value != "" {
+			keyvals = append(keyvals, kv.key, kv.value)
+		}
+	}
+	if c.RuntimeInfo {
+		keyvals = append(keyvals,
+			"go_version", runtime.Version(),
+			"goos", runtime.GOOS,
+			"goarch", runtime.GOARCH,
+		)
+	}
+	if c.RunID && c.runID != "" {
+		keyvals = append(keyvals, runIDKey, c.runID)
+	}
+	keyvals = append(keyvals, c.resourceKeyvals()...)
+	return append(keyvals, c.DefaultFields...)
+}
+
+// resourceKeyvals returns the key/value pairs of the ResourceAttributes, nested
+// or flattened according to the format.
+func (c *Config) resourceKeyvals() []interface{} {
+	if len(c.ResourceAttributes) == 0 {
+		return nil
+	}
+	prefix := c.ResourceAttributesPrefix
+	if prefix == "" {
+		if c.Format != nil && c.Format.s == "json" {
+			return []interface{}{"resource", c.ResourceAttributes}
+		}
+		prefix = "resource."
+	}
+	names := make([]string, 0, len(c.ResourceAttributes))
+	for name := range c.ResourceAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keyvals := make([]interface{}, 0, 2*len(names))
+	for _, name := range names {
+		keyvals = append(keyvals, prefix+name, c.ResourceAttributes[name])
+	}
+	return keyvals
+}
+
+// prefixLogger prepends a prefix to all keys before passing them on.
+type prefixLogger struct {
+	next     log.Logger
+	prefix   string
+	reserved bool // Whether to prefix the reserved keys, too.
+}
+
+// isReservedKey returns whether key is one of the keys the logger adds itself,
+// i.e. "ts", "caller", "level", and "severity" (see SeverityMode).
+func isReservedKey(key string) bool {
+	switch key {
+	case "ts", "caller", severityKey, fmt.Sprint(level.Key()):
+		return true
+	}
+	return false
+}
+
+// withKeyPrefix wraps l in a prefixLogger if config asks for it.
+func withKeyPrefix(l log.Logger, config *Config) log.Logger {
+	if config.KeyPrefix == "" {
+		return l
+	}
+	return prefixLogger{next: l, prefix: config.KeyPrefix, reserved: config.PrefixReservedKeys}
+}
+
+// Log implements log.Logger.
+func (p prefixLogger) Log(keyvals ...interface{}) error {
+	prefixed := make([]interface{}, len(keyvals))
+	copy(prefixed, keyvals)
+	for i := 0; i < len(prefixed); i += 2 {
+		key := fmt.Sprint(prefixed[i])
+		if !p.reserved && isReservedKey(key) {
+			continue
+		}
+		prefixed[i] = p.prefix + key
+	}
+	return p.next.Log(prefixed...)
+}
+
+// wrap wraps l in the loggers implementing the settings of c, innermost
+// first, so that e.g. lines dropped by the sampling never reach the Hook.
+func (c *Config) wrap(l log.Logger) log.Logger {
+	l = withMultiline(l, c)
+	l = withKeyPrefix(l, c)
+	l = withShortLevel(l, c)
+	l = withSeverity(l, c)
+	l = withHook(l, c)
+	l = withSampling(l, c)
+	l = withLatencySampling(l, c)
+	l = withDedup(l, c)
+	return withFieldOrder(l, c)
 }
 
 // New returns a new leveled oklog logger. Each logged line will be annotated
-// with a timestamp. The output always goes to stderr.
+// with a timestamp. The output goes to the Writer of config, stderr by
+// default.
 func New(config *Config) log.Logger {
+	w := withWriteTimeout(config.writer(), config)
 	if config.Format != nil && config.Format.s == "json" {
-		return NewWithLogger(log.NewJSONLogger(log.NewSyncWriter(os.Stderr)), config)
+		return NewWithLogger(log.NewJSONLogger(log.NewSyncWriter(w)), config)
 	}
 
-	return NewWithLogger(log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), config)
+	return NewWithLogger(log.NewLogfmtLogger(log.NewSyncWriter(w)), config)
 }
 
 // NewWithLogger returns a new leveled oklog logger with a custom log.Logger.
 // Each logged line will be annotated with a timestamp.
 func NewWithLogger(l log.Logger, config *Config) log.Logger {
+	config = config.withRunID()
+	l = config.wrap(l)
 	if config.Level != nil {
-		l = log.With(l, "ts", timestampFormat, "caller", log.Caller(5))
+		l = log.With(l, config.defaultKeyvals(log.Caller(5))...)
 		l = level.NewFilter(l, config.Level.o)
 	} else {
-		l = log.With(l, "ts", timestampFormat, "caller", log.DefaultCaller)
+		l = log.With(l, config.defaultKeyvals(log.DefaultCaller)...)
 	}
 	return l
 }
 
 // NewDynamic returns a new leveled logger. Each logged line will be annotated
-// with a timestamp. The output always goes to stderr. Some properties can be
-// changed, like the level.
+// with a timestamp. The output goes to the Writer of config, stderr by
+// default. Some properties can be changed, like the level.
 func NewDynamic(config *Config) *logger {
+	return NewDynamicWithWriter(config.writer(), config)
+}
+
+// NewDynamicWithWriter works like NewDynamic but writes to w instead of the
+// Writer of config.
+// If w implements Reopener (like FileWriter), it is reopened by the Reopen
+// method of the returned logger.
+func NewDynamicWithWriter(w io.Writer, config *Config) *logger {
+	var (
+		l  *logger
+		tw = withWriteTimeout(w, config)
+	)
 	if config.Format != nil && config.Format.s == "json" {
-		return NewDynamicWithLogger(log.NewJSONLogger(log.NewSyncWriter(os.Stderr)), config)
+		l = NewDynamicWithLogger(log.NewJSONLogger(log.NewSyncWriter(tw)), config)
+	} else {
+		l = NewDynamicWithLogger(log.NewLogfmtLogger(log.NewSyncWriter(tw)), config)
 	}
-
-	return NewDynamicWithLogger(log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), config)
+	l.dest = w
+	return l
 }
 
 // NewDynamicWithLogger returns a new leveled logger with a custom io.Writer.
 // Each logged line will be annotated with a timestamp.
 // Some properties can be changed, like the level.
 func NewDynamicWithLogger(l log.Logger, config *Config) *logger {
+	config = config.withRunID()
+	l = config.wrap(l)
 	lo := &logger{
 		base:    l,
 		leveled: l,
+		config: &Config{
+			DefaultFields:            config.DefaultFields,
+			DisableCaller:            config.DisableCaller,
+			Version:                  config.Version,
+			Revision:                 config.Revision,
+			Branch:                   config.Branch,
+			RuntimeInfo:              config.RuntimeInfo,
+			RunID:                    config.RunID,
+			runID:                    config.runID,
+			Format:                   config.Format,
+			ResourceAttributes:       config.ResourceAttributes,
+			ResourceAttributesPrefix: config.ResourceAttributesPrefix,
+			Clock:                    config.Clock,
+		},
 	}
 
 	if config.Level != nil {
@@ -164,6 +473,8 @@ type logger struct {
 	base         log.Logger
 	leveled      log.Logger
 	currentLevel *AllowedLevel
+	config       *Config   // Settings, apart from the level, used to build leveled.
+	dest         io.Writer // Only known if created by NewDynamicWithWriter.
 	mtx          sync.Mutex
 }
 
@@ -174,12 +485,66 @@ func (l *logger) Log(keyvals ...interface{}) error {
 	return l.leveled.Log(keyvals...)
 }
 
+// Reopen reopens the destination of the logger if it implements Reopener. It
+// is a no-op otherwise.
+func (l *logger) Reopen() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if r, ok := l.dest.(Reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// Reconfigure replaces the whole configuration of the logger, including the
+// level, the format, and the destination (the Writer of config, stderr by
+// default), at once: Each line is written either entirely with the old or
+// entirely with the new configuration. config is validated first. If it is
+// invalid, an error is returned, and the logger is left unchanged. The custom
+// logger of a logger created by NewDynamicWithLogger is replaced, too. The old
+// destination is not closed.
+func (l *logger) Reconfigure(config *Config) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	runID := l.config.runID
+	l.mtx.Unlock()
+	if config.RunID && runID != "" {
+		cp := *config
+		cp.runID = runID
+		config = &cp
+	}
+	// Build the new logger, wrapped by config.wrap like any other, without
+	// holding the lock, so that logging isn't blocked meanwhile and the
+	// switch is a single step.
+	n := NewDynamic(config)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.base = n.base
+	l.leveled = n.leveled
+	l.currentLevel = n.currentLevel
+	l.config = n.config
+	l.dest = n.dest
+	return nil
+}
+
+// levelString returns the current log level or an empty string if unset.
+func (l *logger) levelString() string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.currentLevel == nil {
+		return ""
+	}
+	return l.currentLevel.s
+}
+
 // SetLevel changes the log level.
 func (l *logger) SetLevel(lvl *AllowedLevel) {
 	l.mtx.Lock()
 	defer l.mtx.Unlock()
 	if lvl == nil {
-		l.leveled = log.With(l.base, "ts", timestampFormat, "caller", log.DefaultCaller)
+		l.leveled = log.With(l.base, l.config.defaultKeyvals(log.DefaultCaller)...)
 		l.currentLevel = nil
 		return
 	}
@@ -188,5 +553,5 @@ func (l *logger) SetLevel(lvl *AllowedLevel) {
 		_ = l.base.Log("msg", "Log level changed", "prev", l.currentLevel, "current", lvl)
 	}
 	l.currentLevel = lvl
-	l.leveled = level.NewFilter(log.With(l.base, "ts", timestampFormat, "caller", log.Caller(5)), lvl.o)
+	l.leveled = level.NewFilter(log.With(l.base, l.config.defaultKeyvals(log.Caller(5))...), lvl.o)
 }
@@ -14,9 +14,19 @@
 package promlog
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"gopkg.in/yaml.v2"
 )
@@ -125,3 +135,538 @@ func TestDynamic(t *testing.T) {
 		t.Fatal("extra log found")
 	}
 }
+
+func TestDefaultFieldsValuer(t *testing.T) {
+	calls := 0
+	counter := log.Valuer(func() interface{} {
+		calls++
+		return calls
+	})
+
+	for _, dynamic := range []bool{false, true} {
+		calls = 0
+		var buf bytes.Buffer
+		config := &Config{
+			Level:         &AllowedLevel{},
+			DefaultFields: []interface{}{"static", "value", "count", counter},
+		}
+		if err := config.Level.Set("info"); err != nil {
+			t.Fatal(err)
+		}
+
+		var logger log.Logger
+		if dynamic {
+			logger = NewDynamicWithLogger(log.NewLogfmtLogger(&buf), config)
+		} else {
+			logger = NewWithLogger(log.NewLogfmtLogger(&buf), config)
+		}
+		for i := 0; i < 2; i++ {
+			if err := level.Info(logger).Log("msg", "hello"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 lines, got %d: %q", len(lines), buf.String())
+		}
+		for i, line := range lines {
+			if !strings.Contains(line, "static=value") {
+				t.Errorf("expected static field in line %q", line)
+			}
+			if expected := fmt.Sprintf("count=%d", i+1); !strings.Contains(line, expected) {
+				t.Errorf("expected %q in line %q", expected, line)
+			}
+		}
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	for _, reserved := range []bool{false, true} {
+		var buf bytes.Buffer
+		config := &Config{
+			Level:              &AllowedLevel{},
+			DefaultFields:      []interface{}{"component", "db"},
+			KeyPrefix:          "db.",
+			PrefixReservedKeys: reserved,
+		}
+		if err := config.Level.Set("info"); err != nil {
+			t.Fatal(err)
+		}
+		logger := NewWithLogger(log.NewJSONLogger(&buf), config)
+		if err := level.Info(logger).Log("msg", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		// Filtered lines must still be filtered.
+		if err := level.Debug(logger).Log("msg", "filtered"); err != nil {
+			t.Fatal(err)
+		}
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("expected a single JSON line, got %q: %s", buf.String(), err)
+		}
+		for _, key := range []string{"db.component", "db.msg"} {
+			if _, ok := line[key]; !ok {
+				t.Errorf("expected prefixed key %q in %v", key, line)
+			}
+		}
+		reservedPrefix := ""
+		if reserved {
+			reservedPrefix = "db."
+		}
+		for _, key := range []string{"ts", "level", "caller"} {
+			if _, ok := line[reservedPrefix+key]; !ok {
+				t.Errorf("expected key %q in %v", reservedPrefix+key, line)
+			}
+		}
+		if got := line[reservedPrefix+"level"]; got != "info" {
+			t.Errorf("expected level info, got %v", got)
+		}
+	}
+
+	var buf bytes.Buffer
+	logger := NewDynamicWithLogger(log.NewLogfmtLogger(&buf), &Config{KeyPrefix: "db."})
+	if err := logger.Log("msg", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "db.msg=hello\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestDisableCaller(t *testing.T) {
+	for _, withLevel := range []bool{false, true} {
+		config := &Config{DisableCaller: true}
+		if withLevel {
+			config.Level = &AllowedLevel{}
+			if err := config.Level.Set("info"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var buf bytes.Buffer
+		loggers := []log.Logger{NewWithLogger(log.NewLogfmtLogger(&buf), config)}
+		if withLevel {
+			loggers = append(loggers, NewDynamicWithLogger(log.NewLogfmtLogger(&buf), config))
+		}
+		for _, logger := range loggers {
+			buf.Reset()
+			if err := level.Info(logger).Log("msg", "hello"); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if strings.Contains(out, "caller=") {
+				t.Errorf("expected no caller, got %q", out)
+			}
+			for _, key := range []string{"ts=", "level=info", "msg=hello"} {
+				if !strings.Contains(out, key) {
+					t.Errorf("expected %q in %q", key, out)
+				}
+			}
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	for _, format := range []string{"logfmt", "json"} {
+		config := &Config{Level: &AllowedLevel{}, Format: &AllowedFormat{}}
+		if err := config.Level.Set("info"); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Format.Set(format); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		logger := NewDynamicWithWriter(&buf, config)
+		if err := level.Info(logger).Log("msg", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"version", "revision", "branch"} {
+			if strings.Contains(buf.String(), key) {
+				t.Errorf("%s: expected no %s, got %q", format, key, buf.String())
+			}
+		}
+
+		config.Version, config.Revision, config.Branch = "2.48.0", "abc123", "main"
+		expected := map[string]string{
+			"logfmt": "version=2.48.0 revision=abc123 branch=main level=info msg=hello",
+			"json":   `"branch":"main"`,
+		}[format]
+		for _, logger := range []log.Logger{
+			NewDynamicWithWriter(&buf, config),
+			NewWithLogger(map[string]log.Logger{
+				"logfmt": log.NewLogfmtLogger(&buf),
+				"json":   log.NewJSONLogger(&buf),
+			}[format], config),
+		} {
+			buf.Reset()
+			if err := level.Info(logger).Log("msg", "hello"); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if !strings.Contains(out, expected) {
+				t.Errorf("%s: expected %q in %q", format, expected, out)
+			}
+			if format == "json" {
+				for _, field := range []string{`"version":"2.48.0"`, `"revision":"abc123"`} {
+					if !strings.Contains(out, field) {
+						t.Errorf("expected %q in %q", field, out)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRuntimeInfo(t *testing.T) {
+	config := &Config{Level: &AllowedLevel{}, Format: &AllowedFormat{}, RuntimeInfo: true}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Format.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for _, logger := range []log.Logger{
+		NewDynamicWithWriter(&buf, config),
+		NewWithLogger(log.NewJSONLogger(&buf), config),
+	} {
+		buf.Reset()
+		if err := level.Info(logger).Log("msg", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		var line map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range map[string]string{
+			"go_version": runtime.Version(),
+			"goos":       runtime.GOOS,
+			"goarch":     runtime.GOARCH,
+		} {
+			if line[key] != expected {
+				t.Errorf("expected %s=%q, got %v", key, expected, line[key])
+			}
+		}
+	}
+
+	buf.Reset()
+	config.RuntimeInfo = false
+	if err := level.Info(NewDynamicWithWriter(&buf, config)).Log("msg", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "go_version") {
+		t.Errorf("expected no runtime info, got %q", buf.String())
+	}
+}
+
+func TestJSONUnicode(t *testing.T) {
+	config := &Config{Level: &AllowedLevel{}, Format: &AllowedFormat{}, DisableCaller: true}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Format.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := level.Info(NewDynamicWithWriter(&buf, config)).Log("msg", "佖佥 <Björn> & co"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `"msg":"佖佥 <Björn> & co"`; !strings.Contains(buf.String(), expected) {
+		t.Errorf("expected %q in %q", expected, buf.String())
+	}
+}
+
+func BenchmarkCaller(b *testing.B) {
+	for _, disable := range []bool{false, true} {
+		b.Run(fmt.Sprintf("disabled=%t", disable), func(b *testing.B) {
+			config := &Config{Level: &AllowedLevel{}, DisableCaller: disable}
+			if err := config.Level.Set("info"); err != nil {
+				b.Fatal(err)
+			}
+			logger := NewWithLogger(log.NewLogfmtLogger(io.Discard), config)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = level.Info(logger).Log("msg", "hello")
+			}
+		})
+	}
+}
+
+func TestResourceAttributes(t *testing.T) {
+	attributes := map[string]string{
+		"service.name":           "prometheus",
+		"service.instance.id":    "host-1:9090",
+		"deployment.environment": "production",
+	}
+	scenarios := []struct {
+		format, prefix string
+		check          func(t *testing.T, out string)
+	}{
+		{
+			format: "json",
+			check: func(t *testing.T, out string) {
+				var line struct {
+					Resource map[string]string `json:"resource"`
+					Msg      string            `json:"msg"`
+				}
+				if err := json.Unmarshal([]byte(out), &line); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(line.Resource, attributes) {
+					t.Errorf("expected resource %v, got %v in %q", attributes, line.Resource, out)
+				}
+				if line.Msg != "hello" {
+					t.Errorf("expected msg hello in %q", out)
+				}
+			},
+		},
+		{
+			format: "json",
+			prefix: "otel.",
+			check: func(t *testing.T, out string) {
+				var line map[string]interface{}
+				if err := json.Unmarshal([]byte(out), &line); err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := line["resource"]; ok {
+					t.Errorf("expected no resource object in %q", out)
+				}
+				for name, value := range attributes {
+					if line["otel."+name] != value {
+						t.Errorf("expected otel.%s=%s in %q", name, value, out)
+					}
+				}
+			},
+		},
+		{
+			format: "logfmt",
+			check: func(t *testing.T, out string) {
+				expected := "resource.deployment.environment=production resource.service.instance.id=host-1:9090 resource.service.name=prometheus"
+				if !strings.Contains(out, expected) {
+					t.Errorf("expected %q in %q", expected, out)
+				}
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		config := &Config{
+			Level:                    &AllowedLevel{},
+			Format:                   &AllowedFormat{},
+			ResourceAttributes:       attributes,
+			ResourceAttributesPrefix: s.prefix,
+		}
+		if err := config.Level.Set("info"); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Format.Set(s.format); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := level.Info(NewDynamicWithWriter(&buf, config)).Log("msg", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		s.check(t, buf.String())
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))}
+	config := &Config{Level: &AllowedLevel{}, DisableCaller: true, Clock: clock}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for _, logger := range []log.Logger{
+		NewDynamicWithWriter(&buf, config),
+		NewWithLogger(log.NewLogfmtLogger(&buf), config),
+	} {
+		buf.Reset()
+		start := clock.now
+		for i := 0; i < 3; i++ {
+			if err := level.Info(logger).Log("msg", "tick"); err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(1500 * time.Millisecond)
+		}
+		clock.now = start
+
+		expected := `ts=2024-03-01T11:00:00.000Z level=info msg=tick
+ts=2024-03-01T11:00:01.500Z level=info msg=tick
+ts=2024-03-01T11:00:03.000Z level=info msg=tick
+`
+		if got := buf.String(); got != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	jsonFormat := &AllowedFormat{}
+	if err := jsonFormat.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		format *AllowedFormat
+		out    string
+	}{
+		// 0: logfmt.
+		{
+			out: `ts=2024-03-01T12:00:00.000Z level=info msg=hello user=Björn
+`,
+		},
+		// 1: json.
+		{
+			format: jsonFormat,
+			out: `{"level":"info","msg":"hello","ts":"2024-03-01T12:00:00.000Z","user":"Björn"}
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var buf bytes.Buffer
+		config := &Config{
+			Level:         &AllowedLevel{},
+			Format:        scenario.format,
+			DisableCaller: true,
+			Clock:         clock,
+			Writer:        &buf,
+		}
+		if err := config.Level.Set("info"); err != nil {
+			t.Fatal(err)
+		}
+		for j, logger := range []log.Logger{New(config), NewDynamic(config)} {
+			buf.Reset()
+			if err := level.Info(logger).Log("msg", "hello", "user", "Björn"); err != nil {
+				t.Fatal(err)
+			}
+			if err := level.Debug(logger).Log("msg", "filtered"); err != nil {
+				t.Fatal(err)
+			}
+			if expected, got := scenario.out, buf.String(); expected != got {
+				t.Errorf("%d.%d. expected %q, got %q", i, j, expected, got)
+			}
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	infoLevel := &AllowedLevel{}
+	if err := infoLevel.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+	debugLevel := &AllowedLevel{}
+	if err := debugLevel.Set("debug"); err != nil {
+		t.Fatal(err)
+	}
+	jsonFormat := &AllowedFormat{}
+	if err := jsonFormat.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// From logfmt on stderr to json in a buffer.
+	logger := NewDynamic(&Config{Level: infoLevel})
+	if _, ok := logger.dest.(*os.File); !ok || logger.dest != os.Stderr {
+		t.Fatalf("expected stderr as destination, got %v", logger.dest)
+	}
+	var buf bytes.Buffer
+	if err := logger.Reconfigure(&Config{Level: debugLevel, Format: jsonFormat, Writer: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	if err := level.Debug(logger).Log("msg", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a json line, got %q: %s", buf.String(), err)
+	}
+	if line["msg"] != "hello" || line["level"] != "debug" {
+		t.Errorf("unexpected line %q", buf.String())
+	}
+	if logger.levelString() != "debug" {
+		t.Errorf("expected level debug, got %q", logger.levelString())
+	}
+
+	// Invalid configurations leave the logger unchanged.
+	for i, config := range []*Config{
+		{Level: &AllowedLevel{}, Writer: io.Discard},
+		{Multiline: "fold", Writer: io.Discard},
+		{Severity: "numeric", Writer: io.Discard},
+	} {
+		buf.Reset()
+		if err := logger.Reconfigure(config); err == nil {
+			t.Errorf("%d. expected error", i)
+		}
+		if err := level.Debug(logger).Log("msg", "still here"); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(buf.String(), "{") || !strings.Contains(buf.String(), `"msg":"still here"`) {
+			t.Errorf("%d. expected json line in the old destination, got %q", i, buf.String())
+		}
+	}
+
+	// Concurrently logged lines are written entirely with either
+	// configuration.
+	var (
+		oldBuf, newBuf bytes.Buffer
+		wg             sync.WaitGroup
+	)
+	logger = NewDynamic(&Config{Level: infoLevel, Writer: &oldBuf})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := level.Info(logger).Log("msg", "hello", "j", j); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	if err := logger.Reconfigure(&Config{Level: infoLevel, Format: jsonFormat, Writer: &newBuf}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	oldLines := strings.Split(strings.TrimSuffix(oldBuf.String(), "\n"), "\n")
+	newLines := strings.Split(strings.TrimSuffix(newBuf.String(), "\n"), "\n")
+	if oldBuf.Len() == 0 {
+		oldLines = nil
+	}
+	if newBuf.Len() == 0 {
+		newLines = nil
+	}
+	if n := len(oldLines) + len(newLines); n != 400 {
+		t.Errorf("expected 400 lines, got %d", n)
+	}
+	for _, line := range oldLines {
+		if !strings.HasPrefix(line, "ts=") {
+			t.Errorf("expected logfmt line in the old destination, got %q", line)
+		}
+	}
+	for _, line := range newLines {
+		if !strings.HasPrefix(line, "{") {
+			t.Errorf("expected json line in the new destination, got %q", line)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/log"
+)
+
+// MultilineMode determines how values spanning multiple lines, like stack
+// traces, are logged.
+type MultilineMode string
+
+const (
+	// MultilineKeep logs multiline values as they are, leaving the escaping
+	// of the newlines to the format.
+	MultilineKeep MultilineMode = ""
+	// MultilineBase64 replaces a multiline value by its base64 encoding,
+	// logged under the original key suffixed with "_base64".
+	MultilineBase64 MultilineMode = "base64"
+	// MultilineSplit keeps the first line of a multiline value under the
+	// original key and logs the remaining lines under the original key
+	// suffixed with "_stack", e.g. "err" and "err_stack".
+	MultilineSplit MultilineMode = "split"
+)
+
+// multilineLogger folds multiline values according to its mode.
+type multilineLogger struct {
+	next log.Logger
+	mode MultilineMode
+}
+
+// withMultiline wraps l in a multilineLogger if config asks for it.
+func withMultiline(l log.Logger, config *Config) log.Logger {
+	if config.Multiline == MultilineKeep {
+		return l
+	}
+	return multilineLogger{next: l, mode: config.Multiline}
+}
+
+// Log implements log.Logger.
+func (m multilineLogger) Log(keyvals ...interface{}) error {
+	if !hasMultilineValue(keyvals) {
+		return m.next.Log(keyvals...)
+	}
+	folded := make([]interface{}, 0, len(keyvals)+2)
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		v, ok := multilineValue(keyvals[i+1])
+		if !ok {
+			folded = append(folded, keyvals[i], keyvals[i+1])
+			continue
+		}
+		key := fmt.Sprint(keyvals[i])
+		switch m.mode {
+		case MultilineBase64:
+			folded = append(folded, key+"_base64", base64.StdEncoding.EncodeToString([]byte(v)))
+		case MultilineSplit:
+			first, rest, _ := strings.Cut(v, "\n")
+			folded = append(folded, key, first, key+"_stack", rest)
+		default:
+			folded = append(folded, keyvals[i], keyvals[i+1])
+		}
+	}
+	if len(keyvals)%2 == 1 {
+		folded = append(folded, keyvals[len(keyvals)-1])
+	}
+	return m.next.Log(folded...)
+}
+
+func hasMultilineValue(keyvals []interface{}) bool {
+	for i := 1; i < len(keyvals); i += 2 {
+		if _, ok := multilineValue(keyvals[i]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// multilineValue returns the string form of v if it spans multiple lines.
+// Only strings, errors, and fmt.Stringers are considered.
+func multilineValue(v interface{}) (string, bool) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		return "", false
+	}
+	return s, strings.Contains(s, "\n")
+}
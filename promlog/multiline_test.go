@@ -0,0 +1,111 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log/level"
+	"github.com/go-logfmt/logfmt"
+)
+
+// parseLine parses a single logfmt or JSON line into a map.
+func parseLine(t *testing.T, format, line string) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	if format == "json" {
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("unparseable JSON line %q: %v", line, err)
+		}
+		return fields
+	}
+	dec := logfmt.NewDecoder(strings.NewReader(line))
+	for dec.ScanRecord() {
+		for dec.ScanKeyval() {
+			fields[string(dec.Key())] = string(dec.Value())
+		}
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatalf("unparseable logfmt line %q: %v", line, err)
+	}
+	return fields
+}
+
+func TestMultiline(t *testing.T) {
+	stack := "goroutine 1 [running]:\nmain.main()\n\t/app/main.go:12 +0x1d"
+	err := errors.New("boom\n" + stack)
+
+	scenarios := []struct {
+		mode     MultilineMode
+		expected map[string]string
+	}{
+		{
+			mode: MultilineKeep,
+			expected: map[string]string{
+				"msg": "failed",
+				"err": "boom\n" + stack,
+			},
+		},
+		{
+			mode: MultilineBase64,
+			expected: map[string]string{
+				"msg":        "failed",
+				"err_base64": base64.StdEncoding.EncodeToString([]byte("boom\n" + stack)),
+			},
+		},
+		{
+			mode: MultilineSplit,
+			expected: map[string]string{
+				"msg":       "failed",
+				"err":       "boom",
+				"err_stack": stack,
+			},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		for _, format := range []string{"logfmt", "json"} {
+			var buf bytes.Buffer
+			config := &Config{Format: &AllowedFormat{}, Multiline: scenario.mode}
+			if err := config.Format.Set(format); err != nil {
+				t.Fatal(err)
+			}
+			logger := NewDynamicWithWriter(&buf, config)
+			if err := level.Error(logger).Log("msg", "failed", "err", err); err != nil {
+				t.Fatal(err)
+			}
+
+			out := buf.String()
+			if strings.Count(out, "\n") != 1 || !strings.HasSuffix(out, "\n") {
+				t.Fatalf("%d. %s: expected a single line, got %q", i, format, out)
+			}
+			fields := parseLine(t, format, strings.TrimSuffix(out, "\n"))
+			for k, v := range scenario.expected {
+				if fields[k] != v {
+					t.Errorf("%d. %s: expected %s=%q, got %q", i, format, k, v, fields[k])
+				}
+			}
+			if scenario.mode == MultilineBase64 {
+				if _, ok := fields["err"]; ok {
+					t.Errorf("%d. %s: expected err to be replaced, got %v", i, format, fields)
+				}
+			}
+		}
+	}
+}
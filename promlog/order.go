@@ -0,0 +1,68 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"fmt"
+
+	"github.com/go-kit/log"
+)
+
+// leadingKeys are the keys an orderLogger always puts first, in this order.
+var leadingKeys = []string{"ts", "level", "caller"}
+
+// orderLogger moves the key/value pairs with the given keys to the front of
+// each log line, in the given order, keeping the other pairs in call order.
+type orderLogger struct {
+	next  log.Logger
+	order []string
+}
+
+// withFieldOrder wraps l in an orderLogger if config asks for it.
+func withFieldOrder(l log.Logger, config *Config) log.Logger {
+	if config.FieldOrder == nil {
+		return l
+	}
+	order := make([]string, 0, len(leadingKeys)+len(config.FieldOrder))
+	order = append(order, leadingKeys...)
+	return orderLogger{next: l, order: append(order, config.FieldOrder...)}
+}
+
+// Log implements log.Logger.
+func (o orderLogger) Log(keyvals ...interface{}) error {
+	keys := make([]string, len(keyvals)/2)
+	for i := range keys {
+		keys[i] = fmt.Sprint(keyvals[2*i])
+	}
+	var (
+		ordered = make([]interface{}, 0, len(keyvals))
+		moved   = make([]bool, len(keys))
+	)
+	for _, key := range o.order {
+		for i, k := range keys {
+			if !moved[i] && k == key {
+				ordered = append(ordered, keyvals[2*i], keyvals[2*i+1])
+				moved[i] = true
+			}
+		}
+	}
+	for i := range keys {
+		if !moved[i] {
+			ordered = append(ordered, keyvals[2*i], keyvals[2*i+1])
+		}
+	}
+	// A dangling key without value stays at the end.
+	ordered = append(ordered, keyvals[2*len(keys):]...)
+	return o.next.Log(ordered...)
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+func TestFieldOrder(t *testing.T) {
+	config := &Config{
+		Level:         &AllowedLevel{},
+		DefaultFields: []interface{}{"host", "h1", "component", "db"},
+		FieldOrder:    []string{"component", "msg"},
+	}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for _, logger := range []log.Logger{
+		NewWithLogger(log.NewLogfmtLogger(&buf), config),
+		NewDynamicWithLogger(log.NewLogfmtLogger(&buf), config),
+	} {
+		for _, lineLogger := range []log.Logger{
+			level.Info(logger),
+			level.Warn(log.With(logger, "query", "SELECT 1")),
+		} {
+			buf.Reset()
+			if err := lineLogger.Log("duration", "1s", "msg", "done", "rows", 3); err != nil {
+				t.Fatal(err)
+			}
+			re := regexp.MustCompile(`^ts=\S+ level=(info|warn) caller=\S+ component=db msg=done host=h1 (query="SELECT 1" )?duration=1s rows=3\n$`)
+			if got := buf.String(); !re.MatchString(got) {
+				t.Errorf("unexpected line %q", got)
+			}
+		}
+	}
+
+	// Without FieldOrder, the order is left alone.
+	config.FieldOrder = nil
+	buf.Reset()
+	if err := level.Info(NewWithLogger(log.NewLogfmtLogger(&buf), config)).Log("msg", "done"); err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`^ts=\S+ caller=\S+ host=h1 component=db level=info msg=done\n$`)
+	if got := buf.String(); !re.MatchString(got) {
+		t.Errorf("unexpected line %q", got)
+	}
+}
+
+func TestFieldOrderDanglingKey(t *testing.T) {
+	var got []interface{}
+	l := withFieldOrder(log.LoggerFunc(func(keyvals ...interface{}) error {
+		got = keyvals
+		return nil
+	}), &Config{FieldOrder: []string{}})
+	if err := l.Log("msg", "hi", "level", "info", "dangling"); err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"level", "info", "msg", "hi", "dangling"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %v, got %v", want, got)
+			break
+		}
+	}
+}
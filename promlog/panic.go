@@ -0,0 +1,39 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// LogPanic logs a value returned by recover() at error level, together with
+// the stack of the calling goroutine, under the "panic" and "stack" keys. It
+// does nothing if recovered is nil, so it can be called unconditionally:
+//
+//	defer func() {
+//		promlog.LogPanic(logger, recover())
+//	}()
+//
+// The stack spans multiple lines; the format escapes the newlines unless
+// Config.Multiline says otherwise.
+func LogPanic(l log.Logger, recovered interface{}) {
+	if recovered == nil {
+		return
+	}
+	_ = level.Error(l).Log("msg", "recovered from panic", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+}
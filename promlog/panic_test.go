@@ -0,0 +1,53 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestLogPanic(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.NewLogfmtLogger(&buf)
+
+	func() {
+		defer func() {
+			LogPanic(l, recover())
+		}()
+		panic(errors.New("index out of range"))
+	}()
+
+	got := buf.String()
+	if want := `level=error msg="recovered from panic" panic="index out of range" stack="goroutine `; !strings.HasPrefix(got, want) {
+		t.Errorf("expected prefix %q, got %q", want, got)
+	}
+	if want := `panic_test.go`; !strings.Contains(got, want) {
+		t.Errorf("expected stack to contain %q, got %q", want, got)
+	}
+	// The stack is logged on a single line.
+	if n := strings.Count(got, "\n"); n != 1 {
+		t.Errorf("expected a single line, got %d", n)
+	}
+
+	buf.Reset()
+	LogPanic(l, nil)
+	if got := buf.String(); got != "" {
+		t.Errorf("expected nothing logged for a nil value, got %q", got)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"sync"
+)
+
+// RingBuffer is an io.Writer keeping the most recent log lines in memory, e.g.
+// to serve them on a debug endpoint. Once it is full, each new line overwrites
+// the oldest one. It is safe for concurrent use.
+//
+// Use it as the destination of a logger, e.g. with NewDynamicWithWriter, or
+// alongside another destination with io.MultiWriter.
+type RingBuffer struct {
+	mtx   sync.Mutex
+	lines []string
+	next  int  // Index in lines to write the next line to.
+	full  bool // Whether lines has wrapped around.
+}
+
+// NewRingBuffer returns a RingBuffer keeping the last capacity lines. It
+// panics if capacity is not positive.
+func NewRingBuffer(capacity int) *RingBuffer {
+	if capacity <= 0 {
+		panic("promlog: ring buffer capacity must be positive")
+	}
+	return &RingBuffer{lines: make([]string, capacity)}
+}
+
+// Write implements io.Writer. Each line in p, i.e. each part terminated by a
+// newline or the end of p, is kept as a separate line without the newline.
+func (r *RingBuffer) Write(p []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for rest := bytes.TrimSuffix(p, []byte("\n")); ; {
+		line, after, found := bytes.Cut(rest, []byte("\n"))
+		r.lines[r.next] = string(line)
+		r.next++
+		if r.next == len(r.lines) {
+			r.next, r.full = 0, true
+		}
+		if !found {
+			break
+		}
+		rest = after
+	}
+	return len(p), nil
+}
+
+// Lines returns a snapshot of the kept lines, oldest first.
+func (r *RingBuffer) Lines() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	lines := make([]string, 0, len(r.lines))
+	lines = append(lines, r.lines[r.next:]...)
+	return append(lines, r.lines[:r.next]...)
+}
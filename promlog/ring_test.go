@@ -0,0 +1,105 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log/level"
+)
+
+func TestRingBuffer(t *testing.T) {
+	config := &Config{Level: &AllowedLevel{}, DisableCaller: true}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+	rb := NewRingBuffer(3)
+	logger := NewDynamicWithWriter(rb, config)
+
+	if got := rb.Lines(); len(got) != 0 {
+		t.Fatalf("expected no lines, got %q", got)
+	}
+	for i := 0; i < 2; i++ {
+		if err := level.Info(logger).Log("msg", "line", "n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertLines(t, rb.Lines(), 0, 1)
+
+	for i := 2; i < 8; i++ {
+		if err := level.Info(logger).Log("msg", "line", "n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertLines(t, rb.Lines(), 5, 6, 7)
+
+	// The snapshot is not affected by later writes.
+	snapshot := rb.Lines()
+	if err := level.Info(logger).Log("msg", "line", "n", 8); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, snapshot, 5, 6, 7)
+	assertLines(t, rb.Lines(), 6, 7, 8)
+}
+
+func assertLines(t *testing.T, lines []string, ns ...int) {
+	t.Helper()
+	if len(lines) != len(ns) {
+		t.Fatalf("expected %d lines, got %q", len(ns), lines)
+	}
+	for i, n := range ns {
+		if !strings.HasSuffix(lines[i], fmt.Sprintf("level=info msg=line n=%d", n)) {
+			t.Errorf("expected line %d to end in n=%d, got %q", i, n, lines[i])
+		}
+	}
+}
+
+func TestRingBufferMultipleLines(t *testing.T) {
+	rb := NewRingBuffer(4)
+	if _, err := rb.Write([]byte("a\nb\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rb.Write([]byte("c\nd\ne")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(rb.Lines(), ","), "b,c,d,e"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestRingBufferConcurrency(t *testing.T) {
+	rb := NewRingBuffer(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := rb.Write([]byte("line\n")); err != nil {
+					t.Error(err)
+				}
+				if n := len(rb.Lines()); n > 10 {
+					t.Errorf("expected at most 10 lines, got %d", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(rb.Lines()); n != 10 {
+		t.Errorf("expected 10 lines, got %d", n)
+	}
+}
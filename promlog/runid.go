@@ -0,0 +1,50 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runIDKey is the key of the run ID added to every log line if
+// Config.RunID is set.
+const runIDKey = "run_id"
+
+// newRunID returns a random version 4 UUID, like
+// "0b5cbd4a-7a5e-4c4e-9a3f-1d2a6e3f8c7b", to tell the log lines of one logger
+// apart from those of others. Should the random source fail, the ID is derived
+// from the current time and process ID instead.
+func newRunID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), os.Getpid())
+	}
+	b[6] = b[6]&0x0f | 0x40 // Version 4.
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// withRunID returns c itself if it doesn't ask for a run ID or has one
+// already, otherwise a copy of c with a new run ID.
+func (c *Config) withRunID() *Config {
+	if !c.RunID || c.runID != "" {
+		return c
+	}
+	cp := *c
+	cp.runID = newRunID()
+	return &cp
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/go-kit/log/level"
+)
+
+var runIDPattern = regexp.MustCompile(`run_id=([0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12})`)
+
+// runIDs returns the run IDs found in the lines of out.
+func runIDs(out string) []string {
+	var ids []string
+	for _, m := range runIDPattern.FindAllStringSubmatch(out, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+func TestRunID(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+	logger1 := New(&Config{RunID: true, Writer: &buf1})
+	logger2 := New(&Config{RunID: true, Writer: &buf2})
+	for i := 0; i < 3; i++ {
+		if err := logger1.Log("msg", "hello", "i", i); err != nil {
+			t.Fatal(err)
+		}
+		if err := logger2.Log("msg", "hello", "i", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids1, ids2 := runIDs(buf1.String()), runIDs(buf2.String())
+	if len(ids1) != 3 || ids1[0] != ids1[1] || ids1[0] != ids1[2] {
+		t.Errorf("expected the same run ID on all lines, got %v", ids1)
+	}
+	if len(ids2) != 3 || ids2[0] != ids2[1] || ids2[0] != ids2[2] {
+		t.Errorf("expected the same run ID on all lines, got %v", ids2)
+	}
+	if ids1[0] == ids2[0] {
+		t.Errorf("expected different run IDs for different loggers, got %s twice", ids1[0])
+	}
+
+	var buf bytes.Buffer
+	if err := New(&Config{Writer: &buf}).Log("msg", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(runIDKey)) {
+		t.Errorf("expected no run ID, got %q", buf.String())
+	}
+}
+
+func TestRunIDDynamic(t *testing.T) {
+	debug, info := &AllowedLevel{}, &AllowedLevel{}
+	if err := debug.Set("debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	logger := NewDynamic(&Config{Level: info, RunID: true, Writer: &buf})
+	if err := level.Info(logger).Log("msg", "first"); err != nil {
+		t.Fatal(err)
+	}
+	logger.SetLevel(debug)
+	if err := level.Debug(logger).Log("msg", "after level change"); err != nil {
+		t.Fatal(err)
+	}
+	var reconfigured bytes.Buffer
+	if err := logger.Reconfigure(&Config{Level: info, RunID: true, Writer: &reconfigured}); err != nil {
+		t.Fatal(err)
+	}
+	if err := level.Info(logger).Log("msg", "after reconfiguration"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := append(runIDs(buf.String()), runIDs(reconfigured.String())...)
+	// The line about the level change has no run ID, like it has no
+	// timestamp.
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 run IDs, got %v", ids)
+	}
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Errorf("expected run ID %s on all lines, got %v", ids[0], ids)
+			break
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"sync/atomic"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// SamplingRule configures the sampling of the log lines of one level. The
+// first First lines are always logged. Of the following lines, only every
+// Thereafter-th is logged, so that a Thereafter of 10 amounts to a sampling
+// rate of 10%. A Thereafter of 0 or 1 disables sampling.
+type SamplingRule struct {
+	First      uint64
+	Thereafter uint64
+}
+
+// samplingLogger drops log lines according to the rule for their level.
+type samplingLogger struct {
+	next   log.Logger
+	rules  map[string]SamplingRule
+	counts map[string]*uint64
+}
+
+// withSampling wraps l in a samplingLogger if config asks for it. Rules for the
+// levels warn and error are ignored, those lines are never sampled.
+func withSampling(l log.Logger, config *Config) log.Logger {
+	s := samplingLogger{
+		next:   l,
+		rules:  map[string]SamplingRule{},
+		counts: map[string]*uint64{},
+	}
+	for lvl, rule := range config.Sampling {
+		if lvl == "warn" || lvl == "error" || rule.Thereafter <= 1 {
+			continue
+		}
+		s.rules[lvl] = rule
+		s.counts[lvl] = new(uint64)
+	}
+	if len(s.rules) == 0 {
+		return l
+	}
+	return s
+}
+
+// Log implements log.Logger.
+func (s samplingLogger) Log(keyvals ...interface{}) error {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		v, ok := keyvals[i+1].(level.Value)
+		if !ok {
+			break
+		}
+		rule, ok := s.rules[v.String()]
+		if !ok {
+			break
+		}
+		n := atomic.AddUint64(s.counts[v.String()], 1)
+		if n > rule.First && (n-rule.First-1)%rule.Thereafter != 0 {
+			return nil
+		}
+		break
+	}
+	return s.next.Log(keyvals...)
+}
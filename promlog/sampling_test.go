@@ -0,0 +1,77 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// levelCounter counts log lines per level.
+type levelCounter map[string]int
+
+func (c levelCounter) Log(keyvals ...interface{}) error {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] == level.Key() {
+			c[keyvals[i+1].(level.Value).String()]++
+		}
+	}
+	return nil
+}
+
+func TestSampling(t *testing.T) {
+	config := &Config{
+		Level: &AllowedLevel{},
+		Sampling: map[string]SamplingRule{
+			"debug": {Thereafter: 10},
+			"info":  {First: 5, Thereafter: 2},
+			"warn":  {Thereafter: 10},
+			"error": {Thereafter: 10},
+		},
+	}
+	if err := config.Level.Set("debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := levelCounter{}
+	for _, logger := range []log.Logger{
+		NewWithLogger(counter, config),
+		NewDynamicWithLogger(counter, config),
+	} {
+		for k := range counter {
+			delete(counter, k)
+		}
+		for i := 0; i < 100; i++ {
+			for _, lvl := range []func(log.Logger) log.Logger{level.Debug, level.Info, level.Warn, level.Error} {
+				if err := lvl(logger).Log("msg", "hello"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		expected := map[string]int{
+			"debug": 10,
+			"info":  5 + 48,
+			"warn":  100,
+			"error": 100,
+		}
+		for lvl, count := range expected {
+			if counter[lvl] != count {
+				t.Errorf("expected %d %s lines, got %d", count, lvl, counter[lvl])
+			}
+		}
+	}
+}
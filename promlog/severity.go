@@ -0,0 +1,85 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// severityKey is the key of the numeric severity of a log line.
+const severityKey = "severity"
+
+// SeverityMode determines whether the level of a log line is rendered as a
+// numeric severity. The severities follow the syslog priorities: debug is 7,
+// info is 6, warn is 4, and error is 3.
+type SeverityMode string
+
+const (
+	// SeverityOff only renders the textual level.
+	SeverityOff SeverityMode = ""
+	// SeverityAdd renders the numeric severity under the key "severity"
+	// in addition to the textual level.
+	SeverityAdd SeverityMode = "add"
+	// SeverityReplace renders the numeric severity under the key
+	// "severity" instead of the textual level.
+	SeverityReplace SeverityMode = "replace"
+)
+
+var severities = map[string]int{
+	"debug": 7,
+	"info":  6,
+	"warn":  4,
+	"error": 3,
+}
+
+// severityLogger renders the level of log lines as numeric severity.
+type severityLogger struct {
+	next log.Logger
+	mode SeverityMode
+}
+
+// withSeverity wraps l in a severityLogger if config asks for it.
+func withSeverity(l log.Logger, config *Config) log.Logger {
+	if config.Severity == SeverityOff {
+		return l
+	}
+	return severityLogger{next: l, mode: config.Severity}
+}
+
+// Log implements log.Logger.
+func (s severityLogger) Log(keyvals ...interface{}) error {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		v, ok := keyvals[i+1].(level.Value)
+		if !ok {
+			break
+		}
+		severity, ok := severities[v.String()]
+		if !ok {
+			break
+		}
+		rendered := make([]interface{}, 0, len(keyvals)+2)
+		rendered = append(rendered, keyvals[:i]...)
+		if s.mode == SeverityAdd {
+			rendered = append(rendered, keyvals[i], keyvals[i+1])
+		}
+		rendered = append(rendered, severityKey, severity)
+		rendered = append(rendered, keyvals[i+2:]...)
+		return s.next.Log(rendered...)
+	}
+	return s.next.Log(keyvals...)
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+func TestSeverity(t *testing.T) {
+	expected := map[string]float64{
+		"debug": 7,
+		"info":  6,
+		"warn":  4,
+		"error": 3,
+	}
+	levels := map[string]func(log.Logger) log.Logger{
+		"debug": level.Debug,
+		"info":  level.Info,
+		"warn":  level.Warn,
+		"error": level.Error,
+	}
+
+	for _, mode := range []SeverityMode{SeverityAdd, SeverityReplace} {
+		var buf bytes.Buffer
+		config := &Config{
+			Level:    &AllowedLevel{},
+			Format:   &AllowedFormat{},
+			Severity: mode,
+		}
+		if err := config.Level.Set("info"); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Format.Set("json"); err != nil {
+			t.Fatal(err)
+		}
+		logger := NewDynamicWithWriter(&buf, config)
+
+		for lvl, severity := range expected {
+			buf.Reset()
+			if err := levels[lvl](logger).Log("msg", "hello"); err != nil {
+				t.Fatal(err)
+			}
+			if lvl == "debug" {
+				// Still filtered by the textual level.
+				if buf.Len() != 0 {
+					t.Errorf("%s: expected debug line to be filtered, got %q", mode, buf.String())
+				}
+				continue
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if fields["severity"] != severity {
+				t.Errorf("%s: expected severity %v for level %s, got %v", mode, severity, lvl, fields["severity"])
+			}
+			textual, ok := fields["level"]
+			switch {
+			case mode == SeverityAdd && textual != lvl:
+				t.Errorf("%s: expected level %s, got %v", mode, lvl, textual)
+			case mode == SeverityReplace && ok:
+				t.Errorf("%s: expected no textual level, got %v", mode, textual)
+			}
+		}
+	}
+
+	// The mapping itself, including debug.
+	var got interface{}
+	logger := withSeverity(log.LoggerFunc(func(keyvals ...interface{}) error {
+		got = keyvals[1]
+		return nil
+	}), &Config{Severity: SeverityReplace})
+	if err := level.Debug(logger).Log(); err != nil {
+		t.Fatal(err)
+	}
+	if got != 7 {
+		t.Errorf("expected severity 7 for level debug, got %v", got)
+	}
+}
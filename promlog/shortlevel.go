@@ -0,0 +1,53 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// shortLevelLogger renders the level of log lines as a single uppercase
+// character, e.g. "W" for warn.
+type shortLevelLogger struct {
+	next log.Logger
+}
+
+// withShortLevel wraps l in a shortLevelLogger if config asks for it.
+func withShortLevel(l log.Logger, config *Config) log.Logger {
+	if !config.ShortLevel || (config.Format != nil && config.Format.s == "json") {
+		return l
+	}
+	return shortLevelLogger{next: l}
+}
+
+// Log implements log.Logger.
+func (s shortLevelLogger) Log(keyvals ...interface{}) error {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		v, ok := keyvals[i+1].(level.Value)
+		if !ok || v.String() == "" {
+			break
+		}
+		rendered := make([]interface{}, len(keyvals))
+		copy(rendered, keyvals)
+		rendered[i+1] = strings.ToUpper(v.String()[:1])
+		return s.next.Log(rendered...)
+	}
+	return s.next.Log(keyvals...)
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log/level"
+)
+
+func TestShortLevel(t *testing.T) {
+	config := &Config{Level: &AllowedLevel{}, DisableCaller: true, ShortLevel: true}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	l := NewDynamicWithWriter(&buf, config)
+	level.Debug(l).Log("msg", "filtered")
+	level.Info(l).Log("msg", "started")
+	level.Warn(l).Log("msg", "slow")
+	level.Error(l).Log("msg", "failed")
+	l.Log("msg", "no level")
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		// Cut off the timestamp.
+		_, line, _ = strings.Cut(line, " ")
+		got = append(got, line)
+	}
+	want := []string{
+		"level=I msg=started",
+		"level=W msg=slow",
+		"level=E msg=failed",
+		"msg=\"no level\"",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// The json format is not affected.
+	buf.Reset()
+	config.Format = &AllowedFormat{}
+	if err := config.Format.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+	level.Warn(NewDynamicWithWriter(&buf, config)).Log("msg", "slow")
+	if want := `"level":"warn"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected %s in %q", want, buf.String())
+	}
+}
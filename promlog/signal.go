@@ -0,0 +1,66 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/go-kit/log/level"
+)
+
+// HandleSignals installs a handler that calls l.Reopen whenever one of the
+// given signals (typically syscall.SIGHUP) is received, which is what logrotate
+// and similar tools expect. The result of each reopening is logged together
+// with the current log level. HandleSignals returns a function that uninstalls
+// the handler.
+func HandleSignals(l *logger, sig ...os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	stopHandler := handleSignals(l, ch)
+	return func() {
+		signal.Stop(ch)
+		stopHandler()
+	}
+}
+
+// handleSignals reopens l for every signal received from ch until the returned
+// function is called.
+func handleSignals(l *logger, ch <-chan os.Signal) (stop func()) {
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case s := <-ch:
+				if err := l.Reopen(); err != nil {
+					_ = level.Error(l).Log("msg", "Failed to reopen log destination", "signal", s, "err", err)
+					continue
+				}
+				_ = level.Info(l).Log("msg", "Reopened log destination", "signal", s, "current_level", l.levelString())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// reopenRecorder is an io.Writer implementing Reopener that records calls.
+type reopenRecorder struct {
+	mtx     sync.Mutex
+	buf     bytes.Buffer
+	reopens chan struct{}
+}
+
+func (r *reopenRecorder) Write(p []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *reopenRecorder) Reopen() error {
+	r.reopens <- struct{}{}
+	return nil
+}
+
+func (r *reopenRecorder) String() string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.buf.String()
+}
+
+func TestHandleSignals(t *testing.T) {
+	recorder := &reopenRecorder{reopens: make(chan struct{}, 1)}
+	config := &Config{Level: &AllowedLevel{}}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+	logger := NewDynamicWithWriter(recorder, config)
+
+	ch := make(chan os.Signal)
+	stop := handleSignals(logger, ch)
+	ch <- syscall.SIGHUP
+	select {
+	case <-recorder.reopens:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reopen not invoked")
+	}
+	stop()
+
+	out := recorder.String()
+	if !strings.Contains(out, `msg="Reopened log destination"`) || !strings.Contains(out, "current_level=info") {
+		t.Errorf("expected reopening to be logged with the current level, got %q", out)
+	}
+	if n := strings.Count(out, " level="); n != 1 {
+		t.Errorf("expected a single level key, got %d in %q", n, out)
+	}
+
+	// No reopening after stopping.
+	select {
+	case ch <- syscall.SIGHUP:
+		t.Error("signal received after stopping the handler")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestReopenWithoutReopener(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewDynamicWithWriter(&buf, &Config{}).Reopen(); err != nil {
+		t.Fatal(err)
+	}
+}
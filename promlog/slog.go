@@ -0,0 +1,127 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package promlog
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/log"
+)
+
+// NewSlogLogger returns a new log/slog logger configured like the go-kit
+// logger returned by New, for components migrating to log/slog: The output
+// goes to the Writer of config, stderr by default, with the WriteTimeout
+// applied, in the logfmt (via slog.TextHandler) or json format. Lines below
+// the Level are dropped. Each line is annotated with the timestamp under the
+// key "ts", in the same format, taken from the Clock if set and from the log
+// record otherwise, the level under the key
+// "level" in lowercase, e.g. "info", and, unless DisableCaller is set, the
+// caller under the key "caller" as file:line, followed by the version,
+// runtime, and resource fields, the run ID, and the DefaultFields (with
+// log.Valuer values evaluated for each line).
+//
+// Note that log/slog writes the timestamp, level, caller, and message in that
+// fixed order, while the go-kit logger writes the caller before the level. The
+// other settings of config, like the KeyPrefix, the Sampling, or the Hook, are
+// not supported and ignored. Colored output is not supported either: the go-kit
+// logger returned by New doesn't colorize its output, so there is no color
+// setting in Config to honor.
+func NewSlogLogger(config *Config) *slog.Logger {
+	config = config.withRunID()
+	opts := &slog.HandlerOptions{
+		AddSource:   !config.DisableCaller,
+		Level:       config.Level.slogLevel(),
+		ReplaceAttr: config.replaceSlogAttr,
+	}
+	w := withWriteTimeout(config.writer(), config)
+	var h slog.Handler
+	if config.Format != nil && config.Format.s == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+
+	keyvals := config.staticKeyvals()
+	args := make([]any, 0, len(keyvals))
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = log.ErrMissingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		if valuer, ok := v.(log.Valuer); ok {
+			v = slogValuer(valuer)
+		}
+		args = append(args, slog.Any(fmt.Sprint(keyvals[i]), v))
+	}
+	return slog.New(h).With(args...)
+}
+
+// slogLevel returns the minimum log/slog level passing l. A nil or unset l
+// passes all levels.
+func (l *AllowedLevel) slogLevel() slog.Level {
+	if l == nil {
+		return math.MinInt
+	}
+	switch l.s {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return math.MinInt
+	}
+}
+
+// replaceSlogAttr renders the built-in attributes of log/slog like the go-kit
+// logger does.
+func (c *Config) replaceSlogAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.TimeKey:
+		t := a.Value.Time()
+		if c.Clock != nil || t.IsZero() {
+			t = c.now()
+		}
+		return slog.String("ts", t.UTC().Format(timestampLayout))
+	case slog.LevelKey:
+		if lvl, ok := a.Value.Any().(slog.Level); ok {
+			return slog.String(slog.LevelKey, strings.ToLower(lvl.String()))
+		}
+	case slog.SourceKey:
+		if src, ok := a.Value.Any().(*slog.Source); ok {
+			return slog.String("caller", fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+		}
+	}
+	return a
+}
+
+// slogValuer adapts a log.Valuer to log/slog.
+type slogValuer log.Valuer
+
+// LogValue implements slog.LogValuer.
+func (v slogValuer) LogValue() slog.Value {
+	return slog.AnyValue(v())
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package promlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// jsonKeys returns the sorted keys of each JSON line in out.
+func jsonKeys(t *testing.T, out string) [][]string {
+	t.Helper()
+	var keys [][]string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("invalid json line %q: %s", line, err)
+		}
+		var k []string
+		for key := range m {
+			k = append(k, key)
+		}
+		sort.Strings(k)
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestSlogLogger(t *testing.T) {
+	jsonFormat := &AllowedFormat{}
+	if err := jsonFormat.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.FixedZone("CET", 3600))}
+
+	for _, lvl := range []string{"debug", "info", "warn", "error"} {
+		var goKitOut, slogOut bytes.Buffer
+		config := &Config{
+			Level:         &AllowedLevel{},
+			Format:        jsonFormat,
+			Clock:         clock,
+			Version:       "1.2.3",
+			DefaultFields: []interface{}{"component", "tsdb"},
+		}
+		if err := config.Level.Set(lvl); err != nil {
+			t.Fatal(err)
+		}
+		config.Writer = &goKitOut
+		goKitLogger := New(config)
+		config.Writer = &slogOut
+		slogLogger := NewSlogLogger(config)
+
+		for _, logFn := range []func(msg string, args ...interface{}) error{
+			func(msg string, args ...interface{}) error {
+				return level.Debug(goKitLogger).Log(append([]interface{}{"msg", msg}, args...)...)
+			},
+			func(msg string, args ...interface{}) error {
+				return level.Info(goKitLogger).Log(append([]interface{}{"msg", msg}, args...)...)
+			},
+			func(msg string, args ...interface{}) error {
+				return level.Warn(goKitLogger).Log(append([]interface{}{"msg", msg}, args...)...)
+			},
+			func(msg string, args ...interface{}) error {
+				return level.Error(goKitLogger).Log(append([]interface{}{"msg", msg}, args...)...)
+			},
+		} {
+			if err := logFn("hello", "user", "Björn"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		slogLogger.Debug("hello", "user", "Björn")
+		slogLogger.Info("hello", "user", "Björn")
+		slogLogger.Warn("hello", "user", "Björn")
+		slogLogger.Error("hello", "user", "Björn")
+
+		goKitKeys, slogKeys := jsonKeys(t, goKitOut.String()), jsonKeys(t, slogOut.String())
+		if len(goKitKeys) != len(slogKeys) {
+			t.Fatalf("%s: expected %d lines like the go-kit logger, got %d:\n%s", lvl, len(goKitKeys), len(slogKeys), slogOut.String())
+		}
+		for i := range goKitKeys {
+			if expected, got := strings.Join(goKitKeys[i], ","), strings.Join(slogKeys[i], ","); expected != got {
+				t.Errorf("%s: expected keys %s, got %s", lvl, expected, got)
+			}
+		}
+
+		var goKitLine, slogLine map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.SplitN(goKitOut.String(), "\n", 2)[0]), &goKitLine); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(strings.SplitN(slogOut.String(), "\n", 2)[0]), &slogLine); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"ts", "level", "msg", "user", "version", "component"} {
+			if goKitLine[key] != slogLine[key] {
+				t.Errorf("%s: expected %s %v, got %v", lvl, key, goKitLine[key], slogLine[key])
+			}
+		}
+		if expected, got := "slog_test.go:", slogLine["caller"]; !strings.HasPrefix(got.(string), expected) {
+			t.Errorf("%s: expected caller %s..., got %v", lvl, expected, got)
+		}
+	}
+}
+
+func TestSlogLoggerLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(&Config{
+		Writer:        &buf,
+		Clock:         &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC)},
+		DisableCaller: true,
+	})
+	logger.Debug("hello", "user", "Björn")
+	if expected, got := "ts=2024-01-02T03:04:05.006Z level=debug msg=hello user=Björn\n", buf.String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestSlogLoggerRecordTime(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(&Config{Writer: &buf, DisableCaller: true})
+	r := slog.NewRecord(time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.FixedZone("CET", 3600)), slog.LevelInfo, "hello", 0)
+	if err := logger.Handler().Handle(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "ts=2024-01-02T02:04:05.006Z level=info msg=hello\n", buf.String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	stdlog "log"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// StdlibAdapter returns a standard library logger that writes each line
+// through l at the given level ("debug", "info", "warn", or "error"; anything
+// else is treated as "info"). It is meant for dependencies that only accept a
+// *log.Logger.
+//
+// The returned logger has no prefix and no flags, as l already adds a
+// timestamp and caller. Should the flags be changed, the date, time, and file
+// fields are recognized and logged under separate keys rather than as part of
+// the message.
+func StdlibAdapter(l log.Logger, lvl string) *stdlog.Logger {
+	var leveled log.Logger
+	switch lvl {
+	case "debug":
+		leveled = level.Debug(l)
+	case "warn":
+		leveled = level.Warn(l)
+	case "error":
+		leveled = level.Error(l)
+	default:
+		leveled = level.Info(l)
+	}
+	return stdlog.New(log.NewStdlibAdapter(leveled), "", 0)
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	stdlog "log"
+	"strings"
+	"testing"
+)
+
+func TestStdlibAdapter(t *testing.T) {
+	config := &Config{Level: &AllowedLevel{}, DisableCaller: true}
+	if err := config.Level.Set("info"); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		level string
+		want  string
+	}{
+		{level: "error", want: "level=error msg=\"connection refused\"\n"},
+		{level: "warn", want: "level=warn msg=\"connection refused\"\n"},
+		{level: "info", want: "level=info msg=\"connection refused\"\n"},
+		{level: "unknown", want: "level=info msg=\"connection refused\"\n"},
+		{level: "debug", want: ""},
+	}
+	for i, s := range scenarios {
+		var buf bytes.Buffer
+		l := StdlibAdapter(NewDynamicWithWriter(&buf, config), s.level)
+		l.Print("connection refused")
+
+		got := buf.String()
+		if s.want != "" {
+			// Cut off the timestamp.
+			_, got, _ = strings.Cut(got, " ")
+		}
+		if got != s.want {
+			t.Errorf("%d. expected %q, got %q", i, s.want, got)
+		}
+	}
+
+	// Fields added by stdlib flags are split off the message.
+	var buf bytes.Buffer
+	l := StdlibAdapter(NewDynamicWithWriter(&buf, config), "warn")
+	l.SetFlags(stdlog.Lshortfile)
+	l.Printf("retrying in %ds", 5)
+	got := buf.String()
+	if want := `level=warn caller=stdlib_test.go:58 msg="retrying in 5s"`; !strings.Contains(got, want) {
+		t.Errorf("expected %q in %q", want, got)
+	}
+}
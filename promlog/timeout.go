@@ -0,0 +1,63 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// writeDeadliner is implemented by destinations supporting write deadlines,
+// like an *os.File backed by a pipe.
+type writeDeadliner interface {
+	io.Writer
+	SetWriteDeadline(t time.Time) error
+}
+
+// deadlineWriter sets a write deadline before each write.
+type deadlineWriter struct {
+	w         writeDeadliner
+	timeout   time.Duration
+	onDropped func()
+}
+
+// withWriteTimeout wraps w in a deadlineWriter if config asks for it and w
+// supports write deadlines.
+func withWriteTimeout(w io.Writer, config *Config) io.Writer {
+	if config.WriteTimeout <= 0 {
+		return w
+	}
+	dw, ok := w.(writeDeadliner)
+	if !ok {
+		return w
+	}
+	return deadlineWriter{w: dw, timeout: config.WriteTimeout, onDropped: config.OnDroppedLine}
+}
+
+// Write implements io.Writer.
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	// Destinations not supporting deadlines after all (e.g. a regular file,
+	// or a terminal in blocking mode) return an error here. Write without
+	// a deadline then.
+	if err := d.w.SetWriteDeadline(time.Now().Add(d.timeout)); err != nil {
+		return d.w.Write(p)
+	}
+	n, err := d.w.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) && d.onDropped != nil {
+		d.onDropped()
+	}
+	return n, err
+}
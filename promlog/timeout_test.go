@@ -0,0 +1,72 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promlog
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTimeout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	var dropped int
+	logger := NewDynamicWithWriter(w, &Config{
+		WriteTimeout:  50 * time.Millisecond,
+		OnDroppedLine: func() { dropped++ },
+	})
+
+	// Nobody reads from the pipe, so it fills up eventually.
+	payload := strings.Repeat("x", 4096)
+	for i := 0; ; i++ {
+		if i == 1000 {
+			t.Fatal("pipe never filled up")
+		}
+		start := time.Now()
+		err := logger.Log("msg", payload)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("write blocked for %v", elapsed)
+		}
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded error, got %v", err)
+		}
+		break
+	}
+	if dropped != 1 {
+		t.Errorf("expected 1 dropped line, got %d", dropped)
+	}
+}
+
+func TestWriteTimeoutWithoutDeadlines(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewDynamicWithWriter(&buf, &Config{WriteTimeout: time.Nanosecond})
+	if err := logger.Log("msg", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "msg=hello") {
+		t.Errorf("expected line to be written, got %q", buf.String())
+	}
+}